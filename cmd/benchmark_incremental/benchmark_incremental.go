@@ -44,7 +44,7 @@ func main() {
 		log.Fatalf("Failed to configure driver: %s\n", err)
 	}
 
-	client := updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{driver, driver})
+	client := config.UpdatableClient([2]updatable.UpdatableServer{driver, driver})
 
 	err = client.Init()
 	assert.NilError(ep, err)
@@ -73,7 +73,7 @@ func main() {
 		assert.NilError(ep, driver.GetRow(rand.Intn(numKeys), &rowIV))
 
 		start = time.Now()
-		row, err := client.Read(rowIV.Key)
+		row, err := client.ReadKey(rowIV.WideKey)
 		clientReadTime += time.Since(start)
 		assert.NilError(ep, err)
 		assert.DeepEqual(ep, row, rowIV.Value)
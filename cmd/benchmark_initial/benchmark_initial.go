@@ -27,9 +27,9 @@ func main() {
 	defer prof.Close()
 
 	fmt.Printf("# %s %s\n", path.Base(os.Args[0]), strings.Join(os.Args[1:], " "))
-	fmt.Printf("%10s%22s%22s%15s%15s%22s%22s%15s\n",
+	fmt.Printf("%10s%22s%22s%15s%15s%22s%22s%15s%15s\n",
 		"numRows", "OfflineServerTime[us]", "OfflineClientTime[us]", "OfflineBytes", "ClientBytes",
-		"OnlineServerTime[us]", "OnlineClientTime[us]", "OnlineBytes")
+		"OnlineServerTime[us]", "OnlineClientTime[us]", "OnlineBytes", "AnswerThreads")
 
 	dr, err := config.ServerDriver()
 	if err != nil {
@@ -44,6 +44,9 @@ func main() {
 	if err := dr.Configure(config.TestConfig, &none); err != nil {
 		log.Fatalf("Failed to configure driver: %s\n", err)
 	}
+	if err := config.PlanFromServer(dr); err != nil {
+		log.Fatalf("%s\n", err)
+	}
 
 	result := testing.Benchmark(func(b *testing.B) {
 		assert.NilError(ep, dr.ResetMetrics(0, &none))
@@ -52,7 +55,7 @@ func main() {
 		for i := 0; i < b.N; i++ {
 			start := time.Now()
 			if config.Updatable {
-				clientUpdatable = updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{dr, dr})
+				clientUpdatable = config.UpdatableClient([2]updatable.UpdatableServer{dr, dr})
 				err = clientUpdatable.Init()
 			} else {
 				clientStatic = pir.NewPIRReader(rand, dr, dr)
@@ -96,7 +99,7 @@ func main() {
 			if clientStatic != nil {
 				row, err = clientStatic.Read(rowIV.Index)
 			} else {
-				row, err = clientUpdatable.Read(rowIV.Key)
+				row, err = clientUpdatable.ReadKey(rowIV.WideKey)
 			}
 			clientReadTime += time.Since(start)
 			assert.NilError(ep, err)
@@ -124,9 +127,14 @@ func main() {
 		b.ReportMetric(float64(onlineBytes)/float64(b.N), "answer-bytes/op")
 
 	})
-	fmt.Printf("%22d%22d%15d\n",
+	answerThreads := config.AnswerThreads
+	if answerThreads == 0 {
+		answerThreads = 1
+	}
+	fmt.Printf("%22d%22d%15d%15d\n",
 		int(result.Extra["answer-us/op"]),
 		int(result.Extra["read-us/op"]),
-		int(result.Extra["answer-bytes/op"]))
+		int(result.Extra["answer-bytes/op"]),
+		answerThreads)
 
 }
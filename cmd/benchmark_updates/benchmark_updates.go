@@ -41,7 +41,7 @@ func main() {
 	}
 	driver.ResetMetrics(0, &none)
 
-	client := updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{driver, driver})
+	client := config.UpdatableClient([2]updatable.UpdatableServer{driver, driver})
 
 	var clientUpdateTime, clientReadTime time.Duration
 
@@ -64,7 +64,7 @@ func main() {
 		assert.NilError(ep, driver.GetRow(rand.Intn(numKeys), &rowIV))
 
 		start = time.Now()
-		row, err := client.Read(rowIV.Key)
+		row, err := client.ReadKey(rowIV.WideKey)
 		clientReadTime = time.Since(start)
 		assert.NilError(ep, err)
 		assert.DeepEqual(ep, row, rowIV.Value)
@@ -34,17 +34,12 @@ func main() {
 		log.Fatal("Connection error: ", err)
 	}
 
-	fmt.Printf("Obtaining hint (this may take a while)...")
-	client := updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{proxyLeft, proxyRight})
-	client.CallAsync = true
-	err = client.Init()
-	if err != nil {
-		log.Fatalf("Failed to Initialize client: %s\n", err)
+	var read func() error
+	if config.Keyword {
+		read = keywordReader(config, proxyLeft, proxyRight)
+	} else {
+		read = updatableReader(config, proxyLeft, proxyRight)
 	}
-	fmt.Printf("[OK]\n")
-
-	keys := client.Keys()
-	fmt.Printf("Got %d keys from server\n", len(keys))
 
 	inShutdown := false
 
@@ -64,11 +59,9 @@ func main() {
 				close(latencies)
 				break
 			}
-			key := keys[rand.Intn(len(keys))]
 			start := time.Now()
-			_, err := client.Read(key)
-			if err != nil {
-				fmt.Printf("Failed to read key %d: %v", key, err)
+			if err := read(); err != nil {
+				fmt.Printf("%v\n", err)
 				continue
 			}
 			latencies <- requestTime{start, time.Now()}
@@ -95,3 +88,80 @@ func main() {
 		}
 	}
 }
+
+// updatableReader initializes an updatable client, which downloads the keys,
+// and returns a function that reads a random one of them.
+func updatableReader(config *driver.Config, proxyLeft, proxyRight driver.PirServerDriver) func() error {
+	fmt.Printf("Obtaining hint (this may take a while)...")
+	client := config.UpdatableClient([2]updatable.UpdatableServer{proxyLeft, proxyRight})
+	client.CallAsync = true
+	if err := driver.InitClient(client, config.StateFile); err != nil {
+		log.Fatalf("Failed to Initialize client: %s\n", err)
+	}
+	fmt.Printf("[OK]\n")
+	saveState(client, config.StateFile)
+
+	keys := client.Keys()
+	fmt.Printf("Got %d keys from server\n", len(keys))
+
+	return func() error {
+		key := keys[rand.Intn(len(keys))]
+		_, err := client.Read(key)
+		// Even a failed read may have consumed hints.
+		saveState(client, config.StateFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read key %d: %v", key, err)
+		}
+		return nil
+	}
+}
+
+// keywordReader initializes a keyword client for servers started with
+// -keyword, and returns a function that reads a random key of the database.
+func keywordReader(config *driver.Config, proxyLeft, proxyRight driver.PirServerDriver) func() error {
+	if config.StateFile != "" {
+		log.Fatalf("-state is not supported with -keyword")
+	}
+	if err := config.PlanFromServer(proxyLeft); err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("Obtaining hint (this may take a while)...")
+	client := driver.NewKeywordClient(pir.RandSource(), config.PirType, [2]driver.PirServerDriver{proxyLeft, proxyRight})
+	if err := client.Init(); err != nil {
+		log.Fatalf("Failed to Initialize client: %s\n", err)
+	}
+	fmt.Printf("[OK]\n")
+
+	return func() error {
+		if err := client.Update(); err != nil {
+			return fmt.Errorf("Failed to update client: %v", err)
+		}
+		// The client has no key list, so the load generator asks the server
+		// for a key to read. This lookup is not private.
+		var numKeys int
+		if err := proxyLeft.NumKeys(0, &numKeys); err != nil {
+			return err
+		}
+		var row driver.RowIndexVal
+		if err := proxyLeft.GetRow(rand.Intn(numKeys), &row); err != nil {
+			return err
+		}
+		if _, err := client.ReadKey(row.Key); err != nil {
+			return fmt.Errorf("Failed to read key %d: %v", row.Key, err)
+		}
+		return nil
+	}
+}
+
+// saveState saves the client after every read, so that a client that stops
+// at any point never restarts from hints that it has already used.
+func saveState(client *updatable.Client, stateFile string) {
+	if stateFile == "" {
+		return
+	}
+	if err := driver.SaveClient(client, stateFile); err != nil {
+		// The old state must not be restored either.
+		os.Remove(stateFile)
+		log.Fatalf("Failed to save client state: %s\n", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	. "checklist/driver"
+	"checklist/pir"
 	"checklist/rpc"
 
 	sb "checklist/safebrowsing"
@@ -39,6 +40,7 @@ func readBlockedURLs(blockListFile string, config *TestConfig) {
 func main() {
 	config := new(Config).AddPirFlags().AddServerFlags()
 	blockList := config.FlagSet.String("f", "", "URL block list file")
+	dbFile := config.FlagSet.String("dbFile", "", "serve a static database memory-mapped from this file")
 	config.Parse()
 
 	if len(*blockList) != 0 {
@@ -46,17 +48,36 @@ func main() {
 		config.NumRows = len(config.PresetRows)
 	}
 
+	if config.HintWorkers > 0 {
+		pir.SetHintWorkers(config.HintWorkers)
+	}
+	if config.AnswerThreads > 0 {
+		pir.SetAnswerThreads(config.AnswerThreads)
+	}
+
 	driver, err := NewServerDriver()
 	if err != nil {
 		log.Fatalf("Failed to create server: %s", err)
 	}
-	var none int
-	err = driver.Configure(config.TestConfig, &none)
-	if err != nil {
-		log.Fatalf("Failed to configure server: %s\n", err)
+	driver.SetBatchWindow(config.BatchWindow)
+	driver.SetDataDir(config.DataDir)
+	defer driver.Close()
+	if len(*dbFile) != 0 {
+		db, err := pir.OpenStaticDB(*dbFile)
+		if err != nil {
+			log.Fatalf("Failed to open database file: %s\n", err)
+		}
+		defer db.Close()
+		driver.SetStaticDB(&db.StaticDB)
+	} else {
+		var none int
+		err = driver.Configure(config.TestConfig, &none)
+		if err != nil {
+			log.Fatalf("Failed to configure server: %s\n", err)
+		}
 	}
 
-	server, err := rpc.NewServer(config.Port, config.UseTLS, RegisteredTypes())
+	server, err := rpc.NewServer(config.Port, config.UseTLS, config.AllowOrigin, RegisteredTypes())
 	if err != nil {
 		log.Fatalf("Failed to create server: %s", err)
 	}
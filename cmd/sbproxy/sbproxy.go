@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -36,9 +37,10 @@ const (
 
 type sbproxy struct {
 	pirClient *updatable.Client
+	stateFile string
 }
 
-func NewSBProxy(serverAddr string) *sbproxy {
+func NewSBProxy(serverAddr string, pirType pir.PirType, stateFile string) *sbproxy {
 	addrs := strings.Split(serverAddr, ",")
 	rpcLeft, err := driver.NewRpcProxy(addrs[0], true, true)
 	if err != nil {
@@ -54,12 +56,23 @@ func NewSBProxy(serverAddr string) *sbproxy {
 		rpcRight = rpcLeft
 	}
 
-	client := updatable.NewClient(pir.RandSource(), pir.Punc, [2]updatable.UpdatableServer{rpcLeft, rpcRight})
-	if err = client.Init(); err != nil {
+	client := updatable.NewClient(pir.RandSource(), pirType, [2]updatable.UpdatableServer{rpcLeft, rpcRight})
+	if err = driver.InitClient(client, stateFile); err != nil {
 		log.Fatalf("Failed to run PIR Init: %s\n", err)
 	}
 	log.Printf("PIR Init ok with %d keys\n", len(client.Keys()))
-	return &sbproxy{pirClient: client}
+	proxy := &sbproxy{pirClient: client, stateFile: stateFile}
+	proxy.saveState()
+	return proxy
+}
+
+func (proxy *sbproxy) saveState() {
+	if proxy.stateFile == "" {
+		return
+	}
+	if err := driver.SaveClient(proxy.pirClient, proxy.stateFile); err != nil {
+		log.Printf("Failed to save PIR client state: %s\n", err)
+	}
 }
 
 func unmarshalFetch(req *http.Request) (*FetchThreatListUpdatesRequest, error) {
@@ -215,6 +228,7 @@ func (proxy *sbproxy) handleFind(w http.ResponseWriter, req *http.Request) {
 		prefixInt := binary.LittleEndian.Uint32(e.Hash)
 		log.Printf("Looking for hash prefix = %x", prefixInt)
 		h, err := proxy.pirClient.Read(prefixInt)
+		proxy.saveState()
 		if err != nil {
 			log.Printf("PIR query failed: %s\n", err)
 			continue
@@ -256,9 +270,16 @@ func copyHeader(dst, src http.Header) {
 func main() {
 	var serverAddr string
 	flag.StringVar(&serverAddr, "serverAddr", ":12345", "<HOSTNAME>:<PORT> of one or two comma-separated PIR servers")
+	stateFile := flag.String("state", "", "file to save the PIR client state to and restore it from")
+	pirTypeStr := flag.String("pirType", pir.Punc.String(),
+		fmt.Sprintf("PIR type: [%s]", strings.Join(driver.PirTypeStrings(), "|")))
 	flag.Parse()
 
-	proxy := NewSBProxy(serverAddr)
+	pirType, err := pir.PirTypeString(*pirTypeStr)
+	if err != nil {
+		log.Fatalf("Bad PirType: %s\n", *pirTypeStr)
+	}
+	proxy := NewSBProxy(serverAddr, pirType, *stateFile)
 
 	server := &http.Server{
 		Addr: ":8888",
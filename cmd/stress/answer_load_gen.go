@@ -47,7 +47,7 @@ func initAnswerLoadGen(config *Config) *answerLoadGen {
 	proxy.NumRows(0, &numRows)
 	fmt.Printf("[OK] (numRows: %d)\n", numRows)
 
-	client := updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{proxy, proxy})
+	client := config.UpdatableClient([2]updatable.UpdatableServer{proxy, proxy})
 	client.CallAsync = false
 
 	fmt.Printf("Obtaining hint (this may take a while)...")
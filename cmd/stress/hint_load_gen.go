@@ -36,6 +36,9 @@ func initHintLoadGen(config *Config) *hintLoadGen {
 	}
 
 	fmt.Printf("[OK] (num rows: %d)\n", config.NumRows)
+	if err := config.PlanFromServer(proxy); err != nil {
+		log.Fatalf("%s\n", err)
+	}
 
 	sizes := updatable.NewWaterfallClient(pir.RandSource(), config.PirType).LayersMaxSize(config.NumRows)
 	probs := make([]float64, len(sizes))
@@ -24,7 +24,9 @@ type userLoadGen struct {
 }
 
 func initUserLoadGen(config *Config, trace [][]int) *userLoadGen {
+	config.RequirePlan()
 	waterfallClient := updatable.NewWaterfallClient(pir.RandSource(), config.PirType)
+	waterfallClient.SetLayerTypes(config.LayerTypes)
 	config.NumRows = 0
 	hintReqs := make([]*updatable.UpdatableHintReq, 0)
 	numQueries := 0
@@ -0,0 +1,155 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Checklist client for browsers, compiled to WebAssembly. It talks to the
+// HTTPS endpoint of rpc_server and exposes a global checklist object to
+// JavaScript:
+//
+//	await checklist.init({servers: ["host:port", "host:port"], pirType: "Punc", state: savedState})
+//	await checklist.update()
+//	const row = await checklist.lookup(key) // Uint8Array, or null if absent
+//	const state = await checklist.save()    // Uint8Array for init
+//
+// All methods return promises, and calls are run one at a time.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"checklist/driver"
+	"checklist/pir"
+	"checklist/updatable"
+)
+
+type wasmClient struct {
+	mu     sync.Mutex
+	client *updatable.Client
+}
+
+func (c *wasmClient) init(args []js.Value) (interface{}, error) {
+	if len(args) < 1 || args[0].Type() != js.TypeObject {
+		return nil, errors.New("Missing init options")
+	}
+	opts := args[0]
+
+	servers := opts.Get("servers")
+	if servers.Type() != js.TypeObject || servers.Length() < 1 || servers.Length() > 2 {
+		return nil, errors.New("Expected one or two servers")
+	}
+	var proxies [2]updatable.UpdatableServer
+	for i := 0; i < servers.Length(); i++ {
+		proxy, err := driver.NewRpcProxy(servers.Index(i).String(), true, true)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to %s: %v", servers.Index(i).String(), err)
+		}
+		proxies[i] = proxy
+	}
+	// Single-server schemes such as LWE only need one server.
+	if proxies[1] == nil {
+		proxies[1] = proxies[0]
+	}
+
+	pirType := pir.Punc
+	if name := opts.Get("pirType"); name.Type() == js.TypeString {
+		var err error
+		if pirType, err = pir.PirTypeString(name.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	client := updatable.NewClient(pir.RandSource(), pirType, proxies)
+	if state := opts.Get("state"); state.Truthy() {
+		data := make([]byte, state.Length())
+		js.CopyBytesToGo(data, state)
+		if err := client.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("Failed to restore client state: %v", err)
+		}
+		if err := client.Update(); err != nil {
+			return nil, err
+		}
+	} else if err := client.Init(); err != nil {
+		return nil, err
+	}
+	c.client = client
+	return len(client.Keys()), nil
+}
+
+func (c *wasmClient) update(args []js.Value) (interface{}, error) {
+	if c.client == nil {
+		return nil, errors.New("Client not initialized")
+	}
+	if err := c.client.Update(); err != nil {
+		return nil, err
+	}
+	return len(c.client.Keys()), nil
+}
+
+func (c *wasmClient) lookup(args []js.Value) (interface{}, error) {
+	if c.client == nil {
+		return nil, errors.New("Client not initialized")
+	}
+	if len(args) < 1 || args[0].Type() != js.TypeNumber {
+		return nil, errors.New("Expected a numeric key")
+	}
+	row, err := c.client.Read(uint32(args[0].Int()))
+	if errors.Is(err, pir.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return bytesToJS(row), nil
+}
+
+func (c *wasmClient) save(args []js.Value) (interface{}, error) {
+	if c.client == nil {
+		return nil, errors.New("Client not initialized")
+	}
+	data, err := c.client.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bytesToJS(data), nil
+}
+
+func bytesToJS(data []byte) js.Value {
+	array := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(array, data)
+	return array
+}
+
+// async wraps f in a JavaScript function that returns a promise. f runs in
+// its own goroutine, since RPCs block and must not block the event loop.
+func (c *wasmClient) async(f func([]js.Value) (interface{}, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handler := js.FuncOf(func(this js.Value, promise []js.Value) interface{} {
+			resolve, reject := promise[0], promise[1]
+			go func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				res, err := f(args)
+				if err != nil {
+					reject.Invoke(js.Global().Get("Error").New(err.Error()))
+					return
+				}
+				resolve.Invoke(res)
+			}()
+			return nil
+		})
+		defer handler.Release()
+		return js.Global().Get("Promise").New(handler)
+	})
+}
+
+func main() {
+	c := &wasmClient{}
+	js.Global().Set("checklist", js.ValueOf(map[string]interface{}{
+		"init":   c.async(c.init),
+		"update": c.async(c.update),
+		"lookup": c.async(c.lookup),
+		"save":   c.async(c.save),
+	}))
+	select {}
+}
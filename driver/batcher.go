@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"checklist/pir"
+
+	"github.com/dkales/dpf-go/dpf"
+)
+
+// Upper bound on the number of queries answered in one pass.
+const maxBatchSize = 64
+
+// queryBatcher collects the DPF and Matrix queries that arrive within a
+// short window, from any number of clients, and answers them together with
+// DPFBatchQueryReq and MatrixBatchQueryReq, which read every row of the
+// database once per batch instead of once per query. Other queries are
+// answered right away.
+type queryBatcher struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[batchKey]*queryBatch
+}
+
+// Queries are only batched with queries of the same type against the
+// same database.
+type batchKey struct {
+	db        *pir.StaticDB
+	queryType string
+}
+
+type queryBatch struct {
+	queries []pir.QueryReq
+	resps   []interface{}
+	errs    []error
+	done    chan struct{}
+}
+
+func newQueryBatcher(window time.Duration) *queryBatcher {
+	return &queryBatcher{
+		window:  window,
+		pending: make(map[batchKey]*queryBatch),
+	}
+}
+
+func (b *queryBatcher) answer(db *pir.StaticDB, q pir.QueryReq) (interface{}, error) {
+	key := batchKey{db: db}
+	switch q.(type) {
+	case *pir.DPFQueryReq:
+		key.queryType = "DPF"
+	case *pir.MatrixQueryReq:
+		key.queryType = "Matrix"
+	default:
+		return q.Process(*db)
+	}
+
+	b.mu.Lock()
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &queryBatch{done: make(chan struct{})}
+		b.pending[key] = batch
+		time.AfterFunc(b.window, func() { b.flush(key, batch) })
+	}
+	i := len(batch.queries)
+	batch.queries = append(batch.queries, q)
+	full := len(batch.queries) == maxBatchSize
+	b.mu.Unlock()
+
+	if full {
+		b.flush(key, batch)
+	}
+	<-batch.done
+	return batch.resps[i], batch.errs[i]
+}
+
+// flush answers the batch, unless it was already flushed because it was
+// full.
+func (b *queryBatcher) flush(key batchKey, batch *queryBatch) {
+	b.mu.Lock()
+	if b.pending[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+
+	batch.resps = make([]interface{}, len(batch.queries))
+	batch.errs = make([]error, len(batch.queries))
+	if len(batch.queries) == 1 || batch.process(*key.db) != nil {
+		// Answer the queries one by one, so that only the malformed
+		// queries of a batch fail.
+		for i, q := range batch.queries {
+			batch.resps[i], batch.errs[i] = q.Process(*key.db)
+		}
+	}
+	close(batch.done)
+}
+
+func (batch *queryBatch) process(db pir.StaticDB) error {
+	switch batch.queries[0].(type) {
+	case *pir.DPFQueryReq:
+		req := &pir.DPFBatchQueryReq{Keys: make([]dpf.DPFkey, len(batch.queries))}
+		for i, q := range batch.queries {
+			req.Keys[i] = q.(*pir.DPFQueryReq).DPFkey
+		}
+		resp, err := req.Process(db)
+		if err != nil {
+			return err
+		}
+		for i, answer := range resp.(*pir.DPFBatchQueryResp).Answers {
+			batch.resps[i] = &pir.DPFQueryResp{Answer: answer}
+		}
+	case *pir.MatrixQueryReq:
+		req := &pir.MatrixBatchQueryReq{BitVectors: make([][]bool, len(batch.queries))}
+		for i, q := range batch.queries {
+			req.BitVectors[i] = q.(*pir.MatrixQueryReq).BitVector
+		}
+		resp, err := req.Process(db)
+		if err != nil {
+			return err
+		}
+		for i, answer := range resp.(*pir.MatrixBatchQueryResp).Answers {
+			batch.resps[i] = &pir.MatrixQueryResp{Answer: answer}
+		}
+	default:
+		return fmt.Errorf("Unexpected query type in batch: %T", batch.queries[0])
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"checklist/updatable"
+)
+
+// InitClient restores the client from stateFile, if the file exists, and
+// brings it up to date with the servers. Otherwise it initializes the client
+// from scratch, which downloads a full hint.
+func InitClient(client *updatable.Client, stateFile string) error {
+	if stateFile == "" {
+		return client.Init()
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return client.Init()
+	} else if err != nil {
+		return err
+	}
+	if err := client.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return client.Update()
+}
+
+// SaveClient writes the state of the client to stateFile. The file is
+// replaced atomically, so a crash never leaves a truncated state behind.
+//
+// The state must be saved after every read: restoring an older state would
+// make the client reuse hints that the servers have already seen.
+func SaveClient(client *updatable.Client, stateFile string) error {
+	data, err := client.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFile)
+}
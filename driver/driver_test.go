@@ -2,10 +2,17 @@ package driver
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	netrpc "net/rpc"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"checklist/pir"
 	"checklist/rpc"
@@ -32,7 +39,7 @@ func TestStatic(t *testing.T) {
 	presetRow := make(pir.Row, config.RowLen)
 	pir.RandSource().Read(presetRow)
 
-	config.PresetRows = []RowIndexVal{{7, 0x1234, presetRow}}
+	config.PresetRows = []RowIndexVal{{Index: 7, Key: 0x1234, Value: presetRow}}
 	config.Updatable = false
 	config.DataRandSeed = 13
 
@@ -50,6 +57,11 @@ func TestStatic(t *testing.T) {
 	val, err := client.Read(7)
 	assert.NilError(t, err)
 	assert.DeepEqual(t, val, presetRow)
+
+	vals, err := client.ReadBatch([]int{7, 0, 7})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, vals[0], presetRow)
+	assert.DeepEqual(t, vals[2], presetRow)
 }
 
 func TestUpdatable(t *testing.T) {
@@ -61,7 +73,7 @@ func TestUpdatable(t *testing.T) {
 	presetRow := make(pir.Row, config.RowLen)
 	pir.RandSource().Read(presetRow)
 
-	config.PresetRows = []RowIndexVal{{7, 0x1234, presetRow}}
+	config.PresetRows = []RowIndexVal{{Index: 7, Key: 0x1234, Value: presetRow}}
 	config.Updatable = true
 	config.DataRandSeed = 13
 
@@ -82,6 +94,119 @@ func TestUpdatable(t *testing.T) {
 	val, err = client.Read(0x1234)
 	assert.NilError(t, err)
 	assert.DeepEqual(t, val, presetRow)
+
+	stateFile := filepath.Join(t.TempDir(), "client.state")
+	assert.NilError(t, SaveClient(client, stateFile))
+	restored := updatable.NewClient(pir.RandSource(), config.PirType, [2]updatable.UpdatableServer{driverL, driverR})
+	assert.NilError(t, InitClient(restored, stateFile))
+	val, err = restored.Read(0x1234)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, presetRow)
+}
+
+func TestUpdatableWideKeys(t *testing.T) {
+	var drivers []PirServerDriver
+	var none int
+	for s := 0; s < 2; s++ {
+		driver, err := NewServerDriver()
+		assert.NilError(t, err)
+		assert.NilError(t, driver.Configure(TestConfig{NumRows: 100, RowLen: 32, Updatable: true, KeyWidth: 8, DataRandSeed: 13}, &none))
+		drivers = append(drivers, driver)
+	}
+
+	keys := []updatable.Key{updatable.KeyFromUint64(1 << 40), updatable.KeyFromUint64(7)}
+	rows := pir.MakeRows(pir.RandSource(), 3, 32)
+	for _, driver := range drivers {
+		assert.NilError(t, driver.AddRowsWithKeys(KeyRows{keys, rows[:2]}, &none))
+		assert.NilError(t, driver.UpdateRowsWithKeys(KeyRows{keys[1:], rows[2:]}, &none))
+		assert.NilError(t, driver.DeleteRowsWithKeys(keys[:1], &none))
+		assert.NilError(t, driver.AddRows(10, &none))
+	}
+	// The server rejects keys of another width instead of exiting.
+	err := drivers[0].AddRowsWithKeys(KeyRows{[]updatable.Key{updatable.KeyFromUint32(1)}, rows[:1]}, &none)
+	assert.ErrorContains(t, err, "has 4 bytes")
+
+	client := updatable.NewClient(pir.RandSource(), pir.Punc, [2]updatable.UpdatableServer{drivers[0], drivers[1]})
+	assert.NilError(t, client.Init())
+	assert.Equal(t, client.KeyWidth(), 8)
+	val, err := client.ReadKey(keys[1])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rows[2])
+	_, err = client.ReadKey(keys[0])
+	assert.Equal(t, err, pir.ErrKeyNotFound)
+
+	var rowIV RowIndexVal
+	assert.NilError(t, drivers[0].GetRow(50, &rowIV))
+	assert.Equal(t, len(rowIV.WideKey), 8)
+	val, err = client.ReadKey(rowIV.WideKey)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rowIV.Value)
+
+	// Keys are arbitrary bytes, which must survive the RPC encoding.
+	w := new(bytes.Buffer)
+	h := rpc.CodecHandle(RegisteredTypes())
+	req := KeyRows{Keys: []updatable.Key{"\x00\xff\x80\x01\x02\x03\x04\x05"}, Rows: rows[:1]}
+	assert.NilError(t, codec.NewEncoder(w, h).Encode(req))
+	var reqOut KeyRows
+	assert.NilError(t, codec.NewDecoder(w, h).Decode(&reqOut))
+	assert.DeepEqual(t, reqOut, req)
+}
+
+func TestKeyword(t *testing.T) {
+	presetRow := make(pir.Row, 32)
+	pir.RandSource().Read(presetRow)
+	for _, updatableDB := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Updatable=%v", updatableDB), func(t *testing.T) {
+			var servers [2]PirServerDriver
+			var none int
+			for s := range servers {
+				driver, err := NewServerDriver()
+				assert.NilError(t, err)
+				assert.NilError(t, driver.Configure(TestConfig{
+					NumRows:      500,
+					RowLen:       32,
+					Updatable:    updatableDB,
+					Keyword:      true,
+					DataRandSeed: 13,
+					PresetRows:   []RowIndexVal{{Index: 7, Key: 0x1234, Value: presetRow}},
+				}, &none))
+				servers[s] = driver
+			}
+
+			client := NewKeywordClient(pir.RandSource(), pir.Punc, servers)
+			assert.NilError(t, client.Init())
+			val, err := client.ReadKey(0x1234)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, val, presetRow)
+			_, err = client.ReadKey(0x4321)
+			assert.Equal(t, err, pir.ErrKeyNotFound)
+
+			newRows := pir.MakeRows(pir.RandSource(), 1, 32)
+			newKeys := []updatable.Key{updatable.KeyFromUint32(0x4321)}
+			for _, server := range servers {
+				err := server.AddRowsWithKeys(KeyRows{newKeys, newRows}, &none)
+				if !updatableDB {
+					assert.ErrorContains(t, err, "Non-Updatable")
+					return
+				}
+				assert.NilError(t, err)
+			}
+			assert.NilError(t, client.Update())
+			val, err = client.ReadKey(0x4321)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, val, newRows[0])
+			val, err = client.ReadKey(0x1234)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, val, presetRow)
+		})
+	}
+
+	driver, err := NewServerDriver()
+	assert.NilError(t, err)
+	var none int
+	assert.NilError(t, driver.Configure(TestConfig{NumRows: 100, RowLen: 32}, &none))
+	var info KeywordInfo
+	assert.ErrorContains(t, driver.KeywordInfo(0, &info), "not configured for keyword PIR")
 }
 
 func TestSafeBrowsingList(t *testing.T) {
@@ -140,6 +265,81 @@ func TestSerialization(t *testing.T) {
 
 	var reqOut pir.HintReq
 	assert.NilError(t, dec.Decode(&reqOut))
+
+	resp, err := req.Process(pir.MakeDB(100, 32))
+	assert.NilError(t, err)
+	queries, _ := resp.InitClient(pir.RandSource()).QueryBatch([]int{1, 2})
+	assert.NilError(t, enc.Encode(&queries[0]))
+
+	var queryOut pir.QueryReq
+	assert.NilError(t, dec.Decode(&queryOut))
+	assert.DeepEqual(t, queryOut, queries[0])
+}
+
+func TestRemoteValidationError(t *testing.T) {
+	driver, err := NewServerDriver()
+	assert.NilError(t, err)
+	var none int
+	assert.NilError(t, driver.Configure(TestConfig{NumRows: 100, RowLen: 32}, &none))
+
+	var resp interface{}
+	err = driver.Answer(&pir.NonPrivateQueryReq{Index: 100}, &resp)
+	assert.ErrorContains(t, err, "out of bounds")
+
+	// net/rpc only transmits the message of the error.
+	var validationErr *pir.ValidationError
+	err = remoteError(netrpc.ServerError(err.Error()))
+	assert.Assert(t, errors.As(err, &validationErr), "got: %v", err)
+	err = remoteError(netrpc.ServerError("other error"))
+	assert.Assert(t, !errors.As(err, &validationErr))
+}
+
+func TestQueryBatching(t *testing.T) {
+	driver, err := NewServerDriver()
+	assert.NilError(t, err)
+	var none int
+	assert.NilError(t, driver.Configure(TestConfig{NumRows: 1000, RowLen: 32, DataRandSeed: 5}, &none))
+	driver.SetBatchWindow(20 * time.Millisecond)
+
+	for _, pirType := range []pir.PirType{pir.DPF, pir.Matrix} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			const numClients = 10
+			errs := make(chan error, numClients+1)
+			for c := 0; c < numClients; c++ {
+				go func(c int) {
+					// Clients in different goroutines cannot share
+					// pir.RandSource.
+					source := rand.New(rand.NewSource(int64(c)))
+					client := pir.NewPIRReader(source, pir.Server(driver), pir.Server(driver))
+					if err := client.Init(pirType); err != nil {
+						errs <- err
+						return
+					}
+					row, err := client.Read(17 * c)
+					if err == nil && !bytes.Equal(row, driver.staticDB.Row(17*c)) {
+						err = fmt.Errorf("wrong row %d", 17*c)
+					}
+					errs <- err
+				}(c)
+			}
+			// A malformed query fails alone, without failing its batch.
+			go func() {
+				var resp interface{}
+				query := pir.QueryReq(&pir.MatrixQueryReq{})
+				if pirType == pir.DPF {
+					query = &pir.DPFQueryReq{DPFkey: []byte{1, 2, 3}}
+				}
+				if err := driver.Answer(query, &resp); err == nil {
+					errs <- errors.New("malformed query succeeded")
+				} else {
+					errs <- nil
+				}
+			}()
+			for c := 0; c < numClients+1; c++ {
+				assert.NilError(t, <-errs)
+			}
+		})
+	}
 }
 
 func _testMessageSizes(t *testing.T) {
@@ -188,3 +388,148 @@ func _testMessageSizesUpdatable(t *testing.T) {
 		fmt.Fprintf(os.Stdout, "updatable request size: %d\n", size)
 	}
 }
+
+// roundTrip sends a message through the codec of the RPC servers.
+func roundTrip(t *testing.T, h codec.Handle, in, out interface{}) int {
+	var buf bytes.Buffer
+	assert.NilError(t, codec.NewEncoder(&buf, h).Encode(in))
+	size := buf.Len()
+	assert.NilError(t, codec.NewDecoder(&buf, h).Decode(out))
+	return size
+}
+
+func TestWireEncodings(t *testing.T) {
+	h := rpc.CodecHandle(RegisteredTypes())
+	db := pir.MakeDB(1000, 32)
+	for _, pirType := range []pir.PirType{pir.Matrix, pir.Punc, pir.Perm, pir.DPF, pir.NonPrivate, pir.LWE} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			hintReq := pir.NewHintReq(pir.RandSource(), pirType)
+			roundTrip(t, h, &hintReq, &hintReq)
+			hint, err := hintReq.Process(db)
+			assert.NilError(t, err)
+			var hintOut pir.HintResp
+			roundTrip(t, h, &hint, &hintOut)
+			client := hintOut.InitClient(pir.RandSource())
+
+			for _, batch := range []bool{false, true} {
+				var queries []pir.QueryReq
+				var reconstruct pir.ReconstructBatchFunc
+				if batch {
+					queries, reconstruct = client.QueryBatch([]int{3, 999})
+				} else {
+					var rec pir.ReconstructFunc
+					queries, rec = client.Query(3)
+					reconstruct = func(resps []interface{}) ([]pir.Row, error) {
+						row, err := rec(resps)
+						return []pir.Row{row}, err
+					}
+				}
+				resps := make([]interface{}, len(queries))
+				for i := range queries {
+					var queryOut pir.QueryReq
+					roundTrip(t, h, &queries[i], &queryOut)
+					assert.Assert(t, reflect.DeepEqual(queryOut, queries[i]), "%T", queries[i])
+					resp, err := queryOut.Process(db)
+					assert.NilError(t, err)
+					roundTrip(t, h, &resp, &resps[i])
+				}
+				rows, err := reconstruct(resps)
+				assert.NilError(t, err)
+				assert.DeepEqual(t, rows[0], db.Row(3))
+			}
+		})
+	}
+}
+
+func TestWireEncodingSizes(t *testing.T) {
+	h := rpc.CodecHandle(RegisteredTypes())
+	bits := make([]bool, 8000)
+	for i := range bits {
+		bits[i] = i%3 == 0
+	}
+	var req pir.QueryReq = &pir.MatrixQueryReq{BitVector: bits}
+	var out pir.QueryReq
+	size := roundTrip(t, h, &req, &out)
+	assert.Assert(t, size < len(bits)/8+16, "%d bytes for %d bits", size, len(bits))
+	assert.DeepEqual(t, out, req)
+
+	hints := make([]pir.Row, 1000)
+	for i := range hints {
+		hints[i] = make(pir.Row, 32)
+	}
+	var resp pir.HintResp = &pir.PuncHintResp{NRows: 1000, RowLen: 32, Hints: hints}
+	size = roundTrip(t, h, &resp, new(pir.HintResp))
+	assert.Assert(t, size < len(hints)*32+64, "%d bytes for %d hints", size, len(hints))
+}
+
+func TestWireEncodingUpdatable(t *testing.T) {
+	h := rpc.CodecHandle(RegisteredTypes())
+	db := pir.MakeDB(1000, 32)
+	client := updatable.NewWaterfallClient(pir.RandSource(), pir.LWE)
+	numHints := 0
+	for _, n := range []int{900, 100} {
+		req, err := client.HintUpdateReq(n, 32)
+		assert.NilError(t, err)
+		if req == nil {
+			continue
+		}
+		numHints++
+		var reqOut updatable.UpdatableHintReq
+		roundTrip(t, h, req, &reqOut)
+		assert.Assert(t, reflect.DeepEqual(&reqOut, req))
+		resp, err := reqOut.Process(db)
+		assert.NilError(t, err)
+		var respOut pir.HintResp
+		roundTrip(t, h, &resp, &respOut)
+		assert.NilError(t, client.InitHint(respOut))
+	}
+	assert.Assert(t, numHints > 0)
+
+	queries, reconstruct := client.Query(950)
+	resps := make([]interface{}, len(queries))
+	for i := range queries {
+		var queryOut pir.QueryReq
+		roundTrip(t, h, &queries[i], &queryOut)
+		// Structs are decoded as pointers.
+		assert.Assert(t, reflect.DeepEqual(*queryOut.(*updatable.UpdatableQueryReq), queries[i]))
+		resp, err := queryOut.Process(db)
+		assert.NilError(t, err)
+		roundTrip(t, h, &resp, &resps[i])
+	}
+	row, err := reconstruct(resps)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, row, db.Row(950))
+}
+
+func TestWireEncodingMalformed(t *testing.T) {
+	req := &pir.PuncQueryReq{}
+	data, err := (&pir.PuncHintResp{NRows: 10, RowLen: 4, Hints: []pir.Row{{1, 2, 3, 4}}}).MarshalBinary()
+	assert.NilError(t, err)
+	var resp pir.PuncHintResp
+	assert.NilError(t, resp.UnmarshalBinary(data))
+	assert.ErrorContains(t, resp.UnmarshalBinary(data[:len(data)-1]), "exceed")
+	assert.ErrorContains(t, resp.UnmarshalBinary(append(data, 0)), "trailing")
+	assert.Assert(t, req.UnmarshalBinary([]byte{0xff}) != nil)
+}
+
+func TestAutoPirTypeFromServer(t *testing.T) {
+	server, err := NewServerDriver()
+	assert.NilError(t, err)
+	var none int
+	assert.NilError(t, server.Configure(TestConfig{NumRows: 20000, RowLen: 64, Updatable: true}, &none))
+
+	flags := flag.NewFlagSet("auto", flag.ContinueOnError)
+	c := &Config{FlagSet: flags}
+	c.AddPirFlags()
+	assert.NilError(t, flags.Parse([]string{"-pirType=Auto"}))
+	// Without -numRows, the plan is for the server's database, not for
+	// the default of the flag.
+	c.Parse()
+	assert.Assert(t, c.planPending)
+	client := c.UpdatableClient([2]updatable.UpdatableServer{server, server})
+	assert.NilError(t, client.Init())
+	assert.Equal(t, c.NumRows, 20000)
+	assert.Equal(t, c.RowLen, 64)
+	assert.Assert(t, !c.planPending)
+	assert.Assert(t, c.PirType != pir.None)
+}
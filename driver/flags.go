@@ -7,8 +7,10 @@ import (
 	"math"
 	"os"
 	"strings"
+	"time"
 
 	"checklist/pir"
+	"checklist/updatable"
 )
 
 type Config struct {
@@ -19,12 +21,19 @@ type Config struct {
 
 	// For client
 	PirType       pir.PirType
+	LayerTypes    updatable.LayerTypes
+	Workload      updatable.Workload
 	ServerAddr    string
 	ServerAddr2   string
 	UsePersistent bool
+	StateFile     string
 
 	// For server
-	Port int
+	Port        int
+	HintWorkers int
+	BatchWindow time.Duration
+	DataDir     string
+	AllowOrigin string
 
 	// For benchmarks
 	NumUpdates int
@@ -32,19 +41,33 @@ type Config struct {
 	TraceFile  string
 
 	pirTypeStr string
+	parsed     bool
+	// Set with -pirType=Auto until the size of the database is known.
+	planPending bool
 
 	FlagSet *flag.FlagSet
 }
 
+// AddPirFlags adds the flags to c.FlagSet, or to the command line flags if
+// it is not set.
 func (c *Config) AddPirFlags() *Config {
-	c.FlagSet = flag.CommandLine
+	if c.FlagSet == nil {
+		c.FlagSet = flag.CommandLine
+	}
 	c.FlagSet.IntVar(&c.NumRows, "numRows", 10000, "Num DB Rows")
 	c.FlagSet.IntVar(&c.RowLen, "rowLen", 32, "Row length in bytes")
 	c.FlagSet.StringVar(&c.pirTypeStr, "pirType", pir.Punc.String(),
-		fmt.Sprintf("Updatable PIR type: [%s]", strings.Join(PirTypeStrings(), "|")))
+		fmt.Sprintf("Updatable PIR type: [%s|%s]", strings.Join(PirTypeStrings(), "|"), autoPirType))
+	c.FlagSet.Float64Var(&c.Workload.QueriesPerDay, "queriesPerDay", 100, "expected lookups of a client per day, for -pirType="+autoPirType)
+	c.FlagSet.Float64Var(&c.Workload.UpdatesPerDay, "updatesPerDay", 0, "expected rows added per day, for -pirType="+autoPirType)
+	c.FlagSet.IntVar(&c.Workload.MaxClientBytes, "maxClientBytes", 0, "storage budget of a client, for -pirType="+autoPirType+" (default: no limit)")
+	c.FlagSet.Float64Var(&c.Workload.MaxBytesPerDay, "maxBytesPerDay", 0, "communication budget of a client per day, for -pirType="+autoPirType+" (default: no limit)")
 	c.FlagSet.BoolVar(&c.Updatable, "updatable", true, "Test Updatable PIR")
 	c.FlagSet.IntVar(&c.UpdateSize, "updateSize", 500, "number of rows in each update batch (default: 500)")
 	c.FlagSet.StringVar(&c.CpuProfile, "cpuprofile", "", "write cpu profile to `file`")
+	c.FlagSet.IntVar(&c.AnswerThreads, "answerThreads", 0, "number of goroutines that answer a single query (default: 1)")
+	c.FlagSet.IntVar(&c.KeyWidth, "keyWidth", 0, "number of bytes of the keys of the updatable database (default: 4)")
+	c.FlagSet.BoolVar(&c.Keyword, "keyword", false, "lay the database out for keyword PIR, so that clients read rows by key without downloading the keys")
 	return c
 }
 
@@ -53,12 +76,17 @@ func (c *Config) AddClientFlags() *Config {
 	c.FlagSet.StringVar(&c.ServerAddr2, "serverAddr2", "", "<HOSTNAME>:<PORT> of server for RPC test")
 	c.FlagSet.BoolVar(&c.UseTLS, "tls", true, "Should use TLS")
 	c.FlagSet.BoolVar(&c.UsePersistent, "persistent", false, "Should use peristent connection to server")
+	c.FlagSet.StringVar(&c.StateFile, "state", "", "file to save the client state to and restore it from")
 	return c
 }
 
 func (c *Config) AddServerFlags() *Config {
 	c.FlagSet.BoolVar(&c.UseTLS, "tls", true, "Should use TLS")
 	c.FlagSet.IntVar(&c.Port, "p", 12345, "Listening port")
+	c.FlagSet.IntVar(&c.HintWorkers, "hintWorkers", 0, "number of goroutines that generate hints (default: number of CPUs)")
+	c.FlagSet.DurationVar(&c.BatchWindow, "batchWindow", 0, "time to wait for concurrent DPF and Matrix queries to answer together (default: no batching)")
+	c.FlagSet.StringVar(&c.DataDir, "dataDir", "", "directory to persist the updatable database in, and restore it from on restart")
+	c.FlagSet.StringVar(&c.AllowOrigin, "allowOrigin", "", "origin of the web pages that may call the server over HTTPS, or * for any (default: none)")
 	return c
 }
 
@@ -71,11 +99,30 @@ func (c *Config) AddBenchmarkFlags() *Config {
 }
 
 func (c *Config) Parse() *Config {
-	if c.FlagSet.Parsed() {
+	if c.parsed {
 		return c
 	}
-	if err := c.FlagSet.Parse(os.Args[1:]); err != nil {
-		log.Fatalf("%v", err)
+	c.parsed = true
+	if !c.FlagSet.Parsed() {
+		if err := c.FlagSet.Parse(os.Args[1:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if c.pirTypeStr == autoPirType {
+		// The default of -numRows is rarely the size of the database that
+		// a client reads, so without the flag the plan waits for the server.
+		numRowsSet := false
+		c.FlagSet.Visit(func(f *flag.Flag) {
+			numRowsSet = numRowsSet || f.Name == "numRows"
+		})
+		if !numRowsSet {
+			c.planPending = true
+			return c
+		}
+		if err := c.plan(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return c
 	}
 	var err error
 	c.PirType, err = pir.PirTypeString(c.pirTypeStr)
@@ -89,6 +136,68 @@ func (c *Config) Parse() *Config {
 	return c
 }
 
+// With -pirType=Auto, the PIR configuration is chosen by
+// updatable.PlanWorkload from the size of the database and the workload
+// flags.
+const autoPirType = "Auto"
+
+func (c *Config) plan() error {
+	c.Workload.NumRows, c.Workload.RowLen = c.NumRows, c.RowLen
+	plan, err := updatable.PlanWorkload(c.Workload)
+	if err != nil {
+		return err
+	}
+	log.Printf("Planned PIR configuration: %v", plan)
+	c.PirType, c.LayerTypes = plan.PirType, plan.LayerTypes
+	c.planPending = false
+	return nil
+}
+
+// PlanFromServer plans the PIR configuration of -pirType=Auto for the
+// number of rows and row length of the database of the server, unless
+// -numRows was given.
+func (c *Config) PlanFromServer(server PirServerDriver) error {
+	c.Parse()
+	if !c.planPending {
+		return nil
+	}
+	if err := server.NumRows(0, &c.NumRows); err != nil {
+		return fmt.Errorf("Failed to get the number of rows to plan for: %v", err)
+	}
+	if err := server.RowLen(0, &c.RowLen); err != nil {
+		return fmt.Errorf("Failed to get the row length to plan for: %v", err)
+	}
+	return c.plan()
+}
+
+// RequirePlan exits if -pirType=Auto has no database size to plan for,
+// for commands that do not read it from a server.
+func (c *Config) RequirePlan() {
+	c.Parse()
+	if c.planPending {
+		log.Fatalf("-pirType=%s needs -numRows", autoPirType)
+	}
+}
+
+// UpdatableClient returns a client with the PIR configuration of the flags.
+// With -pirType=Auto and no -numRows, the configuration is planned for the
+// database of the left server.
+func (c *Config) UpdatableClient(servers [2]updatable.UpdatableServer) *updatable.Client {
+	c.Parse()
+	if c.planPending {
+		server, ok := servers[pir.Left].(PirServerDriver)
+		if !ok {
+			log.Fatalf("-pirType=%s needs -numRows", autoPirType)
+		}
+		if err := c.PlanFromServer(server); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	client := updatable.NewClient(pir.RandSource(), c.PirType, servers)
+	client.SetLayerTypes(c.LayerTypes)
+	return client
+}
+
 func (c *Config) ServerDriver() (PirServerDriver, error) {
 	c.Parse()
 
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"fmt"
+	"math/rand"
+
+	"checklist/pir"
+	"checklist/updatable"
+)
+
+// A server configured with TestConfig.Keyword lays its rows out with
+// pir.BuildKeywordDB, so that clients read rows by key without downloading
+// the keys. The keys and values are kept in an updatable.Server, and the
+// table is rebuilt after every change. Such a server only answers keyword
+// clients.
+
+// KeywordInfo describes the keyword table of a server. Version changes
+// whenever the table is rebuilt, after which clients need a fresh hint.
+type KeywordInfo struct {
+	Params  pir.KeywordParams
+	Version int
+}
+
+func (driver *serverDriver) KeywordInfo(none int, out *KeywordInfo) error {
+	if !driver.config.Keyword {
+		return fmt.Errorf("Server is not configured for keyword PIR")
+	}
+	*out = driver.keywordInfo
+	return nil
+}
+
+// buildKeywordDB lays out the latest value of every key in a keyword table,
+// which becomes the database that the driver serves.
+func (driver *serverDriver) buildKeywordDB() error {
+	db := driver.updatableServer
+	var keys []uint32
+	var rows []pir.Row
+	seen := make(map[updatable.Key]bool, db.NumKeys())
+	for _, key := range db.FirstKeys(db.NumKeys()) {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		row, _ := db.Value(key)
+		keys = append(keys, key.Uint32())
+		rows = append(rows, row)
+	}
+	// Both servers build the same table from the same changes.
+	version := driver.keywordInfo.Version + 1
+	keywordDB, params, err := pir.BuildKeywordDB(keys, rows, uint64(version)<<32)
+	if err != nil {
+		return err
+	}
+	driver.staticDB = keywordDB
+	driver.keywordInfo = KeywordInfo{Params: params, Version: version}
+	return nil
+}
+
+// changed rebuilds the keyword table after a change of the database.
+func (driver *serverDriver) changed() error {
+	if !driver.config.Keyword {
+		return nil
+	}
+	return driver.buildKeywordDB()
+}
+
+// KeywordClient reads rows by key from servers configured for keyword PIR.
+// Every read makes pir.KeywordNumHashes queries, and the client keeps no
+// state per key.
+type KeywordClient struct {
+	servers    [2]PirServerDriver
+	pirType    pir.PirType
+	randSource *rand.Rand
+
+	reader  *pir.KeywordReader
+	version int
+}
+
+func NewKeywordClient(source *rand.Rand, pirType pir.PirType, servers [2]PirServerDriver) *KeywordClient {
+	return &KeywordClient{servers: servers, pirType: pirType, randSource: source}
+}
+
+// Init fetches the parameters of the keyword table and a hint for it.
+func (c *KeywordClient) Init() error {
+	var info KeywordInfo
+	if err := c.servers[pir.Left].KeywordInfo(0, &info); err != nil {
+		return err
+	}
+	reader := pir.NewPIRReader(c.randSource, c.servers[pir.Left], c.servers[pir.Right])
+	if err := reader.Init(c.pirType); err != nil {
+		return err
+	}
+	c.reader = pir.NewKeywordReader(reader, info.Params)
+	c.version = info.Version
+	return nil
+}
+
+// Update fetches a fresh hint if the servers rebuilt their keyword table.
+func (c *KeywordClient) Update() error {
+	var info KeywordInfo
+	if err := c.servers[pir.Left].KeywordInfo(0, &info); err != nil {
+		return err
+	}
+	if info.Version == c.version {
+		return nil
+	}
+	return c.Init()
+}
+
+// ReadKey returns the row of key, or pir.ErrKeyNotFound.
+func (c *KeywordClient) ReadKey(key uint32) (pir.Row, error) {
+	if c.reader == nil {
+		return nil, fmt.Errorf("Did you forget to call Init?")
+	}
+	return c.reader.ReadKey(key)
+}
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	netrpc "net/rpc"
 	"time"
 
 	"checklist/pir"
@@ -25,11 +26,22 @@ func (p *RpcProxy) KeyUpdates(req updatable.KeyUpdatesReq, resp *updatable.KeyUp
 }
 
 func (p *RpcProxy) Hint(req pir.HintReq, resp *pir.HintResp) error {
-	return p.Call("PirServerDriver.Hint", req, resp)
+	return remoteError(p.Call("PirServerDriver.Hint", req, resp))
 }
 
 func (p *RpcProxy) Answer(query pir.QueryReq, resp *interface{}) error {
-	return p.Call("PirServerDriver.Answer", query, resp)
+	return remoteError(p.Call("PirServerDriver.Answer", query, resp))
+}
+
+// remoteError restores the type of validation errors, which reach the
+// client as plain error messages.
+func remoteError(err error) error {
+	if serverErr, ok := err.(netrpc.ServerError); ok {
+		if validationErr := pir.ParseValidationError(string(serverErr)); validationErr != nil {
+			return validationErr
+		}
+	}
+	return err
 }
 
 func (p *RpcProxy) Configure(config TestConfig, none *int) error {
@@ -59,6 +71,42 @@ func (p *RpcProxy) DeleteRows(numRows int, none *int) error {
 	return p.Call("PirServerDriver.DeleteRows", numRows, none)
 }
 
+func (p *RpcProxy) UpdateRows(numRows int, none *int) error {
+	var non int
+	if none == nil {
+		none = &non
+	}
+
+	return p.Call("PirServerDriver.UpdateRows", numRows, none)
+}
+
+func (p *RpcProxy) AddRowsWithKeys(rows KeyRows, none *int) error {
+	var non int
+	if none == nil {
+		none = &non
+	}
+
+	return p.Call("PirServerDriver.AddRowsWithKeys", rows, none)
+}
+
+func (p *RpcProxy) DeleteRowsWithKeys(keys []updatable.Key, none *int) error {
+	var non int
+	if none == nil {
+		none = &non
+	}
+
+	return p.Call("PirServerDriver.DeleteRowsWithKeys", keys, none)
+}
+
+func (p *RpcProxy) UpdateRowsWithKeys(rows KeyRows, none *int) error {
+	var non int
+	if none == nil {
+		none = &non
+	}
+
+	return p.Call("PirServerDriver.UpdateRowsWithKeys", rows, none)
+}
+
 func (p *RpcProxy) NumRows(none int, out *int) error {
 	return p.Call("PirServerDriver.NumRows", none, out)
 }
@@ -71,6 +119,10 @@ func (p *RpcProxy) RowLen(none int, out *int) error {
 	return p.Call("PirServerDriver.RowLen", none, out)
 }
 
+func (p *RpcProxy) KeywordInfo(none int, out *KeywordInfo) error {
+	return p.Call("PirServerDriver.KeywordInfo", none, out)
+}
+
 func (p *RpcProxy) GetRow(idx int, row *RowIndexVal) error {
 	return p.Call("PirServerDriver.GetRow", idx, row)
 }
@@ -3,6 +3,7 @@ package driver
 import (
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"checklist/pir"
@@ -16,10 +17,15 @@ type PirServerDriver interface {
 
 	AddRows(numRows int, none *int) error
 	DeleteRows(numRows int, none *int) error
+	UpdateRows(numRows int, none *int) error
+	AddRowsWithKeys(rows KeyRows, none *int) error
+	DeleteRowsWithKeys(keys []updatable.Key, none *int) error
+	UpdateRowsWithKeys(rows KeyRows, none *int) error
 	GetRow(idx int, row *RowIndexVal) error
 	NumRows(none int, out *int) error
 	NumKeys(none int, out *int) error
 	RowLen(none int, out *int) error
+	KeywordInfo(none int, out *KeywordInfo) error
 
 	ResetMetrics(none int, none2 *int) error
 	GetOfflineTimer(none int, out *time.Duration) error
@@ -32,9 +38,30 @@ type RowIndexVal struct {
 	Index int
 	Key   uint32
 	Value pir.Row
+	// The key in databases of keys of any width. Key holds it as an
+	// integer if it has 4 bytes.
+	WideKey updatable.Key
+}
+
+func (r RowIndexVal) key() updatable.Key {
+	if r.WideKey != "" {
+		return r.WideKey
+	}
+	return updatable.KeyFromUint32(r.Key)
+}
+
+// KeyRows are rows of given keys of any width.
+type KeyRows struct {
+	Keys []updatable.Key
+	Rows []pir.Row
 }
 
 type serverDriver struct {
+	// For profiling. Concurrent queries update these atomically, and
+	// they come first to be 64-bit aligned.
+	hintTime, answerTime      int64
+	offlineBytes, onlineBytes int64
+
 	updatableServer *updatable.Server
 	staticDB        *pir.StaticDB
 
@@ -42,10 +69,13 @@ type serverDriver struct {
 
 	randSource *rand.Rand
 	updatable  bool
+	// Directory of the persistent updatable database, if not empty.
+	dataDir string
+	// The keyword table that staticDB holds, if config.Keyword is set.
+	keywordInfo KeywordInfo
 
-	// For profiling
-	hintTime, answerTime      time.Duration
-	offlineBytes, onlineBytes int
+	// Batches concurrent queries, if not nil.
+	batcher *queryBatcher
 }
 
 func NewServerDriver() (*serverDriver, error) {
@@ -65,21 +95,21 @@ func (driver *serverDriver) KeyUpdates(req updatable.KeyUpdatesReq, resp *updata
 		if err != nil {
 			return err
 		}
-		driver.offlineBytes += reqSize
+		atomic.AddInt64(&driver.offlineBytes, int64(reqSize))
 	}
 
 	start := time.Now()
 	if err := driver.updatableServer.KeyUpdates(req, resp); err != nil {
 		return err
 	}
-	driver.hintTime += time.Since(start)
+	atomic.AddInt64(&driver.hintTime, int64(time.Since(start)))
 
 	if driver.config.MeasureBandwidth {
 		respSize, err := SerializedSizeOf(resp)
 		if err != nil {
 			return err
 		}
-		driver.offlineBytes += respSize
+		atomic.AddInt64(&driver.offlineBytes, int64(respSize))
 	}
 	return nil
 }
@@ -90,21 +120,21 @@ func (driver *serverDriver) Hint(req pir.HintReq, resp *pir.HintResp) (err error
 		if err != nil {
 			return err
 		}
-		driver.offlineBytes += reqSize
+		atomic.AddInt64(&driver.offlineBytes, int64(reqSize))
 	}
 
 	start := time.Now()
 	if *resp, err = req.Process(*driver.staticDB); err != nil {
 		return err
 	}
-	driver.hintTime += time.Since(start)
+	atomic.AddInt64(&driver.hintTime, int64(time.Since(start)))
 
 	if driver.config.MeasureBandwidth {
 		respSize, err := SerializedSizeOf(resp)
 		if err != nil {
 			return err
 		}
-		driver.offlineBytes += respSize
+		atomic.AddInt64(&driver.offlineBytes, int64(respSize))
 	}
 	return nil
 }
@@ -115,18 +145,23 @@ func (driver *serverDriver) Answer(q pir.QueryReq, resp *interface{}) (err error
 		if err != nil {
 			return err
 		}
-		driver.onlineBytes += reqSize
+		atomic.AddInt64(&driver.onlineBytes, int64(reqSize))
 	}
 
 	start := time.Now()
-	if *resp, err = q.Process(*driver.staticDB); err != nil {
+	if driver.batcher != nil {
+		*resp, err = driver.batcher.answer(driver.staticDB, q)
+	} else {
+		*resp, err = q.Process(*driver.staticDB)
+	}
+	if err != nil {
 		return err
 	}
-	driver.answerTime += time.Since(start)
+	atomic.AddInt64(&driver.answerTime, int64(time.Since(start)))
 
 	if driver.config.MeasureBandwidth {
 		respSize, _ := SerializedSizeOf(resp)
-		driver.onlineBytes += respSize
+		atomic.AddInt64(&driver.onlineBytes, int64(respSize))
 	}
 	return nil
 }
@@ -137,18 +172,53 @@ func (driver *serverDriver) Configure(config TestConfig, none *int) (err error)
 	if config.DataRandSeed > 0 {
 		driver.randSource = rand.New(rand.NewSource(config.DataRandSeed))
 	}
+	if config.AnswerThreads > 0 {
+		pir.SetAnswerThreads(config.AnswerThreads)
+	}
+
+	if config.KeyWidth != 0 && !config.Updatable {
+		return fmt.Errorf("Key width needs an updatable database")
+	}
+	if config.Keyword && config.KeyWidth != 0 && config.KeyWidth != updatable.DefaultKeyWidth {
+		return fmt.Errorf("Keyword PIR needs %d-byte keys", updatable.DefaultKeyWidth)
+	}
+	keyWidth := updatable.DefaultKeyWidth
+	if config.KeyWidth != 0 {
+		keyWidth = config.KeyWidth
+	}
 
 	rows := pir.MakeRows(driver.randSource, config.NumRows, config.RowLen)
-	keys := pir.MakeKeys(driver.randSource, config.NumRows)
+	keys := driver.makeKeys(config.NumRows, keyWidth)
 	for _, preset := range config.PresetRows {
 		copy(rows[preset.Index], preset.Value)
-		keys[preset.Index] = preset.Key
+		keys[preset.Index] = preset.key()
 	}
 
-	if config.Updatable {
-		driver.updatableServer = updatable.NewUpdatableServer()
-		driver.updatableServer.AddRows(keys, rows)
-		driver.staticDB = &driver.updatableServer.StaticDB
+	if config.Updatable || config.Keyword {
+		if err := driver.openUpdatableServer(); err != nil {
+			return err
+		}
+		db := driver.updatableServer
+		// A persistent database keeps its rows across restarts.
+		if db.NumKeys() == 0 && keyWidth != db.KeyWidth() {
+			if err := db.SetKeyWidth(keyWidth); err != nil {
+				return err
+			}
+		}
+		if keyWidth != db.KeyWidth() {
+			return fmt.Errorf("Database has %d-byte keys, configured: %d", db.KeyWidth(), keyWidth)
+		}
+		if db.NumKeys() == 0 {
+			if err := driver.checkKeyRows(KeyRows{keys, rows}); err != nil {
+				return err
+			}
+			db.AddRowsWithKeys(keys, rows)
+		}
+		driver.staticDB = &db.StaticDB
+		driver.keywordInfo = KeywordInfo{}
+		if err := driver.changed(); err != nil {
+			return err
+		}
 	} else {
 		driver.staticDB = pir.StaticDBFromRows(rows)
 		driver.updatableServer = nil
@@ -159,27 +229,170 @@ func (driver *serverDriver) Configure(config TestConfig, none *int) (err error)
 
 }
 
+func (driver *serverDriver) openUpdatableServer() error {
+	if err := driver.Close(); err != nil {
+		return err
+	}
+	if driver.dataDir == "" {
+		driver.updatableServer = updatable.NewUpdatableServer()
+		return nil
+	}
+	db, err := updatable.OpenServer(driver.dataDir)
+	if err != nil {
+		return fmt.Errorf("Failed to open database in %s: %v", driver.dataDir, err)
+	}
+	driver.updatableServer = db
+	return nil
+}
+
+// SetDataDir makes Configure persist the updatable database in dir, and
+// restore it from there instead of generating new rows.
+func (driver *serverDriver) SetDataDir(dir string) {
+	driver.dataDir = dir
+}
+
+// Close closes the persistent database, if any.
+func (driver *serverDriver) Close() error {
+	if driver.updatableServer == nil {
+		return nil
+	}
+	return driver.updatableServer.Close()
+}
+
+// SetBatchWindow makes the driver wait up to window for concurrent DPF and
+// Matrix queries, and answer them together with a single pass over the
+// database. A window of zero disables batching.
+func (driver *serverDriver) SetBatchWindow(window time.Duration) {
+	if window <= 0 {
+		driver.batcher = nil
+		return
+	}
+	driver.batcher = newQueryBatcher(window)
+}
+
+// SetStaticDB makes the driver serve a fixed database, such as one opened
+// with pir.OpenStaticDB, instead of generating one in Configure.
+func (driver *serverDriver) SetStaticDB(db *pir.StaticDB) {
+	driver.staticDB = db
+	driver.updatable = false
+	driver.config.Updatable = false
+	driver.config.Keyword = false
+	driver.updatableServer = nil
+}
+
 func (driver *serverDriver) AddRows(numRows int, none *int) (err error) {
 	if !driver.updatable {
 		return fmt.Errorf("Cannot AddRows to Non-Updatable PIR server")
 	}
 	newVals := pir.MakeRows(driver.randSource, numRows, driver.config.RowLen)
-	newKeys := pir.MakeKeys(driver.randSource, numRows)
+	newKeys := driver.makeKeys(numRows, driver.updatableServer.KeyWidth())
 	// newKeys := make([]uint32, len(newVals))
 	// curNumRows := driver.updatableServer.NumRows
 	// for i := 0; i < len(newVals); i++ {
 	// 	newKeys[i] = uint32(curNumRows + i)
 	// }
-	driver.updatableServer.AddRows(newKeys, newVals)
-	return nil
+	driver.updatableServer.AddRowsWithKeys(newKeys, newVals)
+	return driver.changed()
+}
+
+// makeKeys returns random keys of the given width.
+func (driver *serverDriver) makeKeys(num, width int) []updatable.Key {
+	keys := make([]updatable.Key, num)
+	if width == updatable.DefaultKeyWidth {
+		for i, k := range pir.MakeKeys(driver.randSource, num) {
+			keys[i] = updatable.KeyFromUint32(k)
+		}
+		return keys
+	}
+	buf := make([]byte, width)
+	for i := range keys {
+		driver.randSource.Read(buf)
+		keys[i] = updatable.Key(buf)
+	}
+	return keys
 }
 
 func (driver *serverDriver) DeleteRows(numRows int, none *int) (err error) {
 	if !driver.updatable {
 		return fmt.Errorf("Cannot DeleteRows from Non-Updatable PIR server")
 	}
-	keys := driver.updatableServer.SomeKeys(numRows)
-	driver.updatableServer.DeleteRows(keys)
+	keys := driver.updatableServer.FirstKeys(numRows)
+	driver.updatableServer.DeleteRowsWithKeys(keys)
+	return driver.changed()
+}
+
+func (driver *serverDriver) UpdateRows(numRows int, none *int) (err error) {
+	if !driver.updatable {
+		return fmt.Errorf("Cannot UpdateRows in Non-Updatable PIR server")
+	}
+	keys := driver.updatableServer.FirstKeys(numRows)
+	newVals := pir.MakeRows(driver.randSource, len(keys), driver.config.RowLen)
+	if err := driver.updatableServer.UpdateRowsWithKeys(keys, newVals); err != nil {
+		return err
+	}
+	return driver.changed()
+}
+
+func (driver *serverDriver) AddRowsWithKeys(rows KeyRows, none *int) error {
+	if !driver.updatable {
+		return fmt.Errorf("Cannot AddRows to Non-Updatable PIR server")
+	}
+	if err := driver.checkKeyRows(rows); err != nil {
+		return err
+	}
+	driver.updatableServer.AddRowsWithKeys(rows.Keys, rows.Rows)
+	return driver.changed()
+}
+
+func (driver *serverDriver) DeleteRowsWithKeys(keys []updatable.Key, none *int) error {
+	if !driver.updatable {
+		return fmt.Errorf("Cannot DeleteRows from Non-Updatable PIR server")
+	}
+	if err := driver.checkKeys(keys); err != nil {
+		return err
+	}
+	driver.updatableServer.DeleteRowsWithKeys(keys)
+	return driver.changed()
+}
+
+func (driver *serverDriver) UpdateRowsWithKeys(rows KeyRows, none *int) error {
+	if !driver.updatable {
+		return fmt.Errorf("Cannot UpdateRows in Non-Updatable PIR server")
+	}
+	if err := driver.checkKeys(rows.Keys); err != nil {
+		return err
+	}
+	if err := driver.updatableServer.UpdateRowsWithKeys(rows.Keys, rows.Rows); err != nil {
+		return err
+	}
+	return driver.changed()
+}
+
+// checkKeyRows rejects the rows that the updatable server would not accept,
+// which it treats as fatal errors.
+func (driver *serverDriver) checkKeyRows(rows KeyRows) error {
+	if len(rows.Keys) != len(rows.Rows) {
+		return fmt.Errorf("Mismatching number of keys and rows: %d != %d", len(rows.Keys), len(rows.Rows))
+	}
+	rowLen := driver.updatableServer.RowLen
+	for _, row := range rows.Rows {
+		if rowLen == 0 {
+			rowLen = len(row)
+		}
+		if len(row) != rowLen {
+			return fmt.Errorf("Different row length added, expected: %d, got: %d", rowLen, len(row))
+		}
+	}
+	return driver.checkKeys(rows.Keys)
+}
+
+func (driver *serverDriver) checkKeys(keys []updatable.Key) error {
+	width := driver.updatableServer.KeyWidth()
+	for _, key := range keys {
+		if len(key) != width {
+			return fmt.Errorf("Key %s has %d bytes, expected: %d", key, len(key), width)
+		}
+	}
 	return nil
 }
 
@@ -187,7 +400,10 @@ func (driver *serverDriver) GetRow(idx int, row *RowIndexVal) error {
 	row.Index = idx
 	var err error
 	if driver.updatableServer != nil {
-		row.Key, row.Value, err = driver.updatableServer.Row(idx)
+		row.WideKey, row.Value, err = driver.updatableServer.RowWithKey(idx)
+		if len(row.WideKey) == updatable.DefaultKeyWidth {
+			row.Key = row.WideKey.Uint32()
+		}
 		return err
 	}
 	row.Value = driver.staticDB.Row(idx)
@@ -210,29 +426,29 @@ func (driver *serverDriver) RowLen(none int, out *int) error {
 }
 
 func (driver *serverDriver) GetOfflineTimer(none int, out *time.Duration) error {
-	*out = driver.hintTime
+	*out = time.Duration(atomic.LoadInt64(&driver.hintTime))
 	return nil
 }
 
 func (driver *serverDriver) GetOnlineTimer(none int, out *time.Duration) error {
-	*out = driver.answerTime
+	*out = time.Duration(atomic.LoadInt64(&driver.answerTime))
 	return nil
 }
 
 func (driver *serverDriver) GetOfflineBytes(none int, out *int) error {
-	*out = driver.offlineBytes
+	*out = int(atomic.LoadInt64(&driver.offlineBytes))
 	return nil
 }
 
 func (driver *serverDriver) GetOnlineBytes(none int, out *int) error {
-	*out = driver.onlineBytes
+	*out = int(atomic.LoadInt64(&driver.onlineBytes))
 	return nil
 }
 
 func (driver *serverDriver) ResetMetrics(none int, none2 *int) error {
-	driver.hintTime = 0
-	driver.answerTime = 0
-	driver.offlineBytes = 0
-	driver.onlineBytes = 0
+	atomic.StoreInt64(&driver.hintTime, 0)
+	atomic.StoreInt64(&driver.answerTime, 0)
+	atomic.StoreInt64(&driver.offlineBytes, 0)
+	atomic.StoreInt64(&driver.onlineBytes, 0)
 	return nil
 }
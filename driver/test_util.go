@@ -23,6 +23,17 @@ type TestConfig struct {
 	DataRandSeed int64
 
 	MeasureBandwidth bool
+
+	// Number of goroutines that scan the database for a single query, if
+	// positive. See pir.SetAnswerThreads.
+	AnswerThreads int
+
+	// Number of bytes of the keys of the updatable database, if not the
+	// default of 4. See updatable.Server.SetKeyWidth.
+	KeyWidth int
+
+	// If set, the rows are laid out for keyword PIR. See KeywordClient.
+	Keyword bool
 }
 
 func (c TestConfig) String() string {
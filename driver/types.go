@@ -12,18 +12,35 @@ var registeredObjs = []interface{}{
 	pir.PuncHintResp{},
 	pir.PuncQueryReq{},
 	pir.PuncQueryResp{},
+	pir.PuncBatchQueryReq{},
+	pir.PuncBatchQueryResp{},
+	pir.PermHintReq{},
+	pir.PermHintResp{},
+	pir.PermQueryReq{},
+	pir.PermQueryResp{},
 	pir.DPFHintReq{},
 	pir.DPFHintResp{},
 	pir.DPFQueryReq{},
 	pir.DPFQueryResp{},
+	pir.DPFBatchQueryReq{},
+	pir.DPFBatchQueryResp{},
+	pir.MultiDPFQueryReq{},
 	pir.MatrixHintReq{},
 	pir.MatrixHintResp{},
 	pir.MatrixQueryReq{},
 	pir.MatrixQueryResp{},
+	pir.MatrixBatchQueryReq{},
+	pir.MatrixBatchQueryResp{},
 	pir.NonPrivateHintReq{},
 	pir.NonPrivateHintResp{},
 	pir.NonPrivateQueryReq{},
 	pir.NonPrivateQueryResp{},
+	pir.LWEHintReq{},
+	pir.LWEHintResp{},
+	pir.LWEQueryReq{},
+	pir.LWEQueryResp{},
+	pir.BatchQueryReq{},
+	pir.BatchQueryResp{},
 	updatable.UpdatableHintReq{},
 	updatable.UpdatableQueryReq{},
 	updatable.UpdatableQueryResp{},
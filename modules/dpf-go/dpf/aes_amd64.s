@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build amd64,!gccgo
+// +build amd64,!gccgo,!purego
 
 // func xor16(dst, a, b *byte)
 TEXT ·xor16(SB),4,$0
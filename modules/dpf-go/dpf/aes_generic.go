@@ -0,0 +1,51 @@
+//go:build (!amd64 && !arm64) || gccgo || purego
+// +build !amd64,!arm64 gccgo purego
+
+package dpf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"sync"
+	"unsafe"
+)
+
+// Portable versions of the assembly functions, for architectures such as
+// wasm that have no AES instructions. expandKeyAsm registers a crypto/aes
+// cipher for the expanded key, which the encryption functions look up.
+
+var generic sync.Map // *uint32 -> cipher.Block
+
+func xor16(dst, a, b *byte) {
+	d := (*[16]byte)(unsafe.Pointer(dst))
+	x := (*[16]byte)(unsafe.Pointer(a))
+	y := (*[16]byte)(unsafe.Pointer(b))
+	for i := range d {
+		d[i] = x[i] ^ y[i]
+	}
+}
+
+func expandKeyAsm(key *byte, enc *uint32) {
+	k := (*[16]byte)(unsafe.Pointer(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err)
+	}
+	// Like the assembly, store the key as the first round key.
+	copy((*[16]byte)(unsafe.Pointer(enc))[:], k[:])
+	generic.Store(enc, block)
+}
+
+func encryptAes128(xk *uint32, dst, src *byte) {
+	block, _ := generic.Load(xk)
+	var in [16]byte
+	in = *(*[16]byte)(unsafe.Pointer(src))
+	block.(cipher.Block).Encrypt((*[16]byte)(unsafe.Pointer(dst))[:], in[:])
+}
+
+func aes128MMO(xk *uint32, dst, src *byte) {
+	var in [16]byte
+	in = *(*[16]byte)(unsafe.Pointer(src))
+	encryptAes128(xk, dst, src)
+	xor16(dst, dst, &in[0])
+}
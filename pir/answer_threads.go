@@ -0,0 +1,89 @@
+package pir
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Number of goroutines that scan the database for a single query, read and
+// written atomically.
+var answerThreads int32 = 1
+
+// SetAnswerThreads sets the number of goroutines among which DPF, Matrix and
+// Punc queries split their scan of the database. The partial answers are
+// XORed together, so the answers do not depend on it. More threads lower
+// the latency of single large queries, at the cost of throughput when the
+// server already answers many queries concurrently. It may be called while
+// queries are answered, which keep the number they started with.
+func SetAnswerThreads(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&answerThreads, int32(n))
+}
+
+func numAnswerThreads() int {
+	return int(atomic.LoadInt32(&answerThreads))
+}
+
+// parallelXor splits [0, n) into at most answerThreads ranges whose bounds
+// are multiples of align, except for n. scan computes the answer of the
+// range [start, end) into out, which is zeroed and of the same length as
+// the final answer, and the answers of the ranges are XORed into out.
+func parallelXor(n, align int, out []byte, scan func(start, end int, out []byte)) {
+	parallelXorBatch(n, align, [][]byte{out}, func(start, end int, outs [][]byte) {
+		scan(start, end, outs[0])
+	})
+}
+
+// parallelXorBatch is parallelXor for the answers of a batch of queries.
+func parallelXorBatch(n, align int, outs [][]byte, scan func(start, end int, outs [][]byte)) {
+	threads := numAnswerThreads()
+	chunk := (n-1)/threads + 1
+	chunk = ((chunk-1)/align + 1) * align
+	if threads == 1 || chunk >= n {
+		scan(0, n, outs)
+		return
+	}
+
+	numChunks := (n-1)/chunk + 1
+	partials := make([][][]byte, numChunks)
+	var wg sync.WaitGroup
+	for c := range partials {
+		partials[c] = make([][]byte, len(outs))
+		for q := range outs {
+			partials[c][q] = make([]byte, len(outs[q]))
+		}
+		start, end := c*chunk, (c+1)*chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(c, start, end int) {
+			defer wg.Done()
+			scan(start, end, partials[c])
+		}(c, start, end)
+	}
+	wg.Wait()
+
+	for q, out := range outs {
+		copy(out, partials[0][q])
+		for _, partial := range partials[1:] {
+			xorInto(out, partial[q])
+		}
+	}
+}
+
+// Size of the blocks of the database that batched queries scan in turn,
+// so that a block stays in the cache until every query has read it.
+const batchBlockBytes = 1 << 16
+
+// batchBlockRows returns the number of rows of rowLen bytes of the blocks,
+// rounded down to a multiple of align but at least align.
+func batchBlockRows(rowLen, align int) int {
+	rows := batchBlockBytes / rowLen / align * align
+	if rows < align {
+		rows = align
+	}
+	return rows
+}
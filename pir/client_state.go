@@ -0,0 +1,93 @@
+package pir
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+)
+
+// Every Client implements encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler, so that a client that was initialized with an
+// expensive hint can be saved and restored after a restart. SaveClient and
+// LoadClient additionally record the type of the client.
+
+type savedClient struct {
+	PirType PirType
+	State   []byte
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func clientPirType(c Client) (PirType, error) {
+	switch c.(type) {
+	case *matrixClient:
+		return Matrix, nil
+	case *puncClient:
+		return Punc, nil
+	case *permClient:
+		return Perm, nil
+	case *dpfClient:
+		return DPF, nil
+	case *nonPrivateClient:
+		return NonPrivate, nil
+	case *lweClient:
+		return LWE, nil
+	}
+	return None, fmt.Errorf("Unsupported client type: %T", c)
+}
+
+// SaveClient serializes the state of a client returned by
+// HintResp.InitClient.
+func SaveClient(c Client) ([]byte, error) {
+	pirType, err := clientPirType(c)
+	if err != nil {
+		return nil, err
+	}
+	state, err := c.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return gobEncode(&savedClient{PirType: pirType, State: state})
+}
+
+// LoadClient restores a client saved by SaveClient. The restored client
+// draws the randomness for future queries from source.
+func LoadClient(data []byte, source *rand.Rand) (Client, error) {
+	var saved savedClient
+	if err := gobDecode(data, &saved); err != nil {
+		return nil, err
+	}
+	var c Client
+	switch saved.PirType {
+	case Matrix:
+		c = &matrixClient{randSource: source}
+	case Punc:
+		c = &puncClient{randSource: source}
+	case Perm:
+		c = &permClient{randSource: source}
+	case DPF:
+		c = &dpfClient{randSource: source}
+	case NonPrivate:
+		c = &nonPrivateClient{}
+	case LWE:
+		c = &lweClient{randSource: source}
+	default:
+		return nil, fmt.Errorf("Unknown PIR Type: %d", saved.PirType)
+	}
+	if err := c.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.State); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
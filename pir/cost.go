@@ -0,0 +1,72 @@
+package pir
+
+import (
+	"encoding"
+	"fmt"
+	"math/rand"
+)
+
+// Cost predicts the resources that a scheme uses for a database.
+type Cost struct {
+	// Storage of the client, as reported by Client.StateSize.
+	ClientBytes int
+	// Size of the hint request and response, for schemes whose hint is
+	// computed by a server.
+	OfflineBytes int
+	// Size of the requests and responses of a query, for all servers.
+	OnlineBytes int
+
+	// The time of the servers is dominated by reading rows: the rows read
+	// to compute the hint, and the rows that every server reads per query.
+	OfflineServerRows int
+	OnlineServerRows  int
+}
+
+// EstimateCost predicts the costs of Punc, with the default parameters,
+// DPF, Matrix and NonPrivate for a database of numRows rows of rowLen
+// bytes. Message sizes are those of the wire encoding, without the framing
+// of the RPC codec, and are measured on actual queries.
+func EstimateCost(pirType PirType, numRows, rowLen int) (Cost, error) {
+	if numRows < 1 || rowLen < 1 {
+		return Cost{}, fmt.Errorf("Empty database: %d rows of %d bytes", numRows, rowLen)
+	}
+	var resp encoding.BinaryMarshaler
+	cost := Cost{OnlineServerRows: numRows}
+	switch pirType {
+	case Punc:
+		return DefaultPuncParams().Cost(numRows, rowLen).Cost, nil
+	case DPF:
+		resp = &DPFQueryResp{Answer: make([]byte, rowLen)}
+	case Matrix:
+		width, _ := getHeightWidth(numRows, rowLen)
+		resp = &MatrixQueryResp{Answer: make([]byte, width*rowLen)}
+	case NonPrivate:
+		resp = &NonPrivateQueryResp{Row: make(Row, rowLen)}
+		cost.OnlineServerRows = 1
+	default:
+		return Cost{}, fmt.Errorf("No cost model for PIR type %s", pirType)
+	}
+
+	// The client of these schemes needs no hint from the server.
+	hint, err := NewHintReq(rand.New(rand.NewSource(0)), pirType).Process(StaticDB{NumRows: numRows, RowLen: rowLen})
+	if err != nil {
+		return Cost{}, err
+	}
+	client := hint.InitClient(rand.New(rand.NewSource(0)))
+	bitsPerKey, fixedBytes := client.StateSize()
+	cost.ClientBytes = (numRows*bitsPerKey+7)/8 + fixedBytes
+
+	queries, _ := client.Query(numRows - 1)
+	respBytes, err := resp.MarshalBinary()
+	if err != nil {
+		return Cost{}, err
+	}
+	for _, q := range queries {
+		reqBytes, err := q.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return Cost{}, err
+		}
+		cost.OnlineBytes += len(reqBytes) + len(respBytes)
+	}
+	return cost, nil
+}
@@ -0,0 +1,147 @@
+package pir
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// On-disk database format. All integers are little-endian.
+//
+//   offset  size  field
+//   0       8     magic "CKLSTDB1"
+//   8       8     number of rows
+//   16      8     row length in bytes
+//   24      ...   rows, stored back to back
+//
+// This is exactly the layout of StaticDB.FlatDb after a fixed-size header,
+// so OpenStaticDB can serve queries directly from a memory mapping of the
+// file.
+
+const dbFileMagic = "CKLSTDB1"
+
+const dbFileHeaderLen = 24
+
+// MappedDB is a StaticDB whose rows are memory-mapped from a file.
+type MappedDB struct {
+	StaticDB
+	mapping []byte
+}
+
+// OpenStaticDB maps a database file in the format written by DBFileWriter.
+// The rows are paged in from disk on demand and are read-only. The database
+// must not be used after Close.
+func OpenStaticDB(path string) (*MappedDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var header [dbFileHeaderLen]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read database header from %s: %w", path, err)
+	}
+	if string(header[0:8]) != dbFileMagic {
+		return nil, fmt.Errorf("Not a database file: %s", path)
+	}
+	numRows := binary.LittleEndian.Uint64(header[8:])
+	rowLen := binary.LittleEndian.Uint64(header[16:])
+	size := dbFileHeaderLen + numRows*rowLen
+	if rowLen != 0 && (size-dbFileHeaderLen)/rowLen != numRows {
+		return nil, fmt.Errorf("Invalid database dimensions in %s: %d x %d", path, numRows, rowLen)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(info.Size()) < size {
+		return nil, fmt.Errorf("Truncated database file %s: have: %d bytes, want: %d", path, info.Size(), size)
+	}
+
+	mapping, err := mapFile(f, int(size))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to map %s: %w", path, err)
+	}
+	return &MappedDB{
+		StaticDB: StaticDB{
+			NumRows: int(numRows),
+			RowLen:  int(rowLen),
+			FlatDb:  mapping[dbFileHeaderLen:],
+		},
+		mapping: mapping,
+	}, nil
+}
+
+func (db *MappedDB) Close() error {
+	db.FlatDb = nil
+	return unmapFile(db.mapping)
+}
+
+// DBFileWriter writes a database file row by row, so that databases larger
+// than memory can be created.
+type DBFileWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	rowLen  int
+	numRows int
+}
+
+func CreateDBFile(path string, rowLen int) (*DBFileWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &DBFileWriter{f: f, w: bufio.NewWriter(f), rowLen: rowLen}
+	// The number of rows is filled in by Close.
+	if _, err := w.w.Write(make([]byte, dbFileHeaderLen)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *DBFileWriter) WriteRow(row Row) error {
+	if len(row) != w.rowLen {
+		return fmt.Errorf("Unexpected row length: have: %d, want: %d", len(row), w.rowLen)
+	}
+	if _, err := w.w.Write(row); err != nil {
+		return err
+	}
+	w.numRows++
+	return nil
+}
+
+// Close writes the header and closes the file.
+func (w *DBFileWriter) Close() error {
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	var header [dbFileHeaderLen]byte
+	copy(header[:], dbFileMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(w.numRows))
+	binary.LittleEndian.PutUint64(header[16:], uint64(w.rowLen))
+	if _, err := w.f.WriteAt(header[:], 0); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// WriteDBFile writes an in-memory database in the format read by OpenStaticDB.
+func WriteDBFile(path string, db *StaticDB) error {
+	w, err := CreateDBFile(path, db.RowLen)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < db.NumRows; i++ {
+		if err := w.WriteRow(db.Row(i)); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,168 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+)
+
+// Distributed point function for p > 2 parties, following the
+// square-root construction of Boyle, Gilboa and Ishai ("Function Secret
+// Sharing", Eurocrypt 2015).
+//
+// The domain is viewed as a grid with numBlocks rows of blockLen bits, and
+// the point lies in block gamma. Let m = 2^(p-1). For every block x the
+// dealer picks m random seeds and an ordering of the m p-bit vectors of even
+// weight (if x != gamma) or of odd weight (if x == gamma). Party i receives
+// seed j of block x iff bit i of the j-th vector is set. Every party XORs
+// into its output block the expansions G(seed_j) and the public correction
+// words CW_j of the seeds it holds. Seeds of blocks other than gamma are
+// held by an even number of parties and cancel out, while in block gamma
+// every seed is held by an odd number of parties, and the correction words
+// are chosen so that the block sums to the point. Any p-1 parties see the
+// same distribution of vectors in all blocks.
+
+// MultiDPFKey is the key of one party of a multi-party DPF.
+type MultiDPFKey struct {
+	NumBlocks int
+	BlockLen  int
+	// Bit x*m+j is set if the party holds seed j of block x.
+	Holds []byte
+	// Seeds that the party holds, in order.
+	Seeds []PRGKey
+	// Correction words, one per seed of a block.
+	CorrectionWords [][]byte
+}
+
+// Layout of a domain of n bits as numBlocks blocks of blockLen bits.
+// blockLen is a multiple of 8, so that blocks are byte-aligned.
+func multiDPFLayout(n int) (numBlocks, blockLen int) {
+	blockLen = int(math.Ceil(math.Sqrt(float64(n))))
+	blockLen = (blockLen + 7) / 8 * 8
+	numBlocks = (n-1)/blockLen + 1
+	return numBlocks, blockLen
+}
+
+func expandSeed(seed *PRGKey, out []byte) {
+	NewPRG(seed).Read(out)
+}
+
+// genMultiDPF shares the indicator bit vector of alpha over a domain of n
+// bits among the given number of parties.
+func genMultiDPF(source *rand.Rand, alpha, n, parties int) []MultiDPFKey {
+	numBlocks, blockLen := multiDPFLayout(n)
+	gamma, delta := alpha/blockLen, alpha%blockLen
+	m := 1 << (parties - 1)
+
+	var even, odd []int
+	for v := 0; v < 1<<parties; v++ {
+		if bits.OnesCount(uint(v))%2 == 0 {
+			even = append(even, v)
+		} else {
+			odd = append(odd, v)
+		}
+	}
+
+	keys := make([]MultiDPFKey, parties)
+	for i := range keys {
+		keys[i] = MultiDPFKey{
+			NumBlocks: numBlocks,
+			BlockLen:  blockLen,
+			Holds:     make([]byte, (numBlocks*m+7)/8),
+		}
+	}
+
+	// XOR of the expansions of the seeds of block gamma.
+	target := make([]byte, blockLen/8)
+	expanded := make([]byte, blockLen/8)
+	for x := 0; x < numBlocks; x++ {
+		vectors := even
+		if x == gamma {
+			vectors = odd
+		}
+		for j, k := range source.Perm(m) {
+			var seed PRGKey
+			source.Read(seed[:])
+			for i := range keys {
+				if vectors[k]&(1<<i) != 0 {
+					keys[i].Holds[(x*m+j)/8] |= 1 << ((x*m + j) % 8)
+					keys[i].Seeds = append(keys[i].Seeds, seed)
+				}
+			}
+			if x == gamma {
+				expandSeed(&seed, expanded)
+				xorInto(target, expanded)
+			}
+		}
+	}
+
+	// Random correction words that XOR to target with the point flipped.
+	target[delta/8] ^= 1 << (delta % 8)
+	cws := make([][]byte, m)
+	for j := range cws {
+		cws[j] = make([]byte, blockLen/8)
+		if j < m-1 {
+			source.Read(cws[j])
+			xorInto(target, cws[j])
+		}
+	}
+	copy(cws[m-1], target)
+
+	for i := range keys {
+		keys[i].CorrectionWords = cws
+	}
+	return keys
+}
+
+// EvalFull evaluates the party's share of the indicator vector on the whole
+// domain, with bit j stored in bit j%8 of byte j/8.
+func (k *MultiDPFKey) EvalFull() ([]byte, error) {
+	m := len(k.CorrectionWords)
+	if k.BlockLen%8 != 0 || len(k.Holds)*8 < k.NumBlocks*m {
+		return nil, fmt.Errorf("Invalid multi-party DPF key")
+	}
+	out := make([]byte, k.NumBlocks*k.BlockLen/8)
+	expanded := make([]byte, k.BlockLen/8)
+	seed := 0
+	for x := 0; x < k.NumBlocks; x++ {
+		block := out[x*k.BlockLen/8 : (x+1)*k.BlockLen/8]
+		for j := 0; j < m; j++ {
+			if k.Holds[(x*m+j)/8]&(1<<((x*m+j)%8)) == 0 {
+				continue
+			}
+			if seed >= len(k.Seeds) || len(k.CorrectionWords[j]) != len(block) {
+				return nil, fmt.Errorf("Invalid multi-party DPF key")
+			}
+			expandSeed(&k.Seeds[seed], expanded)
+			seed++
+			xorInto(block, expanded)
+			xorInto(block, k.CorrectionWords[j])
+		}
+	}
+	return out, nil
+}
+
+// MultiDPFQueryReq is a DPF query for schemes that share every query among
+// more than two servers.
+type MultiDPFQueryReq struct {
+	Key MultiDPFKey
+}
+
+func (req *MultiDPFQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	if numBlocks, blockLen := multiDPFLayout(db.NumRows); req.Key.NumBlocks != numBlocks || req.Key.BlockLen != blockLen {
+		return nil, invalidf("DPF domain of %d blocks of %d bits, expected %d blocks of %d bits",
+			req.Key.NumBlocks, req.Key.BlockLen, numBlocks, blockLen)
+	}
+	bitVec, err := req.Key.EvalFull()
+	if err != nil {
+		return nil, err
+	}
+	if len(bitVec)*8 < db.NumRows {
+		return nil, fmt.Errorf("DPF domain too small: %d bits for %d rows", len(bitVec)*8, db.NumRows)
+	}
+	return &DPFQueryResp{matVecProduct(db, bitVec)}, nil
+}
@@ -0,0 +1,179 @@
+package pir
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Integrity mode protects clients against servers that return incorrect
+// answers. The database owner appends to every row a signature over the
+// row and its index, made with a private key that only the owner holds.
+// A verifying client checks the signature of every reconstructed row with
+// the public key, so neither a server nor anyone else who runs a client can
+// make it accept a modified row or a row from a different position.
+
+// TagLen is the number of bytes that integrity mode appends to every row.
+const TagLen = ed25519.SignatureSize
+
+// ErrVerification is returned, possibly wrapped, when a reconstructed row
+// fails integrity verification.
+var ErrVerification = errors.New("row failed integrity verification")
+
+// VerifyFunc checks row i as reconstructed by a client, and returns an
+// error wrapping ErrVerification if it is not authentic.
+type VerifyFunc func(i int, row Row) error
+
+// SignRow returns the row followed by its TagLen-byte signature, which
+// binds it to id, such as its index or its key.
+func SignRow(key ed25519.PrivateKey, id []byte, row Row) Row {
+	msg := append(append(make([]byte, 0, len(id)+len(row)), id...), row...)
+	return append(append(make(Row, 0, len(row)+TagLen), row...), ed25519.Sign(key, msg)...)
+}
+
+// VerifyRow checks the signature of a row signed with SignRow and returns
+// the row without it.
+func VerifyRow(key ed25519.PublicKey, id []byte, row Row) (Row, error) {
+	if len(row) < TagLen {
+		return nil, fmt.Errorf("too short: %w", ErrVerification)
+	}
+	data, sig := row[:len(row)-TagLen], row[len(row)-TagLen:]
+	msg := append(append(make([]byte, 0, len(id)+len(data)), id...), data...)
+	if !ed25519.Verify(key, msg, sig) {
+		return nil, ErrVerification
+	}
+	return data, nil
+}
+
+func indexID(i int) []byte {
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], uint64(i))
+	return id[:]
+}
+
+// NewAuthenticatedDB builds a database in which every row is followed by
+// its signature.
+func NewAuthenticatedDB(rows []Row, key ed25519.PrivateKey) *StaticDB {
+	signed := make([]Row, len(rows))
+	for i, row := range rows {
+		signed[i] = SignRow(key, indexID(i), row)
+	}
+	return StaticDBFromRows(signed)
+}
+
+// verifiedQuerier is implemented by clients that update their hint with
+// the rows they reconstruct, so that they only do so with verified rows.
+type verifiedQuerier interface {
+	queryVerified(i int, verify VerifyFunc) ([]QueryReq, ReconstructFunc)
+	queryBatchVerified(indices []int, verify VerifyFunc) ([]QueryReq, ReconstructBatchFunc)
+}
+
+// QueryVerified is like c.Query, but the reconstruct function fails if
+// verify rejects the row. Clients that refresh their hint with the rows
+// they read check the row before they do.
+func QueryVerified(c Client, i int, verify VerifyFunc) ([]QueryReq, ReconstructFunc) {
+	if v, ok := c.(verifiedQuerier); ok {
+		return v.queryVerified(i, verify)
+	}
+	queryReq, reconstructFunc := c.Query(i)
+	if reconstructFunc == nil {
+		return nil, nil
+	}
+	return queryReq, func(resps []interface{}) (Row, error) {
+		row, err := reconstructFunc(resps)
+		if err != nil {
+			return nil, err
+		}
+		if err := verify(i, row); err != nil {
+			return nil, err
+		}
+		return row, nil
+	}
+}
+
+// queryBatchVerified is like QueryVerified for c.QueryBatch.
+func queryBatchVerified(c Client, indices []int, verify VerifyFunc) ([]QueryReq, ReconstructBatchFunc) {
+	if v, ok := c.(verifiedQuerier); ok {
+		return v.queryBatchVerified(indices, verify)
+	}
+	queryReq, reconstructFunc := c.QueryBatch(indices)
+	if reconstructFunc == nil {
+		return nil, nil
+	}
+	return queryReq, func(resps []interface{}) ([]Row, error) {
+		rows, err := reconstructFunc(resps)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indices {
+			if err := verify(i, rows[j]); err != nil {
+				return nil, err
+			}
+		}
+		return rows, nil
+	}
+}
+
+type verifyingClient struct {
+	Client
+	key ed25519.PublicKey
+}
+
+// NewVerifyingClient wraps a client of an authenticated database so that
+// its reconstruct functions verify and strip the signature of every row.
+func NewVerifyingClient(c Client, key ed25519.PublicKey) Client {
+	return &verifyingClient{Client: c, key: key}
+}
+
+func (c *verifyingClient) verify(i int, row Row) error {
+	if _, err := VerifyRow(c.key, indexID(i), row); err != nil {
+		return fmt.Errorf("row %d: %w", i, err)
+	}
+	return nil
+}
+
+func (c *verifyingClient) Query(i int) ([]QueryReq, ReconstructFunc) {
+	queryReq, reconstructFunc := QueryVerified(c.Client, i, c.verify)
+	if reconstructFunc == nil {
+		return nil, nil
+	}
+	return queryReq, func(resps []interface{}) (Row, error) {
+		row, err := reconstructFunc(resps)
+		if err != nil {
+			return nil, err
+		}
+		return row[:len(row)-TagLen], nil
+	}
+}
+
+func (c *verifyingClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	queryReq, reconstructFunc := queryBatchVerified(c.Client, indices, c.verify)
+	if reconstructFunc == nil {
+		return nil, nil
+	}
+	return queryReq, func(resps []interface{}) ([]Row, error) {
+		rows, err := reconstructFunc(resps)
+		if err != nil {
+			return nil, err
+		}
+		for j := range rows {
+			rows[j] = rows[j][:len(rows[j])-TagLen]
+		}
+		return rows, nil
+	}
+}
+
+// NewVerifyingPIRReader returns a PIRReader for a database built with
+// NewAuthenticatedDB. Reads return rows without their signature, or an
+// error wrapping ErrVerification if a server answered incorrectly.
+func NewVerifyingPIRReader(source *rand.Rand, serverL, serverR Server, key ed25519.PublicKey) PIRReader {
+	return &pirReader{
+		servers:          []Server{serverL, serverR},
+		randSource:       source,
+		verifyKey:        key,
+		refreshThreshold: DefaultRefreshThreshold,
+		refreshInterval:  DefaultRefreshInterval,
+	}
+}
@@ -0,0 +1,176 @@
+package pir
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Keyword PIR lets a client fetch a row by its key without knowing the
+// key's position in the database. The server lays the rows out in a cuckoo
+// hash table: every key is stored in one of KeywordNumHashes slots, each
+// derived from the key by a public hash function. The client reads all of
+// the candidate slots of a key in a single batch, so the servers learn
+// nothing about the key and the client keeps no per-key state.
+//
+// The layout is fixed when the database is built, so a changing database
+// is served by rebuilding the table after every change, which invalidates
+// the hints of the clients. driver.KeywordClient reads such tables from
+// rpc_server started with -keyword.
+
+// KeywordNumHashes is the number of candidate slots of every key, and hence
+// the number of rows that every keyword lookup reads.
+const KeywordNumHashes = 3
+
+// Layout of a slot: a present flag, the key and the row.
+const keywordSlotHeader = 1 + 4
+
+// Number of slots per key in the hash table.
+const keywordLoadFactor = 1.25
+
+// Number of evictions after which inserting into a table is abandoned.
+const keywordMaxEvictions = 1000
+
+// Number of seeds that BuildKeywordDB tries before giving up.
+const keywordMaxAttempts = 16
+
+// ErrKeyNotFound is returned when a client looks up a key that is not in
+// the database.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeywordParams are the public parameters of a keyword database that a
+// client needs to locate keys.
+type KeywordParams struct {
+	Seed     uint64
+	NumSlots int
+}
+
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Positions returns the candidate slots of a key.
+func (p KeywordParams) Positions(key uint32) [KeywordNumHashes]int {
+	var pos [KeywordNumHashes]int
+	for j := range pos {
+		h := splitMix64(p.Seed ^ uint64(j)<<32 ^ uint64(key))
+		pos[j] = int(h % uint64(p.NumSlots))
+	}
+	return pos
+}
+
+// BuildKeywordDB lays out the rows in a cuckoo hash table indexed by the
+// keys. The returned parameters must be published to the clients.
+func BuildKeywordDB(keys []uint32, rows []Row, seed uint64) (*StaticDB, KeywordParams, error) {
+	if len(keys) != len(rows) {
+		return nil, KeywordParams{}, fmt.Errorf("Mismatching number of keys and rows: %d != %d", len(keys), len(rows))
+	}
+	seen := make(map[uint32]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			return nil, KeywordParams{}, fmt.Errorf("Duplicate key: %d", k)
+		}
+		seen[k] = true
+	}
+	numSlots := int(float64(len(keys))*keywordLoadFactor) + KeywordNumHashes
+
+	for attempt := 0; attempt < keywordMaxAttempts; attempt++ {
+		params := KeywordParams{Seed: seed + uint64(attempt), NumSlots: numSlots}
+		if slots, ok := cuckooInsert(keys, params); ok {
+			return keywordDB(keys, rows, slots), params, nil
+		}
+	}
+	return nil, KeywordParams{}, fmt.Errorf("Failed to build cuckoo hash table for %d keys", len(keys))
+}
+
+// cuckooInsert computes the index of the key stored in every slot,
+// or -1 for empty slots.
+func cuckooInsert(keys []uint32, params KeywordParams) ([]int, bool) {
+	slots := make([]int, params.NumSlots)
+	for i := range slots {
+		slots[i] = -1
+	}
+	walk := rand.New(rand.NewSource(int64(params.Seed)))
+
+	for i := range keys {
+		cur := i
+		evictions := 0
+		for {
+			pos := params.Positions(keys[cur])
+			placed := false
+			for _, p := range pos {
+				if slots[p] < 0 {
+					slots[p] = cur
+					placed = true
+					break
+				}
+			}
+			if placed {
+				break
+			}
+			if evictions == keywordMaxEvictions {
+				return nil, false
+			}
+			p := pos[walk.Intn(len(pos))]
+			slots[p], cur = cur, slots[p]
+			evictions++
+		}
+	}
+	return slots, true
+}
+
+func keywordDB(keys []uint32, rows []Row, slots []int) *StaticDB {
+	rowLen := 0
+	if len(rows) > 0 {
+		rowLen = len(rows[0])
+	}
+	slotLen := keywordSlotHeader + rowLen
+	db := &StaticDB{NumRows: len(slots), RowLen: slotLen, FlatDb: make([]byte, len(slots)*slotLen)}
+	for s, i := range slots {
+		if i < 0 {
+			continue
+		}
+		if len(rows[i]) != rowLen {
+			panic("Database rows must all be of the same length")
+		}
+		slot := db.Row(s)
+		slot[0] = 1
+		binary.LittleEndian.PutUint32(slot[1:], keys[i])
+		copy(slot[keywordSlotHeader:], rows[i])
+	}
+	return db
+}
+
+type KeywordReader struct {
+	reader PIRReader
+	params KeywordParams
+}
+
+// NewKeywordReader returns a reader that looks up keys in a database built
+// by BuildKeywordDB. The reader must already be initialized.
+func NewKeywordReader(reader PIRReader, params KeywordParams) *KeywordReader {
+	return &KeywordReader{reader: reader, params: params}
+}
+
+// ReadKey returns the row of the given key, or ErrKeyNotFound.
+// It always reads KeywordNumHashes rows, whether the key is present or not.
+func (r *KeywordReader) ReadKey(key uint32) (Row, error) {
+	pos := r.params.Positions(key)
+	slots, err := r.reader.ReadBatch(pos[:])
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		if len(slot) < keywordSlotHeader {
+			return nil, fmt.Errorf("Invalid slot length: %d", len(slot))
+		}
+		if slot[0] == 1 && binary.LittleEndian.Uint32(slot[1:]) == key {
+			return slot[keywordSlotHeader:], nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,22 @@
+//go:build windows || js || wasip1
+// +build windows js wasip1
+
+package pir
+
+import (
+	"io"
+	"os"
+)
+
+// Without mmap support the file is read into memory.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func unmapFile(mapping []byte) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !js && !wasip1
+// +build !windows,!js,!wasip1
+
+package pir
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
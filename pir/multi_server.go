@@ -0,0 +1,91 @@
+package pir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Matrix and DPF queries can be spread over k servers with a t-of-k privacy
+// threshold. The client splits every query into t+1 XOR shares and sends
+// share s mod (t+1) to server s, so that any t colluding servers together
+// see at most t shares, which are independent of the queried index.
+// Servers that receive the same share must return the same answer, which
+// lets the client detect inconsistent servers whenever t+1 < k.
+
+// ErrInconsistentAnswers is returned, possibly wrapped, when servers that
+// received the same query share return different answers.
+var ErrInconsistentAnswers = errors.New("servers returned inconsistent answers")
+
+// MultiServerHintResp is implemented by hints of schemes that can spread
+// their queries over more than two servers.
+type MultiServerHintResp interface {
+	HintResp
+	// InitMultiServerClient returns a client whose queries consist of one
+	// request per server and remain private as long as at most threshold
+	// of the servers collude.
+	InitMultiServerClient(source *rand.Rand, numServers, threshold int) (Client, error)
+}
+
+type shareLayout struct {
+	NumServers int
+	Threshold  int
+}
+
+var twoServerLayout = shareLayout{NumServers: 2, Threshold: 1}
+
+func newShareLayout(numServers, threshold int) (shareLayout, error) {
+	if threshold < 1 || threshold >= numServers {
+		return shareLayout{}, fmt.Errorf("Invalid collusion threshold %d for %d servers", threshold, numServers)
+	}
+	return shareLayout{NumServers: numServers, Threshold: threshold}, nil
+}
+
+func (l shareLayout) numShares() int {
+	return l.Threshold + 1
+}
+
+// serverRequests sends share s mod numShares to server s.
+func (l shareLayout) serverRequests(shares []QueryReq) []QueryReq {
+	reqs := make([]QueryReq, l.NumServers)
+	for s := range reqs {
+		reqs[s] = shares[s%l.numShares()]
+	}
+	return reqs
+}
+
+// combine XORs the answers to the different shares, after checking that
+// all servers that received the same share agree.
+func (l shareLayout) combine(answers [][]byte) ([]byte, error) {
+	if len(answers) != l.NumServers {
+		return nil, fmt.Errorf("Unexpected number of answers: have: %d, want: %d", len(answers), l.NumServers)
+	}
+	for s := l.numShares(); s < len(answers); s++ {
+		if !bytes.Equal(answers[s], answers[s%l.numShares()]) {
+			return nil, fmt.Errorf("server %d: %w", s, ErrInconsistentAnswers)
+		}
+	}
+	out := make([]byte, len(answers[0]))
+	for _, answer := range answers[:l.numShares()] {
+		if len(answer) != len(out) {
+			return nil, fmt.Errorf("Mismatching answer lengths: %d != %d", len(answer), len(out))
+		}
+		xorInto(out, answer)
+	}
+	return out, nil
+}
+
+// NewMultiServerPIRReader returns a reader that spreads its queries over
+// all of the given servers and remains private as long as at most threshold
+// of them collude. Only schemes whose hints implement MultiServerHintResp
+// are supported.
+func NewMultiServerPIRReader(source *rand.Rand, servers []Server, threshold int) PIRReader {
+	return &pirReader{
+		servers:          servers,
+		threshold:        threshold,
+		randSource:       source,
+		refreshThreshold: DefaultRefreshThreshold,
+		refreshInterval:  DefaultRefreshInterval,
+	}
+}
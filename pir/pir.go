@@ -28,13 +28,34 @@ type HintResp interface {
 
 type Client interface {
 	Query(i int) ([]QueryReq, ReconstructFunc)
+	// QueryBatch generates a single request per server that retrieves all
+	// of the given rows.
+	QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc)
 	DummyQuery() []QueryReq
 	StateSize() (bitsPerKey, fixedBytes int)
 }
 
+// HintStatus describes how much of the database a client's hint still covers.
+type HintStatus struct {
+	NumRows  int
+	NumHints int
+	// Number of rows that the client can currently look up.
+	NumCovered int
+	// Probability that a lookup of a uniformly random row fails.
+	FailureProb float64
+}
+
+// HintTracker is implemented by clients whose hint is consumed by queries
+// and may eventually stop covering some rows.
+type HintTracker interface {
+	HintStatus() HintStatus
+}
+
 //QueryReq is a PIR query from a client to a server.
 type QueryReq interface {
 	Process(db StaticDB) (interface{}, error)
 }
 
 type ReconstructFunc func(resp []interface{}) (Row, error)
+
+type ReconstructBatchFunc func(resp []interface{}) ([]Row, error)
@@ -0,0 +1,126 @@
+package pir
+
+import (
+	"fmt"
+)
+
+// BatchQueryReq bundles several queries to the same server, for schemes
+// that have no specialized batch evaluation.
+type BatchQueryReq struct {
+	Reqs []QueryReq
+}
+
+type BatchQueryResp struct {
+	Resps []interface{}
+}
+
+func (req *BatchQueryReq) Process(db StaticDB) (interface{}, error) {
+	resp := BatchQueryResp{Resps: make([]interface{}, len(req.Reqs))}
+	var err error
+	for i, q := range req.Reqs {
+		if err := validateSubRequest(i, q); err != nil {
+			return nil, err
+		}
+		if resp.Resps[i], err = q.Process(db); err != nil {
+			return nil, err
+		}
+	}
+	return &resp, nil
+}
+
+// queryUndoer is implemented by clients whose queries replace the sets
+// that their hints are for. recordQueries starts recording the sets that
+// queries replace, and returns a function that stops recording and, if
+// undo is set, puts the replaced sets back, so that the hints stay valid
+// for queries that are never sent.
+type queryUndoer interface {
+	recordQueries() (stop func(undo bool))
+}
+
+// queryEach generates a single-index query for each of the indices, in order.
+// queries[j][s] is the request for server s of the j-th query. If verify is
+// set, the rows are checked with it, as with QueryVerified.
+// Returns nil if any of the indices cannot be queried, and then leaves the
+// client as it was.
+func queryEach(c Client, indices []int, verify VerifyFunc) (queries [][]QueryReq, recons []ReconstructFunc) {
+	stop := func(undo bool) {}
+	if u, ok := c.(queryUndoer); ok {
+		stop = u.recordQueries()
+	}
+	queries = make([][]QueryReq, len(indices))
+	recons = make([]ReconstructFunc, len(indices))
+	for j, i := range indices {
+		if verify != nil {
+			queries[j], recons[j] = QueryVerified(c, i, verify)
+		} else {
+			queries[j], recons[j] = c.Query(i)
+		}
+		if recons[j] == nil {
+			stop(true)
+			return nil, nil
+		}
+	}
+	stop(false)
+	return queries, recons
+}
+
+// reconstructEach reconstructs every query of a batch, in the order in which
+// the queries were generated, from the per-query responses returned by split.
+func reconstructEach(recons []ReconstructFunc, resps []interface{},
+	split func(resp interface{}) ([]interface{}, error)) ([]Row, error) {
+	perServer := make([][]interface{}, len(resps))
+	for s := range resps {
+		var err error
+		if perServer[s], err = split(resps[s]); err != nil {
+			return nil, err
+		}
+		if len(perServer[s]) != len(recons) {
+			return nil, fmt.Errorf("Unexpected number of batch answers: have: %d, want: %d",
+				len(perServer[s]), len(recons))
+		}
+	}
+
+	rows := make([]Row, len(recons))
+	for j := range recons {
+		queryResps := make([]interface{}, len(resps))
+		for s := range resps {
+			queryResps[s] = perServer[s][j]
+		}
+		var err error
+		if rows[j], err = recons[j](queryResps); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// queryBatchSequential implements QueryBatch on top of Query by sending all
+// single-index queries for a server in one BatchQueryReq.
+func queryBatchSequential(c Client, indices []int, verify VerifyFunc) ([]QueryReq, ReconstructBatchFunc) {
+	if len(indices) == 0 {
+		return nil, nil
+	}
+	queries, recons := queryEach(c, indices, verify)
+	if recons == nil {
+		return nil, nil
+	}
+	batch := make([]QueryReq, len(queries[0]))
+	for s := range batch {
+		batch[s] = &BatchQueryReq{}
+	}
+	for _, q := range queries {
+		for s := range batch {
+			req := batch[s].(*BatchQueryReq)
+			req.Reqs = append(req.Reqs, q[s])
+		}
+	}
+	return batch, func(resps []interface{}) ([]Row, error) {
+		return reconstructEach(recons, resps, func(resp interface{}) ([]interface{}, error) {
+			batchResp, ok := resp.(*BatchQueryResp)
+			if !ok {
+				return nil, fmt.Errorf("Invalid response type: %T, expected: *BatchQueryResp", resp)
+			}
+			return batchResp.Resps, nil
+		})
+	}
+}
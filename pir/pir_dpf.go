@@ -1,7 +1,6 @@
 package pir
 
 import (
-	"checklist/psetggm"
 	"fmt"
 	"math"
 	"math/rand"
@@ -11,22 +10,25 @@ import (
 
 type dpfClient struct {
 	nRows int
+	shareLayout
 
 	randSource *rand.Rand
 }
 
 func matVecProduct(db StaticDB, bitVector []byte) []byte {
 	out := make(Row, db.RowLen)
-	if db.RowLen == 32 {
-		psetggm.XorHashesByBitVector(db.FlatDb, bitVector, out)
-	} else {
-		var j uint
-		for j = 0; j < uint(db.NumRows); j++ {
+	// Ranges start at multiples of 8 rows, on byte boundaries of bitVector.
+	parallelXor(db.NumRows, 8, out, func(start, end int, out []byte) {
+		if db.RowLen == 32 {
+			xorHashesByBitVector(db.FlatDb[32*start:32*end], bitVector[start/8:], out)
+			return
+		}
+		for j := uint(start); j < uint(end); j++ {
 			if ((1 << (j % 8)) & bitVector[j/8]) != 0 {
 				xorInto(out, db.FlatDb[j*uint(db.RowLen):(j+1)*uint(db.RowLen)])
 			}
 		}
-	}
+	})
 	return out
 }
 
@@ -46,7 +48,37 @@ type DPFHintResp struct {
 }
 
 func (resp *DPFHintResp) InitClient(source *rand.Rand) Client {
-	return &dpfClient{randSource: source, nRows: resp.NRows}
+	return &dpfClient{randSource: source, nRows: resp.NRows, shareLayout: twoServerLayout}
+}
+
+// With a threshold of one, queries consist of two-party DPF keys with
+// logarithmic size. Higher thresholds need a multi-party DPF, whose keys
+// have size proportional to the square root of the number of rows.
+func (resp *DPFHintResp) InitMultiServerClient(source *rand.Rand, numServers, threshold int) (Client, error) {
+	layout, err := newShareLayout(numServers, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return &dpfClient{randSource: source, nRows: resp.NRows, shareLayout: layout}, nil
+}
+
+type dpfClientState struct {
+	NRows  int
+	Layout shareLayout
+}
+
+func (c *dpfClient) MarshalBinary() ([]byte, error) {
+	return gobEncode(&dpfClientState{NRows: c.nRows, Layout: c.shareLayout})
+}
+
+func (c *dpfClient) UnmarshalBinary(data []byte) error {
+	var state dpfClientState
+	if err := gobDecode(data, &state); err != nil {
+		return err
+	}
+	c.nRows = state.NRows
+	c.shareLayout = state.Layout
+	return nil
 }
 
 type DPFQueryReq struct {
@@ -57,15 +89,29 @@ type DPFQueryResp struct {
 }
 
 func (key *DPFQueryReq) Process(db StaticDB) (interface{}, error) {
-	bitVec := dpf.EvalFull(key.DPFkey, uint64(math.Ceil(math.Log2(float64(db.NumRows)))))
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	if err := validateDPFKey(db, key.DPFkey); err != nil {
+		return nil, err
+	}
+	bitVec := dpf.EvalFull(key.DPFkey, dpfLogN(db))
 	return &DPFQueryResp{matVecProduct(db, bitVec)}, nil
 }
 
 func (c *dpfClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
-	numBits := uint64(math.Ceil(math.Log2(float64(c.nRows))))
-	qL, qR := dpf.Gen(uint64(idx), numBits)
+	var shares []QueryReq
+	if c.numShares() == 2 {
+		numBits := uint64(math.Ceil(math.Log2(float64(c.nRows))))
+		qL, qR := dpf.Gen(uint64(idx), numBits)
+		shares = []QueryReq{&DPFQueryReq{qL}, &DPFQueryReq{qR}}
+	} else {
+		for _, key := range genMultiDPF(c.randSource, idx, c.nRows, c.numShares()) {
+			shares = append(shares, &MultiDPFQueryReq{key})
+		}
+	}
 
-	return []QueryReq{&DPFQueryReq{qL}, &DPFQueryReq{qR}}, func(resps []interface{}) (Row, error) {
+	return c.serverRequests(shares), func(resps []interface{}) (Row, error) {
 		queryResps := make([]*DPFQueryResp, len(resps))
 		var ok bool
 		for i, r := range resps {
@@ -78,6 +124,106 @@ func (c *dpfClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
 	}
 }
 
+// DPFBatchQueryReq holds several DPF keys to be evaluated by the same server.
+type DPFBatchQueryReq struct {
+	Keys []dpf.DPFkey
+}
+
+type DPFBatchQueryResp struct {
+	Answers [][]byte
+}
+
+// Process answers all queries in the batch with a single pass over the database.
+func (req *DPFBatchQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	for q := range req.Keys {
+		if err := validateDPFKey(db, req.Keys[q]); err != nil {
+			return nil, fmt.Errorf("query %d: %w", q, err)
+		}
+	}
+	logN := dpfLogN(db)
+	bitVecs := make([][]byte, len(req.Keys))
+	for q := range req.Keys {
+		bitVecs[q] = dpf.EvalFull(req.Keys[q], logN)
+	}
+	return &DPFBatchQueryResp{matVecsProduct(db, bitVecs)}, nil
+}
+
+// matVecsProduct computes the products of the database with several bit vectors
+// while reading every row of the database only once. The rows are scanned in
+// blocks, and every query reads a block before moving on to the next one.
+func matVecsProduct(db StaticDB, bitVectors [][]byte) [][]byte {
+	out := make([][]byte, len(bitVectors))
+	for q := range out {
+		out[q] = make([]byte, db.RowLen)
+	}
+	blockRows := batchBlockRows(db.RowLen, 8)
+	parallelXorBatch(db.NumRows, blockRows, out, func(start, end int, out [][]byte) {
+		blockOut := make([]byte, db.RowLen)
+		for blockStart := start; blockStart < end; blockStart += blockRows {
+			blockEnd := blockStart + blockRows
+			if blockEnd > end {
+				blockEnd = end
+			}
+			for q, bitVector := range bitVectors {
+				if db.RowLen == 32 {
+					xorHashesByBitVector(db.FlatDb[32*blockStart:32*blockEnd], bitVector[blockStart/8:], blockOut)
+					xorInto(out[q], blockOut)
+					continue
+				}
+				for j := blockStart; j < blockEnd; j++ {
+					if ((1 << (j % 8)) & bitVector[j/8]) != 0 {
+						xorInto(out[q], db.Row(j))
+					}
+				}
+			}
+		}
+	})
+	return out
+}
+
+func (c *dpfClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	if c.numShares() != 2 {
+		return queryBatchSequential(c, indices, nil)
+	}
+	numBits := uint64(math.Ceil(math.Log2(float64(c.nRows))))
+	batchL, batchR := new(DPFBatchQueryReq), new(DPFBatchQueryReq)
+	for _, idx := range indices {
+		qL, qR := dpf.Gen(uint64(idx), numBits)
+		batchL.Keys = append(batchL.Keys, qL)
+		batchR.Keys = append(batchR.Keys, qR)
+	}
+
+	return c.serverRequests([]QueryReq{batchL, batchR}), func(resps []interface{}) ([]Row, error) {
+		queryResps := make([]*DPFBatchQueryResp, len(resps))
+		var ok bool
+		for i, r := range resps {
+			if queryResps[i], ok = r.(*DPFBatchQueryResp); !ok {
+				return nil, fmt.Errorf("Invalid response type: %T, expected *DPFBatchQueryResp", r)
+			}
+			if len(queryResps[i].Answers) != len(indices) {
+				return nil, fmt.Errorf("Unexpected number of batch answers: have: %d, want: %d",
+					len(queryResps[i].Answers), len(indices))
+			}
+		}
+
+		rows := make([]Row, len(indices))
+		for j := range rows {
+			answers := make([]*DPFQueryResp, len(queryResps))
+			for s := range queryResps {
+				answers[s] = &DPFQueryResp{queryResps[s].Answers[j]}
+			}
+			var err error
+			if rows[j], err = c.reconstruct(answers); err != nil {
+				return nil, err
+			}
+		}
+		return rows, nil
+	}
+}
+
 func (c *dpfClient) DummyQuery() []QueryReq {
 	q, _ := c.Query(0)
 	return q
@@ -88,8 +234,9 @@ func (c *dpfClient) StateSize() (int, int) {
 }
 
 func (c *dpfClient) reconstruct(resp []*DPFQueryResp) (Row, error) {
-	out := make([]byte, len(resp[Left].Answer))
-	xorInto(out, resp[Left].Answer)
-	xorInto(out, resp[Right].Answer)
-	return out, nil
+	answers := make([][]byte, len(resp))
+	for s := range resp {
+		answers[s] = resp[s].Answer
+	}
+	return c.combine(answers)
 }
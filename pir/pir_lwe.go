@@ -0,0 +1,301 @@
+package pir
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Single-server PIR based on the learning-with-errors assumption, following
+// the "SimplePIR" construction of Henzinger, Hong, Corrigan-Gibbs, Meiklejohn
+// and Vaikuntanathan.
+//
+// The database is viewed as a matrix D over Z_p with p = 2^8 (one entry per
+// byte), in which every database row is stored in one column. The client
+// downloads the hint H = D*A, where A is a public random matrix over Z_q with
+// q = 2^32 expanded from a seed. To fetch column c, the client sends an LWE
+// encryption q = A*s + e + (q/p)*u_c of the unit vector u_c, and decrypts the
+// server's answer D*q using H*s.
+//
+// The server picks the seed of A, so that computing the hint, which takes
+// lweSecretDim multiplications per byte of the database, happens once per
+// version of the database rather than once per client.
+
+const (
+	// LWE secret dimension.
+	lweSecretDim = 1024
+	// Standard deviation of the LWE error distribution.
+	lweErrorStdDev = 6.4
+	// Scaling factor q/p of the plaintext, with q = 2^32 and p = 2^8.
+	lweDelta = 1 << 24
+)
+
+// Layout of the database matrix: every column holds rowsPerCol database rows
+// stacked on top of each other, so that the matrix has rowsPerCol*RowLen
+// rows and cols columns.
+type lweParams struct {
+	NRows  int
+	RowLen int
+	Seed   PRGKey
+
+	cols, rowsPerCol int
+}
+
+func newLWEParams(nRows, rowLen int, seed PRGKey) lweParams {
+	p := lweParams{NRows: nRows, RowLen: rowLen, Seed: seed}
+	p.cols = int(math.Ceil(math.Sqrt(float64(nRows * rowLen))))
+	if p.cols > nRows {
+		p.cols = nRows
+	}
+	if p.cols < 1 {
+		p.cols = 1
+	}
+	p.rowsPerCol = (nRows-1)/p.cols + 1
+	return p
+}
+
+func (p *lweParams) height() int {
+	return p.rowsPerCol * p.RowLen
+}
+
+// matrixA expands the seed into the public cols x lweSecretDim matrix A,
+// stored row by row.
+func (p *lweParams) matrixA() []uint32 {
+	buf := make([]byte, 4*p.cols*lweSecretDim)
+	NewPRG(&p.Seed).Read(buf)
+	a := make([]uint32, p.cols*lweSecretDim)
+	for i := range a {
+		a[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return a
+}
+
+type LWEHintReq struct {
+}
+
+type LWEHintResp struct {
+	NRows  int
+	RowLen int
+	Seed   PRGKey
+	// The height x lweSecretDim matrix D*A, stored row by row.
+	Hint []uint32
+}
+
+func NewLWEHintReq() *LWEHintReq {
+	return new(LWEHintReq)
+}
+
+// The hint of the database that LWE hints were last requested for. A
+// database is identified by its digest, which costs one pass over the
+// database instead of lweSecretDim.
+var lweHintCache struct {
+	sync.Mutex
+	digest [sha256.Size]byte
+	resp   *LWEHintResp
+}
+
+func lweDigest(db StaticDB) [sha256.Size]byte {
+	h := sha256.New()
+	var size [16]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(db.NumRows))
+	binary.LittleEndian.PutUint64(size[8:], uint64(db.RowLen))
+	h.Write(size[:])
+	h.Write(db.Slice(0, db.NumRows))
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return digest
+}
+
+// Process returns the hint of db under a seed of the server, which is
+// shared by all clients of the same database. Callers must not modify it.
+func (req *LWEHintReq) Process(db StaticDB) (HintResp, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	digest := lweDigest(db)
+	// Concurrent requests wait for the hint instead of computing it again.
+	lweHintCache.Lock()
+	defer lweHintCache.Unlock()
+	if lweHintCache.resp == nil || lweHintCache.digest != digest {
+		lweHintCache.resp = lweHint(db, *RandomPRGKey())
+		lweHintCache.digest = digest
+	}
+	return lweHintCache.resp, nil
+}
+
+func lweHint(db StaticDB, seed PRGKey) *LWEHintResp {
+	params := newLWEParams(db.NumRows, db.RowLen, seed)
+	a := params.matrixA()
+	hint := make([]uint32, params.height()*lweSecretDim)
+
+	for i := 0; i < db.NumRows; i++ {
+		col, block := i%params.cols, i/params.cols
+		aRow := a[col*lweSecretDim : (col+1)*lweSecretDim]
+		for t, d := range db.Row(i) {
+			if d == 0 {
+				continue
+			}
+			r := block*db.RowLen + t
+			hRow := hint[r*lweSecretDim : (r+1)*lweSecretDim]
+			for k := range hRow {
+				hRow[k] += uint32(d) * aRow[k]
+			}
+		}
+	}
+
+	return &LWEHintResp{
+		NRows:  db.NumRows,
+		RowLen: db.RowLen,
+		Seed:   seed,
+		Hint:   hint,
+	}
+}
+
+func (resp *LWEHintResp) InitClient(source *rand.Rand) Client {
+	return &lweClient{
+		lweParams:  newLWEParams(resp.NRows, resp.RowLen, resp.Seed),
+		randSource: source,
+		hint:       resp.Hint,
+	}
+}
+
+func (resp *LWEHintResp) NumRows() int {
+	return resp.NRows
+}
+
+// lweClientState has the fields of LWEHintResp but not its wire encoding, so
+// that saved clients keep their gob encoding.
+type lweClientState LWEHintResp
+
+func (c *lweClient) MarshalBinary() ([]byte, error) {
+	return gobEncode(&lweClientState{
+		NRows:  c.NRows,
+		RowLen: c.RowLen,
+		Seed:   c.Seed,
+		Hint:   c.hint,
+	})
+}
+
+func (c *lweClient) UnmarshalBinary(data []byte) error {
+	var resp lweClientState
+	if err := gobDecode(data, &resp); err != nil {
+		return err
+	}
+	c.lweParams = newLWEParams(resp.NRows, resp.RowLen, resp.Seed)
+	c.hint = resp.Hint
+	c.a = nil
+	return nil
+}
+
+type lweClient struct {
+	lweParams
+
+	randSource *rand.Rand
+	hint       []uint32
+	// Public matrix A, expanded from the seed on first use.
+	a []uint32
+}
+
+type LWEQueryReq struct {
+	Query []uint32
+}
+
+type LWEQueryResp struct {
+	Answer []uint32
+}
+
+func (req *LWEQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	params := newLWEParams(db.NumRows, db.RowLen, PRGKey{})
+	if len(req.Query) != params.cols {
+		return nil, invalidf("query of length %d, expected %d", len(req.Query), params.cols)
+	}
+	ans := make([]uint32, params.height())
+	for i := 0; i < db.NumRows; i++ {
+		col, block := i%params.cols, i/params.cols
+		q := req.Query[col]
+		out := ans[block*db.RowLen : (block+1)*db.RowLen]
+		for t, d := range db.Row(i) {
+			out[t] += uint32(d) * q
+		}
+	}
+	return &LWEQueryResp{Answer: ans}, nil
+}
+
+// Sample an LWE error term from a rounded Gaussian.
+func (c *lweClient) sampleError() uint32 {
+	return uint32(int32(math.Round(c.randSource.NormFloat64() * lweErrorStdDev)))
+}
+
+func (c *lweClient) Query(i int) ([]QueryReq, ReconstructFunc) {
+	if i < 0 || i >= c.NRows {
+		return nil, nil
+	}
+	col, block := i%c.cols, i/c.cols
+
+	secret := make([]uint32, lweSecretDim)
+	for k := range secret {
+		secret[k] = c.randSource.Uint32()
+	}
+	if c.a == nil {
+		c.a = c.matrixA()
+	}
+	a := c.a
+	query := make([]uint32, c.cols)
+	for j := range query {
+		var v uint32
+		aRow := a[j*lweSecretDim : (j+1)*lweSecretDim]
+		for k := range aRow {
+			v += aRow[k] * secret[k]
+		}
+		query[j] = v + c.sampleError()
+	}
+	query[col] += lweDelta
+
+	return []QueryReq{&LWEQueryReq{Query: query}}, func(resps []interface{}) (Row, error) {
+		if len(resps) != 1 {
+			return nil, fmt.Errorf("Unexpected number of answers: have: %d, want: 1", len(resps))
+		}
+		resp, ok := resps[0].(*LWEQueryResp)
+		if !ok {
+			return nil, fmt.Errorf("Invalid response type: %T, expected: *LWEQueryResp", resps[0])
+		}
+		return c.reconstruct(block, secret, resp)
+	}
+}
+
+func (c *lweClient) reconstruct(block int, secret []uint32, resp *LWEQueryResp) (Row, error) {
+	if len(resp.Answer) != c.height() {
+		return nil, fmt.Errorf("Unexpected answer length: have: %d, want: %d", len(resp.Answer), c.height())
+	}
+	out := make(Row, c.RowLen)
+	for t := range out {
+		r := block*c.RowLen + t
+		v := resp.Answer[r]
+		hRow := c.hint[r*lweSecretDim : (r+1)*lweSecretDim]
+		for k := range hRow {
+			v -= hRow[k] * secret[k]
+		}
+		// Round to the nearest multiple of lweDelta.
+		out[t] = byte((v + lweDelta/2) / lweDelta)
+	}
+	return out, nil
+}
+
+func (c *lweClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	return queryBatchSequential(c, indices, nil)
+}
+
+func (c *lweClient) DummyQuery() []QueryReq {
+	q, _ := c.Query(0)
+	return q
+}
+
+func (c *lweClient) StateSize() (bitsPerKey, fixedBytes int) {
+	return 0, 4 * len(c.hint)
+}
@@ -11,6 +11,7 @@ type matrixClient struct {
 	height int
 	width  int
 	rowLen int
+	shareLayout
 
 	randSource *rand.Rand
 }
@@ -27,20 +28,20 @@ func matBoolVecProduct(db StaticDB, bitVector []bool) []byte {
 	width, height := getHeightWidth(db.NumRows, db.RowLen)
 	out := make([]byte, width*db.RowLen)
 
-	cnt := 0
 	tableWidth := db.RowLen * width
 	flatDb := db.Slice(0, db.NumRows)
-	for j := 0; j < height; j++ {
-		if bitVector[j] {
-			start := tableWidth * j
-			length := tableWidth
-			if start+length >= len(flatDb) {
-				length = len(flatDb) - start
+	parallelXor(height, 1, out, func(startRow, endRow int, out []byte) {
+		for j := startRow; j < endRow; j++ {
+			if bitVector[j] {
+				start := tableWidth * j
+				length := tableWidth
+				if start+length >= len(flatDb) {
+					length = len(flatDb) - start
+				}
+				xorInto(out[0:length], flatDb[start:start+length])
 			}
-			xorInto(out[0:length], flatDb[start:start+length])
-			cnt = cnt + tableWidth
 		}
-	}
+	})
 	return out
 }
 
@@ -53,9 +54,69 @@ type MatrixQueryResp struct {
 }
 
 func (req *MatrixQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	if err := validateBitVector(db, req.BitVector); err != nil {
+		return nil, err
+	}
 	return &MatrixQueryResp{matBoolVecProduct(db, req.BitVector)}, nil
 }
 
+// MatrixBatchQueryReq holds several Matrix queries to the same server.
+type MatrixBatchQueryReq struct {
+	BitVectors [][]bool
+}
+
+type MatrixBatchQueryResp struct {
+	Answers [][]byte
+}
+
+// Process answers all queries in the batch with a single pass over the database.
+func (req *MatrixBatchQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	for q := range req.BitVectors {
+		if err := validateBitVector(db, req.BitVectors[q]); err != nil {
+			return nil, fmt.Errorf("query %d: %w", q, err)
+		}
+	}
+	width, height := getHeightWidth(db.NumRows, db.RowLen)
+	out := make([][]byte, len(req.BitVectors))
+	for q := range out {
+		out[q] = make([]byte, width*db.RowLen)
+	}
+
+	// As in matVecsProduct, the queries take turns scanning blocks of rows
+	// of the matrix.
+	tableWidth := db.RowLen * width
+	blockRows := batchBlockRows(tableWidth, 1)
+	flatDb := db.Slice(0, db.NumRows)
+	parallelXorBatch(height, blockRows, out, func(startRow, endRow int, out [][]byte) {
+		for blockStart := startRow; blockStart < endRow; blockStart += blockRows {
+			blockEnd := blockStart + blockRows
+			if blockEnd > endRow {
+				blockEnd = endRow
+			}
+			for q, bitVector := range req.BitVectors {
+				for j := blockStart; j < blockEnd; j++ {
+					if !bitVector[j] {
+						continue
+					}
+					start := tableWidth * j
+					length := tableWidth
+					if start+length >= len(flatDb) {
+						length = len(flatDb) - start
+					}
+					xorInto(out[q][0:length], flatDb[start:start+length])
+				}
+			}
+		}
+	})
+	return &MatrixBatchQueryResp{out}, nil
+}
+
 type MatrixHintReq struct{}
 type MatrixHintResp struct {
 	DBParams
@@ -71,24 +132,75 @@ func (req *MatrixHintReq) Process(db StaticDB) (HintResp, error) {
 
 func (resp *MatrixHintResp) InitClient(source *rand.Rand) Client {
 	client := matrixClient{
-		randSource: source,
-		nRows:      resp.NRows,
-		rowLen:     resp.RowLen}
+		randSource:  source,
+		nRows:       resp.NRows,
+		rowLen:      resp.RowLen,
+		shareLayout: twoServerLayout}
 	client.width, client.height = getHeightWidth(resp.NRows, client.rowLen)
 	return &client
 }
 
-func (c *matrixClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
+func (resp *MatrixHintResp) InitMultiServerClient(source *rand.Rand, numServers, threshold int) (Client, error) {
+	layout, err := newShareLayout(numServers, threshold)
+	if err != nil {
+		return nil, err
+	}
+	client := resp.InitClient(source).(*matrixClient)
+	client.shareLayout = layout
+	return client, nil
+}
+
+type matrixClientState struct {
+	DBParams
+	Layout shareLayout
+}
+
+func (c *matrixClient) MarshalBinary() ([]byte, error) {
+	return gobEncode(&matrixClientState{
+		DBParams: DBParams{NRows: c.nRows, RowLen: c.rowLen},
+		Layout:   c.shareLayout,
+	})
+}
+
+func (c *matrixClient) UnmarshalBinary(data []byte) error {
+	var state matrixClientState
+	if err := gobDecode(data, &state); err != nil {
+		return err
+	}
+	c.nRows, c.rowLen = state.NRows, state.RowLen
+	c.shareLayout = state.Layout
+	c.width, c.height = getHeightWidth(c.nRows, c.rowLen)
+	return nil
+}
+
+// bitVectorShares splits the indicator vector of the row that contains idx
+// into XOR shares.
+func (c *matrixClient) bitVectorShares(idx int) [][]bool {
 	rowNum := idx / c.width
-	colNum := idx % c.width
-	qL := make([]bool, c.height)
-	qR := make([]bool, c.height)
+	shares := make([][]bool, c.numShares())
+	for s := range shares {
+		shares[s] = make([]bool, c.height)
+	}
+	last := shares[len(shares)-1]
 	for i := 0; i < c.height; i++ {
-		qL[i] = (c.randSource.Uint64()&1 == 0)
-		qR[i] = (qL[i] != (i == rowNum))
+		last[i] = (i == rowNum)
+		for _, share := range shares[:len(shares)-1] {
+			share[i] = (c.randSource.Uint64()&1 == 0)
+			last[i] = (last[i] != share[i])
+		}
 	}
+	return shares
+}
 
-	return []QueryReq{&MatrixQueryReq{qL}, &MatrixQueryReq{qR}}, func(resps []interface{}) (Row, error) {
+func (c *matrixClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
+	colNum := idx % c.width
+	bitVectors := c.bitVectorShares(idx)
+	shares := make([]QueryReq, len(bitVectors))
+	for s := range shares {
+		shares[s] = &MatrixQueryReq{bitVectors[s]}
+	}
+
+	return c.serverRequests(shares), func(resps []interface{}) (Row, error) {
 		queryResps := make([]*MatrixQueryResp, len(resps))
 		var ok bool
 		for i, r := range resps {
@@ -100,15 +212,64 @@ func (c *matrixClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
 	}
 }
 
+func (c *matrixClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	batches := make([]QueryReq, c.numShares())
+	for s := range batches {
+		batches[s] = new(MatrixBatchQueryReq)
+	}
+	for _, idx := range indices {
+		for s, bitVector := range c.bitVectorShares(idx) {
+			batch := batches[s].(*MatrixBatchQueryReq)
+			batch.BitVectors = append(batch.BitVectors, bitVector)
+		}
+	}
+
+	return c.serverRequests(batches), func(resps []interface{}) ([]Row, error) {
+		queryResps := make([]*MatrixBatchQueryResp, len(resps))
+		var ok bool
+		for i, r := range resps {
+			if queryResps[i], ok = r.(*MatrixBatchQueryResp); !ok {
+				return nil, fmt.Errorf("Invalid response type: %T, expected: *MatrixBatchQueryResp", r)
+			}
+			if len(queryResps[i].Answers) != len(indices) {
+				return nil, fmt.Errorf("Unexpected number of batch answers: have: %d, want: %d",
+					len(queryResps[i].Answers), len(indices))
+			}
+		}
+
+		rows := make([]Row, len(indices))
+		for j, idx := range indices {
+			answers := make([]*MatrixQueryResp, len(queryResps))
+			for s := range queryResps {
+				answers[s] = &MatrixQueryResp{queryResps[s].Answers[j]}
+			}
+			var err error
+			if rows[j], err = c.reconstruct(idx%c.width, answers); err != nil {
+				return nil, err
+			}
+		}
+		return rows, nil
+	}
+}
+
 func (c *matrixClient) DummyQuery() []QueryReq {
 	q, _ := c.Query(0)
 	return q
 }
 
 func (c *matrixClient) reconstruct(colNum int, resp []*MatrixQueryResp) (Row, error) {
-	out := make([]byte, len(resp[Left].Answer))
-	xorInto(out, resp[Left].Answer)
-	xorInto(out, resp[Right].Answer)
+	answers := make([][]byte, len(resp))
+	for s := range resp {
+		answers[s] = resp[s].Answer
+	}
+	out, err := c.combine(answers)
+	if err != nil {
+		return nil, err
+	}
+	// The answers come from the servers.
+	if len(out) < c.rowLen*(colNum+1) {
+		return nil, fmt.Errorf("Answer too short: have: %d bytes, want: at least %d", len(out), c.rowLen*(colNum+1))
+	}
 	return out[c.rowLen*colNum : (c.rowLen * (colNum + 1))], nil
 }
 
@@ -40,6 +40,9 @@ type NonPrivateQueryResp struct {
 
 func (req *NonPrivateQueryReq) Process(db StaticDB) (interface{}, error) {
 	idx := req.Index
+	if err := validateRowIndex(db, "index", idx); err != nil {
+		return nil, err
+	}
 	return &NonPrivateQueryResp{db.FlatDb[idx*db.RowLen : (idx+1)*db.RowLen]}, nil
 }
 
@@ -55,6 +58,10 @@ func (c *nonPrivateClient) Query(idx int) ([]QueryReq, ReconstructFunc) {
 	}
 }
 
+func (c *nonPrivateClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	return queryBatchSequential(c, indices, nil)
+}
+
 func (c *nonPrivateClient) DummyQuery() []QueryReq {
 	q, _ := c.Query(0)
 	return q
@@ -63,3 +70,12 @@ func (c *nonPrivateClient) DummyQuery() []QueryReq {
 func (c *nonPrivateClient) StateSize() (int, int) {
 	return 0, 0
 }
+
+// The non-private client is stateless.
+func (c *nonPrivateClient) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (c *nonPrivateClient) UnmarshalBinary(data []byte) error {
+	return nil
+}
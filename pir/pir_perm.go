@@ -0,0 +1,622 @@
+package pir
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+)
+
+// The Perm scheme partitions the (power-of-two padded) universe of rows into
+// sqrt(n) sets of size sqrt(n) using a pseudorandom permutation, and stores
+// the parity of every set as the client's hint. Sets used by queries are
+// replaced by fresh random sets, so, as in the Punc scheme, the client keeps
+// SecParam*ln(2) independent partitions ("tables") to keep every row covered.
+
+const (
+	// Number of Feistel rounds in the small-domain pseudorandom permutation.
+	feistelRounds = 4
+)
+
+// feistelPRP is a pseudorandom permutation over [0, domain) built from a
+// balanced Feistel network over 2*halfBits bits with cycle walking.
+type feistelPRP struct {
+	block    cipher.Block
+	halfBits uint
+	domain   uint64
+}
+
+func newFeistelPRP(key []byte, domainBits uint) feistelPRP {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return feistelPRP{
+		block:    block,
+		halfBits: (domainBits + 1) / 2,
+		domain:   1 << domainBits,
+	}
+}
+
+func (p *feistelPRP) round(r int, x uint64) uint64 {
+	var in, out [aes.BlockSize]byte
+	in[0] = byte(r)
+	binary.LittleEndian.PutUint64(in[1:], x)
+	p.block.Encrypt(out[:], in[:])
+	return binary.LittleEndian.Uint64(out[:]) & (1<<p.halfBits - 1)
+}
+
+func (p *feistelPRP) Permute(x int) int {
+	mask := uint64(1<<p.halfBits - 1)
+	v := uint64(x)
+	for {
+		left, right := v>>p.halfBits, v&mask
+		for r := 0; r < feistelRounds; r++ {
+			left, right = right, left^p.round(r, right)
+		}
+		v = left<<p.halfBits | right
+		if v < p.domain {
+			return int(v)
+		}
+	}
+}
+
+func (p *feistelPRP) Invert(y int) int {
+	mask := uint64(1<<p.halfBits - 1)
+	v := uint64(y)
+	for {
+		left, right := v>>p.halfBits, v&mask
+		for r := feistelRounds - 1; r >= 0; r-- {
+			left, right = right^p.round(r, left), left
+		}
+		v = left<<p.halfBits | right
+		if v < p.domain {
+			return int(v)
+		}
+	}
+}
+
+type permParams struct {
+	NRows     int
+	RowLen    int
+	NumTables int
+	// log2 of the padded universe size.
+	UnivBits int
+	SetSize  int
+}
+
+func newPermParams(nRows, rowLen, numTables int) permParams {
+	univBits := 1
+	if nRows > 2 {
+		univBits = int(math.Ceil(math.Log2(float64(nRows))))
+	}
+	return permParams{
+		NRows:     nRows,
+		RowLen:    rowLen,
+		NumTables: numTables,
+		UnivBits:  univBits,
+		SetSize:   1 << ((univBits + 1) / 2),
+	}
+}
+
+func (p *permParams) univSize() int {
+	return 1 << p.UnivBits
+}
+
+func (p *permParams) setsPerTable() int {
+	return p.univSize() / p.SetSize
+}
+
+func (p *permParams) numSets() int {
+	return p.NumTables * p.setsPerTable()
+}
+
+// tablePRPs derives one independent permutation per table from the seed.
+func (p *permParams) tablePRPs(seed PRGKey) []feistelPRP {
+	block, err := aes.NewCipher(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	prps := make([]feistelPRP, p.NumTables)
+	var in, key [aes.BlockSize]byte
+	for t := range prps {
+		in[0] = 0xCC
+		binary.LittleEndian.PutUint32(in[1:], uint32(t))
+		block.Encrypt(key[:], in[:])
+		prps[t] = newFeistelPRP(key[:], uint(p.UnivBits))
+	}
+	return prps
+}
+
+// Elements of set number setIdx as defined by the permutations.
+func (p *permParams) setElems(prps []feistelPRP, setIdx int, elems []int) {
+	table := setIdx / p.setsPerTable()
+	first := (setIdx % p.setsPerTable()) * p.SetSize
+	for k := range elems {
+		elems[k] = prps[table].Permute(first + k)
+	}
+}
+
+type PermHintReq struct {
+	RandSeed  PRGKey
+	NumTables int
+}
+
+type PermHintResp struct {
+	NRows     int
+	RowLen    int
+	NumTables int
+	SetGenKey PRGKey
+	Hints     []Row
+}
+
+func NewPermHintReq(randSource *rand.Rand) *PermHintReq {
+	req := &PermHintReq{
+		RandSeed:  PRGKey{},
+		NumTables: int(float64(SecParam) * math.Log(2)),
+	}
+	_, err := io.ReadFull(randSource, req.RandSeed[:])
+	if err != nil {
+		log.Fatalf("Failed to initialize random seed: %s", err)
+	}
+	return req
+}
+
+// xorRows XORs into out all rows of the database at the given indices,
+// treating indices beyond the end of the database as all-zero rows.
+func xorRows(db *StaticDB, out []byte, indices []int) {
+	for _, idx := range indices {
+		if idx < db.NumRows {
+			xorInto(out, db.Row(idx))
+		}
+	}
+}
+
+func (req *PermHintReq) Process(db StaticDB) (HintResp, error) {
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	if err := validateNumHints("number of tables", req.NumTables); err != nil {
+		return nil, err
+	}
+	params := newPermParams(db.NumRows, db.RowLen, req.NumTables)
+	prps := params.tablePRPs(req.RandSeed)
+
+	hints := make([]Row, params.numSets())
+	hintBuf := make([]byte, db.RowLen*len(hints))
+	elems := make([]int, params.SetSize)
+	for i := range hints {
+		params.setElems(prps, i, elems)
+		hints[i] = Row(hintBuf[db.RowLen*i : db.RowLen*(i+1)])
+		xorRows(&db, hints[i], elems)
+	}
+
+	return &PermHintResp{
+		NRows:     db.NumRows,
+		RowLen:    db.RowLen,
+		NumTables: req.NumTables,
+		SetGenKey: req.RandSeed,
+		Hints:     hints,
+	}, nil
+}
+
+func (resp *PermHintResp) InitClient(source *rand.Rand) Client {
+	params := newPermParams(resp.NRows, resp.RowLen, resp.NumTables)
+	c := permClient{
+		permParams: params,
+		randSource: source,
+		setGenKey:  resp.SetGenKey,
+		prps:       params.tablePRPs(resp.SetGenKey),
+		hints:      resp.Hints,
+		replaced:   make(map[int]replacedSet),
+		idxToSet:   make([]int32, resp.NRows),
+	}
+	for i := range c.idxToSet {
+		c.idxToSet[i] = -1
+	}
+	return &c
+}
+
+func (resp *PermHintResp) NumRows() int {
+	return resp.NRows
+}
+
+type permClientState struct {
+	Params    permParams
+	SetGenKey PRGKey
+	Hints     []Row
+	Replaced  map[int]replacedSet
+	IdxToSet  []int32
+}
+
+func (c *permClient) MarshalBinary() ([]byte, error) {
+	return gobEncode(&permClientState{
+		Params:    c.permParams,
+		SetGenKey: c.setGenKey,
+		Hints:     c.hints,
+		Replaced:  c.replaced,
+		IdxToSet:  c.idxToSet,
+	})
+}
+
+func (c *permClient) UnmarshalBinary(data []byte) error {
+	var state permClientState
+	if err := gobDecode(data, &state); err != nil {
+		return err
+	}
+	c.permParams = state.Params
+	c.setGenKey = state.SetGenKey
+	c.prps = c.tablePRPs(state.SetGenKey)
+	c.hints = state.Hints
+	c.replaced = state.Replaced
+	if c.replaced == nil {
+		c.replaced = make(map[int]replacedSet)
+	}
+	c.idxToSet = state.IdxToSet
+	return nil
+}
+
+// A set that was consumed by a query and replaced by a fresh random set
+// containing the queried row. The set is stored compactly as a PRF key.
+type replacedSet struct {
+	Key  PRGKey
+	With int
+	// Set if the hint of the set could not be updated, so that the set
+	// covers no rows.
+	Invalid bool
+}
+
+type permClient struct {
+	permParams
+
+	randSource *rand.Rand
+	setGenKey  PRGKey
+	prps       []feistelPRP
+	hints      []Row
+
+	// Sets that are no longer defined by the permutations.
+	replaced map[int]replacedSet
+	// Index of a replaced set that covers a given row, or -1.
+	idxToSet []int32
+
+	// Sets replaced since recordQueries, with their index, or nil.
+	replacedSets []permReplacedSet
+}
+
+type permReplacedSet struct {
+	setIdx int
+	// The replaced set, if it was no longer defined by the permutations.
+	set      replacedSet
+	replaced bool
+}
+
+type PermQueryReq struct {
+	Indices   []int
+	ExtraElem int
+}
+
+type PermQueryResp struct {
+	Answer    Row
+	ExtraElem Row
+}
+
+type permQueryCtx struct {
+	randCase int
+	setIdx   int
+	index    int
+	verify   VerifyFunc
+}
+
+func (q *PermQueryReq) Process(db StaticDB) (interface{}, error) {
+	// Indices beyond the end of the database stand for all-zero rows, up
+	// to the size of the permuted universe.
+	params := newPermParams(db.NumRows, db.RowLen, 0)
+	univSize := params.univSize()
+	for _, idx := range q.Indices {
+		if idx < 0 || idx >= univSize {
+			return nil, invalidf("index %d out of bounds [0:%d)", idx, univSize)
+		}
+	}
+	if q.ExtraElem < 0 || q.ExtraElem >= univSize {
+		return nil, invalidf("extra element %d out of bounds [0:%d)", q.ExtraElem, univSize)
+	}
+	resp := PermQueryResp{Answer: make(Row, db.RowLen)}
+	xorRows(&db, resp.Answer, q.Indices)
+	resp.ExtraElem = dbElem(db, q.ExtraElem)
+	return &resp, nil
+}
+
+// randomSetElems expands a PRF key into a pseudorandom set of SetSize
+// distinct elements of the universe that contains `with`.
+func (p *permParams) randomSetElems(set replacedSet) []int {
+	if set.Invalid {
+		return nil
+	}
+	block, err := aes.NewCipher(set.Key[:])
+	if err != nil {
+		panic(err)
+	}
+	var in, out [aes.BlockSize]byte
+	prf := func(ctr uint64) uint64 {
+		binary.LittleEndian.PutUint64(in[:], ctr)
+		block.Encrypt(out[:], in[:])
+		return binary.LittleEndian.Uint64(out[:])
+	}
+
+	elems := make([]int, 0, p.SetSize)
+	seen := map[int]bool{set.With: true}
+	for ctr := uint64(1); len(elems) < p.SetSize-1; ctr++ {
+		v := int(prf(ctr) % uint64(p.univSize()))
+		if !seen[v] {
+			seen[v] = true
+			elems = append(elems, v)
+		}
+	}
+	pos := int(prf(0) % uint64(p.SetSize))
+	elems = append(elems, 0)
+	copy(elems[pos+1:], elems[pos:])
+	elems[pos] = set.With
+	return elems
+}
+
+// elems returns the current elements of set setIdx.
+func (c *permClient) elems(setIdx int) []int {
+	if set, ok := c.replaced[setIdx]; ok {
+		return c.randomSetElems(set)
+	}
+	elems := make([]int, c.SetSize)
+	c.setElems(c.prps, setIdx, elems)
+	return elems
+}
+
+// findSet returns the index of a set covering row i, or -1 if none does.
+func (c *permClient) findSet(i int) int {
+	if setIdx := c.idxToSet[i]; setIdx >= 0 {
+		return int(setIdx)
+	}
+	for t := range c.prps {
+		setIdx := t*c.setsPerTable() + c.prps[t].Invert(i)/c.SetSize
+		if _, ok := c.replaced[setIdx]; !ok {
+			return setIdx
+		}
+	}
+	// All permutation-defined sets containing i were replaced; use this
+	// opportunity to upgrade invalid pointers while doing a linear scan.
+	found := -1
+	for setIdx, set := range c.replaced {
+		for _, v := range c.randomSetElems(set) {
+			if v == i {
+				found = setIdx
+			}
+			if v < c.NRows && c.idxToSet[v] < 0 {
+				c.idxToSet[v] = int32(setIdx)
+			}
+		}
+	}
+	return found
+}
+
+// Sample a fresh random set of size SetSize that contains i.
+func (c *permClient) randomSetWith(i int) (replacedSet, []int) {
+	set := replacedSet{With: i}
+	io.ReadFull(c.randSource, set.Key[:])
+	return set, c.randomSetElems(set)
+}
+
+// Sample a random element of the set that is not equal to `idx`.
+func (c *permClient) randomMemberExcept(set []int, idx int) int {
+	for {
+		val := set[c.randSource.Intn(len(set))]
+		if val != idx {
+			return val
+		}
+	}
+}
+
+func without(set []int, idx int) []int {
+	out := make([]int, 0, len(set)-1)
+	for _, v := range set {
+		if v != idx {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (c *permClient) replaceSet(setIdx int, newSet replacedSet, newElems []int) {
+	old, ok := c.replaced[setIdx]
+	if c.replacedSets != nil {
+		c.replacedSets = append(c.replacedSets, permReplacedSet{setIdx, old, ok})
+	}
+	if ok {
+		c.clearPointers(setIdx)
+	}
+	c.replaced[setIdx] = newSet
+	for _, v := range newElems {
+		if v < c.NRows {
+			c.idxToSet[v] = int32(setIdx)
+		}
+	}
+}
+
+// clearPointers drops the pointers of the rows of a replaced set to it.
+func (c *permClient) clearPointers(setIdx int) {
+	for _, v := range c.elems(setIdx) {
+		if v < c.NRows && c.idxToSet[v] == int32(setIdx) {
+			c.idxToSet[v] = -1
+		}
+	}
+}
+
+func (c *permClient) recordQueries() func(undo bool) {
+	c.replacedSets = make([]permReplacedSet, 0)
+	return func(undo bool) {
+		replaced := c.replacedSets
+		c.replacedSets = nil
+		for j := len(replaced) - 1; undo && j >= 0; j-- {
+			r := replaced[j]
+			if r.replaced {
+				c.replaceSet(r.setIdx, r.set, c.randomSetElems(r.set))
+			} else {
+				// Back to the set of the permutations, which findSet
+				// finds without pointers.
+				c.clearPointers(r.setIdx)
+				delete(c.replaced, r.setIdx)
+			}
+		}
+	}
+}
+
+func (c *permClient) Query(i int) ([]QueryReq, ReconstructFunc) {
+	return c.queryVerified(i, nil)
+}
+
+func (c *permClient) queryVerified(i int, verify VerifyFunc) ([]QueryReq, ReconstructFunc) {
+	if len(c.hints) < 1 {
+		panic("No stored hints. Did you forget to call InitHint?")
+	}
+
+	ctx := permQueryCtx{index: i, verify: verify}
+	if i < 0 || i >= c.NRows {
+		return nil, nil
+	}
+	if ctx.setIdx = c.findSet(i); ctx.setIdx < 0 {
+		return nil, nil
+	}
+	set := c.elems(ctx.setIdx)
+	newKey, newSet := c.randomSetWith(i)
+
+	var qL, qR PermQueryReq
+	// Same case analysis as in the Punc scheme: with small probability
+	// both servers get punctured versions of the same fresh set, so that
+	// the distribution of each server's view is independent of i.
+	ctx.randCase = c.sample(c.SetSize-1, c.SetSize-1, c.univSize())
+	switch ctx.randCase {
+	case 0:
+		qL = PermQueryReq{Indices: without(newSet, i), ExtraElem: c.randomMemberExcept(newSet, i)}
+		qR = PermQueryReq{Indices: without(set, i), ExtraElem: c.randomMemberExcept(set, i)}
+		c.replaceSet(ctx.setIdx, newKey, newSet)
+	case 1:
+		qR.ExtraElem = c.randomMemberExcept(newSet, i)
+		qL.ExtraElem = c.randomMemberExcept(newSet, qR.ExtraElem)
+		qL.Indices = without(newSet, qR.ExtraElem)
+		qR.Indices = without(newSet, i)
+	case 2:
+		qL.ExtraElem = c.randomMemberExcept(newSet, i)
+		qR.ExtraElem = c.randomMemberExcept(newSet, qL.ExtraElem)
+		qL.Indices = without(newSet, i)
+		qR.Indices = without(newSet, qL.ExtraElem)
+	}
+
+	return []QueryReq{&qL, &qR},
+		func(resps []interface{}) (Row, error) {
+			queryResps := make([]*PermQueryResp, len(resps))
+			var ok bool
+			for i, r := range resps {
+				if queryResps[i], ok = r.(*PermQueryResp); !ok {
+					c.queryFailed(ctx)
+					return nil, fmt.Errorf("Invalid response type: %T, expected: *PermQueryResp", r)
+				}
+			}
+
+			return c.reconstruct(ctx, queryResps)
+		}
+}
+
+// Sample one of three cases with probabilities odd1/total, odd2/total and
+// the remainder, as in puncClient.sample.
+func (c *permClient) sample(odd1 int, odd2 int, total int) int {
+	coin := c.randSource.Intn(total)
+	if coin < odd1 {
+		return 1
+	} else if coin < odd1+odd2 {
+		return 2
+	} else {
+		return 0
+	}
+}
+
+// queryFailed invalidates the set that a query replaced if its hint cannot
+// be updated. Reusing the replaced set would show the right server the
+// same set twice, so the rows of the set stay uncovered until the next
+// hint.
+func (c *permClient) queryFailed(ctx permQueryCtx) {
+	if ctx.randCase == 0 {
+		c.clearPointers(ctx.setIdx)
+		c.replaced[ctx.setIdx] = replacedSet{Invalid: true}
+	}
+}
+
+func (c *permClient) reconstruct(ctx permQueryCtx, resp []*PermQueryResp) (Row, error) {
+	if len(resp) != 2 {
+		c.queryFailed(ctx)
+		return nil, fmt.Errorf("Unexpected number of answers: have: %d, want: 2", len(resp))
+	}
+
+	out := make(Row, c.RowLen)
+	switch ctx.randCase {
+	case 0:
+		hint := c.hints[ctx.setIdx]
+		xorInto(out, hint)
+		xorInto(out, resp[Right].Answer)
+		// A forged row must not get into the hint. The set has already
+		// been replaced, so it is dropped with its hint.
+		if ctx.verify != nil {
+			if err := ctx.verify(ctx.index, out); err != nil {
+				c.queryFailed(ctx)
+				return nil, err
+			}
+		}
+		// Update hint with refresh info
+		xorInto(hint, hint)
+		xorInto(hint, resp[Left].Answer)
+		xorInto(hint, out)
+	case 1:
+		xorInto(out, resp[Left].Answer)
+		xorInto(out, resp[Right].Answer)
+		xorInto(out, resp[Right].ExtraElem)
+	case 2:
+		xorInto(out, resp[Left].Answer)
+		xorInto(out, resp[Right].Answer)
+		xorInto(out, resp[Left].ExtraElem)
+	}
+	if ctx.verify != nil && ctx.randCase != 0 {
+		if err := ctx.verify(ctx.index, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (c *permClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	return c.queryBatchVerified(indices, nil)
+}
+
+func (c *permClient) queryBatchVerified(indices []int, verify VerifyFunc) ([]QueryReq, ReconstructBatchFunc) {
+	return queryBatchSequential(c, indices, verify)
+}
+
+func (c *permClient) DummyQuery() []QueryReq {
+	_, set := c.randomSetWith(0)
+	q := PermQueryReq{Indices: without(set, 0), ExtraElem: c.randomMemberExcept(set, 0)}
+	return []QueryReq{&q, &q}
+}
+
+func (c *permClient) NumCovered() int {
+	covered := 0
+	for i := 0; i < c.NRows; i++ {
+		if c.findSet(i) >= 0 {
+			covered++
+		}
+	}
+	return covered
+}
+
+func (c *permClient) StateSize() (bitsPerKey, fixedBytes int) {
+	fixedBytes = len(c.hints)*c.RowLen + len(c.replaced)*(len(PRGKey{})+4)
+	return int(math.Log2(float64(len(c.hints)))), fixedBytes
+}
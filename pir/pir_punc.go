@@ -8,8 +8,10 @@ import (
 	"math"
 
 	"math/rand"
-
-	"checklist/psetggm"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type puncClient struct {
@@ -26,11 +28,28 @@ type puncClient struct {
 	origSetGen, setGen SetGenerator
 
 	idxToSetIdx []int32
+
+	// Number of sets that contain each row, saturating at math.MaxUint8,
+	// and the number of rows contained in at least one set.
+	coverage   []uint8
+	numCovered int
+
+	// Sets replaced since recordQueries, with their index, or nil.
+	replacedSets []puncReplacedSet
+
+	// Sets whose hint no longer matches them, which cover no rows.
+	invalid map[int]bool
+}
+
+type puncReplacedSet struct {
+	setIdx int
+	set    PuncturableSet
 }
 
 type PuncHintReq struct {
 	RandSeed           PRGKey
 	NumHintsMultiplier int
+	SetSizeExponent    float64
 }
 
 type PuncHintResp struct {
@@ -45,14 +64,21 @@ func xorRowsFlatSlice(db *StaticDB, out []byte, indices Set) {
 	for i := range indices {
 		indices[i] *= db.RowLen
 	}
-	psetggm.XorBlocks(db.FlatDb, indices, out)
+	xorBlocks(db.FlatDb, indices, out)
 
 }
 
 func NewPuncHintReq(randSource *rand.Rand) *PuncHintReq {
+	return NewPuncHintReqWithParams(randSource, DefaultPuncParams())
+}
+
+// NewPuncHintReqWithParams returns a request for a hint with the given
+// parameters. See PuncParams.Cost for their costs.
+func NewPuncHintReqWithParams(randSource *rand.Rand, params PuncParams) *PuncHintReq {
 	req := &PuncHintReq{
 		RandSeed:           PRGKey{},
-		NumHintsMultiplier: int(float64(SecParam) * math.Log(2)),
+		NumHintsMultiplier: params.NumHintsMultiplier,
+		SetSizeExponent:    params.SetSizeExponent,
 	}
 	_, err := io.ReadFull(randSource, req.RandSeed[:])
 	if err != nil {
@@ -61,18 +87,53 @@ func NewPuncHintReq(randSource *rand.Rand) *PuncHintReq {
 	return req
 }
 
+func (req *PuncHintReq) params() PuncParams {
+	return PuncParams{SetSizeExponent: req.SetSizeExponent, NumHintsMultiplier: req.NumHintsMultiplier}
+}
+
+// Number of goroutines that generate Punc hints, read and written
+// atomically.
+var hintWorkers = int32(runtime.GOMAXPROCS(0))
+
+// SetHintWorkers sets the number of goroutines that generate Punc hints.
+// It may be called while hints are generated, which keep the number they
+// started with.
+func SetHintWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&hintWorkers, int32(n))
+}
+
+func numHintWorkers() int {
+	return int(atomic.LoadInt32(&hintWorkers))
+}
+
 func (req *PuncHintReq) Process(db StaticDB) (HintResp, error) {
-	setSize := int(math.Round(math.Pow(float64(db.NumRows), 0.5)))
-	nHints := req.NumHintsMultiplier * db.NumRows / setSize
+	if err := validateNonEmpty(db); err != nil {
+		return nil, err
+	}
+	params := req.params()
+	if err := params.validate(db); err != nil {
+		return nil, err
+	}
+	setSize := params.SetSize(db.NumRows)
+	nHints := params.NumHints(db.NumRows)
 
 	hints := make([]Row, nHints)
 	hintBuf := make([]byte, db.RowLen*nHints)
-	setGen := NewSetGenerator(req.RandSeed, 0, db.NumRows, setSize)
-	var pset PuncturableSet
-	for i := 0; i < nHints; i++ {
-		setGen.Gen(&pset)
+	for i := range hints {
 		hints[i] = Row(hintBuf[db.RowLen*i : db.RowLen*(i+1)])
-		xorRowsFlatSlice(&db, hints[i], pset.elems)
+	}
+	if workers := numHintWorkers(); workers == 1 {
+		setGen := NewSetGenerator(req.RandSeed, 0, db.NumRows, setSize)
+		var pset PuncturableSet
+		for i := 0; i < nHints; i++ {
+			setGen.Gen(&pset)
+			xorRowsFlatSlice(&db, hints[i], pset.elems)
+		}
+	} else {
+		puncHintsParallel(&db, req.RandSeed, setSize, hints, workers)
 	}
 
 	return &PuncHintResp{
@@ -84,6 +145,52 @@ func (req *PuncHintReq) Process(db StaticDB) (HintResp, error) {
 	}, nil
 }
 
+// puncHintsParallel computes the same hints as sequential generation.
+// Since the set generator skips set ids whose elements are not distinct,
+// the number of ids that are needed is not known upfront. The workers
+// process consecutive chunks of set ids in rounds, each with a generator
+// that starts at the first id of its chunk, and the hints of the chunks are
+// concatenated in order until there are enough of them.
+func puncHintsParallel(db *StaticDB, seed PRGKey, setSize int, hints []Row, workers int) {
+	if db.RowLen == 0 {
+		return
+	}
+	chunkSize := (len(hints)-1)/(8*workers) + 1
+
+	done := 0
+	for chunkStart := 0; done < len(hints); chunkStart += workers * chunkSize {
+		chunks := make([][]byte, workers)
+		var wg sync.WaitGroup
+		for w := range chunks {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				start := uint32(chunkStart + w*chunkSize)
+				end := start + uint32(chunkSize)
+				setGen := NewSetGenerator(seed, start, db.NumRows, setSize)
+				var pset PuncturableSet
+				for {
+					setGen.Gen(&pset)
+					if pset.id >= end {
+						return
+					}
+					hint := make([]byte, db.RowLen)
+					xorRowsFlatSlice(db, hint, pset.elems)
+					chunks[w] = append(chunks[w], hint...)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for _, chunk := range chunks {
+			for ; len(chunk) > 0 && done < len(hints); done++ {
+				copy(hints[done], chunk[:db.RowLen])
+				chunk = chunk[db.RowLen:]
+			}
+		}
+	}
+}
+
 func dbElem(db StaticDB, i int) Row {
 	if i < db.NumRows {
 		return db.Row(i)
@@ -109,12 +216,78 @@ func (resp *PuncHintResp) NumRows() int {
 	return resp.NRows
 }
 
+type puncClientState struct {
+	NRows       int
+	RowLen      int
+	SetSize     int
+	SetIds      []uint32
+	SetShifts   []uint32
+	Hints       []Row
+	OrigSetGen  setGenState
+	SetGen      setGenState
+	IdxToSetIdx []int32
+	InvalidSets []int
+}
+
+func (c *puncClient) MarshalBinary() ([]byte, error) {
+	state := puncClientState{
+		NRows:       c.nRows,
+		RowLen:      c.RowLen,
+		SetSize:     c.setSize,
+		SetIds:      make([]uint32, len(c.sets)),
+		SetShifts:   make([]uint32, len(c.sets)),
+		Hints:       c.hints,
+		OrigSetGen:  c.origSetGen.state(),
+		SetGen:      c.setGen.state(),
+		IdxToSetIdx: c.idxToSetIdx,
+	}
+	for i, key := range c.sets {
+		state.SetIds[i], state.SetShifts[i] = key.id, key.shift
+	}
+	for setIdx := range c.invalid {
+		state.InvalidSets = append(state.InvalidSets, setIdx)
+	}
+	return gobEncode(&state)
+}
+
+func (c *puncClient) UnmarshalBinary(data []byte) error {
+	var state puncClientState
+	if err := gobDecode(data, &state); err != nil {
+		return err
+	}
+	if len(state.SetIds) != len(state.Hints) || len(state.SetShifts) != len(state.Hints) {
+		return fmt.Errorf("Inconsistent number of sets and hints: %d, %d", len(state.SetIds), len(state.Hints))
+	}
+	c.nRows = state.NRows
+	c.RowLen = state.RowLen
+	c.setSize = state.SetSize
+	c.hints = state.Hints
+	c.origSetGen = state.OrigSetGen.generator()
+	c.setGen = state.SetGen.generator()
+	c.idxToSetIdx = state.IdxToSetIdx
+	c.sets = make([]SetKey, len(state.SetIds))
+	for i := range c.sets {
+		c.sets[i] = SetKey{id: state.SetIds[i], shift: state.SetShifts[i]}
+	}
+	c.invalid = nil
+	for _, setIdx := range state.InvalidSets {
+		if setIdx < 0 || setIdx >= len(c.sets) {
+			return fmt.Errorf("Invalid set %d out of bounds [0:%d)", setIdx, len(c.sets))
+		}
+		c.markInvalid(setIdx)
+	}
+	c.initCoverage()
+	return nil
+}
+
 func (c *puncClient) initSets() {
 	c.sets = make([]SetKey, len(c.hints))
 	c.idxToSetIdx = make([]int32, c.nRows)
 	for i := range c.idxToSetIdx {
 		c.idxToSetIdx[i] = -1
 	}
+	c.coverage = make([]uint8, c.nRows)
+	c.numCovered = 0
 	var pset PuncturableSet
 	for i := 0; i < len(c.hints); i++ {
 		c.origSetGen.Gen(&pset)
@@ -122,6 +295,7 @@ func (c *puncClient) initSets() {
 		for _, j := range pset.elems {
 			c.idxToSetIdx[j] = int32(i)
 		}
+		c.cover(pset.elems)
 	}
 
 	// Use a separate set generator with a new key for all future sets
@@ -160,6 +334,9 @@ func (c *puncClient) findIndex(i int) (setIdx int) {
 	var pset PuncturableSet
 	// If set pointer of i is invalid, use this opportunity to upgrade other invalid pointers while doing linear scan
 	for j := range c.sets {
+		if c.invalid[j] {
+			continue
+		}
 		setGen := c.setGenForSet(j)
 		setKeyNoShift := c.sets[j]
 		shift := setKeyNoShift.shift
@@ -194,14 +371,20 @@ type PuncQueryResp struct {
 type puncQueryCtx struct {
 	randCase int
 	setIdx   int
+	index    int
+	verify   VerifyFunc
 }
 
 func (c *puncClient) Query(i int) ([]QueryReq, ReconstructFunc) {
+	return c.queryVerified(i, nil)
+}
+
+func (c *puncClient) queryVerified(i int, verify VerifyFunc) ([]QueryReq, ReconstructFunc) {
 	if len(c.hints) < 1 {
 		panic("No stored hints. Did you forget to call InitHint?")
 	}
 
-	var ctx puncQueryCtx
+	ctx := puncQueryCtx{index: i, verify: verify}
 
 	if ctx.setIdx = c.findIndex(i); ctx.setIdx < 0 {
 		return nil, nil
@@ -246,6 +429,7 @@ func (c *puncClient) Query(i int) ([]QueryReq, ReconstructFunc) {
 			var ok bool
 			for i, r := range resps {
 				if queryResps[i], ok = r.(*PuncQueryResp); !ok {
+					c.queryFailed(ctx)
 					return nil, fmt.Errorf("Invalid response type: %T, expected: *PuncQueryResp", r)
 				}
 			}
@@ -272,16 +456,100 @@ func (c *puncClient) setGenForSet(setIdx int) *SetGenerator {
 
 func (c *puncClient) replaceSet(setIdx int, newSet PuncturableSet) {
 	pset := c.eval(setIdx)
+	if c.replacedSets != nil {
+		c.replacedSets = append(c.replacedSets, puncReplacedSet{setIdx, pset})
+	}
 	for _, idx := range pset.elems {
 		if idx < c.nRows && c.idxToSetIdx[idx] == int32(setIdx) {
 			c.idxToSetIdx[idx] = -1
 		}
 	}
+	c.uncover(pset.elems)
 
 	c.sets[setIdx] = newSet.SetKey
 	for _, v := range newSet.elems {
 		c.idxToSetIdx[v] = int32(setIdx)
 	}
+	c.cover(newSet.elems)
+}
+
+// invalidateSet drops a set whose hint could not be updated after a query
+// replaced it. Reusing the replaced set would show the right server the
+// same set twice, so the rows of the set stay uncovered until the next
+// hint.
+func (c *puncClient) invalidateSet(setIdx int) {
+	for _, idx := range c.eval(setIdx).elems {
+		if idx < c.nRows && c.idxToSetIdx[idx] == int32(setIdx) {
+			c.idxToSetIdx[idx] = -1
+		}
+	}
+	c.uncover(c.eval(setIdx).elems)
+	c.markInvalid(setIdx)
+}
+
+func (c *puncClient) markInvalid(setIdx int) {
+	if c.invalid == nil {
+		c.invalid = make(map[int]bool)
+	}
+	c.invalid[setIdx] = true
+}
+
+func (c *puncClient) recordQueries() func(undo bool) {
+	c.replacedSets = make([]puncReplacedSet, 0)
+	return func(undo bool) {
+		replaced := c.replacedSets
+		c.replacedSets = nil
+		for j := len(replaced) - 1; undo && j >= 0; j-- {
+			c.replaceSet(replaced[j].setIdx, replaced[j].set)
+		}
+	}
+}
+
+// initCoverage recomputes the coverage counts from the current sets.
+func (c *puncClient) initCoverage() {
+	c.coverage = make([]uint8, c.nRows)
+	c.numCovered = 0
+	for j := range c.sets {
+		if !c.invalid[j] {
+			c.cover(c.eval(j).elems)
+		}
+	}
+}
+
+func (c *puncClient) cover(elems Set) {
+	for _, idx := range elems {
+		if idx >= c.nRows || c.coverage[idx] == math.MaxUint8 {
+			continue
+		}
+		if c.coverage[idx] == 0 {
+			c.numCovered++
+		}
+		c.coverage[idx]++
+	}
+}
+
+func (c *puncClient) uncover(elems Set) {
+	for _, idx := range elems {
+		// A saturated count no longer tracks the exact number of sets, so
+		// conservatively treat the row as covered forever. With the
+		// default parameters this practically never happens.
+		if idx >= c.nRows || c.coverage[idx] == math.MaxUint8 {
+			continue
+		}
+		c.coverage[idx]--
+		if c.coverage[idx] == 0 {
+			c.numCovered--
+		}
+	}
+}
+
+func (c *puncClient) HintStatus() HintStatus {
+	return HintStatus{
+		NumRows:     c.nRows,
+		NumHints:    len(c.hints),
+		NumCovered:  c.numCovered,
+		FailureProb: float64(c.nRows-c.numCovered) / float64(c.nRows),
+	}
 }
 
 func (c *puncClient) DummyQuery() []QueryReq {
@@ -293,16 +561,106 @@ func (c *puncClient) DummyQuery() []QueryReq {
 }
 
 func (q *PuncQueryReq) Process(db StaticDB) (interface{}, error) {
+	if err := q.validate(db); err != nil {
+		return nil, err
+	}
 	resp := PuncQueryResp{Answer: make(Row, db.RowLen)}
-	psetggm.FastAnswer(q.PuncturedSet.Keys, q.PuncturedSet.Hole, q.PuncturedSet.UnivSize, q.PuncturedSet.SetSize, int(q.PuncturedSet.Shift),
-		db.FlatDb, db.RowLen, resp.Answer)
+	if numAnswerThreads() == 1 {
+		fastAnswer(q.PuncturedSet.Keys, q.PuncturedSet.Hole, q.PuncturedSet.UnivSize, q.PuncturedSet.SetSize, int(q.PuncturedSet.Shift),
+			db.FlatDb, db.RowLen, resp.Answer)
+	} else {
+		offsets := q.PuncturedSet.Eval()
+		for i := range offsets {
+			offsets[i] *= db.RowLen
+		}
+		parallelXor(len(offsets), 1, resp.Answer, func(start, end int, out []byte) {
+			xorBlocks(db.FlatDb, offsets[start:end], out)
+		})
+	}
 	resp.ExtraElem = db.FlatDb[db.RowLen*q.ExtraElem : db.RowLen*q.ExtraElem+db.RowLen]
 
 	return &resp, nil
 }
 
+// PuncBatchQueryReq holds several Punc queries to the same server.
+type PuncBatchQueryReq struct {
+	Queries []PuncQueryReq
+}
+
+type PuncBatchQueryResp struct {
+	Resps []PuncQueryResp
+}
+
+// Process answers all queries in the batch with a single pass over the
+// database, in increasing row order.
+func (q *PuncBatchQueryReq) Process(db StaticDB) (interface{}, error) {
+	type access struct {
+		row, query int
+	}
+	for j := range q.Queries {
+		if err := q.Queries[j].validate(db); err != nil {
+			return nil, fmt.Errorf("query %d: %w", j, err)
+		}
+	}
+	var accesses []access
+	resp := PuncBatchQueryResp{Resps: make([]PuncQueryResp, len(q.Queries))}
+	for j := range q.Queries {
+		for _, row := range q.Queries[j].PuncturedSet.Eval() {
+			accesses = append(accesses, access{row, j})
+		}
+		resp.Resps[j].Answer = make(Row, db.RowLen)
+		resp.Resps[j].ExtraElem = db.Row(q.Queries[j].ExtraElem)
+	}
+	sort.Slice(accesses, func(i, j int) bool { return accesses[i].row < accesses[j].row })
+
+	for _, a := range accesses {
+		if a.row < db.NumRows {
+			xorInto(resp.Resps[a.query].Answer, db.Row(a.row))
+		}
+	}
+	return &resp, nil
+}
+
+func (c *puncClient) QueryBatch(indices []int) ([]QueryReq, ReconstructBatchFunc) {
+	return c.queryBatchVerified(indices, nil)
+}
+
+func (c *puncClient) queryBatchVerified(indices []int, verify VerifyFunc) ([]QueryReq, ReconstructBatchFunc) {
+	queries, recons := queryEach(c, indices, verify)
+	if recons == nil {
+		return nil, nil
+	}
+	batchL, batchR := new(PuncBatchQueryReq), new(PuncBatchQueryReq)
+	for _, q := range queries {
+		batchL.Queries = append(batchL.Queries, *q[Left].(*PuncQueryReq))
+		batchR.Queries = append(batchR.Queries, *q[Right].(*PuncQueryReq))
+	}
+	return []QueryReq{batchL, batchR}, func(resps []interface{}) ([]Row, error) {
+		return reconstructEach(recons, resps, func(resp interface{}) ([]interface{}, error) {
+			batchResp, ok := resp.(*PuncBatchQueryResp)
+			if !ok {
+				return nil, fmt.Errorf("Invalid response type: %T, expected: *PuncBatchQueryResp", resp)
+			}
+			out := make([]interface{}, len(batchResp.Resps))
+			for j := range batchResp.Resps {
+				out[j] = &batchResp.Resps[j]
+			}
+			return out, nil
+		})
+	}
+}
+
+// queryFailed invalidates the set that a query replaced if its hint cannot
+// be updated.
+func (c *puncClient) queryFailed(ctx puncQueryCtx) {
+	if ctx.randCase == 0 {
+		c.invalidateSet(ctx.setIdx)
+	}
+}
+
 func (c *puncClient) reconstruct(ctx puncQueryCtx, resp []*PuncQueryResp) (Row, error) {
 	if len(resp) != 2 {
+		c.queryFailed(ctx)
 		return nil, fmt.Errorf("Unexpected number of answers: have: %d, want: 2", len(resp))
 	}
 
@@ -316,6 +674,14 @@ func (c *puncClient) reconstruct(ctx puncQueryCtx, resp []*PuncQueryResp) (Row,
 		hint := c.hints[ctx.setIdx]
 		xorInto(out, hint)
 		xorInto(out, resp[Right].Answer)
+		// A forged row must not get into the hint. The set has already
+		// been replaced, so it is dropped with its hint.
+		if ctx.verify != nil {
+			if err := ctx.verify(ctx.index, out); err != nil {
+				c.queryFailed(ctx)
+				return nil, err
+			}
+		}
 		// Update hint with refresh info
 		xorInto(hint, hint)
 		xorInto(hint, resp[Left].Answer)
@@ -331,12 +697,20 @@ func (c *puncClient) reconstruct(ctx puncQueryCtx, resp []*PuncQueryResp) (Row,
 		xorInto(out, resp[Right].Answer)
 		xorInto(out, resp[Left].ExtraElem)
 	}
+	if ctx.verify != nil && ctx.randCase != 0 {
+		if err := ctx.verify(ctx.index, out); err != nil {
+			return nil, err
+		}
+	}
 	return out, nil
 }
 
 func (c *puncClient) NumCovered() int {
 	covered := make(map[int]bool)
 	for j := range c.sets {
+		if c.invalid[j] {
+			continue
+		}
 		for _, elem := range c.eval(j).elems {
 			covered[elem] = true
 		}
@@ -359,5 +733,10 @@ func (c *puncClient) randomMemberExcept(set PuncturableSet, idx int) int {
 }
 
 func (c *puncClient) StateSize() (bitsPerKey, fixedBytes int) {
-	return int(math.Log2(float64(len(c.hints)))), len(c.hints) * c.RowLen
+	return puncStateSize(len(c.hints), c.RowLen)
+}
+
+func puncStateSize(numHints, rowLen int) (bitsPerKey, fixedBytes int) {
+	// Set pointer and coverage count of every row.
+	return int(math.Log2(float64(numHints))) + 8, numHints * rowLen
 }
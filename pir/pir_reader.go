@@ -1,8 +1,13 @@
 package pir
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
+	"sync"
+	"time"
 )
 
 //go:generate enumer -type=PirType
@@ -15,6 +20,7 @@ const (
 	Perm
 	DPF
 	NonPrivate
+	LWE
 )
 
 type Server interface {
@@ -28,56 +34,259 @@ func NewHintReq(source *rand.Rand, pirType PirType) HintReq {
 		return NewMatrixHintReq()
 	case Punc:
 		return NewPuncHintReq(source)
+	case Perm:
+		return NewPermHintReq(source)
 	case DPF:
 		return NewDPFHintReq()
 	case NonPrivate:
 		return NewNonPrivateHintReq()
+	case LWE:
+		return NewLWEHintReq()
 	}
 	panic(fmt.Sprintf("Unknown PIR Type: %d", pirType))
 }
 
+// NumServers returns the number of non-colluding servers that the scheme
+// sends queries to.
+func NumServers(pirType PirType) int {
+	if pirType == LWE {
+		return 1
+	}
+	return 2
+}
+
 type PIRReader interface {
 	Init(pirType PirType) error
 	Read(i int) (Row, error)
+	ReadBatch(indices []int) ([]Row, error)
+	// HintStatus reports how much of the database the current hint covers.
+	HintStatus() HintStatus
+	// SetRefreshThreshold sets the failure probability above which the
+	// reader fetches a fresh hint in the background.
+	SetRefreshThreshold(failureProb float64)
+	// SetRefreshInterval sets the schedule of the background refreshes,
+	// which happen at multiples of interval since the zero time.
+	SetRefreshInterval(interval time.Duration)
 }
 
+// DefaultRefreshThreshold is the default failure probability of a lookup
+// above which a reader starts fetching a fresh hint.
+const DefaultRefreshThreshold = 1e-3
+
+// DefaultRefreshInterval is the default schedule of background refreshes.
+const DefaultRefreshInterval = time.Minute
+
+// ErrNotCovered is returned by reads of rows that the hint of the reader
+// does not cover. Fetching a hint just before the query would tell the
+// server that the row is not covered, so the row can only be read after
+// the next scheduled refresh.
+var ErrNotCovered = errors.New("row not covered by the hint")
+
+// A pirReader is not safe for concurrent reads, but its hint is refreshed
+// in the background.
 type pirReader struct {
-	impl       Client
-	servers    [2]Server
+	// Guards all fields below, and the use of the client. It is not held
+	// while waiting for the servers.
+	mu sync.Mutex
+
+	impl    Client
+	servers []Server
+	// Collusion threshold for schemes with more than two servers,
+	// or 0 to use the scheme's default number of servers.
+	threshold  int
 	randSource *rand.Rand
+	// If set, rows are verified against their signatures.
+	verifyKey ed25519.PublicKey
+
+	pirType PirType
+	numRows int
+	// Set if the client's hint is consumed by queries.
+	tracker          HintTracker
+	refreshThreshold float64
+	refreshInterval  time.Duration
+	// Set while a refresh is scheduled or fetching a hint.
+	refreshTimer *time.Timer
+	refreshing   sync.WaitGroup
 }
 
 func NewPIRReader(source *rand.Rand, serverL, serverR Server) PIRReader {
-	return &pirReader{servers: [2]Server{serverL, serverR}, randSource: source}
+	return &pirReader{
+		servers:          []Server{serverL, serverR},
+		randSource:       source,
+		refreshThreshold: DefaultRefreshThreshold,
+		refreshInterval:  DefaultRefreshInterval,
+	}
 }
 
 func (c *pirReader) Init(pirType PirType) error {
+	c.mu.Lock()
+	c.pirType = pirType
 	req := NewHintReq(c.randSource, pirType)
+	c.mu.Unlock()
+	hintResp, err := c.fetchHint(req)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.initClient(hintResp)
+}
+
+func (c *pirReader) fetchHint(req HintReq) (HintResp, error) {
 	var hintResp HintResp
 	if err := c.servers[Left].Hint(req, &hintResp); err != nil {
-		return err
+		return nil, err
+	}
+	return hintResp, nil
+}
+
+func (c *pirReader) initClient(hintResp HintResp) error {
+	if c.threshold == 0 {
+		c.impl = hintResp.InitClient(c.randSource)
+	} else {
+		multi, ok := hintResp.(MultiServerHintResp)
+		if !ok {
+			return fmt.Errorf("PIR type %s does not support more than two servers", c.pirType)
+		}
+		var err error
+		if c.impl, err = multi.InitMultiServerClient(c.randSource, len(c.servers), c.threshold); err != nil {
+			return err
+		}
+	}
+	c.numRows = hintResp.NumRows()
+	c.tracker, _ = c.impl.(HintTracker)
+	if c.verifyKey != nil {
+		c.impl = NewVerifyingClient(c.impl, c.verifyKey)
 	}
-	c.impl = hintResp.InitClient(c.randSource)
 	return nil
 }
 
-func (c pirReader) Read(i int) (Row, error) {
+func (c *pirReader) HintStatus() HintStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tracker != nil {
+		return c.tracker.HintStatus()
+	}
+	return HintStatus{NumRows: c.numRows, NumCovered: c.numRows}
+}
+
+func (c *pirReader) SetRefreshThreshold(failureProb float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshThreshold = failureProb
+}
+
+func (c *pirReader) SetRefreshInterval(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshInterval = interval
+}
+
+// scheduleRefresh schedules fetching a fresh hint at the next multiple of
+// the refresh interval, rather than when a query needs it, so that the
+// server cannot link the hint request to a query. Must be called with c.mu
+// held.
+func (c *pirReader) scheduleRefresh() {
+	if c.refreshTimer != nil {
+		return
+	}
+	now := time.Now()
+	next := now.Truncate(c.refreshInterval).Add(c.refreshInterval)
+	c.refreshing.Add(1)
+	c.refreshTimer = time.AfterFunc(next.Sub(now), c.refresh)
+}
+
+func (c *pirReader) refresh() {
+	defer c.refreshing.Done()
+	c.mu.Lock()
+	req := NewHintReq(c.randSource, c.pirType)
+	c.mu.Unlock()
+	hintResp, err := c.fetchHint(req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshTimer = nil
+	if err == nil {
+		err = c.initClient(hintResp)
+	}
+	if err != nil {
+		log.Printf("Failed to refresh hint: %v", err)
+	}
+}
+
+// query generates a query with the current client. A refresh is scheduled
+// if lookups with the hint fail too often, or if this one failed. Must be
+// called with c.mu held.
+func (c *pirReader) query(gen func() ([]QueryReq, bool)) ([]QueryReq, error) {
 	if c.impl == nil {
 		return nil, fmt.Errorf("Did you forget to call Init?")
 	}
-	queryReq, reconstructFunc := c.impl.Query(i)
+	queryReq, ok := gen()
+	if c.tracker != nil && (!ok || c.tracker.HintStatus().FailureProb > c.refreshThreshold) {
+		c.scheduleRefresh()
+	}
+	if !ok && c.tracker != nil {
+		return nil, ErrNotCovered
+	}
+	return queryReq, nil
+}
+
+func (c *pirReader) Read(i int) (Row, error) {
+	c.mu.Lock()
+	var reconstructFunc ReconstructFunc
+	queryReq, err := c.query(func() (q []QueryReq, ok bool) {
+		q, reconstructFunc = c.impl.Query(i)
+		return q, reconstructFunc != nil
+	})
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 	if reconstructFunc == nil {
 		return nil, fmt.Errorf("Failed to query: %d", i)
 	}
-	responses := make([]interface{}, 2)
-	err := c.servers[Left].Answer(queryReq[Left], &responses[Left])
+	responses, err := c.answer(queryReq)
 	if err != nil {
 		return nil, err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return reconstructFunc(responses)
+}
 
-	err = c.servers[Right].Answer(queryReq[Right], &responses[Right])
+func (c *pirReader) ReadBatch(indices []int) ([]Row, error) {
+	c.mu.Lock()
+	var reconstructFunc ReconstructBatchFunc
+	queryReq, err := c.query(func() (q []QueryReq, ok bool) {
+		q, reconstructFunc = c.impl.QueryBatch(indices)
+		return q, reconstructFunc != nil
+	})
+	c.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	if reconstructFunc == nil {
+		return nil, fmt.Errorf("Failed to query: %v", indices)
+	}
+	responses, err := c.answer(queryReq)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return reconstructFunc(responses)
 }
+
+// answer sends the s-th request to the s-th server. Single-server schemes
+// generate just one request.
+func (c *pirReader) answer(queryReq []QueryReq) ([]interface{}, error) {
+	if len(queryReq) > len(c.servers) {
+		return nil, fmt.Errorf("Query needs %d servers, have: %d", len(queryReq), len(c.servers))
+	}
+	responses := make([]interface{}, len(queryReq))
+	for s := range queryReq {
+		if err := c.servers[s].Answer(queryReq[s], &responses[s]); err != nil {
+			return nil, err
+		}
+	}
+	return responses, nil
+}
@@ -1,9 +1,17 @@
 package pir
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/dkales/dpf-go/dpf"
 	"gotest.tools/assert"
 )
 
@@ -26,6 +34,43 @@ func TestPIRPunc(t *testing.T) {
 
 }
 
+func TestPIRPerm(t *testing.T) {
+	db := MakeDB(1000, 100)
+
+	client := NewPIRReader(RandSource(), Server(db), Server(db))
+
+	err := client.Init(Perm)
+	assert.NilError(t, err)
+
+	for i := 0; i < 50; i++ {
+		val, err := client.Read(i * 17)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, db.Row(i*17))
+	}
+
+	// Test refreshing by reading the same item again
+	val, err := client.Read(0x7)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, db.Row(7))
+	val, err = client.Read(0x7)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, db.Row(7))
+}
+
+func TestFeistelPRP(t *testing.T) {
+	for _, bits := range []uint{1, 4, 7} {
+		prp := newFeistelPRP(masterKey[:], bits)
+		seen := make(map[int]bool)
+		for x := 0; x < 1<<bits; x++ {
+			y := prp.Permute(x)
+			assert.Assert(t, y >= 0 && y < 1<<bits)
+			assert.Assert(t, !seen[y])
+			seen[y] = true
+			assert.Equal(t, prp.Invert(y), x)
+		}
+	}
+}
+
 func TestMatrix(t *testing.T) {
 	db := MakeDB(10000, 4)
 
@@ -37,6 +82,14 @@ func TestMatrix(t *testing.T) {
 	val, err := client.Read(0x7)
 	assert.NilError(t, err)
 	assert.DeepEqual(t, val, db.Row(7))
+
+	// Short answers from the servers are an error.
+	hint, err := NewMatrixHintReq().Process(db)
+	assert.NilError(t, err)
+	c := hint.InitClient(RandSource()).(*matrixClient)
+	short := &MatrixQueryResp{Answer: make([]byte, c.rowLen)}
+	_, err = c.reconstruct(c.width-1, []*MatrixQueryResp{short, short})
+	assert.ErrorContains(t, err, "Answer too short")
 }
 
 func TestDPF(t *testing.T) {
@@ -52,6 +105,43 @@ func TestDPF(t *testing.T) {
 	assert.DeepEqual(t, val, db.Row(128))
 }
 
+func TestLWE(t *testing.T) {
+	db := MakeDB(1000, 32)
+
+	// Single-server scheme: the second server is never contacted.
+	client := NewPIRReader(RandSource(), Server(db), nil)
+
+	err := client.Init(LWE)
+	assert.NilError(t, err)
+
+	for _, i := range []int{0, 17, 500, 999} {
+		val, err := client.Read(i)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, db.Row(i))
+	}
+}
+
+func TestLWEHintShared(t *testing.T) {
+	db := MakeDB(100, 16)
+	resp1, err := NewLWEHintReq().Process(db)
+	assert.NilError(t, err)
+	resp2, err := NewLWEHintReq().Process(db)
+	assert.NilError(t, err)
+	// The server computes the hint once for all clients of a database.
+	assert.Equal(t, resp1, resp2)
+
+	changed := MakeDB(100, 16)
+	resp3, err := NewLWEHintReq().Process(changed)
+	assert.NilError(t, err)
+	assert.Assert(t, resp3.(*LWEHintResp).Seed != resp1.(*LWEHintResp).Seed)
+
+	client := NewPIRReader(RandSource(), Server(changed), nil)
+	assert.NilError(t, client.Init(LWE))
+	val, err := client.Read(42)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, changed.Row(42))
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func randStringBytes(r *rand.Rand, n int) string {
@@ -76,3 +166,634 @@ func TestSample(t *testing.T) {
 		assert.Check(t, c > 280)
 	}
 }
+
+func TestReadBatch(t *testing.T) {
+	db := MakeDB(1000, 32)
+	indices := []int{3, 999, 500, 3, 0, 77}
+
+	for _, pirType := range []PirType{Punc, Perm, Matrix, DPF, NonPrivate, LWE} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			client := NewPIRReader(RandSource(), Server(db), Server(db))
+			assert.NilError(t, client.Init(pirType))
+
+			for iter := 0; iter < 3; iter++ {
+				vals, err := client.ReadBatch(indices)
+				assert.NilError(t, err)
+				assert.Equal(t, len(vals), len(indices))
+				for j, idx := range indices {
+					assert.DeepEqual(t, vals[j], db.Row(idx))
+				}
+			}
+		})
+	}
+}
+
+func TestReadBatchFailure(t *testing.T) {
+	db := MakeDB(1000, 32)
+	indices := make([]int, 50)
+	for j := range indices {
+		indices[j] = j * 20
+	}
+
+	// The queries of these schemes replace the sets of their hints.
+	for _, pirType := range []PirType{Punc, Perm} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			client := NewPIRReader(RandSource(), Server(db), Server(db))
+			assert.NilError(t, client.Init(pirType))
+
+			// A bad index last fails the batch without using up the
+			// hints of the indices before it.
+			_, err := client.ReadBatch(append(indices, db.NumRows))
+			assert.Assert(t, err != nil)
+			for _, idx := range indices {
+				val, err := client.Read(idx)
+				assert.NilError(t, err)
+				assert.DeepEqual(t, val, db.Row(idx))
+			}
+		})
+	}
+}
+
+// tamperingServer computes hints honestly but answers queries over a
+// database with one corrupted byte in every row.
+type tamperingServer struct {
+	StaticDB
+	tampered StaticDB
+}
+
+func (s tamperingServer) Answer(q QueryReq, resp *interface{}) error {
+	return s.tampered.Answer(q, resp)
+}
+
+// tamperedDB returns a copy of db with random bytes at the start of every
+// row, so that parities of rows differ from the honest ones too.
+func tamperedDB(db StaticDB) StaticDB {
+	tampered := StaticDB{db.NumRows, db.RowLen, append([]byte(nil), db.FlatDb...)}
+	source := RandSource()
+	for i := 0; i < tampered.NumRows; i++ {
+		source.Read(tampered.Row(i)[:8])
+	}
+	return tampered
+}
+
+func TestIntegrity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(RandSource())
+	assert.NilError(t, err)
+	rows := MakeRows(RandSource(), 1000, 32)
+	db := *NewAuthenticatedDB(rows, priv)
+	assert.Equal(t, db.RowLen, 32+TagLen)
+
+	tampered := tamperedDB(db)
+	bad := tamperingServer{db, tampered}
+
+	for _, pirType := range []PirType{Punc, Perm, Matrix, DPF, LWE} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			client := NewVerifyingPIRReader(RandSource(), Server(db), Server(db), pub)
+			assert.NilError(t, client.Init(pirType))
+			val, err := client.Read(17)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, val, rows[17])
+			vals, err := client.ReadBatch([]int{3, 999})
+			assert.NilError(t, err)
+			assert.DeepEqual(t, vals, []Row{rows[3], rows[999]})
+
+			client = NewVerifyingPIRReader(RandSource(), bad, bad, pub)
+			assert.NilError(t, client.Init(pirType))
+			_, err = client.Read(17)
+			assert.Assert(t, errors.Is(err, ErrVerification), "got error: %v", err)
+			_, err = client.ReadBatch([]int{3, 999})
+			assert.Assert(t, errors.Is(err, ErrVerification), "got error: %v", err)
+		})
+	}
+}
+
+// Rows that fail verification must not be folded into the hint.
+func TestIntegrityKeepsHint(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(RandSource())
+	assert.NilError(t, err)
+	db := *NewAuthenticatedDB(MakeRows(RandSource(), 1000, 32), priv)
+	tampered := tamperedDB(db)
+
+	for _, pirType := range []PirType{Punc, Perm} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			hintResp, err := NewHintReq(RandSource(), pirType).Process(db)
+			assert.NilError(t, err)
+			client := hintResp.InitClient(RandSource())
+			var hints []Row
+			switch c := client.(type) {
+			case *puncClient:
+				hints = c.hints
+			case *permClient:
+				hints = c.hints
+			}
+			saved := make([]Row, len(hints))
+			for j := range hints {
+				saved[j] = append(Row(nil), hints[j]...)
+			}
+
+			verifying := NewVerifyingClient(client, pub)
+			for i := 0; i < 50; i++ {
+				queryReq, reconstructFunc := verifying.Query(i)
+				assert.Assert(t, reconstructFunc != nil)
+				resps := make([]interface{}, len(queryReq))
+				assert.NilError(t, db.Answer(queryReq[Left], &resps[Left]))
+				assert.NilError(t, tampered.Answer(queryReq[Right], &resps[Right]))
+				_, err := reconstructFunc(resps)
+				assert.Assert(t, errors.Is(err, ErrVerification), "got error: %v", err)
+			}
+			assert.DeepEqual(t, hints, saved)
+
+			// The sets replaced by the forged reads no longer cover rows,
+			// so honest reads of any row succeed or find no set.
+			if punc, ok := client.(*puncClient); ok {
+				assert.Equal(t, punc.HintStatus().NumCovered, punc.NumCovered())
+				data, err := punc.MarshalBinary()
+				assert.NilError(t, err)
+				restored := new(puncClient)
+				assert.NilError(t, restored.UnmarshalBinary(data))
+				assert.DeepEqual(t, restored.HintStatus(), punc.HintStatus())
+			}
+			for i := 0; i < db.NumRows; i++ {
+				queryReq, reconstructFunc := verifying.Query(i)
+				if reconstructFunc == nil {
+					continue
+				}
+				resps := make([]interface{}, len(queryReq))
+				assert.NilError(t, db.Answer(queryReq[Left], &resps[Left]))
+				assert.NilError(t, db.Answer(queryReq[Right], &resps[Right]))
+				row, err := reconstructFunc(resps)
+				assert.NilError(t, err, "row %d", i)
+				assert.DeepEqual(t, row, db.Row(i)[:db.RowLen-TagLen])
+			}
+		})
+	}
+}
+
+func TestKeywordPIR(t *testing.T) {
+	keys, rows := MakeKeysRows(1000, 32)
+	db, params, err := BuildKeywordDB(keys, rows, 7)
+	assert.NilError(t, err)
+
+	for _, pirType := range []PirType{Punc, DPF} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			reader := NewPIRReader(RandSource(), Server(*db), Server(*db))
+			assert.NilError(t, reader.Init(pirType))
+			client := NewKeywordReader(reader, params)
+
+			for _, i := range []int{0, 17, 999} {
+				val, err := client.ReadKey(keys[i])
+				assert.NilError(t, err)
+				assert.DeepEqual(t, val, rows[i])
+			}
+
+			missing := uint32(1 << 31)
+			_, err := client.ReadKey(missing)
+			assert.Assert(t, errors.Is(err, ErrKeyNotFound))
+		})
+	}
+}
+
+func readFromDB(t *testing.T, c Client, db StaticDB, i int) Row {
+	queryReq, reconstructFunc := c.Query(i)
+	assert.Assert(t, reconstructFunc != nil)
+	resps := make([]interface{}, len(queryReq))
+	for s := range queryReq {
+		assert.NilError(t, db.Answer(queryReq[s], &resps[s]))
+	}
+	row, err := reconstructFunc(resps)
+	assert.NilError(t, err)
+	return row
+}
+
+func TestSaveLoadClient(t *testing.T) {
+	db := MakeDB(1000, 32)
+
+	for _, pirType := range []PirType{Punc, Perm, Matrix, DPF, NonPrivate, LWE} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			var hintResp HintResp
+			assert.NilError(t, db.Hint(NewHintReq(RandSource(), pirType), &hintResp))
+			client := hintResp.InitClient(RandSource())
+
+			// Consume some sets before saving.
+			for i := 0; i < 100; i++ {
+				assert.DeepEqual(t, readFromDB(t, client, db, i*7), db.Row(i*7))
+			}
+
+			data, err := SaveClient(client)
+			assert.NilError(t, err)
+			restored, err := LoadClient(data, RandSource())
+			assert.NilError(t, err)
+
+			for i := 0; i < 100; i++ {
+				assert.DeepEqual(t, readFromDB(t, restored, db, i*7), db.Row(i*7))
+			}
+		})
+	}
+}
+
+// Hint for which lookups fail often, since not every row is in some set.
+func weakPuncHint(t *testing.T, db StaticDB) HintResp {
+	req := NewPuncHintReq(RandSource())
+	req.NumHintsMultiplier = 1
+	resp, err := req.Process(db)
+	assert.NilError(t, err)
+	return resp
+}
+
+func TestPuncHintStatus(t *testing.T) {
+	db := MakeDB(1000, 32)
+	client := weakPuncHint(t, db).InitClient(RandSource()).(*puncClient)
+
+	status := client.HintStatus()
+	assert.Equal(t, status.NumCovered, client.NumCovered())
+	assert.Assert(t, status.FailureProb > 0.1)
+
+	for i := 0; i < 300; i++ {
+		if client.coverage[i] == 0 {
+			continue
+		}
+		assert.DeepEqual(t, readFromDB(t, client, db, i), db.Row(i))
+	}
+	status = client.HintStatus()
+	assert.Equal(t, status.NumCovered, client.NumCovered())
+	assert.Equal(t, status.FailureProb, float64(db.NumRows-status.NumCovered)/float64(db.NumRows))
+}
+
+func TestPuncParams(t *testing.T) {
+	db := MakeDB(1000, 32)
+	params := PuncParams{SetSizeExponent: 0.4, NumHintsMultiplier: 4}
+	cost := params.Cost(db.NumRows, db.RowLen)
+	assert.Equal(t, cost.SetSize, 16)
+	assert.Equal(t, cost.NumHints, 250)
+
+	req := NewPuncHintReqWithParams(RandSource(), params)
+	reqBytes, err := req.MarshalBinary()
+	assert.NilError(t, err)
+	hint, err := req.Process(db)
+	assert.NilError(t, err)
+	hintBytes, err := hint.(*PuncHintResp).MarshalBinary()
+	assert.NilError(t, err)
+	assert.Equal(t, cost.OfflineBytes, len(reqBytes)+len(hintBytes))
+	assert.Equal(t, hint.(*PuncHintResp).SetSize, cost.SetSize)
+
+	client := hint.InitClient(RandSource()).(*puncClient)
+	bitsPerKey, fixedBytes := client.StateSize()
+	assert.Equal(t, cost.ClientBytes, (db.NumRows*bitsPerKey+7)/8+fixedBytes)
+	// About exp(-4) of the rows are in no set.
+	failureProb := client.HintStatus().FailureProb
+	assert.Assert(t, failureProb > cost.FailureProb/3 && failureProb < 3*cost.FailureProb,
+		"measured %v, predicted %v", failureProb, cost.FailureProb)
+
+	for i := 0; i < 50; i++ {
+		queries, recon := client.Query(i)
+		if queries == nil {
+			continue
+		}
+		onlineBytes := 0
+		resps := make([]interface{}, len(queries))
+		for s, q := range queries {
+			reqBytes, err := q.(*PuncQueryReq).MarshalBinary()
+			assert.NilError(t, err)
+			resps[s], err = q.Process(db)
+			assert.NilError(t, err)
+			respBytes, err := resps[s].(*PuncQueryResp).MarshalBinary()
+			assert.NilError(t, err)
+			onlineBytes += len(reqBytes) + len(respBytes)
+		}
+		assert.Assert(t, onlineBytes <= cost.OnlineBytes && onlineBytes+8 > cost.OnlineBytes,
+			"measured %d, predicted %d", onlineBytes, cost.OnlineBytes)
+		row, err := recon(resps)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, row, db.Row(i))
+	}
+
+	def := DefaultPuncParams().Cost(1<<20, 32)
+	assert.Equal(t, def.SetSize, 1<<10)
+	assert.Assert(t, def.FailureProb < math.Pow(2, -SecParam+1))
+	assert.Equal(t, def.OfflineServerRows, def.NumHints*def.SetSize)
+}
+
+// countingHintServer counts the hints that it sends.
+type countingHintServer struct {
+	StaticDB
+	numHints int
+}
+
+func (s *countingHintServer) Hint(req HintReq, resp *HintResp) error {
+	s.numHints++
+	return s.StaticDB.Hint(req, resp)
+}
+
+func TestPIRReaderRefresh(t *testing.T) {
+	db := MakeDB(1000, 32)
+	counting := &countingHintServer{StaticDB: db}
+	reader := NewPIRReader(RandSource(), counting, Server(db)).(*pirReader)
+	reader.SetRefreshInterval(time.Hour)
+	assert.NilError(t, reader.Init(Punc))
+	assert.Assert(t, reader.HintStatus().FailureProb < DefaultRefreshThreshold)
+	assert.Equal(t, counting.numHints, 1)
+
+	// An uncovered row cannot be read until the scheduled refresh, and no
+	// hint is fetched along with the read.
+	assert.NilError(t, reader.initClient(weakPuncHint(t, db)))
+	uncovered := 0
+	for reader.tracker.(*puncClient).coverage[uncovered] > 0 {
+		uncovered++
+	}
+	_, err := reader.Read(uncovered)
+	assert.Assert(t, errors.Is(err, ErrNotCovered), "got error: %v", err)
+	assert.Equal(t, counting.numHints, 1)
+	assert.Assert(t, reader.refreshTimer != nil)
+	reader.refreshTimer.Reset(0)
+	reader.refreshing.Wait()
+	assert.Equal(t, counting.numHints, 2)
+	assert.Assert(t, reader.HintStatus().FailureProb < DefaultRefreshThreshold)
+	val, err := reader.Read(uncovered)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, db.Row(uncovered))
+
+	// A covered row is fetched with the old hint, which is then refreshed
+	// on schedule.
+	assert.NilError(t, reader.initClient(weakPuncHint(t, db)))
+	covered := 0
+	for reader.tracker.(*puncClient).coverage[covered] == 0 {
+		covered++
+	}
+	val, err = reader.Read(covered)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, db.Row(covered))
+	assert.Equal(t, counting.numHints, 2)
+	reader.refreshTimer.Reset(0)
+	reader.refreshing.Wait()
+	assert.Equal(t, counting.numHints, 3)
+	assert.Assert(t, reader.HintStatus().FailureProb < DefaultRefreshThreshold)
+
+	// Refreshes happen at multiples of the interval.
+	reader.SetRefreshInterval(time.Millisecond)
+	assert.NilError(t, reader.initClient(weakPuncHint(t, db)))
+	_, err = reader.Read(covered)
+	assert.NilError(t, err)
+	reader.refreshing.Wait()
+	assert.Equal(t, counting.numHints, 4)
+}
+
+func TestMultiDPF(t *testing.T) {
+	for _, parties := range []int{3, 4} {
+		for _, alpha := range []int{0, 77, 999} {
+			keys := genMultiDPF(RandSource(), alpha, 1000, parties)
+			var sum []byte
+			for _, key := range keys {
+				share, err := key.EvalFull()
+				assert.NilError(t, err)
+				if sum == nil {
+					sum = make([]byte, len(share))
+				}
+				xorInto(sum, share)
+			}
+			for j := 0; j < len(sum)*8; j++ {
+				assert.Equal(t, sum[j/8]&(1<<(j%8)) != 0, j == alpha, "bit %d", j)
+			}
+		}
+	}
+}
+
+func TestMultiServer(t *testing.T) {
+	db := MakeDB(1000, 20)
+	for _, pirType := range []PirType{Matrix, DPF} {
+		for _, layout := range []shareLayout{{3, 1}, {3, 2}, {4, 2}, {5, 4}} {
+			t.Run(fmt.Sprintf("%s/k=%d,t=%d", pirType, layout.NumServers, layout.Threshold), func(t *testing.T) {
+				servers := make([]Server, layout.NumServers)
+				for s := range servers {
+					servers[s] = db
+				}
+				reader := NewMultiServerPIRReader(RandSource(), servers, layout.Threshold)
+				assert.NilError(t, reader.Init(pirType))
+
+				val, err := reader.Read(17)
+				assert.NilError(t, err)
+				assert.DeepEqual(t, val, db.Row(17))
+				vals, err := reader.ReadBatch([]int{3, 999, 3})
+				assert.NilError(t, err)
+				assert.DeepEqual(t, vals, []Row{db.Row(3), db.Row(999), db.Row(3)})
+			})
+		}
+	}
+}
+
+// flippingServer corrupts every Matrix answer.
+type flippingServer struct {
+	StaticDB
+}
+
+func (s flippingServer) Answer(q QueryReq, resp *interface{}) error {
+	if err := s.StaticDB.Answer(q, resp); err != nil {
+		return err
+	}
+	(*resp).(*MatrixQueryResp).Answer[0] ^= 1
+	return nil
+}
+
+func TestMultiServerInconsistent(t *testing.T) {
+	db := MakeDB(1000, 32)
+
+	// Server 2 receives the same share as server 0.
+	reader := NewMultiServerPIRReader(RandSource(), []Server{db, db, flippingServer{db}}, 1)
+	assert.NilError(t, reader.Init(Matrix))
+	_, err := reader.Read(17)
+	assert.Assert(t, errors.Is(err, ErrInconsistentAnswers), "got error: %v", err)
+
+	reader = NewMultiServerPIRReader(RandSource(), []Server{db, db, db}, 1)
+	assert.ErrorContains(t, reader.Init(Punc), "does not support")
+}
+
+func TestMappedDB(t *testing.T) {
+	db := MakeDB(1000, 32)
+	path := filepath.Join(t.TempDir(), "db")
+	assert.NilError(t, WriteDBFile(path, &db))
+
+	mapped, err := OpenStaticDB(path)
+	assert.NilError(t, err)
+	defer mapped.Close()
+	assert.Equal(t, mapped.NumRows, db.NumRows)
+	assert.Equal(t, mapped.RowLen, db.RowLen)
+
+	for _, pirType := range []PirType{Punc, Matrix, DPF} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			client := NewPIRReader(RandSource(), mapped.StaticDB, mapped.StaticDB)
+			assert.NilError(t, client.Init(pirType))
+			val, err := client.Read(17)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, val, db.Row(17))
+		})
+	}
+
+	_, err = OpenStaticDB(filepath.Join(t.TempDir(), "missing"))
+	assert.Assert(t, err != nil)
+}
+
+func TestParallelPuncHint(t *testing.T) {
+	db := MakeDB(2000, 32)
+	req := NewPuncHintReq(RandSource())
+
+	defer SetHintWorkers(numHintWorkers())
+	SetHintWorkers(1)
+	want, err := req.Process(db)
+	assert.NilError(t, err)
+
+	for _, workers := range []int{2, 3, 16} {
+		SetHintWorkers(workers)
+		got, err := req.Process(db)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, want)
+	}
+}
+
+func TestAnswerThreads(t *testing.T) {
+	defer SetAnswerThreads(numAnswerThreads())
+	for _, rowLen := range []int{32, 20} {
+		db := MakeDB(3001, rowLen)
+		var queries []QueryReq
+		for _, pirType := range []PirType{Punc, DPF, Matrix} {
+			hint, err := NewHintReq(RandSource(), pirType).Process(db)
+			assert.NilError(t, err)
+			q, _ := hint.InitClient(RandSource()).Query(17)
+			queries = append(queries, q[Left])
+		}
+
+		SetAnswerThreads(1)
+		var want []interface{}
+		for _, q := range queries {
+			resp, err := q.Process(db)
+			assert.NilError(t, err)
+			want = append(want, resp)
+		}
+
+		for _, threads := range []int{2, 3, 16, 5000} {
+			SetAnswerThreads(threads)
+			for i, q := range queries {
+				resp, err := q.Process(db)
+				assert.NilError(t, err)
+				assert.DeepEqual(t, resp, want[i])
+			}
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	db := MakeDB(1000, 32)
+
+	hint, err := NewPuncHintReq(RandSource()).Process(db)
+	assert.NilError(t, err)
+	queries, _ := hint.InitClient(RandSource()).Query(5)
+	valid := *queries[Left].(*PuncQueryReq)
+	puncQuery := func(modify func(q *PuncQueryReq)) *PuncQueryReq {
+		q := valid
+		q.PuncturedSet.Keys = append([]byte{}, valid.PuncturedSet.Keys...)
+		modify(&q)
+		return &q
+	}
+	dpfQueries, _ := (&DPFHintResp{*db.Params()}).InitClient(RandSource()).Query(5)
+	dpfKey := dpfQueries[Left].(*DPFQueryReq).DPFkey
+
+	for name, req := range map[string]QueryReq{
+		"PuncExtraElem": puncQuery(func(q *PuncQueryReq) { q.ExtraElem = db.NumRows }),
+		"PuncHole":      puncQuery(func(q *PuncQueryReq) { q.PuncturedSet.Hole = 1 << 20 }),
+		"PuncKeys":      puncQuery(func(q *PuncQueryReq) { q.PuncturedSet.Keys = q.PuncturedSet.Keys[1:] }),
+		"PuncUnivSize":  puncQuery(func(q *PuncQueryReq) { q.PuncturedSet.UnivSize = 1 << 30 }),
+		"PuncSetSize":   puncQuery(func(q *PuncQueryReq) { q.PuncturedSet.SetSize = 0 }),
+		"PuncBatch":     &PuncBatchQueryReq{Queries: []PuncQueryReq{valid, *puncQuery(func(q *PuncQueryReq) { q.ExtraElem = -1 })}},
+		"Perm":          &PermQueryReq{Indices: []int{1, -1}},
+		"Matrix":        &MatrixQueryReq{BitVector: make([]bool, 3)},
+		"DPF":           &DPFQueryReq{dpfKey[:len(dpfKey)-1]},
+		"DPFBatch":      &DPFBatchQueryReq{Keys: []dpf.DPFkey{dpfKey, nil}},
+		"MultiDPF":      &MultiDPFQueryReq{MultiDPFKey{NumBlocks: 1 << 30, BlockLen: 8}},
+		"LWE":           &LWEQueryReq{Query: make([]uint32, 1)},
+		"NonPrivate":    &NonPrivateQueryReq{Index: -1},
+		"Batch":         &BatchQueryReq{Reqs: []QueryReq{&NonPrivateQueryReq{Index: 0}, nil}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := req.Process(db)
+			var validationErr *ValidationError
+			assert.Assert(t, errors.As(err, &validationErr), "got: %v", err)
+		})
+	}
+
+	for name, req := range map[string]HintReq{
+		"Punc":      &PuncHintReq{NumHintsMultiplier: 1 << 30},
+		"PuncSets":  NewPuncHintReqWithParams(RandSource(), PuncParams{SetSizeExponent: 0.9, NumHintsMultiplier: 1}),
+		"Perm":      &PermHintReq{NumTables: 0},
+		"PuncEmpty": NewPuncHintReq(RandSource()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			hintDB := db
+			if name == "PuncEmpty" {
+				hintDB = StaticDB{}
+			}
+			_, err := req.Process(hintDB)
+			var validationErr *ValidationError
+			assert.Assert(t, errors.As(err, &validationErr), "got: %v", err)
+		})
+	}
+
+	msg := (&ValidationError{Msg: "test"}).Error()
+	assert.DeepEqual(t, ParseValidationError(msg), &ValidationError{Msg: "test"})
+	assert.Assert(t, ParseValidationError("other error") == nil)
+}
+
+func TestEstimateCost(t *testing.T) {
+	db := MakeDB(1000, 32)
+	for _, pirType := range []PirType{DPF, Matrix, NonPrivate} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			cost, err := EstimateCost(pirType, db.NumRows, db.RowLen)
+			assert.NilError(t, err)
+
+			hint, err := NewHintReq(RandSource(), pirType).Process(db)
+			assert.NilError(t, err)
+			client := hint.InitClient(RandSource())
+			queries, _ := client.Query(db.NumRows - 1)
+			onlineBytes := 0
+			for _, q := range queries {
+				reqBytes, err := marshalMessage(q)
+				assert.NilError(t, err)
+				resp, err := q.Process(db)
+				assert.NilError(t, err)
+				respBytes, err := marshalMessage(resp)
+				assert.NilError(t, err)
+				onlineBytes += len(reqBytes) + len(respBytes)
+			}
+			assert.Equal(t, cost.OnlineBytes, onlineBytes)
+			assert.Equal(t, cost.ClientBytes, 0)
+			assert.Equal(t, cost.OfflineBytes, 0)
+		})
+	}
+
+	cost, err := EstimateCost(Punc, db.NumRows, db.RowLen)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cost, DefaultPuncParams().Cost(db.NumRows, db.RowLen).Cost)
+	_, err = EstimateCost(Perm, db.NumRows, db.RowLen)
+	assert.ErrorContains(t, err, "No cost model")
+}
+
+func TestWireNesting(t *testing.T) {
+	query := &NonPrivateQueryReq{Index: 3}
+	data, err := (&BatchQueryReq{Reqs: []QueryReq{query}}).MarshalBinary()
+	assert.NilError(t, err)
+	var batch BatchQueryReq
+	assert.NilError(t, batch.UnmarshalBinary(data))
+	assert.DeepEqual(t, batch.Reqs, []QueryReq{query})
+
+	// Batches of batches are rejected, however deep, without recursing.
+	batchID := uint64(wireMessageIDs[reflect.TypeOf(BatchQueryReq{})])
+	for depth := 0; depth < 1000; depth++ {
+		var w WireWriter
+		w.Uvarint(1)
+		w.Uvarint(batchID)
+		w.Bytes(data)
+		data, err = w.Finish()
+		assert.NilError(t, err)
+		if depth == 0 {
+			assert.ErrorContains(t, batch.UnmarshalBinary(data), "nested deeper than 1")
+		}
+	}
+	assert.ErrorContains(t, batch.UnmarshalBinary(data), "nested deeper than 1")
+}
@@ -7,9 +7,9 @@ import (
 	"fmt"
 )
 
-const _PirTypeName = "NoneMatrixPuncPermDPFNonPrivate"
+const _PirTypeName = "NoneMatrixPuncPermDPFNonPrivateLWE"
 
-var _PirTypeIndex = [...]uint8{0, 4, 10, 14, 18, 21, 31}
+var _PirTypeIndex = [...]uint8{0, 4, 10, 14, 18, 21, 31, 34}
 
 func (i PirType) String() string {
 	if i < 0 || i >= PirType(len(_PirTypeIndex)-1) {
@@ -18,7 +18,7 @@ func (i PirType) String() string {
 	return _PirTypeName[_PirTypeIndex[i]:_PirTypeIndex[i+1]]
 }
 
-var _PirTypeValues = []PirType{0, 1, 2, 3, 4, 5}
+var _PirTypeValues = []PirType{0, 1, 2, 3, 4, 5, 6}
 
 var _PirTypeNameToValueMap = map[string]PirType{
 	_PirTypeName[0:4]:   0,
@@ -27,6 +27,7 @@ var _PirTypeNameToValueMap = map[string]PirType{
 	_PirTypeName[14:18]: 3,
 	_PirTypeName[18:21]: 4,
 	_PirTypeName[21:31]: 5,
+	_PirTypeName[31:34]: 6,
 }
 
 // PirTypeString retrieves an enum value from the enum constants string name.
@@ -5,8 +5,6 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
-
-	"checklist/psetggm"
 )
 
 type Present int
@@ -43,10 +41,18 @@ type PuncturedSet struct {
 type SetGenerator struct {
 	baseGen           BaseGenerator
 	num               uint32
+	masterKey         PRGKey
 	idGen             cipher.Block
 	univSize, setSize int
 }
 
+// setGenState is the serializable state of a SetGenerator.
+type setGenState struct {
+	MasterKey         PRGKey
+	Num               uint32
+	UnivSize, SetSize int
+}
+
 func NewSetGenerator(masterKey PRGKey, startId uint32, univSize int, setSize int) SetGenerator {
 	aes, err := aes.NewCipher(masterKey[:])
 	if err != nil {
@@ -54,14 +60,28 @@ func NewSetGenerator(masterKey PRGKey, startId uint32, univSize int, setSize int
 	}
 
 	return SetGenerator{
-		baseGen:  psetggm.NewGGMSetGeneratorC(univSize, setSize),
-		num:      startId,
-		idGen:    aes,
-		univSize: univSize,
-		setSize:  setSize,
+		baseGen:   newBaseGenerator(univSize, setSize),
+		num:       startId,
+		masterKey: masterKey,
+		idGen:     aes,
+		univSize:  univSize,
+		setSize:   setSize,
 	}
 }
 
+func (gen *SetGenerator) state() setGenState {
+	return setGenState{
+		MasterKey: gen.masterKey,
+		Num:       gen.num,
+		UnivSize:  gen.univSize,
+		SetSize:   gen.setSize,
+	}
+}
+
+func (s *setGenState) generator() SetGenerator {
+	return NewSetGenerator(s.MasterKey, s.Num, s.UnivSize, s.SetSize)
+}
+
 func (gen *SetGenerator) Gen(pset *PuncturableSet) {
 	gen.gen(pset)
 
@@ -168,7 +188,7 @@ func (gen *SetGenerator) Punc(pset PuncturableSet, idx int) PuncturedSet {
 }
 
 func (pset *PuncturedSet) Eval() Set {
-	baseGen := psetggm.NewGGMSetGeneratorC(pset.UnivSize, pset.SetSize+1)
+	baseGen := newBaseGenerator(pset.UnivSize, pset.SetSize+1)
 	elems := make([]int, pset.SetSize)
 	baseGen.EvalPunctured(pset.Keys, pset.Hole, elems)
 	for i := 0; i < len(elems); i++ {
@@ -0,0 +1,28 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package pir
+
+import (
+	"checklist/psetggm"
+)
+
+// By default the set generator and the XOR kernels run in C++ through cgo.
+// Build with the purego tag, or with CGO_ENABLED=0, to use the Go
+// implementation in pset_ggm.go instead.
+
+func newBaseGenerator(univSize, setSize int) BaseGenerator {
+	return psetggm.NewGGMSetGeneratorC(univSize, setSize)
+}
+
+func xorBlocks(db []byte, offsets []int, out []byte) {
+	psetggm.XorBlocks(db, offsets, out)
+}
+
+func xorHashesByBitVector(db []byte, bitVector []byte, out []byte) {
+	psetggm.XorHashesByBitVector(db, bitVector, out)
+}
+
+func fastAnswer(pset []byte, hole, univSize, setSize, shift int, db []byte, rowLen int, out []byte) {
+	psetggm.FastAnswer(pset, hole, univSize, setSize, shift, db, rowLen, out)
+}
@@ -0,0 +1,168 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package pir
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"checklist/psetggm"
+
+	"gotest.tools/assert"
+)
+
+// The Go set generator must match the C++ one bit for bit, since servers
+// and clients may be built differently.
+func TestGGMGoMatchesC(t *testing.T) {
+	source := rand.New(rand.NewSource(7))
+	for _, setSize := range []int{1, 2, 3, 4, 5, 8, 31, 100, 1000} {
+		for _, univSize := range []int{setSize, 3 * setSize, 1 << 20} {
+			t.Run(fmt.Sprintf("%d/%d", univSize, setSize), func(t *testing.T) {
+				genC := psetggm.NewGGMSetGeneratorC(univSize, setSize)
+				genGo := newGGMSetGenerator(univSize, setSize)
+				elemsC, elemsGo := make([]int, setSize), make([]int, setSize)
+				seed := make([]byte, 16)
+				for trial := 0; trial < 10; trial++ {
+					source.Read(seed)
+					genC.Eval(seed, elemsC)
+					genGo.Eval(seed, elemsGo)
+					assert.DeepEqual(t, elemsGo, elemsC)
+					assert.Equal(t, genGo.Distinct(elemsGo), genC.Distinct(elemsC))
+
+					pos := source.Intn(setSize)
+					psetC := genC.Punc(seed, pos)
+					psetGo := genGo.Punc(seed, pos)
+					assert.DeepEqual(t, psetGo, psetC)
+					assert.Equal(t, len(psetGo), puncturedKeySize(setSize))
+
+					puncC, puncGo := make([]int, setSize-1), make([]int, setSize-1)
+					if setSize > 1 {
+						genC.EvalPunctured(psetC, pos, puncC)
+						genGo.EvalPunctured(psetGo, pos, puncGo)
+						assert.DeepEqual(t, puncGo, puncC)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGGMDistinctGoMatchesC(t *testing.T) {
+	genC := psetggm.NewGGMSetGeneratorC(100, 8)
+	genGo := newGGMSetGenerator(100, 8)
+	for _, elems := range [][]int{
+		{1, 2, 3, 4, 5, 6, 7, 8},
+		{1, 2, 3, 4, 5, 6, 7, 1},
+		{0, 2, 3, 4, 5, 6, 7, 0},
+		{32, 2, 3, 4, 5, 6, 7, 64},
+		{32, 2, 3, 4, 5, 6, 7, 32},
+	} {
+		assert.Equal(t, genGo.Distinct(elems), genC.Distinct(elems), "%v", elems)
+	}
+}
+
+// forEachKernels runs f with each of the XOR kernels that the host supports.
+func forEachKernels(t *testing.T, f func(t *testing.T)) {
+	active := psetggm.ActiveKernels()
+	defer psetggm.UseKernels(active)
+	for _, k := range psetggm.SupportedKernels() {
+		assert.NilError(t, psetggm.UseKernels(k))
+		t.Run(k.String(), f)
+	}
+}
+
+func TestXorGoMatchesC(t *testing.T) {
+	forEachKernels(t, func(t *testing.T) {
+		source := rand.New(rand.NewSource(7))
+		for _, rowLen := range []int{4, 7, 16, 32, 45, 64, 100, 129, 200} {
+			db := MakeDB(300, rowLen)
+			// Rows beyond the end of the database are skipped.
+			offsets := []int{db.NumRows * rowLen, (db.NumRows + 1) * rowLen, (db.NumRows + 7) * rowLen, db.NumRows*rowLen - 1}
+			for i := 0; i < 50; i++ {
+				offsets = append(offsets, source.Intn(db.NumRows)*rowLen)
+			}
+			outC, outGo := make([]byte, rowLen), make([]byte, rowLen)
+			psetggm.XorBlocks(db.FlatDb, offsets, outC)
+			xorBlocksGo(db.FlatDb, offsets, outGo)
+			assert.DeepEqual(t, outGo, outC)
+		}
+
+		for _, numRows := range []int{1, 2, 9, 299, 300} {
+			db := MakeDB(numRows, 32)
+			bitVector := make([]byte, numRows/8+1)
+			source.Read(bitVector)
+			outC, outGo := make([]byte, 32), make([]byte, 32)
+			psetggm.XorHashesByBitVector(db.FlatDb, bitVector, outC)
+			xorHashesByBitVectorGo(db.FlatDb, bitVector, outGo)
+			assert.DeepEqual(t, outGo, outC)
+		}
+	})
+}
+
+func TestFastAnswerGoMatchesC(t *testing.T) {
+	forEachKernels(t, func(t *testing.T) {
+		db := MakeDB(1000, 32)
+		setSize := int(math.Round(math.Sqrt(float64(db.NumRows))))
+		gen := NewSetGenerator(masterKey, 0, db.NumRows, setSize)
+		for i := 0; i < 20; i++ {
+			pset := gen.GenWith(i)
+			punc := gen.Punc(pset, i)
+			outC, outGo := make([]byte, db.RowLen), make([]byte, db.RowLen)
+			psetggm.FastAnswer(punc.Keys, punc.Hole, punc.UnivSize, punc.SetSize, int(punc.Shift), db.FlatDb, db.RowLen, outC)
+			fastAnswerGo(punc.Keys, punc.Hole, punc.UnivSize, punc.SetSize, int(punc.Shift), db.FlatDb, db.RowLen, outGo)
+			assert.DeepEqual(t, outGo, outC)
+		}
+	})
+}
+
+func init() {
+	benchBaseGenerators = append(benchBaseGenerators, struct {
+		name   string
+		newGen func(univSize, setSize int) BaseGenerator
+	}{"C", func(univSize, setSize int) BaseGenerator {
+		return psetggm.NewGGMSetGeneratorC(univSize, setSize)
+	}})
+}
+
+func BenchmarkGGMEvalC(b *testing.B) {
+	setSize := int(math.Sqrt(float64(*univSize)))
+
+	gen := psetggm.NewGGMSetGeneratorC(*univSize, setSize)
+	set := make([]int, setSize)
+	seed := make([]byte, 16)
+	b.Run(fmt.Sprintf("UnivSize=%d", *univSize), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			seed[0] = (byte)(i % 256)
+			gen.Eval(seed, set)
+		}
+	})
+}
+
+func BenchmarkXorKernels(b *testing.B) {
+	db := MakeDB(1<<16, 32)
+	offsets := make([]int, 256)
+	for i := range offsets {
+		offsets[i] = rand.Intn(db.NumRows) * db.RowLen
+	}
+	bitVector := make([]byte, db.NumRows/8)
+	rand.Read(bitVector)
+	out := make([]byte, db.RowLen)
+	active := psetggm.ActiveKernels()
+	defer psetggm.UseKernels(active)
+	for _, k := range psetggm.SupportedKernels() {
+		assert.NilError(b, psetggm.UseKernels(k))
+		b.Run(fmt.Sprintf("XorBlocks/%s", k), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				psetggm.XorBlocks(db.FlatDb, offsets, out)
+			}
+		})
+		b.Run(fmt.Sprintf("XorHashesByBitVector/%s", k), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				psetggm.XorHashesByBitVector(db.FlatDb, bitVector, out)
+			}
+		})
+	}
+}
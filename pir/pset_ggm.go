@@ -5,254 +5,219 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
-	"io"
-	"math"
 )
 
-type ggmSet struct {
-	key      [16]byte
-	setSize  int
-	univSize int
-	height   int
-	prg      cipher.Block
-}
+// Go implementation of the GGM-tree puncturable set generator of
+// psetggm/pset_ggm.cpp. It produces the same sets, punctured keys and
+// answers as the C++ generator, so clients and servers built with and
+// without cgo interoperate.
+//
+// The tree has height get_height(setSize). Its leaves are 16-byte blocks
+// at depth height-2, each holding four 32-bit words, and word i is mapped
+// to element i of the set by Lemire's multiply-shift reduction. Every node
+// k has children AES(k)^k and AES(k^one)^(k^one), where one flips the
+// lowest bit of the last word of the block, under a fixed public key.
 
-type ggmSetGenerator struct {
-	keyGen io.Reader
-	prg    cipher.Block
+var ggmFixedKey = []byte{36, 156, 50, 234, 92, 230, 49, 9, 174, 170, 205, 160, 98, 236, 29, 243}
 
-	exist []bool
-}
+var ggmPRG cipher.Block
 
-func NewGGMSetGenerator(randReader io.Reader) ggmSetGenerator {
-	prg, err := aes.NewCipher(zeroBlock)
-	if err != nil {
+func init() {
+	var err error
+	if ggmPRG, err = aes.NewCipher(ggmFixedKey); err != nil {
 		panic(fmt.Sprintf("Failed to create AES cipher: %s", err))
 	}
-
-	return ggmSetGenerator{prg: prg, keyGen: randReader}
 }
 
-func (g *ggmSetGenerator) SetGen(univSize int, setSize int) ggmSet {
-	pset, _ := g.SetGenAndEval(univSize, setSize)
-	return pset
-}
-
-func (g *ggmSetGenerator) SetGenAndEval(univSize int, setSize int) (ggmSet, Set) {
-	var key [16]byte
-	if len(g.exist) != univSize {
-		g.exist = make([]bool, univSize)
+// ggmHeight mirrors get_height: the number of bits needed to index setSize
+// elements, but at least 1.
+func ggmHeight(setSize int) int {
+	height := 1
+	for v := uint(setSize-1) >> 1; v > 0; v >>= 1 {
+		height++
 	}
-	height := int(math.Ceil(math.Log2(float64(setSize))))
-	for {
-		if _, err := io.ReadFull(g.keyGen, key[:]); err != nil {
-			panic(err)
-		}
-
-		pset := ggmSet{key: key, setSize: setSize, height: height, univSize: univSize,
-			prg: g.prg,
-		}
+	return height
+}
 
-		return pset, pset.Eval()
+// puncturedKeySize returns the length of the punctured keys of a generator
+// of sets of setSize elements.
+func puncturedKeySize(setSize int) int {
+	if height := ggmHeight(setSize); height > 2 {
+		return 16 * (height - 1)
 	}
+	return 16
 }
 
-func (set *ggmSet) Eval() Set {
-	elems := make(Set, 1<<set.height)
-	return set.Eval_prealloc(elems)
+// ggmExpand writes the two children of the node key into left and right,
+// which may alias key.
+func ggmExpand(key, left, right []byte) {
+	var in, out [16]byte
+	copy(in[:], key)
+	ggmPRG.Encrypt(out[:], in[:])
+	in[12] ^= 1
+	ggmPRG.Encrypt(right, in[:])
+	xorInto(right, in[:])
+	in[12] ^= 1
+	xorInto(out[:], in[:])
+	copy(left, out[:])
 }
 
-func (set *ggmSet) Eval_prealloc(elems Set) Set {
-	preallocKey := make([]byte, 16*(set.height+1))
-	copy(preallocKey[0:16], set.key[:])
-	treeEvalAll(set.prg, preallocKey, set.height, set.univSize, elems)
-	return elems[0:set.setSize]
+type ggmSetGenerator struct {
+	univSize, setSize int
+	height            int
+	// Nodes of the current level of the tree, 16 bytes each.
+	keys []byte
+	// Hash table of Distinct.
+	table []uint32
+}
+
+func newGGMSetGenerator(univSize, setSize int) *ggmSetGenerator {
+	height := ggmHeight(setSize)
+	numLeaves := 1
+	if height > 2 {
+		numLeaves = 1 << (height - 2)
+	}
+	return &ggmSetGenerator{
+		univSize: univSize,
+		setSize:  setSize,
+		height:   height,
+		keys:     make([]byte, 16*numLeaves),
+	}
 }
 
-func (set *ggmSet) Size() int {
-	return set.setSize
+// expandLevel replaces the first numKeys nodes by their 2*numKeys children.
+// Going backwards, every node is read before its slot is overwritten.
+func (g *ggmSetGenerator) expandLevel(numKeys int) {
+	for i := numKeys - 1; i >= 0; i-- {
+		ggmExpand(g.keys[16*i:16*i+16], g.keys[32*i:32*i+16], g.keys[32*i+16:32*i+32])
+	}
 }
 
-func (set *ggmSet) Contains(idx int) bool {
-	return set.findPos(idx) != -1
+func (g *ggmSetGenerator) leafElem(i int) int {
+	word := binary.LittleEndian.Uint32(g.keys[4*i:])
+	return int((uint64(word) * uint64(g.univSize)) >> 32)
 }
 
-func (set *ggmSet) findPos(idx int) int {
-	for i, v := range set.Eval() {
-		if v == idx {
-			return i
-		}
+func (g *ggmSetGenerator) Eval(seed []byte, elems []int) {
+	copy(g.keys, seed[:16])
+	for depth := 0; depth < g.height-2; depth++ {
+		g.expandLevel(1 << depth)
+	}
+	for i := 0; i < g.setSize; i++ {
+		elems[i] = g.leafElem(i)
 	}
-	return -1
 }
 
-func (set *ggmSet) ElemAt(pos int) int {
-	return treeEval(set.prg, set.key[:], set.height, set.univSize, pos)
-}
+func (g *ggmSetGenerator) Punc(seed []byte, pos int) []byte {
+	pset := make([]byte, puncturedKeySize(g.setSize))
+	var key, left, right [16]byte
+	copy(key[:], seed[:16])
 
-func treeEval(prg cipher.Block, key []byte, height int, univSize int, pos int) int {
-	for ; height > 0; height-- {
-		newKey := make([]byte, len(key))
-		if pos < (1 << (height - 1)) {
-			leftChild(prg, key, newKey)
+	depth := 0
+	for height := g.height; height > 2; height-- {
+		ggmExpand(key[:], left[:], right[:])
+		if pos&(1<<(height-1)) != 0 {
+			copy(pset[16*depth:], left[:])
+			key = right
 		} else {
-			rightChild(prg, key, newKey)
+			copy(pset[16*depth:], right[:])
+			key = left
 		}
-		pos &^= (1 << (height - 1))
-		key = newKey
+		depth++
 	}
-
-	return MathMod(int(binary.LittleEndian.Uint32(key)), univSize)
-
-}
-
-var zeroBlock = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-
-func leftChild(prg cipher.Block, seed []byte, out []byte) {
-	prg.Encrypt(out, seed)
-	xorInto(out, seed)
+	copy(pset[16*depth:], key[:])
+	binary.LittleEndian.PutUint32(pset[16*depth+4*(pos&3):], 0)
+	return pset
 }
 
-// warning this is not thread safe since it mutates seed throughout (and reverts at the end)
-// to avoid the extra copy
-func rightChild(prg cipher.Block, seed []byte, out []byte) {
-	seed[0] ^= 1
-	prg.Encrypt(out, seed)
-	xorInto(out, seed)
-	seed[0] ^= 1
-}
+func (g *ggmSetGenerator) EvalPunctured(pset []byte, hole int, elems []int) {
+	height := g.height
+	depth := 0
+	for ; height > 2; height-- {
+		// The nodes on the path to the hole are unknown, and overwritten
+		// below with the co-path keys or, for the leaf, the punctured leaf.
+		g.expandLevel(1 << depth)
+		sibling := (hole >> (height - 1)) ^ 1
+		copy(g.keys[16*sibling:16*sibling+16], pset[16*depth:16*depth+16])
+		depth++
+	}
+	leaf := hole >> height
+	copy(g.keys[16*leaf:16*leaf+16], pset[16*depth:16*depth+16])
 
-func treeEvalAll(prg cipher.Block, pathKey []byte, height int, univSize int, out []int) {
-	curHeight := height
-	curKeyPos := 0
-	curNode := 0
-	for {
-		if curHeight == 0 {
-			out[curNode] = int(binary.LittleEndian.Uint32(pathKey[curKeyPos:]) % uint32(univSize))
-			for isRight := true; isRight; curNode >>= 1 {
-				isRight = (curNode&1 == 1)
-				curHeight++
-				curKeyPos -= 16
-			}
-			if curHeight > height {
-				return
-			}
-			rightChild(prg, pathKey[curKeyPos:curKeyPos+16], pathKey[curKeyPos+16:curKeyPos+32])
-			curNode = (curNode << 1) + 1
-			curHeight--
-			curKeyPos += 16
+	out := 0
+	for i := 0; i < g.setSize; i++ {
+		if i == hole {
 			continue
 		}
-		leftChild(prg, pathKey[curKeyPos:curKeyPos+16], pathKey[curKeyPos+16:curKeyPos+32])
-		curNode = (curNode << 1)
-		curHeight--
-		curKeyPos += 16
+		elems[out] = g.leafElem(i)
+		out++
 	}
-
-	// key := pathKey[0:16]
-	// if height == 0 {
-	// 	out[0] = int(binary.LittleEndian.Uint32(key) % uint32(univSize))
-	// 	return
-	// }
-	// remainingKey := pathKey[16:]
-	// nextKey := remainingKey[0:16]
-	// leftChild(prg, key, nextKey)
-	// treeEvalAll(prg, remainingKey, height-1, univSize, out[0:1<<(height-1)])
-	// rightChild(prg, key, nextKey)
-	// treeEvalAll(prg, remainingKey, height-1, univSize, out[1<<(height-1):])
 }
 
-func (set *ggmSet) Punc(idx int) *puncturedGGMSet {
-	hole := set.findPos(idx)
-	if hole < 0 {
-		panic(fmt.Sprintf("Puncturing at non-existing element: %d", idx))
+// Distinct mirrors distinct in pset_ggm.cpp, which uses zero to mark empty
+// slots of its hash table and therefore never detects repeated zeros. The
+// same set ids must be skipped with and without cgo.
+func (g *ggmSetGenerator) Distinct(elems []int) bool {
+	tableSize := 1
+	for tableSize < 4*len(elems) {
+		tableSize <<= 1
 	}
-	keys := make([][]byte, 0)
-	key := set.key[:]
-	pos := hole
-	for height := set.height; height > 0; height-- {
-		pathKey := make([]byte, 16)
-		copathKey := make([]byte, 16)
-		if pos < (1 << (height - 1)) {
-			leftChild(set.prg, key, pathKey)
-			rightChild(set.prg, key, copathKey)
-		} else {
-			leftChild(set.prg, key, copathKey)
-			rightChild(set.prg, key, pathKey)
-		}
-		keys = append(keys, copathKey)
-		key = pathKey
-		pos &^= (1 << (height - 1))
+	if len(g.table) < tableSize {
+		g.table = make([]uint32, tableSize)
 	}
-	return &puncturedGGMSet{
-		Keys:     keys,
-		Hole:     hole,
-		SetSize:  set.setSize - 1,
-		Height:   set.height,
-		UnivSize: set.univSize,
-		prg:      set.prg,
+	table := g.table[:tableSize]
+	for i := range table {
+		table[i] = 0
 	}
-}
-
-type puncturedGGMSet struct {
-	Keys     [][]byte
-	Hole     int
-	SetSize  int
-	UnivSize int
-	Height   int
-	prg      cipher.Block
-}
 
-func (set *puncturedGGMSet) Eval() Set {
-	// To recover PRG after deserialization
-	if set.prg == nil {
-		set.prg, _ = aes.NewCipher(zeroBlock)
+	for _, e := range elems {
+		for h := uint32(e) & uint32(tableSize-1); ; h = (h + 1) & uint32(tableSize-1) {
+			if table[h] == 0 {
+				table[h] = uint32(e)
+				break
+			}
+			if table[h] == uint32(e) {
+				return false
+			}
+		}
 	}
-
-	elems := make(Set, 1<<set.Height)
-	puncturedTreeEvalAll(set.prg, set.Keys, set.Hole, set.Height, set.UnivSize, elems)
-	return elems[0:set.SetSize]
+	return true
 }
 
-func puncturedTreeEvalAll(prg cipher.Block, keys [][]byte, hole int, height int, univSize int, out []int) {
-	if height == 0 {
-		return
+// xorBlocksGo XORs into out the blocks of len(out) bytes of db that start at
+// the given offsets, skipping blocks that do not fit in db.
+func xorBlocksGo(db []byte, offsets []int, out []byte) {
+	for i := range out {
+		out[i] = 0
 	}
-	if hole < (1 << (height - 1)) {
-		puncturedTreeEvalAll(prg, keys[1:], hole, height-1, univSize, out[0:1<<(height-1)-1])
-		pathKey := append(keys[0], make([]byte, height*len(keys[0]))...)
-		treeEvalAll(prg, pathKey, height-1, univSize, out[1<<(height-1)-1:])
-	} else {
-		pathKey := append(keys[0], make([]byte, height*len(keys[0]))...)
-		treeEvalAll(prg, pathKey, height-1, univSize, out[0:1<<(height-1)])
-		puncturedTreeEvalAll(prg, keys[1:], hole-(1<<(height-1)), height-1, univSize, out[1<<(height-1):])
+	for _, off := range offsets {
+		if off < 0 || off+len(out) > len(db) {
+			continue
+		}
+		xorInto(out, db[off:off+len(out)])
 	}
-
 }
 
-func (set *puncturedGGMSet) elemAt(pos int) int {
-	if pos >= set.Hole {
-		pos++
+// xorHashesByBitVectorGo XORs into out the 32-byte rows of db whose bit is
+// set in bitVector.
+func xorHashesByBitVectorGo(db []byte, bitVector []byte, out []byte) {
+	for i := range out {
+		out[i] = 0
 	}
-	hole := set.Hole
-	height := set.Height
-	for {
-		holeMsb := hole & (1<<height - 1)
-		posMsb := pos & (1<<height - 1)
-		hole &^= (1<<height - 1)
-		pos &^= (1<<height - 1)
-		height--
-
-		if (holeMsb) != (posMsb) {
-			break
+	for i := 0; i < len(db)/32; i++ {
+		if bitVector[i/8]&(1<<(i%8)) != 0 {
+			xorInto(out, db[32*i:32*i+32])
 		}
 	}
-	if height == 0 {
-		panic("Cannot evaluate punctured set at punctured point")
-	}
-	return treeEval(set.prg, set.Keys[set.Height-height], height, set.UnivSize, pos)
 }
 
-func (set *puncturedGGMSet) Size() int {
-	return set.SetSize
+// fastAnswerGo XORs the rows of the punctured set, shifted by shift, into out.
+func fastAnswerGo(pset []byte, hole, univSize, setSize, shift int, db []byte, rowLen int, out []byte) {
+	gen := newGGMSetGenerator(univSize, setSize+1)
+	elems := make([]int, setSize)
+	gen.EvalPunctured(pset, hole, elems)
+	for i := range elems {
+		elems[i] = ((elems[i] + shift) % univSize) * rowLen
+	}
+	xorBlocksGo(db, elems, out)
 }
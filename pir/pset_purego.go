@@ -0,0 +1,20 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package pir
+
+func newBaseGenerator(univSize, setSize int) BaseGenerator {
+	return newGGMSetGenerator(univSize, setSize)
+}
+
+func xorBlocks(db []byte, offsets []int, out []byte) {
+	xorBlocksGo(db, offsets, out)
+}
+
+func xorHashesByBitVector(db []byte, bitVector []byte, out []byte) {
+	xorHashesByBitVectorGo(db, bitVector, out)
+}
+
+func fastAnswer(pset []byte, hole, univSize, setSize, shift int, db []byte, rowLen int, out []byte) {
+	fastAnswerGo(pset, hole, univSize, setSize, shift, db, rowLen, out)
+}
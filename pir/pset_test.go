@@ -6,8 +6,6 @@ import (
 	"math"
 	"testing"
 
-	"checklist/psetggm"
-
 	"gotest.tools/assert"
 )
 
@@ -189,6 +187,17 @@ func TestPuncSetGenWithPunc(t *testing.T) {
 
 var univSize = flag.Int("univSize", 10000, "universe size for puncturable-set test")
 
+// Base generators that BenchmarkPuncSetGen compares. Builds with cgo add
+// the C++ one.
+var benchBaseGenerators = []struct {
+	name   string
+	newGen func(univSize, setSize int) BaseGenerator
+}{
+	{"Go", func(univSize, setSize int) BaseGenerator {
+		return newGGMSetGenerator(univSize, setSize)
+	}},
+}
+
 // Starting result:
 // BenchmarkGGMEval-4   	    2926	    373090 ns/op	  104448 B/op	    2699 allocs/op
 //
@@ -199,18 +208,22 @@ var univSize = flag.Int("univSize", 10000, "universe size for puncturable-set te
 // BenchmarkGGMEval-4   	    5881	    203453 ns/op	   53334 B/op	      14 allocs/op
 func BenchmarkPuncSetGen(b *testing.B) {
 	setSize := int(math.Sqrt(float64(*univSize)))
-	gen := NewGGMSetGenerator(RandSource())
-	b.Run(fmt.Sprintf("UnivSize=%d", *univSize), func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			gen.SetGenAndEval(*univSize, setSize)
-		}
-	})
+	for _, base := range benchBaseGenerators {
+		gen := NewSetGenerator(masterKey, 0, *univSize, setSize)
+		gen.baseGen = base.newGen(*univSize, setSize)
+		var set PuncturableSet
+		b.Run(fmt.Sprintf("%s/UnivSize=%d", base.name, *univSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				gen.Gen(&set)
+			}
+		})
+	}
 }
 
-func BenchmarkGGMEvalC(b *testing.B) {
+func BenchmarkGGMEvalGo(b *testing.B) {
 	setSize := int(math.Sqrt(float64(*univSize)))
 
-	gen := psetggm.NewGGMSetGeneratorC(*univSize, setSize)
+	gen := newGGMSetGenerator(*univSize, setSize)
 	set := make([]int, setSize)
 	seed := make([]byte, 16)
 	b.Run(fmt.Sprintf("UnivSize=%d", *univSize), func(b *testing.B) {
@@ -0,0 +1,121 @@
+package pir
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// PuncParams are the parameters of the hint sets of Punc, which trade the
+// storage of the client against the online cost of queries. Larger sets
+// mean fewer hints but longer query answers, and more hints per row make
+// lookups fail less often.
+type PuncParams struct {
+	// Every set holds about NumRows^SetSizeExponent rows.
+	SetSizeExponent float64
+	// The client holds NumHintsMultiplier*NumRows/setSize hints, so that
+	// every row is in about NumHintsMultiplier sets, and a lookup fails
+	// with probability about exp(-NumHintsMultiplier).
+	NumHintsMultiplier int
+}
+
+// DefaultPuncParams returns sets of sqrt(NumRows) rows and enough hints for
+// lookups to fail with probability 2^-SecParam.
+func DefaultPuncParams() PuncParams {
+	return PuncParams{
+		SetSizeExponent:    0.5,
+		NumHintsMultiplier: int(float64(SecParam) * math.Log(2)),
+	}
+}
+
+// SetSize returns the number of rows of every set for a database of
+// numRows rows.
+func (p PuncParams) SetSize(numRows int) int {
+	setSize := int(math.Round(math.Pow(float64(numRows), p.SetSizeExponent)))
+	if setSize < 1 {
+		setSize = 1
+	}
+	return setSize
+}
+
+// NumHints returns the number of hints for a database of numRows rows.
+func (p PuncParams) NumHints(numRows int) int {
+	return p.NumHintsMultiplier * numRows / p.SetSize(numRows)
+}
+
+func (p PuncParams) validate(db StaticDB) error {
+	if err := validateNumHints("hints multiplier", p.NumHintsMultiplier); err != nil {
+		return err
+	}
+	if !(p.SetSizeExponent >= minSetSizeExponent && p.SetSizeExponent < 1) {
+		return invalidf("set size exponent %v out of bounds [%v:1)", p.SetSizeExponent, minSetSizeExponent)
+	}
+	// The set generator draws sets until their elements are distinct,
+	// which takes about exp(setSize^2/(2*NumRows)) draws.
+	if setSize := p.SetSize(db.NumRows); setSize*(setSize-1) > maxSetSizeSquareRatio*db.NumRows {
+		return invalidf("set size %d too large for %d rows", setSize, db.NumRows)
+	}
+	return nil
+}
+
+// Smaller sets make the hints outnumber the rows of the database.
+const minSetSizeExponent = 0.25
+
+const maxSetSizeSquareRatio = 8
+
+// PuncCost predicts the costs of Punc with some parameters.
+type PuncCost struct {
+	Cost
+
+	SetSize  int
+	NumHints int
+
+	// Probability that a lookup of a row fails because the row is in no
+	// hint set.
+	FailureProb float64
+}
+
+// Cost predicts the costs of Punc with these parameters for a database of
+// numRows rows of rowLen bytes. Message sizes are those of the wire
+// encoding, without the framing of the RPC codec.
+func (p PuncParams) Cost(numRows, rowLen int) PuncCost {
+	setSize := p.SetSize(numRows)
+	numHints := p.NumHints(numRows)
+	bitsPerKey, fixedBytes := puncStateSize(numHints, rowLen)
+
+	hintReq, _ := (&PuncHintReq{NumHintsMultiplier: p.NumHintsMultiplier, SetSizeExponent: p.SetSizeExponent}).MarshalBinary()
+	hintResp, _ := (&PuncHintResp{NRows: numRows, RowLen: rowLen, SetSize: setSize}).MarshalBinary()
+	// Hints are sent as their number, their length and a flat buffer,
+	// instead of the zero length of an empty list.
+	hintBytes := len(hintResp) - 1 + uvarintLen(uint64(numHints)) + uvarintLen(uint64(rowLen)+1) + numHints*rowLen
+
+	// The largest fields of a query, for an upper bound on its size.
+	query, _ := (&PuncQueryReq{
+		PuncturedSet: PuncturedSet{
+			UnivSize: numRows,
+			SetSize:  setSize - 1,
+			Keys:     make([]byte, puncturedKeySize(setSize)),
+			Hole:     setSize - 1,
+			Shift:    uint32(numRows - 1),
+		},
+		ExtraElem: numRows - 1,
+	}).MarshalBinary()
+	resp, _ := (&PuncQueryResp{Answer: make(Row, rowLen), ExtraElem: make(Row, rowLen)}).MarshalBinary()
+
+	return PuncCost{
+		Cost: Cost{
+			ClientBytes:       (numRows*bitsPerKey+7)/8 + fixedBytes,
+			OfflineBytes:      len(hintReq) + hintBytes,
+			OnlineBytes:       2 * (len(query) + len(resp)),
+			OfflineServerRows: numHints * setSize,
+			OnlineServerRows:  setSize,
+		},
+		SetSize:     setSize,
+		NumHints:    numHints,
+		FailureProb: math.Pow(1-math.Min(1, float64(setSize)/float64(numRows)), float64(numHints)),
+	}
+}
+
+func uvarintLen(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
@@ -0,0 +1,126 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Servers process requests from untrusted clients. Every HintReq and
+// QueryReq checks its fields against the database before computing and
+// returns a *ValidationError if they do not match, instead of indexing out
+// of bounds or passing them on to the C code.
+
+// ValidationError is returned when a request is malformed or does not match
+// the database that it is processed against.
+type ValidationError struct {
+	Msg string
+}
+
+const validationErrorPrefix = "Invalid request: "
+
+func (e *ValidationError) Error() string {
+	return validationErrorPrefix + e.Msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &ValidationError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// ParseValidationError recovers a ValidationError from its message, for
+// errors that lost their type on the way from the server, and returns nil
+// if msg is not the message of a ValidationError.
+func ParseValidationError(msg string) *ValidationError {
+	if !strings.HasPrefix(msg, validationErrorPrefix) {
+		return nil
+	}
+	return &ValidationError{Msg: strings.TrimPrefix(msg, validationErrorPrefix)}
+}
+
+// Upper bound on the number of hints per row of the hint sets that clients
+// may request, far above the default of SecParam*ln(2).
+const maxNumHintsMultiplier = 16 * SecParam
+
+func validateNonEmpty(db StaticDB) error {
+	if db.NumRows <= 0 || db.RowLen <= 0 {
+		return invalidf("empty database: %d rows of %d bytes", db.NumRows, db.RowLen)
+	}
+	return nil
+}
+
+func validateRowIndex(db StaticDB, what string, i int) error {
+	if i < 0 || i >= db.NumRows {
+		return invalidf("%s %d out of bounds [0:%d)", what, i, db.NumRows)
+	}
+	return nil
+}
+
+func validateNumHints(what string, n int) error {
+	if n < 1 || n > maxNumHintsMultiplier {
+		return invalidf("%s %d out of bounds [1:%d]", what, n, maxNumHintsMultiplier)
+	}
+	return nil
+}
+
+func validatePuncturedSet(db StaticDB, set *PuncturedSet) error {
+	if set.UnivSize < 1 || set.UnivSize > db.NumRows {
+		return invalidf("universe size %d out of bounds [1:%d]", set.UnivSize, db.NumRows)
+	}
+	// The punctured set has one element less than the sets of the generator.
+	if set.SetSize < 1 || set.SetSize >= set.UnivSize {
+		return invalidf("set size %d out of bounds [1:%d)", set.SetSize, set.UnivSize)
+	}
+	if set.Hole < 0 || set.Hole > set.SetSize {
+		return invalidf("hole %d out of bounds [0:%d]", set.Hole, set.SetSize)
+	}
+	if want := puncturedKeySize(set.SetSize + 1); len(set.Keys) != want {
+		return invalidf("punctured set keys of %d bytes, expected %d", len(set.Keys), want)
+	}
+	return nil
+}
+
+func (q *PuncQueryReq) validate(db StaticDB) error {
+	if err := validateNonEmpty(db); err != nil {
+		return err
+	}
+	if err := validateRowIndex(db, "extra element", q.ExtraElem); err != nil {
+		return err
+	}
+	return validatePuncturedSet(db, &q.PuncturedSet)
+}
+
+func dpfLogN(db StaticDB) uint64 {
+	return uint64(math.Ceil(math.Log2(float64(db.NumRows))))
+}
+
+// Length of a two-party DPF key over a domain of 2^logN bits: a seed and
+// a control bit, one seed and two control bit correction words per level
+// above the 128-bit leaves, and the final correction word.
+func dpfKeyLen(logN uint64) int {
+	levels := 0
+	if logN >= 7 {
+		levels = int(logN - 7)
+	}
+	return 17 + 18*levels + 16
+}
+
+func validateDPFKey(db StaticDB, key []byte) error {
+	if want := dpfKeyLen(dpfLogN(db)); len(key) != want {
+		return invalidf("DPF key of %d bytes, expected %d", len(key), want)
+	}
+	return nil
+}
+
+func validateBitVector(db StaticDB, bitVector []bool) error {
+	if _, height := getHeightWidth(db.NumRows, db.RowLen); len(bitVector) < height {
+		return invalidf("bit vector of length %d, expected %d", len(bitVector), height)
+	}
+	return nil
+}
+
+func validateSubRequest(i int, req interface{}) error {
+	if req == nil {
+		return invalidf("missing request %d", i)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package pir
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Compact binary encodings of the messages that clients and servers
+// exchange. Every request and response type implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler with them, and
+// rpc.CodecHandle uses them instead of the generic struct encoding: bit
+// vectors are packed, rows of equal length are sent as a single flat
+// buffer, and integers are varints.
+//
+// Messages that hold other messages, such as BatchQueryReq, prefix every
+// nested message with the index of its type in wireMessages, so new types
+// must only be appended there.
+
+var wireMessages = []interface{}{
+	PuncHintReq{},
+	PuncHintResp{},
+	PuncQueryReq{},
+	PuncQueryResp{},
+	PuncBatchQueryReq{},
+	PuncBatchQueryResp{},
+	PermHintReq{},
+	PermHintResp{},
+	PermQueryReq{},
+	PermQueryResp{},
+	DPFHintReq{},
+	DPFHintResp{},
+	DPFQueryReq{},
+	DPFQueryResp{},
+	DPFBatchQueryReq{},
+	DPFBatchQueryResp{},
+	MultiDPFQueryReq{},
+	MatrixHintReq{},
+	MatrixHintResp{},
+	MatrixQueryReq{},
+	MatrixQueryResp{},
+	MatrixBatchQueryReq{},
+	MatrixBatchQueryResp{},
+	NonPrivateHintReq{},
+	NonPrivateHintResp{},
+	NonPrivateQueryReq{},
+	NonPrivateQueryResp{},
+	LWEHintReq{},
+	LWEHintResp{},
+	LWEQueryReq{},
+	LWEQueryResp{},
+	BatchQueryReq{},
+	BatchQueryResp{},
+}
+
+var wireMessageIDs = make(map[reflect.Type]int)
+
+func init() {
+	for i, m := range wireMessages {
+		wireMessageIDs[reflect.TypeOf(m)] = i + 1
+	}
+}
+
+// WireWriter appends the fields of a message to a buffer.
+type WireWriter struct {
+	buf []byte
+	err error
+}
+
+// Finish returns the encoded message, or the first error of the writer.
+func (w *WireWriter) Finish() ([]byte, error) {
+	return w.buf, w.err
+}
+
+func (w *WireWriter) Uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *WireWriter) Int(v int) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], int64(v))]...)
+}
+
+func (w *WireWriter) Ints(v []int) {
+	w.Uvarint(uint64(len(v)))
+	for _, x := range v {
+		w.Int(x)
+	}
+}
+
+func (w *WireWriter) Uint32s(v []uint32) {
+	w.Uvarint(uint64(len(v)))
+	var b [4]byte
+	for _, x := range v {
+		binary.LittleEndian.PutUint32(b[:], x)
+		w.buf = append(w.buf, b[:]...)
+	}
+}
+
+func (w *WireWriter) Float64(v float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	w.buf = append(w.buf, b[:]...)
+}
+
+// Fixed appends b without its length.
+func (w *WireWriter) Fixed(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *WireWriter) Bytes(b []byte) {
+	w.Uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// Bools appends a bit vector, packed eight bits to a byte.
+func (w *WireWriter) Bools(v []bool) {
+	w.Uvarint(uint64(len(v)))
+	packed := make([]byte, (len(v)+7)/8)
+	for i, bit := range v {
+		if bit {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	w.buf = append(w.buf, packed...)
+}
+
+// Rows appends rows of equal length as the length followed by a single flat
+// buffer, and other rows one by one.
+func (w *WireWriter) Rows(rows [][]byte) {
+	w.Uvarint(uint64(len(rows)))
+	if len(rows) == 0 {
+		return
+	}
+	for _, row := range rows {
+		if len(row) != len(rows[0]) {
+			w.Uvarint(0)
+			for _, row := range rows {
+				w.Bytes(row)
+			}
+			return
+		}
+	}
+	w.Uvarint(uint64(len(rows[0])) + 1)
+	for _, row := range rows {
+		w.buf = append(w.buf, row...)
+	}
+}
+
+// Message appends a nested message, which may be nil.
+func (w *WireWriter) Message(m interface{}) {
+	if m == nil {
+		w.Uvarint(0)
+		return
+	}
+	t := reflect.TypeOf(m)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	id, ok := wireMessageIDs[t]
+	if !ok {
+		w.fail(fmt.Errorf("Unsupported nested message type: %T", m))
+		return
+	}
+	data, err := marshalMessage(m)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.Uvarint(uint64(id))
+	w.Bytes(data)
+}
+
+func (w *WireWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func marshalMessage(m interface{}) ([]byte, error) {
+	if marshaler, ok := m.(encoding.BinaryMarshaler); ok {
+		return marshaler.MarshalBinary()
+	}
+	// A message passed by value.
+	p := reflect.New(reflect.TypeOf(m))
+	p.Elem().Set(reflect.ValueOf(m))
+	return p.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// WireReader reads the fields of a message written by WireWriter. After the
+// first error, it returns zero values, and Done reports the error.
+type WireReader struct {
+	buf []byte
+	err error
+	// Number of messages that the message of the reader is nested in.
+	depth int
+}
+
+func NewWireReader(data []byte) *WireReader {
+	return &WireReader{buf: data}
+}
+
+// Done returns the first error of the reader, or an error if part of the
+// message was not read.
+func (r *WireReader) Done() error {
+	if r.err == nil && len(r.buf) > 0 {
+		r.err = fmt.Errorf("%d trailing bytes in message", len(r.buf))
+	}
+	return r.err
+}
+
+// Failf records an error, for messages whose fields do not make sense.
+func (r *WireReader) Failf(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("Malformed message: "+format, args...)
+	}
+	r.buf = nil
+}
+
+func (r *WireReader) Uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.Failf("bad varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *WireReader) Int() int {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.Failf("bad varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return int(v)
+}
+
+// Length reads the number of elements of a list, each of which takes at
+// least minSize bytes, so that lengths cannot make the reader allocate more
+// than the message holds.
+func (r *WireReader) Length(minSize int) int {
+	n := r.Uvarint()
+	if n > uint64(len(r.buf)) || (minSize > 0 && n*uint64(minSize) > uint64(len(r.buf))) {
+		r.Failf("length %d exceeds the message", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *WireReader) Ints() []int {
+	n := r.Length(1)
+	if n == 0 {
+		return nil
+	}
+	v := make([]int, n)
+	for i := range v {
+		v[i] = r.Int()
+	}
+	return v
+}
+
+func (r *WireReader) Uint32s() []uint32 {
+	n := r.Length(4)
+	if n == 0 {
+		return nil
+	}
+	v := make([]uint32, n)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint32(r.buf[4*i:])
+	}
+	r.buf = r.buf[4*n:]
+	return v
+}
+
+func (r *WireReader) Float64() float64 {
+	var b [8]byte
+	r.Fixed(b[:])
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+}
+
+// Fixed fills b.
+func (r *WireReader) Fixed(b []byte) {
+	if len(b) > len(r.buf) {
+		r.Failf("message too short")
+		return
+	}
+	copy(b, r.buf)
+	r.buf = r.buf[len(b):]
+}
+
+func (r *WireReader) next(n int) []byte {
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *WireReader) Bytes() []byte {
+	n := r.Length(1)
+	if n == 0 {
+		return nil
+	}
+	return r.next(n)
+}
+
+func (r *WireReader) Bools() []bool {
+	n := r.Uvarint()
+	if (n+7)/8 > uint64(len(r.buf)) {
+		r.Failf("bit vector of length %d exceeds the message", n)
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	packed := r.next(int((n + 7) / 8))
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = packed[i/8]&(1<<(i%8)) != 0
+	}
+	return v
+}
+
+func (r *WireReader) Rows() [][]byte {
+	n := r.Length(0)
+	if n == 0 {
+		return nil
+	}
+	rowLen := r.Uvarint()
+	if rowLen == 0 {
+		if n > len(r.buf) {
+			r.Failf("%d rows exceed the message", n)
+			return nil
+		}
+		rows := make([][]byte, n)
+		for i := range rows {
+			rows[i] = r.Bytes()
+		}
+		return rows
+	}
+	rowLen--
+	if rowLen > uint64(len(r.buf)) || uint64(n)*rowLen > uint64(len(r.buf)) {
+		r.Failf("%d rows of %d bytes exceed the message", n, rowLen)
+		return nil
+	}
+	rows := make([][]byte, n)
+	for i := range rows {
+		rows[i] = r.next(int(rowLen))
+	}
+	return rows
+}
+
+// Messages nest at most this deep: a batch holds queries, which hold no
+// other messages. A deeper message is rejected rather than decoded with
+// unbounded recursion.
+const maxWireNesting = 1
+
+// Message reads a nested message, as a pointer to a message type, or nil.
+func (r *WireReader) Message() interface{} {
+	id := r.Uvarint()
+	if id == 0 || r.err != nil {
+		return nil
+	}
+	if r.depth >= maxWireNesting {
+		r.Failf("message nested deeper than %d", maxWireNesting)
+		return nil
+	}
+	if id > uint64(len(wireMessages)) {
+		r.Failf("unknown message type %d", id)
+		return nil
+	}
+	data := r.Bytes()
+	if r.err != nil {
+		return nil
+	}
+	m := reflect.New(reflect.TypeOf(wireMessages[id-1])).Interface().(wireMessage)
+	nested := NewWireReader(append([]byte(nil), data...))
+	nested.depth = r.depth + 1
+	m.readFrom(nested)
+	if err := nested.Done(); err != nil {
+		r.err = err
+		return nil
+	}
+	return m
+}
+
+func rowsOf(rows []Row) [][]byte {
+	out := make([][]byte, len(rows))
+	for i := range rows {
+		out[i] = rows[i]
+	}
+	return out
+}
+
+func asRows(rows [][]byte) []Row {
+	if rows == nil {
+		return nil
+	}
+	out := make([]Row, len(rows))
+	for i := range rows {
+		out[i] = rows[i]
+	}
+	return out
+}
@@ -0,0 +1,702 @@
+package pir
+
+import (
+	"github.com/dkales/dpf-go/dpf"
+)
+
+// Wire encodings of the messages of every scheme. See wire.go.
+
+type wireMessage interface {
+	writeTo(w *WireWriter)
+	readFrom(r *WireReader)
+}
+
+func marshalWire(m wireMessage) ([]byte, error) {
+	var w WireWriter
+	m.writeTo(&w)
+	return w.Finish()
+}
+
+// unmarshalWire copies data, which the decoder may reuse, and lets the
+// slices of the message point into the copy.
+func unmarshalWire(m wireMessage, data []byte) error {
+	r := NewWireReader(append([]byte(nil), data...))
+	m.readFrom(r)
+	return r.Done()
+}
+
+func writePRGKey(w *WireWriter, key *PRGKey) {
+	w.Fixed(key[:])
+}
+
+func readPRGKey(r *WireReader, key *PRGKey) {
+	r.Fixed(key[:])
+}
+
+// Punc
+
+func (req *PuncHintReq) writeTo(w *WireWriter) {
+	writePRGKey(w, &req.RandSeed)
+	w.Int(req.NumHintsMultiplier)
+	w.Float64(req.SetSizeExponent)
+}
+
+func (req *PuncHintReq) readFrom(r *WireReader) {
+	readPRGKey(r, &req.RandSeed)
+	req.NumHintsMultiplier = r.Int()
+	req.SetSizeExponent = r.Float64()
+}
+
+func (resp *PuncHintResp) writeTo(w *WireWriter) {
+	w.Int(resp.NRows)
+	w.Int(resp.RowLen)
+	w.Int(resp.SetSize)
+	writePRGKey(w, &resp.SetGenKey)
+	w.Rows(rowsOf(resp.Hints))
+}
+
+func (resp *PuncHintResp) readFrom(r *WireReader) {
+	resp.NRows = r.Int()
+	resp.RowLen = r.Int()
+	resp.SetSize = r.Int()
+	readPRGKey(r, &resp.SetGenKey)
+	resp.Hints = asRows(r.Rows())
+}
+
+func (set *PuncturedSet) writeTo(w *WireWriter) {
+	w.Int(set.UnivSize)
+	w.Int(set.SetSize)
+	w.Bytes(set.Keys)
+	w.Int(set.Hole)
+	w.Uvarint(uint64(set.Shift))
+}
+
+func (set *PuncturedSet) readFrom(r *WireReader) {
+	set.UnivSize = r.Int()
+	set.SetSize = r.Int()
+	set.Keys = r.Bytes()
+	set.Hole = r.Int()
+	set.Shift = uint32(r.Uvarint())
+}
+
+func (q *PuncQueryReq) writeTo(w *WireWriter) {
+	q.PuncturedSet.writeTo(w)
+	w.Int(q.ExtraElem)
+}
+
+func (q *PuncQueryReq) readFrom(r *WireReader) {
+	q.PuncturedSet.readFrom(r)
+	q.ExtraElem = r.Int()
+}
+
+func (resp *PuncQueryResp) writeTo(w *WireWriter) {
+	w.Bytes(resp.Answer)
+	w.Bytes(resp.ExtraElem)
+}
+
+func (resp *PuncQueryResp) readFrom(r *WireReader) {
+	resp.Answer = r.Bytes()
+	resp.ExtraElem = r.Bytes()
+}
+
+func (q *PuncBatchQueryReq) writeTo(w *WireWriter) {
+	w.Uvarint(uint64(len(q.Queries)))
+	for i := range q.Queries {
+		q.Queries[i].writeTo(w)
+	}
+}
+
+func (q *PuncBatchQueryReq) readFrom(r *WireReader) {
+	if n := r.Length(1); n > 0 {
+		q.Queries = make([]PuncQueryReq, n)
+		for i := range q.Queries {
+			q.Queries[i].readFrom(r)
+		}
+	}
+}
+
+func (resp *PuncBatchQueryResp) writeTo(w *WireWriter) {
+	w.Uvarint(uint64(len(resp.Resps)))
+	for i := range resp.Resps {
+		resp.Resps[i].writeTo(w)
+	}
+}
+
+func (resp *PuncBatchQueryResp) readFrom(r *WireReader) {
+	if n := r.Length(1); n > 0 {
+		resp.Resps = make([]PuncQueryResp, n)
+		for i := range resp.Resps {
+			resp.Resps[i].readFrom(r)
+		}
+	}
+}
+
+// Perm
+
+func (req *PermHintReq) writeTo(w *WireWriter) {
+	writePRGKey(w, &req.RandSeed)
+	w.Int(req.NumTables)
+}
+
+func (req *PermHintReq) readFrom(r *WireReader) {
+	readPRGKey(r, &req.RandSeed)
+	req.NumTables = r.Int()
+}
+
+func (resp *PermHintResp) writeTo(w *WireWriter) {
+	w.Int(resp.NRows)
+	w.Int(resp.RowLen)
+	w.Int(resp.NumTables)
+	writePRGKey(w, &resp.SetGenKey)
+	w.Rows(rowsOf(resp.Hints))
+}
+
+func (resp *PermHintResp) readFrom(r *WireReader) {
+	resp.NRows = r.Int()
+	resp.RowLen = r.Int()
+	resp.NumTables = r.Int()
+	readPRGKey(r, &resp.SetGenKey)
+	resp.Hints = asRows(r.Rows())
+}
+
+func (q *PermQueryReq) writeTo(w *WireWriter) {
+	w.Ints(q.Indices)
+	w.Int(q.ExtraElem)
+}
+
+func (q *PermQueryReq) readFrom(r *WireReader) {
+	q.Indices = r.Ints()
+	q.ExtraElem = r.Int()
+}
+
+func (resp *PermQueryResp) writeTo(w *WireWriter) {
+	w.Bytes(resp.Answer)
+	w.Bytes(resp.ExtraElem)
+}
+
+func (resp *PermQueryResp) readFrom(r *WireReader) {
+	resp.Answer = r.Bytes()
+	resp.ExtraElem = r.Bytes()
+}
+
+// DPF
+
+func (p *DBParams) writeTo(w *WireWriter) {
+	w.Int(p.NRows)
+	w.Int(p.RowLen)
+}
+
+func (p *DBParams) readFrom(r *WireReader) {
+	p.NRows = r.Int()
+	p.RowLen = r.Int()
+}
+
+func (req *DPFHintReq) writeTo(w *WireWriter) {}
+
+func (req *DPFHintReq) readFrom(r *WireReader) {}
+
+func (resp *DPFHintResp) writeTo(w *WireWriter) {
+	resp.DBParams.writeTo(w)
+}
+
+func (resp *DPFHintResp) readFrom(r *WireReader) {
+	resp.DBParams.readFrom(r)
+}
+
+func (key *DPFQueryReq) writeTo(w *WireWriter) {
+	w.Bytes(key.DPFkey)
+}
+
+func (key *DPFQueryReq) readFrom(r *WireReader) {
+	key.DPFkey = r.Bytes()
+}
+
+func (resp *DPFQueryResp) writeTo(w *WireWriter) {
+	w.Bytes(resp.Answer)
+}
+
+func (resp *DPFQueryResp) readFrom(r *WireReader) {
+	resp.Answer = r.Bytes()
+}
+
+func (req *DPFBatchQueryReq) writeTo(w *WireWriter) {
+	keys := make([][]byte, len(req.Keys))
+	for i := range keys {
+		keys[i] = req.Keys[i]
+	}
+	w.Rows(keys)
+}
+
+func (req *DPFBatchQueryReq) readFrom(r *WireReader) {
+	keys := r.Rows()
+	if keys == nil {
+		return
+	}
+	req.Keys = make([]dpf.DPFkey, len(keys))
+	for i := range keys {
+		req.Keys[i] = keys[i]
+	}
+}
+
+func (resp *DPFBatchQueryResp) writeTo(w *WireWriter) {
+	w.Rows(resp.Answers)
+}
+
+func (resp *DPFBatchQueryResp) readFrom(r *WireReader) {
+	resp.Answers = r.Rows()
+}
+
+func (req *MultiDPFQueryReq) writeTo(w *WireWriter) {
+	w.Int(req.Key.NumBlocks)
+	w.Int(req.Key.BlockLen)
+	w.Bytes(req.Key.Holds)
+	w.Uvarint(uint64(len(req.Key.Seeds)))
+	for i := range req.Key.Seeds {
+		writePRGKey(w, &req.Key.Seeds[i])
+	}
+	w.Rows(req.Key.CorrectionWords)
+}
+
+func (req *MultiDPFQueryReq) readFrom(r *WireReader) {
+	req.Key.NumBlocks = r.Int()
+	req.Key.BlockLen = r.Int()
+	req.Key.Holds = r.Bytes()
+	if n := r.Length(len(PRGKey{})); n > 0 {
+		req.Key.Seeds = make([]PRGKey, n)
+		for i := range req.Key.Seeds {
+			readPRGKey(r, &req.Key.Seeds[i])
+		}
+	}
+	req.Key.CorrectionWords = r.Rows()
+}
+
+// Matrix
+
+func (req *MatrixHintReq) writeTo(w *WireWriter) {}
+
+func (req *MatrixHintReq) readFrom(r *WireReader) {}
+
+func (resp *MatrixHintResp) writeTo(w *WireWriter) {
+	resp.DBParams.writeTo(w)
+}
+
+func (resp *MatrixHintResp) readFrom(r *WireReader) {
+	resp.DBParams.readFrom(r)
+}
+
+func (req *MatrixQueryReq) writeTo(w *WireWriter) {
+	w.Bools(req.BitVector)
+}
+
+func (req *MatrixQueryReq) readFrom(r *WireReader) {
+	req.BitVector = r.Bools()
+}
+
+func (resp *MatrixQueryResp) writeTo(w *WireWriter) {
+	w.Bytes(resp.Answer)
+}
+
+func (resp *MatrixQueryResp) readFrom(r *WireReader) {
+	resp.Answer = r.Bytes()
+}
+
+func (req *MatrixBatchQueryReq) writeTo(w *WireWriter) {
+	w.Uvarint(uint64(len(req.BitVectors)))
+	for _, bitVector := range req.BitVectors {
+		w.Bools(bitVector)
+	}
+}
+
+func (req *MatrixBatchQueryReq) readFrom(r *WireReader) {
+	if n := r.Length(1); n > 0 {
+		req.BitVectors = make([][]bool, n)
+		for i := range req.BitVectors {
+			req.BitVectors[i] = r.Bools()
+		}
+	}
+}
+
+func (resp *MatrixBatchQueryResp) writeTo(w *WireWriter) {
+	w.Rows(resp.Answers)
+}
+
+func (resp *MatrixBatchQueryResp) readFrom(r *WireReader) {
+	resp.Answers = r.Rows()
+}
+
+// NonPrivate
+
+func (req *NonPrivateHintReq) writeTo(w *WireWriter) {}
+
+func (req *NonPrivateHintReq) readFrom(r *WireReader) {}
+
+func (resp *NonPrivateHintResp) writeTo(w *WireWriter) {
+	w.Int(resp.NRows)
+}
+
+func (resp *NonPrivateHintResp) readFrom(r *WireReader) {
+	resp.NRows = r.Int()
+}
+
+func (req *NonPrivateQueryReq) writeTo(w *WireWriter) {
+	w.Int(req.Index)
+}
+
+func (req *NonPrivateQueryReq) readFrom(r *WireReader) {
+	req.Index = r.Int()
+}
+
+func (resp *NonPrivateQueryResp) writeTo(w *WireWriter) {
+	w.Bytes(resp.Row)
+}
+
+func (resp *NonPrivateQueryResp) readFrom(r *WireReader) {
+	resp.Row = r.Bytes()
+}
+
+// LWE
+
+func (req *LWEHintReq) writeTo(w *WireWriter) {}
+
+func (req *LWEHintReq) readFrom(r *WireReader) {}
+
+func (resp *LWEHintResp) writeTo(w *WireWriter) {
+	w.Int(resp.NRows)
+	w.Int(resp.RowLen)
+	writePRGKey(w, &resp.Seed)
+	w.Uint32s(resp.Hint)
+}
+
+func (resp *LWEHintResp) readFrom(r *WireReader) {
+	resp.NRows = r.Int()
+	resp.RowLen = r.Int()
+	readPRGKey(r, &resp.Seed)
+	resp.Hint = r.Uint32s()
+}
+
+func (req *LWEQueryReq) writeTo(w *WireWriter) {
+	w.Uint32s(req.Query)
+}
+
+func (req *LWEQueryReq) readFrom(r *WireReader) {
+	req.Query = r.Uint32s()
+}
+
+func (resp *LWEQueryResp) writeTo(w *WireWriter) {
+	w.Uint32s(resp.Answer)
+}
+
+func (resp *LWEQueryResp) readFrom(r *WireReader) {
+	resp.Answer = r.Uint32s()
+}
+
+// Batches of queries of any scheme
+
+func (req *BatchQueryReq) writeTo(w *WireWriter) {
+	w.Uvarint(uint64(len(req.Reqs)))
+	for _, q := range req.Reqs {
+		w.Message(q)
+	}
+}
+
+func (req *BatchQueryReq) readFrom(r *WireReader) {
+	n := r.Length(1)
+	if n == 0 {
+		return
+	}
+	req.Reqs = make([]QueryReq, n)
+	for i := range req.Reqs {
+		m := r.Message()
+		if m == nil {
+			continue
+		}
+		q, ok := m.(QueryReq)
+		if !ok {
+			r.Failf("%T is not a query", m)
+			return
+		}
+		req.Reqs[i] = q
+	}
+}
+
+func (resp *BatchQueryResp) writeTo(w *WireWriter) {
+	w.Uvarint(uint64(len(resp.Resps)))
+	for _, m := range resp.Resps {
+		w.Message(m)
+	}
+}
+
+func (resp *BatchQueryResp) readFrom(r *WireReader) {
+	if n := r.Length(1); n > 0 {
+		resp.Resps = make([]interface{}, n)
+		for i := range resp.Resps {
+			resp.Resps[i] = r.Message()
+		}
+	}
+}
+
+// MarshalBinary and UnmarshalBinary of every message.
+
+func (req *PuncHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *PuncHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *PuncHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *PuncHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (q *PuncQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(q)
+}
+
+func (q *PuncQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(q, data)
+}
+
+func (resp *PuncQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *PuncQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (q *PuncBatchQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(q)
+}
+
+func (q *PuncBatchQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(q, data)
+}
+
+func (resp *PuncBatchQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *PuncBatchQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *PermHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *PermHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *PermHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *PermHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (q *PermQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(q)
+}
+
+func (q *PermQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(q, data)
+}
+
+func (resp *PermQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *PermQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *DPFHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *DPFHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *DPFHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *DPFHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (key *DPFQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(key)
+}
+
+func (key *DPFQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(key, data)
+}
+
+func (resp *DPFQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *DPFQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *DPFBatchQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *DPFBatchQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *DPFBatchQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *DPFBatchQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *MultiDPFQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *MultiDPFQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (req *MatrixHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *MatrixHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *MatrixHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *MatrixHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *MatrixQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *MatrixQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *MatrixQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *MatrixQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *MatrixBatchQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *MatrixBatchQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *MatrixBatchQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *MatrixBatchQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *NonPrivateHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *NonPrivateHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *NonPrivateHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *NonPrivateHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *NonPrivateQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *NonPrivateQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *NonPrivateQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *NonPrivateQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *LWEHintReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *LWEHintReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *LWEHintResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *LWEHintResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *LWEQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *LWEQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *LWEQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *LWEQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
+
+func (req *BatchQueryReq) MarshalBinary() ([]byte, error) {
+	return marshalWire(req)
+}
+
+func (req *BatchQueryReq) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(req, data)
+}
+
+func (resp *BatchQueryResp) MarshalBinary() ([]byte, error) {
+	return marshalWire(resp)
+}
+
+func (resp *BatchQueryResp) UnmarshalBinary(data []byte) error {
+	return unmarshalWire(resp, data)
+}
@@ -0,0 +1,64 @@
+package psetggm
+
+/*
+#include <stdint.h>
+#include "xor.h"
+*/
+import "C"
+import (
+	"fmt"
+)
+
+// Kernels identifies an implementation of the XOR kernels behind XorBlocks,
+// XorHashesByBitVector and FastAnswer. The fastest kernels that the host
+// supports are used by default.
+type Kernels int
+
+const (
+	KernelsSSE2   Kernels = C.XOR_KERNELS_SSE2
+	KernelsAVX2   Kernels = C.XOR_KERNELS_AVX2
+	KernelsAVX512 Kernels = C.XOR_KERNELS_AVX512
+	KernelsNEON   Kernels = C.XOR_KERNELS_NEON
+)
+
+var allKernels = []Kernels{KernelsSSE2, KernelsAVX2, KernelsAVX512, KernelsNEON}
+
+func (k Kernels) String() string {
+	switch k {
+	case KernelsSSE2:
+		return "SSE2"
+	case KernelsAVX2:
+		return "AVX2"
+	case KernelsAVX512:
+		return "AVX-512"
+	case KernelsNEON:
+		return "NEON"
+	}
+	return fmt.Sprintf("Kernels(%d)", int(k))
+}
+
+// SupportedKernels returns the kernels that the host supports, from the
+// slowest to the fastest.
+func SupportedKernels() []Kernels {
+	var supported []Kernels
+	for _, k := range allKernels {
+		if C.xor_kernels_supported(C.int(k)) != 0 {
+			supported = append(supported, k)
+		}
+	}
+	return supported
+}
+
+// ActiveKernels returns the kernels in use.
+func ActiveKernels() Kernels {
+	return Kernels(C.xor_kernels_active())
+}
+
+// UseKernels switches to the given kernels, mostly for tests and
+// benchmarks. It must not be called while the kernels are running.
+func UseKernels(k Kernels) error {
+	if C.xor_kernels_use(C.int(k)) == 0 {
+		return fmt.Errorf("%s kernels not supported on this host", k)
+	}
+	return nil
+}
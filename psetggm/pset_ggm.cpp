@@ -190,6 +190,7 @@ void pset_ggm_eval_punc(generator* gen, const uint8_t* pset, unsigned int pos, l
     __m128i* keys = gen->keys;
     __m128i* tmp =  gen->tmp;
 
+    // The punctured set may be decoded from a message at any offset.
     const __m128i* pset_keys = (const __m128i*)pset;
     
     int depth = 0;
@@ -206,11 +207,11 @@ void pset_ggm_eval_punc(generator* gen, const uint8_t* pset, unsigned int pos, l
             keys[i] = _mm_xor_si128(keys[i], key);
         }
         height--;
-        keys[(pos >> height)^1] = pset_keys[depth];
+        keys[(pos >> height)^1] = _mm_loadu_si128(pset_keys + depth);
         depth++;
     }
     
-    keys[(pos >> height)] = pset_keys[depth];
+    keys[(pos >> height)] = _mm_loadu_si128(pset_keys + depth);
     
     size_t out_pos = 0;
     uint32_t* keys_as_elems = (uint32_t*)keys;
@@ -1,7 +1,7 @@
 package psetggm
 
 /*
-#cgo amd64 CXXFLAGS: -msse2 -msse -march=native -maes -Ofast -std=c++11
+#cgo amd64 CXXFLAGS: -msse2 -msse -maes -Ofast -std=c++11
 #cgo arm64 CXXFLAGS: -march=armv8-a+fp+simd+crypto+crc -Ofast -std=c++11
 #cgo LDFLAGS: -static-libstdc++
 #include "pset_ggm.h"
@@ -2,294 +2,386 @@
 #include <cstdio>
 #include <cstring>
 #include "intrinsics.h"
+#include "xor.h"
 
-extern "C"
+// The kernels are compiled for every instruction set that the architecture
+// may offer, and the fastest one that the host supports is picked when the
+// library is loaded. The binary therefore runs on any amd64 CPU with SSE2,
+// whatever machine it was built on.
+
+namespace {
+
+typedef void (*xor_rows_fn)(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
+    unsigned int block_len, uint8_t* out);
+
+typedef void (*xor_hashes_fn)(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing, uint8_t* out);
+
+struct kernel_set {
+    xor_rows_fn xor_rows;
+    xor_hashes_fn xor_hashes_by_bit_vector;
+};
+
+inline bool block_in_db(long long unsigned int elem, unsigned int db_len, unsigned int block_len)
 {
-#ifdef __AVX2__
+    return elem <= db_len && block_len <= db_len - elem;
+}
 
-    void xor_rows(const uint8_t* db, unsigned int db_len, 
-        const long long unsigned int* elems, unsigned int num_elems, 
-        unsigned int block_len, uint8_t* out)
+inline bool bit_set(const uint8_t* indexing, size_t i)
+{
+    return (indexing[i/8] >> (i%8)) & 1;
+}
+
+// XORs bytes [from, block_len) of block into out, 8 bytes at a time.
+inline void xor_words(const uint8_t* block, unsigned int from, unsigned int block_len, uint8_t* out)
+{
+    for (; from + 8 <= block_len; from += 8)
+    {
+        uint64_t a, b;
+        memcpy(&a, out + from, 8);
+        memcpy(&b, block + from, 8);
+        a ^= b;
+        memcpy(out + from, &a, 8);
+    }
+    for (; from < block_len; from++)
+    {
+        out[from] ^= block[from];
+    }
+}
+
+#ifdef __amd64__
+
+// XORs bytes [from, block_len) of block into out, where fewer than 32 bytes
+// remain.
+inline void xor_tail(const uint8_t* block, unsigned int from, unsigned int block_len, uint8_t* out)
+{
+    if (from + 16 <= block_len)
     {
-        memset(out, 0, block_len);
-        for (int i = 0; i < num_elems; i++)
+        __m128i acc = _mm_loadu_si128((const __m128i*)(out + from));
+        acc = _mm_xor_si128(acc, _mm_loadu_si128((const __m128i*)(block + from)));
+        _mm_storeu_si128((__m128i*)(out + from), acc);
+        from += 16;
+    }
+    xor_words(block, from, block_len, out);
+}
+
+// SSE2
+
+void xor_rows_sse2(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
+    unsigned int block_len, uint8_t* out)
+{
+    memset(out, 0, block_len);
+    unsigned int vec_len = block_len - (block_len % 16);
+    for (unsigned int i = 0; i < num_elems; i++)
+    {
+        if (!block_in_db(elems[i], db_len, block_len))
         {
-            if (elems[i] > (db_len-block_len))
-            {
-                continue;
-            }
-            __m256i *block = (__m256i *)(db + elems[i]);
-            for (int b = 0; b < (block_len / 32); b++)
-            {
-                __m256i out256 = _mm256_loadu_si256((__m256i *)out + b);
-                __m256i elem = _mm256_loadu_si256(block + b);
-                out256 = _mm256_xor_si256(out256, elem);
-                _mm256_storeu_si256((__m256i *)out + b,  out256);
-            }
+            continue;
         }
-        if ((block_len % 32) == 0)
-            return;
-
-        bool use128 = ((block_len % 32) >= 16);
-        bool use64 = ((block_len % 16) >= 8);
-        bool use32 = ((block_len % 8) >= 4);
-        bool use16 = ((block_len % 4) >= 2);
-        bool use8 = ((block_len % 2) >= 1);
-
-        size_t off128 = block_len - (block_len % 32);
-        size_t off64 = block_len - (block_len % 16);
-        size_t off32 = block_len - (block_len % 8);
-        size_t off16 = block_len - (block_len % 4);
-        size_t off8 = block_len - 1;
-
-        __m128i out128 = _mm_setzero_si128();
-        uint64_t out64 = 0;
-        uint32_t out32 = 0;
-        uint16_t out16 = 0;
-        uint8_t out8 = 0;
-        for (int i = 0; i < num_elems; i++)
+        const uint8_t* block = db + elems[i];
+        for (unsigned int b = 0; b < vec_len; b += 16)
         {
-            if (elems[i] > db_len)
-            {
-                continue;
-            }
-            const uint8_t *block = db + elems[i];
-            if (use128)
-            {
-                __m128i elem = _mm_load_si128((__m128i *)(block + off128));
-                out128 = _mm_xor_si128(out128, elem);
-            }
-            if (use64)
-            {
-                out64 ^= *(uint64_t *)(block + off64);
-            }
-            if (use32)
-            {
-                out32 ^= *(uint32_t *)(block + off32);
-            }
-            if (use16)
-            {
-                out16 ^= *(uint16_t *)(block + off16);
-            }
-            if (use8)
-            {
-                out8 ^= *(uint8_t *)(block + off8);
-            }
+            __m128i acc = _mm_loadu_si128((const __m128i*)(out + b));
+            acc = _mm_xor_si128(acc, _mm_loadu_si128((const __m128i*)(block + b)));
+            _mm_storeu_si128((__m128i*)(out + b), acc);
         }
-        if (use128)
+        xor_words(block, vec_len, block_len, out);
+    }
+}
+
+// Copied from:  https://github.com/dkales/dpf-cpp/blob/master/hashdatastore.cpp
+// Every hash is XORed into one of two accumulators, of which only the
+// second is kept, to avoid branching on the bits of the vector.
+void xor_hashes_by_bit_vector_sse2(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing, uint8_t* out)
+{
+    __m128i zero = _mm_setzero_si128();
+    __m128i results_lo[8][2], results_hi[8][2];
+    for (int j = 0; j < 8; j++)
+    {
+        results_lo[j][0] = results_lo[j][1] = zero;
+        results_hi[j][0] = results_hi[j][1] = zero;
+    }
+    const __m128i* hashes = (const __m128i*)db;
+    for (size_t i = 0; i < db_len/32; i++)
+    {
+        int bit = bit_set(indexing, i);
+        results_lo[i%8][bit] = _mm_xor_si128(results_lo[i%8][1], _mm_loadu_si128(hashes + 2*i));
+        results_hi[i%8][bit] = _mm_xor_si128(results_hi[i%8][1], _mm_loadu_si128(hashes + 2*i + 1));
+    }
+    __m128i lo = zero, hi = zero;
+    for (int j = 0; j < 8; j++)
+    {
+        lo = _mm_xor_si128(lo, results_lo[j][1]);
+        hi = _mm_xor_si128(hi, results_hi[j][1]);
+    }
+    _mm_storeu_si128((__m128i*)out, lo);
+    _mm_storeu_si128((__m128i*)out + 1, hi);
+}
+
+// AVX2
+
+__attribute__((target("avx2")))
+void xor_rows_avx2(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
+    unsigned int block_len, uint8_t* out)
+{
+    memset(out, 0, block_len);
+    unsigned int vec_len = block_len - (block_len % 32);
+    for (unsigned int i = 0; i < num_elems; i++)
+    {
+        if (!block_in_db(elems[i], db_len, block_len))
         {
-            _mm_storeu_si128((__m128i *)(out + off128), out128);
+            continue;
         }
-        if (use64)
+        const uint8_t* block = db + elems[i];
+        for (unsigned int b = 0; b < vec_len; b += 32)
         {
-            *(uint64_t *)(out + off64) = out64;
+            __m256i acc = _mm256_loadu_si256((const __m256i*)(out + b));
+            acc = _mm256_xor_si256(acc, _mm256_loadu_si256((const __m256i*)(block + b)));
+            _mm256_storeu_si256((__m256i*)(out + b), acc);
         }
-        if (use32)
+        xor_tail(block, vec_len, block_len, out);
+    }
+}
+
+__attribute__((target("avx2")))
+void xor_hashes_by_bit_vector_avx2(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing, uint8_t* out)
+{
+    __m256i zero = _mm256_setzero_si256();
+    __m256i results[8][2];
+    for (int j = 0; j < 8; j++)
+    {
+        results[j][0] = results[j][1] = zero;
+    }
+    const __m256i* hashes = (const __m256i*)db;
+    for (size_t i = 0; i < db_len/32; i++)
+    {
+        int bit = bit_set(indexing, i);
+        results[i%8][bit] = _mm256_xor_si256(results[i%8][1], _mm256_loadu_si256(hashes + i));
+    }
+    __m256i result = zero;
+    for (int j = 0; j < 8; j++)
+    {
+        result = _mm256_xor_si256(result, results[j][1]);
+    }
+    _mm256_storeu_si256((__m256i*)out, result);
+}
+
+// AVX-512
+
+__attribute__((target("avx512f")))
+void xor_rows_avx512(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
+    unsigned int block_len, uint8_t* out)
+{
+    memset(out, 0, block_len);
+    unsigned int vec_len = block_len - (block_len % 64);
+    for (unsigned int i = 0; i < num_elems; i++)
+    {
+        if (!block_in_db(elems[i], db_len, block_len))
         {
-            *(uint32_t *)(out + off32) = out32;
+            continue;
         }
-        if (use16)
+        const uint8_t* block = db + elems[i];
+        unsigned int b = 0;
+        for (; b < vec_len; b += 64)
         {
-            *(uint16_t *)(out + off16) = out16;
+            __m512i acc = _mm512_loadu_si512(out + b);
+            acc = _mm512_xor_si512(acc, _mm512_loadu_si512(block + b));
+            _mm512_storeu_si512(out + b, acc);
         }
-        if (use8)
+        if (b + 32 <= block_len)
         {
-            *(uint8_t *)(out + off8) = out8;
+            __m256i acc = _mm256_loadu_si256((const __m256i*)(out + b));
+            acc = _mm256_xor_si256(acc, _mm256_loadu_si256((const __m256i*)(block + b)));
+            _mm256_storeu_si256((__m256i*)(out + b), acc);
+            b += 32;
         }
+        xor_tail(block, b, block_len, out);
     }
+}
 
-    // Copied from:  https://github.com/dkales/dpf-cpp/blob/master/hashdatastore.cpp
-    void xor_hashes_by_bit_vector(const uint8_t* db, unsigned int db_len, 
-        const uint8_t* indexing, uint8_t* out) {
-    // Optimize for a hash list of 32-bytes hashes.
-        __m256i result = _mm256_set_epi64x(0,0,0,0);
-        __m256i results[8][2] = {
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result}, };
-        
-        int len_full_bytes = (db_len/32)&(~0x7);
-        for(size_t i = 0; i < len_full_bytes; i+=8) {
-            uint8_t tmp = indexing[i/8];
-            results[0][(tmp>>0)&1] = _mm256_xor_si256(results[0][1], (((__m256i*)db))[i]);
-            results[1][(tmp>>1)&1] = _mm256_xor_si256(results[1][1], (((__m256i*)db))[i+1]);
-            results[2][(tmp>>2)&1] = _mm256_xor_si256(results[2][1], (((__m256i*)db))[i+2]);
-            results[3][(tmp>>3)&1] = _mm256_xor_si256(results[3][1], (((__m256i*)db))[i+3]);
-            results[4][(tmp>>4)&1] = _mm256_xor_si256(results[4][1], (((__m256i*)db))[i+4]);
-            results[5][(tmp>>5)&1] = _mm256_xor_si256(results[5][1], (((__m256i*)db))[i+5]);
-            results[6][(tmp>>6)&1] = _mm256_xor_si256(results[6][1], (((__m256i*)db))[i+6]);
-            results[7][(tmp>>7)&1] = _mm256_xor_si256(results[7][1], (((__m256i*)db))[i+7]);
+// Two hashes fit in a register. Every pair of bits of the vector becomes a
+// mask over the 64-bit lanes, where lanes 0-3 hold the first hash and lanes
+// 4-7 the second.
+__attribute__((target("avx512f")))
+void xor_hashes_by_bit_vector_avx512(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing, uint8_t* out)
+{
+    static const __mmask8 pair_masks[4] = {0x00, 0x0f, 0xf0, 0xff};
+    __m512i results[4];
+    for (int j = 0; j < 4; j++)
+    {
+        results[j] = _mm512_setzero_si512();
+    }
+    size_t num_hashes = db_len/32;
+    size_t i = 0;
+    for (; i + 8 <= num_hashes; i += 8)
+    {
+        uint8_t bits = indexing[i/8];
+        for (int j = 0; j < 4; j++)
+        {
+            results[j] = _mm512_mask_xor_epi64(results[j], pair_masks[(bits >> (2*j)) & 3],
+                results[j], _mm512_loadu_si512(db + 32*(i + 2*j)));
         }
-        for (size_t i = len_full_bytes; i < db_len/32; i++) {
-            uint8_t tmp = indexing[i/8];
-            results[i%8][(tmp>>(i%8))&1] = _mm256_xor_si256(results[i%8][1], (((__m256i*)db))[i]);
+    }
+    __m512i acc = _mm512_xor_si512(_mm512_xor_si512(results[0], results[1]),
+        _mm512_xor_si512(results[2], results[3]));
+    __m256i result = _mm256_xor_si256(_mm512_castsi512_si256(acc), _mm512_extracti64x4_epi64(acc, 1));
+    _mm256_storeu_si256((__m256i*)out, result);
+    for (; i < num_hashes; i++)
+    {
+        if (bit_set(indexing, i))
+        {
+            xor_tail(db + 32*i, 0, 32, out);
         }
-        result = _mm256_xor_si256(results[0][1], results[1][1]);
-        result = _mm256_xor_si256(result, results[2][1]);
-        result = _mm256_xor_si256(result, results[3][1]);
-        result = _mm256_xor_si256(result, results[4][1]);
-        result = _mm256_xor_si256(result, results[5][1]);
-        result = _mm256_xor_si256(result, results[6][1]);
-        result = _mm256_xor_si256(result, results[7][1]);
-        _mm256_storeu_si256((__m256i *)out, result);
-        return;
+    }
 }
 
-#else
+const kernel_set kernel_sets[] = {
+    {xor_rows_sse2, xor_hashes_by_bit_vector_sse2},
+    {xor_rows_avx2, xor_hashes_by_bit_vector_avx2},
+    {xor_rows_avx512, xor_hashes_by_bit_vector_avx512},
+    {nullptr, nullptr},
+};
 
-    void xor_rows(const uint8_t* db, unsigned int db_len, 
-        const long long unsigned int* elems, unsigned int num_elems, 
-        unsigned int block_len, uint8_t* out)
+bool supported(int kernels)
+{
+    __builtin_cpu_init();
+    switch (kernels)
     {
-        memset(out, 0, block_len);
-        for (int i = 0; i < num_elems; i++)
-        {
-            if (elems[i] > (db_len-block_len))
-            {
-                continue;
-            }
-            __m128i *block = (__m128i *)(db + elems[i]);
-            for (int b = 0; b < (block_len / 16); b++)
-            {
-                __m128i out128 = _mm_loadu_si128((__m128i *)out + b);
-                __m128i elem = _mm_loadu_si128(block + b);
-                out128 = _mm_xor_si128(out128, elem);
-                _mm_storeu_si128((__m128i *)out + b,  out128);
-            }
-        }
-        if ((block_len % 16) == 0)
-            return;
-
-        bool use64 = ((block_len % 16) >= 8);
-        bool use32 = ((block_len % 8) >= 4);
-        bool use16 = ((block_len % 4) >= 2);
-        bool use8 = ((block_len % 2) >= 1);
-
-        size_t off64 = block_len - (block_len % 16);
-        size_t off32 = block_len - (block_len % 8);
-        size_t off16 = block_len - (block_len % 4);
-        size_t off8 = block_len - 1;
-
-        uint64_t out64 = 0;
-        uint32_t out32 = 0;
-        uint16_t out16 = 0;
-        uint8_t out8 = 0;
-        for (int i = 0; i < num_elems; i++)
+    case XOR_KERNELS_SSE2:
+        return true;
+    case XOR_KERNELS_AVX2:
+        return __builtin_cpu_supports("avx2");
+    case XOR_KERNELS_AVX512:
+        return __builtin_cpu_supports("avx512f");
+    }
+    return false;
+}
+
+#else // __amd64__
+
+// NEON
+
+void xor_rows_neon(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
+    unsigned int block_len, uint8_t* out)
+{
+    memset(out, 0, block_len);
+    unsigned int vec_len = block_len - (block_len % 32);
+    for (unsigned int i = 0; i < num_elems; i++)
+    {
+        if (!block_in_db(elems[i], db_len, block_len))
         {
-            if (elems[i] > db_len)
-            {
-                continue;
-            }
-            const uint8_t *block = db + elems[i];
-            if (use64)
-            {
-                out64 ^= *(uint64_t *)(block + off64);
-            }
-            if (use32)
-            {
-                out32 ^= *(uint32_t *)(block + off32);
-            }
-            if (use16)
-            {
-                out16 ^= *(uint16_t *)(block + off16);
-            }
-            if (use8)
-            {
-                out8 ^= *(uint8_t *)(block + off8);
-            }
+            continue;
         }
-        if (use64)
+        const uint8_t* block = db + elems[i];
+        for (unsigned int b = 0; b < vec_len; b += 32)
         {
-            *(uint64_t *)(out + off64) = out64;
+            uint8x16x2_t acc = vld1q_u8_x2(out + b);
+            uint8x16x2_t elem = vld1q_u8_x2(block + b);
+            acc.val[0] = veorq_u8(acc.val[0], elem.val[0]);
+            acc.val[1] = veorq_u8(acc.val[1], elem.val[1]);
+            vst1q_u8_x2(out + b, acc);
         }
-        if (use32)
+        if (vec_len + 16 <= block_len)
         {
-            *(uint32_t *)(out + off32) = out32;
+            vst1q_u8(out + vec_len, veorq_u8(vld1q_u8(out + vec_len), vld1q_u8(block + vec_len)));
+            vec_len += 16;
         }
-        if (use16)
+        xor_words(block, vec_len, block_len, out);
+    }
+}
+
+// The bits of the vector are widened into all-ones masks, which select the
+// hashes to XOR without branching.
+void xor_hashes_by_bit_vector_neon(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing, uint8_t* out)
+{
+    uint8x16_t lo[4], hi[4];
+    for (int j = 0; j < 4; j++)
+    {
+        lo[j] = hi[j] = vdupq_n_u8(0);
+    }
+    for (size_t i = 0; i < db_len/32; i++)
+    {
+        uint8x16_t mask = vdupq_n_u8(-(uint8_t)bit_set(indexing, i));
+        lo[i%4] = veorq_u8(lo[i%4], vandq_u8(mask, vld1q_u8(db + 32*i)));
+        hi[i%4] = veorq_u8(hi[i%4], vandq_u8(mask, vld1q_u8(db + 32*i + 16)));
+    }
+    vst1q_u8(out, veorq_u8(veorq_u8(lo[0], lo[1]), veorq_u8(lo[2], lo[3])));
+    vst1q_u8(out + 16, veorq_u8(veorq_u8(hi[0], hi[1]), veorq_u8(hi[2], hi[3])));
+}
+
+const kernel_set kernel_sets[] = {
+    {nullptr, nullptr},
+    {nullptr, nullptr},
+    {nullptr, nullptr},
+    {xor_rows_neon, xor_hashes_by_bit_vector_neon},
+};
+
+bool supported(int kernels)
+{
+    return kernels == XOR_KERNELS_NEON;
+}
+
+#endif // __amd64__
+
+int best_kernels()
+{
+    for (int kernels = XOR_KERNELS_NEON; kernels > XOR_KERNELS_SSE2; kernels--)
+    {
+        if (supported(kernels))
         {
-            *(uint16_t *)(out + off16) = out16;
+            return kernels;
         }
-        if (use8)
+    }
+    return XOR_KERNELS_SSE2;
+}
+
+int active_kernels = best_kernels();
+
+} // namespace
+
+extern "C"
+{
+
+    int xor_kernels_supported(int kernels)
+    {
+        return kernels >= XOR_KERNELS_SSE2 && kernels <= XOR_KERNELS_NEON && supported(kernels);
+    }
+
+    int xor_kernels_active()
+    {
+        return active_kernels;
+    }
+
+    int xor_kernels_use(int kernels)
+    {
+        if (!xor_kernels_supported(kernels))
         {
-            *(uint8_t *)(out + off8) = out8;
+            return 0;
         }
+        active_kernels = kernels;
+        return 1;
     }
 
-    // Copied from:  https://github.com/dkales/dpf-cpp/blob/master/hashdatastore.cpp
-    void xor_hashes_by_bit_vector(const uint8_t* db, unsigned int db_len, 
-        const uint8_t* indexing, uint8_t* out) {
-    // Optimize for a hash list of 32-bytes hashes.
-        __m128i result = _mm_set_epi64x(0,0);
-        __m128i results_hi[8][2] = {
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result}, };
-        __m128i results_lo[8][2] = {
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result},
-                {result, result}, };
-
-
-        int len_full_bytes = (db_len/32)&(~0x7);
-        for(size_t i = 0; i < len_full_bytes; i+=8) {
-            uint8_t tmp = indexing[i/8];
-            results_lo[0][(tmp>>0)&1] = _mm_xor_si128(results_lo[0][1], (((__m128i*)db))[2*i]);
-            results_lo[1][(tmp>>1)&1] = _mm_xor_si128(results_lo[1][1], (((__m128i*)db))[2*i+2]);
-            results_lo[2][(tmp>>2)&1] = _mm_xor_si128(results_lo[2][1], (((__m128i*)db))[2*i+4]);
-            results_lo[3][(tmp>>3)&1] = _mm_xor_si128(results_lo[3][1], (((__m128i*)db))[2*i+6]);
-            results_lo[4][(tmp>>4)&1] = _mm_xor_si128(results_lo[4][1], (((__m128i*)db))[2*i+8]);
-            results_lo[5][(tmp>>5)&1] = _mm_xor_si128(results_lo[5][1], (((__m128i*)db))[2*i+10]);
-            results_lo[6][(tmp>>6)&1] = _mm_xor_si128(results_lo[6][1], (((__m128i*)db))[2*i+12]);
-            results_lo[7][(tmp>>7)&1] = _mm_xor_si128(results_lo[7][1], (((__m128i*)db))[2*i+14]);
-            results_hi[0][(tmp>>0)&1] = _mm_xor_si128(results_hi[0][1], (((__m128i*)db))[2*i+1]);
-            results_hi[1][(tmp>>1)&1] = _mm_xor_si128(results_hi[1][1], (((__m128i*)db))[2*i+3]);
-            results_hi[2][(tmp>>2)&1] = _mm_xor_si128(results_hi[2][1], (((__m128i*)db))[2*i+5]);
-            results_hi[3][(tmp>>3)&1] = _mm_xor_si128(results_hi[3][1], (((__m128i*)db))[2*i+7]);
-            results_hi[4][(tmp>>4)&1] = _mm_xor_si128(results_hi[4][1], (((__m128i*)db))[2*i+9]);
-            results_hi[5][(tmp>>5)&1] = _mm_xor_si128(results_hi[5][1], (((__m128i*)db))[2*i+11]);
-            results_hi[6][(tmp>>6)&1] = _mm_xor_si128(results_hi[6][1], (((__m128i*)db))[2*i+13]);
-            results_hi[7][(tmp>>7)&1] = _mm_xor_si128(results_hi[7][1], (((__m128i*)db))[2*i+15]);
-        }
-        for (size_t i = len_full_bytes; i < db_len/32; i++) {
-            uint8_t tmp = indexing[i/8];
-            results_lo[i%8][(tmp>>(i%8))&1] = _mm_xor_si128(results_lo[i%8][1], (((__m128i*)db))[2*i]);
-            results_hi[i%8][(tmp>>(i%8))&1] = _mm_xor_si128(results_hi[i%8][1], (((__m128i*)db))[2*i+1]);
-        }
-        result = _mm_xor_si128(results_lo[0][1], results_lo[1][1]);
-        result = _mm_xor_si128(result, results_lo[2][1]);
-        result = _mm_xor_si128(result, results_lo[3][1]);
-        result = _mm_xor_si128(result, results_lo[4][1]);
-        result = _mm_xor_si128(result, results_lo[5][1]);
-        result = _mm_xor_si128(result, results_lo[6][1]);
-        result = _mm_xor_si128(result, results_lo[7][1]);
-        _mm_storeu_si128((__m128i *)out, result);
-        result = _mm_xor_si128(results_hi[0][1], results_hi[1][1]);
-        result = _mm_xor_si128(result, results_hi[2][1]);
-        result = _mm_xor_si128(result, results_hi[3][1]);
-        result = _mm_xor_si128(result, results_hi[4][1]);
-        result = _mm_xor_si128(result, results_hi[5][1]);
-        result = _mm_xor_si128(result, results_hi[6][1]);
-        result = _mm_xor_si128(result, results_hi[7][1]);
-        _mm_storeu_si128((__m128i *)out+1, result);
-        return;
-}
+    void xor_rows(const uint8_t* db, unsigned int db_len,
+        const long long unsigned int* elems, unsigned int num_elems,
+        unsigned int block_len, uint8_t* out)
+    {
+        kernel_sets[active_kernels].xor_rows(db, db_len, elems, num_elems, block_len, out);
+    }
 
-#endif // __AVX2__
+    void xor_hashes_by_bit_vector(const uint8_t* db, unsigned int db_len,
+        const uint8_t* indexing, uint8_t* out)
+    {
+        kernel_sets[active_kernels].xor_hashes_by_bit_vector(db, db_len, indexing, out);
+    }
 
 } // extern "C"
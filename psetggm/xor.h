@@ -2,14 +2,27 @@
 extern "C" {
 #endif
 
+// Implementations of xor_rows and xor_hashes_by_bit_vector.
+#define XOR_KERNELS_SSE2 0
+#define XOR_KERNELS_AVX2 1
+#define XOR_KERNELS_AVX512 2
+#define XOR_KERNELS_NEON 3
 
+// Whether the host supports the given kernels.
+int xor_kernels_supported(int kernels);
 
-void xor_rows(const uint8_t* db, unsigned int db_len, 
-    const long long unsigned int* elems, unsigned int num_elems, 
+// The kernels in use, by default the fastest ones that the host supports.
+int xor_kernels_active(void);
+
+// Switches to the given kernels, and returns 0 if they are not supported.
+int xor_kernels_use(int kernels);
+
+void xor_rows(const uint8_t* db, unsigned int db_len,
+    const long long unsigned int* elems, unsigned int num_elems,
     unsigned int block_len, uint8_t* out);
 
-void xor_hashes_by_bit_vector(const uint8_t* db, unsigned int db_len, 
-    const uint8_t* indexing, 
+void xor_hashes_by_bit_vector(const uint8_t* db, unsigned int db_len,
+    const uint8_t* indexing,
     uint8_t* out);
 
 #ifdef __cplusplus
@@ -2,7 +2,6 @@ package rpc
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -39,21 +38,8 @@ type httpPostCodec struct {
 }
 
 func newHttpPostCodec(codecHandle codec.Handle, serverAddr string, usePersistent bool) *httpPostCodec {
-	config := tls.Config{
-		InsecureSkipVerify: true,
-	}
-
-	http := &http.Client{
-		Transport: &http.Transport{
-			DialTLS: func(network, addr string) (net.Conn, error) {
-				return tls.Dial("tcp", addr, &config)
-			},
-			DisableKeepAlives: !usePersistent,
-		},
-	}
-
 	return &httpPostCodec{
-		http:       http,
+		http:       newHTTPClient(usePersistent),
 		serverAddr: serverAddr,
 		encoder:    codec.NewEncoderBytes(nil, codecHandle),
 		decoder:    codec.NewDecoder(nil, codecHandle),
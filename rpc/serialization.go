@@ -1,11 +1,21 @@
 package rpc
 
 import (
+	"encoding"
 	"reflect"
 
 	"github.com/ugorji/go/codec"
 )
 
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// CodecHandle registers types as extensions of the binc format. Types whose
+// pointers implement encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler are sent in their own binary encoding, and
+// other types field by field.
 func CodecHandle(types []reflect.Type) codec.Handle {
 	h := codec.BincHandle{}
 	h.StructToArray = true
@@ -13,7 +23,11 @@ func CodecHandle(types []reflect.Type) codec.Handle {
 	h.PreferPointerForStructOrArray = true
 
 	for i, t := range types {
-		err := h.SetBytesExt(t, uint64(0x10+i), codec.SelfExt)
+		var ext codec.BytesExt = codec.SelfExt
+		if p := reflect.PtrTo(t); p.Implements(binaryMarshalerType) && p.Implements(binaryUnmarshalerType) {
+			ext = binaryExt{}
+		}
+		err := h.SetBytesExt(t, uint64(0x10+i), ext)
 		if err != nil {
 			panic(err)
 		}
@@ -21,3 +35,42 @@ func CodecHandle(types []reflect.Type) codec.Handle {
 
 	return &h
 }
+
+// binaryExt encodes values with their MarshalBinary method. The codec
+// recovers the panics of failed encodings and returns them as errors.
+type binaryExt struct{}
+
+func (binaryExt) WriteExt(v interface{}) []byte {
+	data, err := binaryMarshaler(reflect.ValueOf(v)).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	if data == nil {
+		// The codec sends nil as a nil value instead of an empty message.
+		data = []byte{}
+	}
+	return data
+}
+
+// binaryMarshaler finds the marshaler of v, which the codec passes by value
+// for non-struct types, and through a pointer to an interface for structs
+// held by value in an interface.
+func binaryMarshaler(v reflect.Value) encoding.BinaryMarshaler {
+	for {
+		if m, ok := v.Interface().(encoding.BinaryMarshaler); ok {
+			return m
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			return p.Interface().(encoding.BinaryMarshaler)
+		}
+		v = v.Elem()
+	}
+}
+
+func (binaryExt) ReadExt(dst interface{}, src []byte) {
+	if err := dst.(encoding.BinaryUnmarshaler).UnmarshalBinary(src); err != nil {
+		panic(err)
+	}
+}
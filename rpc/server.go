@@ -69,7 +69,10 @@ func (s *httpRpcServer) Serve() error {
 	return err
 }
 
-func NewServer(port int, useTLS bool, types []reflect.Type) (Server, error) {
+// NewServer returns a server on port. If allowOrigin is set, HTTPS
+// responses allow web pages from that origin, or from any origin if it is
+// "*", to call the server, as the WebAssembly client does.
+func NewServer(port int, useTLS bool, allowOrigin string, types []reflect.Type) (Server, error) {
 	rpcServer := rpc.NewServer()
 
 	codecHandle := CodecHandle(types)
@@ -82,6 +85,14 @@ func NewServer(port int, useTLS bool, types []reflect.Type) (Server, error) {
 		}
 		server := httpRpcServer{httpSrv, httpSrv, rpcServer}
 		httpSrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowOrigin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+				if r.Method == http.MethodOptions {
+					w.Header().Set("Access-Control-Allow-Methods", "POST")
+					w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+					return
+				}
+			}
 			if strings.HasPrefix(r.URL.Path, rpc.DefaultRPCPath) {
 				w.Header().Set("Content-type", "application/octet-stream")
 				codec := httpServerCodec{
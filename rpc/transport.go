@@ -0,0 +1,25 @@
+//go:build !js
+// +build !js
+
+package rpc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+func newHTTPClient(usePersistent bool) *http.Client {
+	config := tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				return tls.Dial("tcp", addr, &config)
+			},
+			DisableKeepAlives: !usePersistent,
+		},
+	}
+}
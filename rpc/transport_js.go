@@ -0,0 +1,15 @@
+//go:build js
+// +build js
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// In the browser, requests go through the Fetch API, which only uses the
+// default transport. The browser verifies the server's certificate, so the
+// server must use a certificate that the browser trusts.
+func newHTTPClient(usePersistent bool) *http.Client {
+	return &http.Client{}
+}
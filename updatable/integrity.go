@@ -0,0 +1,41 @@
+package updatable
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"checklist/pir"
+)
+
+// A database owner can sign every row with its key, so that clients detect
+// servers that answer incorrectly. The signature binds the value to the key
+// rather than to a position, since positions change as the database is
+// updated. A server can still return an earlier signed value of a key.
+// Records are not signed.
+
+// SignRows returns the rows, each followed by its signature over the row and
+// its key, to be added to the database with the same keys.
+func SignRows(privKey ed25519.PrivateKey, keys []Key, rows []pir.Row) []pir.Row {
+	signed := make([]pir.Row, len(rows))
+	for i, row := range rows {
+		signed[i] = pir.SignRow(privKey, []byte(keys[i]), row)
+	}
+	return signed
+}
+
+// SetVerifyKey makes the client check the signature of every row it reads
+// with the public key of the database owner, and return the rows without it.
+// Reads of rows that fail the check return an error wrapping
+// pir.ErrVerification.
+func (c *Client) SetVerifyKey(pubKey ed25519.PublicKey) {
+	c.verifyKey = pubKey
+}
+
+func (c *Client) verifyFunc(key Key) pir.VerifyFunc {
+	return func(_ int, row pir.Row) error {
+		if _, err := pir.VerifyRow(c.verifyKey, []byte(key), row); err != nil {
+			return fmt.Errorf("Key %s: %w", key, err)
+		}
+		return nil
+	}
+}
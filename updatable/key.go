@@ -0,0 +1,137 @@
+package updatable
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Key is a key of the updatable database: KeyWidth bytes, in big-endian
+// order for integer keys, so that keys sort like the integers. A database
+// has 4-byte keys unless Server.SetKeyWidth says otherwise. Wider keys,
+// such as full-length hashes, make collisions unlikely in large lists.
+type Key string
+
+const DefaultKeyWidth = 4
+
+// Databases with keys wider than this are probably a mistake.
+const MaxKeyWidth = 64
+
+func KeyFromUint32(k uint32) Key {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], k)
+	return Key(b[:])
+}
+
+func KeyFromUint64(k uint64) Key {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], k)
+	return Key(b[:])
+}
+
+// Uint32 returns the integer value of a 4-byte key.
+func (k Key) Uint32() uint32 {
+	return binary.BigEndian.Uint32([]byte(k))
+}
+
+// Uint64 returns the integer value of an 8-byte key.
+func (k Key) Uint64() uint64 {
+	return binary.BigEndian.Uint64([]byte(k))
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%x", string(k))
+}
+
+func validateKeyWidth(width int) error {
+	if width < 1 || width > MaxKeyWidth {
+		return fmt.Errorf("Key width %d out of bounds [1:%d]", width, MaxKeyWidth)
+	}
+	return nil
+}
+
+func keysFromUint32s(keys []uint32) []Key {
+	out := make([]Key, len(keys))
+	for i, k := range keys {
+		out[i] = KeyFromUint32(k)
+	}
+	return out
+}
+
+func keysToUint32s(keys []Key) []uint32 {
+	out := make([]uint32, len(keys))
+	for i, k := range keys {
+		out[i] = k.Uint32()
+	}
+	return out
+}
+
+// flattenKeys concatenates keys of the same width.
+func flattenKeys(keys []Key, width int) []byte {
+	flat := make([]byte, 0, len(keys)*width)
+	for _, k := range keys {
+		flat = append(flat, k...)
+	}
+	return flat
+}
+
+func splitKeys(flat []byte, width int) ([]Key, error) {
+	if width < 1 || len(flat)%width != 0 {
+		return nil, fmt.Errorf("%d bytes of keys do not split into keys of %d bytes", len(flat), width)
+	}
+	keys := make([]Key, len(flat)/width)
+	for i := range keys {
+		keys[i] = Key(flat[i*width : (i+1)*width])
+	}
+	return keys, nil
+}
+
+// posMap maps keys to positions. Keys of the default width are kept as
+// integers, which takes much less memory than strings in large lists.
+type posMap struct {
+	narrow map[uint32]int32
+	wide   map[Key]int32
+}
+
+func newPosMap() posMap {
+	return posMap{narrow: make(map[uint32]int32), wide: make(map[Key]int32)}
+}
+
+func (m posMap) get(key Key) (int32, bool) {
+	if len(key) == DefaultKeyWidth {
+		pos, ok := m.narrow[key.Uint32()]
+		return pos, ok
+	}
+	pos, ok := m.wide[key]
+	return pos, ok
+}
+
+func (m posMap) set(key Key, pos int32) {
+	if len(key) == DefaultKeyWidth {
+		m.narrow[key.Uint32()] = pos
+	} else {
+		m.wide[key] = pos
+	}
+}
+
+func (m posMap) delete(key Key) {
+	if len(key) == DefaultKeyWidth {
+		delete(m.narrow, key.Uint32())
+	} else {
+		delete(m.wide, key)
+	}
+}
+
+func (m posMap) len() int {
+	return len(m.narrow) + len(m.wide)
+}
+
+func (m posMap) keys() []Key {
+	keys := make([]Key, 0, m.len())
+	for k := range m.narrow {
+		keys = append(keys, KeyFromUint32(k))
+	}
+	for k := range m.wide {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,513 @@
+package updatable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"checklist/pir"
+)
+
+// A server opened with OpenServer keeps its database in a directory, so
+// that it restarts with the same timestamps and clients keep updating
+// their hints incrementally:
+//
+//   snapshot      the ops, the rows of StaticDB and the records, as of the
+//                 start of log number LogSeq
+//   log-<seq>     every change since, one entry per call of AddRows,
+//                 AppendRows, DeleteRows, UpdateRows, AddRecords or
+//                 DeleteRecords
+//
+// Changes are appended to the log, and synced, before they are applied.
+// Once the log outgrows the snapshot, a new log is started and a new
+// snapshot replaces the old one, so that writing snapshots takes time
+// linear in the number of changes. On startup, the snapshot is loaded and
+// the logs from LogSeq on are replayed. A log entry that was not written
+// completely is discarded.
+
+const snapshotFile = "snapshot"
+
+// Logs smaller than this are never snapshotted automatically.
+const minSnapshotLogBytes = 16 << 20
+
+type serverLog struct {
+	dir string
+	seq int
+	f   *os.File
+	// Sizes of the current log and of the last snapshot.
+	size, snapshotSize int64
+}
+
+const (
+	logAddRows = iota + 1
+	logDeleteRows
+	logAddRecords
+	logDeleteRecords
+	logUpdateRows
+	logSetKeyWidth
+	logAppendRows
+)
+
+type logEntry struct {
+	Kind   int
+	Keys   []Key
+	Rows   [][]byte
+	RowLen int
+	// For logSetKeyWidth.
+	KeyWidth int
+}
+
+// Every log entry is framed by its length and CRC-32, in 4 bytes each.
+const logFrameLen = 8
+
+func (e *logEntry) marshal() ([]byte, error) {
+	w := new(pir.WireWriter)
+	w.Fixed(make([]byte, logFrameLen))
+	w.Uvarint(uint64(e.Kind))
+	keys := make([][]byte, len(e.Keys))
+	for i, key := range e.Keys {
+		keys[i] = []byte(key)
+	}
+	w.Rows(keys)
+	w.Rows(e.Rows)
+	w.Int(e.RowLen)
+	w.Int(e.KeyWidth)
+	data, err := w.Finish()
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(data)-logFrameLen))
+	binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(data[logFrameLen:]))
+	return data, nil
+}
+
+func (e *logEntry) unmarshal(data []byte) error {
+	r := pir.NewWireReader(data)
+	e.Kind = int(r.Uvarint())
+	if keys := r.Rows(); keys != nil {
+		e.Keys = make([]Key, len(keys))
+		for i, key := range keys {
+			e.Keys[i] = Key(key)
+		}
+	}
+	e.Rows = r.Rows()
+	e.RowLen = r.Int()
+	e.KeyWidth = r.Int()
+	return r.Done()
+}
+
+func (e *logEntry) rows() []pir.Row {
+	rows := make([]pir.Row, len(e.Rows))
+	for i := range rows {
+		rows[i] = e.Rows[i]
+	}
+	return rows
+}
+
+func rowsOf(rows []pir.Row) [][]byte {
+	out := make([][]byte, len(rows))
+	for i := range rows {
+		out[i] = rows[i]
+	}
+	return out
+}
+
+func logPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("log-%08d", seq))
+}
+
+// OpenServer opens the server stored in dir, or creates an empty one if
+// dir holds none. The server must be closed with Close.
+func OpenServer(dir string) (*Server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := NewUpdatableServer()
+	persist := &serverLog{dir: dir}
+	if err := s.loadSnapshot(persist); err != nil {
+		return nil, err
+	}
+
+	var seqs []int
+	paths, err := filepath.Glob(filepath.Join(dir, "log-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), "log-%d", &seq); err != nil {
+			continue
+		}
+		if seq < persist.seq {
+			// Already in the snapshot.
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for i, seq := range seqs {
+		size, err := s.replayLog(logPath(dir, seq), i == len(seqs)-1)
+		if err != nil {
+			return nil, err
+		}
+		persist.seq, persist.size = seq, size
+	}
+
+	persist.f, err = os.OpenFile(logPath(dir, persist.seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Entries synced to a new log are lost with it if its directory entry
+	// is not synced too.
+	if err := syncDir(dir); err != nil {
+		persist.f.Close()
+		return nil, err
+	}
+	s.persist = persist
+	return s, nil
+}
+
+// replayLog applies the entries of a log and returns the size of its
+// complete entries. A torn entry at the end of the last log is truncated.
+func (s *Server) replayLog(path string, last bool) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < logFrameLen {
+			break
+		}
+		n := int(binary.LittleEndian.Uint32(data[pos:]))
+		if n > len(data)-pos-logFrameLen {
+			break
+		}
+		payload := data[pos+logFrameLen : pos+logFrameLen+n]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[pos+4:]) {
+			break
+		}
+		var entry logEntry
+		if err := entry.unmarshal(payload); err != nil {
+			return 0, fmt.Errorf("Failed to decode log entry at %s:%d: %v", path, pos, err)
+		}
+		s.apply(&entry)
+		pos += logFrameLen + n
+	}
+	if pos < len(data) {
+		if !last {
+			return 0, fmt.Errorf("Corrupted log entry at %s:%d", path, pos)
+		}
+		log.Printf("Discarding %d bytes of an incomplete log entry at %s:%d", len(data)-pos, path, pos)
+		if err := os.Truncate(path, int64(pos)); err != nil {
+			return 0, err
+		}
+	}
+	return int64(pos), nil
+}
+
+func (s *Server) apply(e *logEntry) {
+	switch e.Kind {
+	case logAddRows:
+		s.addRows(e.Keys, e.rows())
+	case logDeleteRows:
+		s.deleteRows(e.Keys)
+	case logAddRecords:
+		// Fails again if it failed when it was logged.
+		s.addRecords(keysToUint32s(e.Keys), e.Rows, e.RowLen)
+	case logDeleteRecords:
+		s.deleteRecords(keysToUint32s(e.Keys))
+	case logUpdateRows:
+		s.updateRows(e.Keys, e.rows())
+	case logSetKeyWidth:
+		s.setKeyWidth(e.KeyWidth)
+	case logAppendRows:
+		s.appendRows(e.Keys, e.rows())
+	default:
+		log.Fatalf("Unknown log entry kind %d", e.Kind)
+	}
+}
+
+// log appends a change to the log of a persistent server before it is
+// applied.
+func (s *Server) log(e logEntry) error {
+	if s.persist == nil {
+		return nil
+	}
+	data, err := e.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := s.persist.f.Write(data); err != nil {
+		return fmt.Errorf("Failed to write log: %v", err)
+	}
+	if err := s.persist.f.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync log: %v", err)
+	}
+	s.persist.size += int64(len(data))
+	return nil
+}
+
+// mustLog logs a change that cannot fail, such as AddRows, whose callers
+// cannot recover from a change that is applied but not persisted.
+func (s *Server) mustLog(e logEntry) {
+	if err := s.log(e); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// maybeSnapshot is called after a logged change is applied, so that the
+// snapshot includes it.
+func (s *Server) maybeSnapshot() {
+	if s.persist == nil || s.persist.size < minSnapshotLogBytes || s.persist.size < s.persist.snapshotSize {
+		return
+	}
+	if err := s.Snapshot(); err != nil {
+		// The log still holds every change.
+		log.Printf("Failed to write snapshot: %v", err)
+	}
+}
+
+type serverSnapshot struct {
+	LogSeq           int
+	InitialTimestamp int
+	DefragTimestamp  int
+	NumRows          int
+	RowLen           int
+
+	// The keys of the ops, with a bit set for deletions, for updates and
+	// for appended values, and the data of the updates. The rows of the
+	// other ops are those of StaticDB, in order, which follow the gob
+	// encoding of the snapshot.
+	KeyWidth  int
+	OpKeys    []byte
+	OpDeletes []uint8
+	OpUpdates []uint8
+	OpAppends []uint8
+	Deltas    [][]byte
+	// Keys in the order of Row, once per value.
+	KVKeys []byte
+
+	Records         map[uint32]int
+	ChunkOwner      map[uint32]uint32
+	MaxRecordChunks int
+}
+
+// Snapshot writes the state of a server opened with OpenServer and starts
+// a new log. It is called automatically once the log grows larger than the
+// last snapshot.
+func (s *Server) Snapshot() error {
+	if s.persist == nil {
+		return fmt.Errorf("Server has no data directory")
+	}
+	p := s.persist
+	// Changes from now on go to a new log, which is replayed after the
+	// old log if the snapshot is not written completely.
+	f, err := os.OpenFile(logPath(p.dir, p.seq+1), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		f.Close()
+		os.Remove(logPath(p.dir, p.seq+1))
+		return err
+	}
+	snap := serverSnapshot{
+		LogSeq:           p.seq + 1,
+		InitialTimestamp: s.initialTimestamp,
+		DefragTimestamp:  s.defragTimestamp,
+		NumRows:          s.NumRows,
+		RowLen:           s.RowLen,
+		KeyWidth:         s.keyWidth,
+		OpKeys:           make([]byte, 0, len(s.ops)*s.KeyWidth()),
+		OpDeletes:        make([]uint8, (len(s.ops)+7)/8),
+		OpUpdates:        make([]uint8, (len(s.ops)+7)/8),
+		OpAppends:        make([]uint8, (len(s.ops)+7)/8),
+		KVKeys:           make([]byte, 0, s.kv.Len()*s.KeyWidth()),
+		Records:          s.records,
+		ChunkOwner:       s.chunkOwner,
+		MaxRecordChunks:  s.maxRecordChunks,
+	}
+	for i, op := range s.ops {
+		snap.OpKeys = append(snap.OpKeys, op.Key...)
+		if op.Delete {
+			snap.OpDeletes[i/8] |= 1 << (i % 8)
+		}
+		if op.Update {
+			snap.OpUpdates[i/8] |= 1 << (i % 8)
+			snap.Deltas = append(snap.Deltas, op.data)
+		}
+		if op.Append {
+			snap.OpAppends[i/8] |= 1 << (i % 8)
+		}
+	}
+	s.kv.each(func(e *storeEntry) bool {
+		snap.KVKeys = append(snap.KVKeys, e.key...)
+		return true
+	})
+	size, err := writeSnapshot(p.dir, &snap, s.FlatDb[:s.NumRows*s.RowLen])
+	if err != nil {
+		f.Close()
+		os.Remove(logPath(p.dir, p.seq+1))
+		return err
+	}
+
+	p.f.Close()
+	os.Remove(logPath(p.dir, p.seq))
+	p.f, p.seq, p.size, p.snapshotSize = f, p.seq+1, 0, size
+	// A restart after a crash finds the old log unless its removal is
+	// synced, and removes it then.
+	return syncDir(p.dir)
+}
+
+// writeSnapshot replaces the snapshot atomically.
+func writeSnapshot(dir string, snap *serverSnapshot, flatDb []byte) (int64, error) {
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(snap)
+	if err == nil {
+		_, err = w.Write(flatDb)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if info, statErr := f.Stat(); err == nil {
+		size, err = info.Size(), statErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, snapshotFile))
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("Failed to write snapshot: %v", err)
+	}
+	return size, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Server) loadSnapshot(p *serverLog) error {
+	f, err := os.Open(filepath.Join(p.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var snap serverSnapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("Failed to read snapshot: %v", err)
+	}
+	flatDb := make([]byte, snap.NumRows*snap.RowLen)
+	if _, err := io.ReadFull(r, flatDb); err != nil {
+		return fmt.Errorf("Failed to read snapshot rows: %v", err)
+	}
+	if info, err := f.Stat(); err == nil {
+		p.snapshotSize = info.Size()
+	}
+
+	s.StaticDB = pir.StaticDB{NumRows: snap.NumRows, RowLen: snap.RowLen, FlatDb: flatDb}
+	s.initialTimestamp = snap.InitialTimestamp
+	s.defragTimestamp = snap.DefragTimestamp
+	s.records = snap.Records
+	s.chunkOwner = snap.ChunkOwner
+	s.maxRecordChunks = snap.MaxRecordChunks
+
+	s.keyWidth = snap.KeyWidth
+	opKeys, err := splitKeys(snap.OpKeys, s.KeyWidth())
+	if err != nil {
+		return err
+	}
+	kvKeys, err := splitKeys(snap.KVKeys, s.KeyWidth())
+	if err != nil {
+		return err
+	}
+	s.ops = make([]dbOp, len(opKeys))
+	// The rows of the values of every key, in order.
+	values := make(map[Key][]int)
+	row := 0
+	for i, key := range opKeys {
+		s.ops[i].Key = key
+		if snap.OpDeletes[i/8]&(1<<(i%8)) != 0 {
+			s.ops[i].Delete = true
+			delete(values, key)
+			continue
+		}
+		if len(snap.OpUpdates) > 0 && snap.OpUpdates[i/8]&(1<<(i%8)) != 0 {
+			if len(snap.Deltas) == 0 {
+				return fmt.Errorf("Snapshot is missing updates")
+			}
+			s.ops[i].Update = true
+			s.ops[i].data, snap.Deltas = snap.Deltas[0], snap.Deltas[1:]
+			continue
+		}
+		if row >= snap.NumRows {
+			return fmt.Errorf("Snapshot has more ops than rows: %d", snap.NumRows)
+		}
+		if len(snap.OpAppends) > 0 && snap.OpAppends[i/8]&(1<<(i%8)) != 0 {
+			s.ops[i].Append = true
+			values[key] = append(values[key], row)
+		} else {
+			values[key] = []int{row}
+		}
+		row++
+	}
+	s.kv = newKeyStore()
+	// The values of a key come in order.
+	next := make(map[Key]int)
+	for _, key := range kvKeys {
+		rows := values[key]
+		if next[key] >= len(rows) {
+			return fmt.Errorf("Snapshot has no row for value %d of key %s", next[key], key)
+		}
+		s.kv.append(key, rows[next[key]])
+		next[key]++
+	}
+	s.refreshPending()
+	p.seq = snap.LogSeq
+	return nil
+}
+
+// Close closes the log of a server opened with OpenServer. Every change
+// is already on disk.
+func (s *Server) Close() error {
+	if s.persist == nil {
+		return nil
+	}
+	err := s.persist.f.Close()
+	s.persist = nil
+	return err
+}
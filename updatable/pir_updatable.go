@@ -1,6 +1,9 @@
 package updatable
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
 	"fmt"
 	"log"
 	"math/rand"
@@ -14,19 +17,38 @@ import (
 type KeyUpdatesReq struct {
 	DefragTimestamp int32
 	NextTimestamp   int32
+	// Width of the keys that the client has, or zero for a new client.
+	KeyWidth int32
 }
 
 type KeyUpdatesResp struct {
 	InitialTimestamp int32
 	DefragTimestamp  int
 
+	// Keys of the default width of 4 bytes, as integers, or Rice-encoded
+	// if they are sorted.
 	Keys     []uint32
 	KeysRice *sb.RiceDeltaEncoding
+	// Keys of other widths, flat or Rice-encoded.
+	KeyWidth     int
+	WideKeys     []byte
+	WideKeysRice *WideRiceEncoding
 
 	//Bit vector
 	IsDeletion []byte
 	RowLen     int
 
+	// Bit vector of the keys whose value changed in place, and the XOR of
+	// the old and new value of each, in order.
+	IsUpdate []byte
+	Deltas   []pir.Row
+
+	// Bit vector of the keys that get another value.
+	IsAppend []byte
+
+	// Number of queries that every ReadRecord issues.
+	MaxRecordChunks int
+
 	ShouldDeleteHistory bool
 }
 type UpdatableServer interface {
@@ -43,8 +65,16 @@ type Client struct {
 	defragTimestamp  int
 	numRows          int
 	rowLen           int
+	maxRecordChunks  int
+	keyWidth         int
 	ops              []dbOp
-	keyToPos         map[uint32]int32
+	// Position of the latest value of every key, and of the earlier values
+	// of the keys with several, in order.
+	keyToPos       posMap
+	olderPos       map[Key][]int32
+	readAllQueries int
+	// If set, rows are verified against their signatures.
+	verifyKey ed25519.PublicKey
 
 	// For testing
 	CallAsync           bool
@@ -54,10 +84,17 @@ type Client struct {
 func NewClient(source *rand.Rand, pirType pir.PirType, servers [2]UpdatableServer) *Client {
 	return &Client{
 		waterfall: NewWaterfallClient(source, pirType),
-		keyToPos:  make(map[uint32]int32),
+		keyToPos:  newPosMap(),
+		olderPos:  make(map[Key][]int32),
 		servers:   servers}
 }
 
+// SetLayerTypes sets the schemes of the layers of the client. See
+// WaterfallClient.SetLayerTypes.
+func (c *Client) SetLayerTypes(types LayerTypes) {
+	c.waterfall.SetLayerTypes(types)
+}
+
 func (c *Client) Init() error {
 	err := c.Update()
 	return err
@@ -68,6 +105,7 @@ func (c *Client) Update() error {
 	keyReq := KeyUpdatesReq{
 		DefragTimestamp: int32(c.defragTimestamp),
 		NextTimestamp:   int32(nextTimestamp),
+		KeyWidth:        int32(c.keyWidth),
 	}
 	var keyResp KeyUpdatesResp
 	if err := c.servers[pir.Left].KeyUpdates(keyReq, &keyResp); err != nil {
@@ -89,84 +127,324 @@ func (c *Client) Update() error {
 	return c.waterfall.InitHint(hintResp)
 }
 
+// Read privately reads the row of a 4-byte key, or its latest row if it
+// has several.
 func (c *Client) Read(key uint32) (pir.Row, error) {
-	pos, ok := c.keyToPos[key]
+	return c.ReadKey(KeyFromUint32(key))
+}
+
+// ReadKey is like Read for keys of any width.
+func (c *Client) ReadKey(key Key) (pir.Row, error) {
+	if len(key) != c.KeyWidth() {
+		return nil, fmt.Errorf("Key %s has %d bytes, the database has %d-byte keys", key, len(key), c.KeyWidth())
+	}
+	pos, ok := c.keyToPos.get(key)
+	if !ok {
+		return nil, pir.ErrKeyNotFound
+	}
+	return c.readPos(key, pos)
+}
+
+// SetReadAllQueries sets the number of queries that every ReadAll issues.
+// With zero, the default, it is the largest number of values of any key.
+func (c *Client) SetReadAllQueries(num int) {
+	c.readAllQueries = num
+}
+
+// ReadAll privately reads all the rows of a 4-byte key, in the order in
+// which they were added. It issues the same number of queries whatever the
+// number of rows of the key, padding with dummy queries, so the servers do
+// not learn it.
+func (c *Client) ReadAll(key uint32) ([]pir.Row, error) {
+	return c.ReadAllKey(KeyFromUint32(key))
+}
+
+// ReadAllKey is like ReadAll for keys of any width.
+func (c *Client) ReadAllKey(key Key) ([]pir.Row, error) {
+	if len(key) != c.KeyWidth() {
+		return nil, fmt.Errorf("Key %s has %d bytes, the database has %d-byte keys", key, len(key), c.KeyWidth())
+	}
+	latest, ok := c.keyToPos.get(key)
 	if !ok {
-		return nil, fmt.Errorf("key not found")
+		return nil, pir.ErrKeyNotFound
+	}
+	positions := append(append([]int32(nil), c.olderPos[key]...), latest)
+	numQueries := c.readAllQueries
+	if numQueries == 0 {
+		numQueries = c.maxValues()
+	}
+	if len(positions) > numQueries {
+		return nil, fmt.Errorf("Key %s has %d values, more than the %d queries of ReadAll", key, len(positions), numQueries)
+	}
+
+	// All the queries are generated before any is sent, and all are sent
+	// even if one fails, so that failures do not reveal the number of
+	// values either.
+	queries := make([][]pir.QueryReq, numQueries)
+	recons := make([]pir.ReconstructFunc, len(positions))
+	var err error
+	for i := range queries {
+		if i < len(positions) {
+			queries[i], recons[i] = c.queryPos(key, positions[i])
+			if recons[i] == nil && err == nil {
+				err = fmt.Errorf("Failed to query: %s", key)
+			}
+		}
+		if i >= len(positions) || recons[i] == nil {
+			queries[i] = c.waterfall.DummyQuery()
+		}
+	}
+	responses := make([][]interface{}, numQueries)
+	for i := range queries {
+		var answerErr error
+		if responses[i], answerErr = c.answer(queries[i]); answerErr != nil && err == nil {
+			err = answerErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]pir.Row, len(positions))
+	for i := range positions {
+		if rows[i], err = c.reconstructRow(recons[i], responses[i]); err != nil {
+			return nil, err
+		}
 	}
-	queryReq, reconstructFunc := c.waterfall.Query(int(pos))
+	return rows, nil
+}
+
+// maxValues returns the largest number of values of any key.
+func (c *Client) maxValues() int {
+	most := 1
+	for _, older := range c.olderPos {
+		if len(older)+1 > most {
+			most = len(older) + 1
+		}
+	}
+	return most
+}
+
+func (c *Client) readPos(key Key, pos int32) (pir.Row, error) {
+	queryReq, reconstructFunc := c.queryPos(key, pos)
 	if reconstructFunc == nil {
-		return nil, fmt.Errorf("Failed to query: %x", key)
+		return nil, fmt.Errorf("Failed to query: %s", key)
 	}
-	responses := make([]interface{}, 2)
-	errs := make([]error, 2)
+	responses, err := c.answer(queryReq)
+	if err != nil {
+		return nil, err
+	}
+	return c.reconstructRow(reconstructFunc, responses)
+}
+
+func (c *Client) queryPos(key Key, pos int32) ([]pir.QueryReq, pir.ReconstructFunc) {
+	if c.verifyKey != nil {
+		return c.waterfall.QueryVerified(int(pos), c.verifyFunc(key))
+	}
+	return c.waterfall.Query(int(pos))
+}
+
+// reconstructRow reconstructs a row and strips its signature, if verified.
+func (c *Client) reconstructRow(reconstructFunc pir.ReconstructFunc, responses []interface{}) (pir.Row, error) {
+	row, err := reconstructFunc(responses)
+	if err != nil || c.verifyKey == nil {
+		return row, err
+	}
+	return row[:len(row)-pir.TagLen], nil
+}
+
+func (c *Client) answer(queryReq []pir.QueryReq) ([]interface{}, error) {
+	responses := make([]interface{}, len(queryReq))
+	errs := make([]error, len(queryReq))
 
 	if c.CallAsync {
 		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			errs[pir.Left] = c.servers[pir.Left].Answer(queryReq[pir.Left], &responses[pir.Left])
-		}()
-		go func() {
-			defer wg.Done()
-			errs[pir.Right] = c.servers[pir.Right].Answer(queryReq[pir.Right], &responses[pir.Right])
-		}()
+		wg.Add(len(queryReq))
+		for s := range queryReq {
+			go func(s int) {
+				defer wg.Done()
+				errs[s] = c.servers[s].Answer(queryReq[s], &responses[s])
+			}(s)
+		}
 		wg.Wait()
 	} else {
-		errs[pir.Left] = c.servers[pir.Left].Answer(queryReq[pir.Left], &responses[pir.Left])
-		errs[pir.Right] = c.servers[pir.Right].Answer(queryReq[pir.Right], &responses[pir.Right])
+		for s := range queryReq {
+			errs[s] = c.servers[s].Answer(queryReq[s], &responses[s])
+		}
 	}
-	if errs[pir.Left] != nil {
-		return nil, errs[pir.Left]
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return responses, nil
+}
+
+type savedClient struct {
+	Waterfall        []byte
+	InitialTimestamp int
+	DefragTimestamp  int
+	RowLen           int
+	MaxRecordChunks  int
+	KeyWidth         int
+	Ops              []dbOp
+	// The data of the update ops, in order.
+	Deltas []pir.Row
+}
+
+// MarshalBinary saves the state of the client, so that a restarted client
+// can be restored with UnmarshalBinary and brought up to date with Update
+// instead of Init.
+func (c *Client) MarshalBinary() ([]byte, error) {
+	waterfall, err := c.waterfall.MarshalBinary()
+	if err != nil {
+		return nil, err
 	}
-	if errs[pir.Right] != nil {
-		return nil, errs[pir.Left]
+	var deltas []pir.Row
+	for _, op := range c.ops {
+		if op.Update {
+			deltas = append(deltas, op.data)
+		}
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&savedClient{
+		Waterfall:        waterfall,
+		InitialTimestamp: c.initialTimestamp,
+		DefragTimestamp:  c.defragTimestamp,
+		RowLen:           c.rowLen,
+		MaxRecordChunks:  c.maxRecordChunks,
+		KeyWidth:         c.keyWidth,
+		Ops:              c.ops,
+		Deltas:           deltas,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	return reconstructFunc(responses)
+// UnmarshalBinary restores a client saved with MarshalBinary. The client
+// must have been created by NewClient with the same PIR type.
+func (c *Client) UnmarshalBinary(data []byte) error {
+	var saved savedClient
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return err
+	}
+	if err := c.waterfall.UnmarshalBinary(saved.Waterfall); err != nil {
+		return err
+	}
+	c.initialTimestamp = saved.InitialTimestamp
+	c.defragTimestamp = saved.DefragTimestamp
+	c.rowLen = saved.RowLen
+	c.maxRecordChunks = saved.MaxRecordChunks
+	c.keyWidth = saved.KeyWidth
+	c.ops = saved.Ops
+	for i := range c.ops {
+		if c.ops[i].Update {
+			if len(saved.Deltas) == 0 {
+				return fmt.Errorf("Saved client is missing updates")
+			}
+			c.ops[i].data, saved.Deltas = saved.Deltas[0], saved.Deltas[1:]
+		}
+	}
+	c.numRows = 0
+	c.resetPositions()
+	c.updatePositionMap(0)
+	return nil
 }
 
+// Keys returns the keys of a database of 4-byte keys.
 func (c *Client) Keys() []uint32 {
-	keys := make([]uint32, 0, len(c.keyToPos))
-	for k := range c.keyToPos {
-		keys = append(keys, k)
+	return keysToUint32s(c.AllKeys())
+}
+
+// AllKeys returns the keys of the database, of any width.
+func (c *Client) AllKeys() []Key {
+	return c.keyToPos.keys()
+}
+
+// KeyWidth returns the number of bytes of the keys of the database.
+func (c *Client) KeyWidth() int {
+	if c.keyWidth == 0 {
+		return DefaultKeyWidth
 	}
-	return keys
+	return c.keyWidth
 }
 
 func (c *Client) processKeyUpdate(keyResp *KeyUpdatesResp) (numNewRows int, err error) {
 	c.rowLen = keyResp.RowLen
+	c.maxRecordChunks = keyResp.MaxRecordChunks
 	if keyResp.ShouldDeleteHistory {
 		c.ops = []dbOp{}
 		c.numRows = 0
 		c.initialTimestamp = int(keyResp.InitialTimestamp)
 		c.defragTimestamp = keyResp.DefragTimestamp
-		c.keyToPos = make(map[uint32]int32)
+		c.resetPositions()
 		c.totalKeyUpdateBytes = 0
 		c.waterfall.reset()
 	}
-	var keys []uint32
-	if keyResp.KeysRice != nil {
+	// Servers from before key widths only send 4-byte keys.
+	c.keyWidth = keyResp.KeyWidth
+	if c.keyWidth == 0 {
+		c.keyWidth = DefaultKeyWidth
+	}
+	var keys []Key
+	switch {
+	case keyResp.KeysRice != nil:
 		c.totalKeyUpdateBytes += len(keyResp.KeysRice.EncodedData)
-		var err error
-		keys, err = DecodeRiceIntegers(keyResp.KeysRice)
+		ints, err := DecodeRiceIntegers(keyResp.KeysRice)
 		if err != nil {
 			return 0, fmt.Errorf("Failed to Rice-decode key updates: %v", err)
 		}
-	} else {
-		keys = keyResp.Keys
+		keys = keysFromUint32s(ints)
+	case keyResp.WideKeysRice != nil:
+		c.totalKeyUpdateBytes += len(keyResp.WideKeysRice.EncodedData)
+		var err error
+		if keys, err = DecodeRiceKeys(keyResp.WideKeysRice); err != nil {
+			return 0, fmt.Errorf("Failed to Rice-decode key updates: %v", err)
+		}
+	case keyResp.WideKeys != nil:
+		c.totalKeyUpdateBytes += len(keyResp.WideKeys) + len(keyResp.IsDeletion)
+		var err error
+		if keys, err = splitKeys(keyResp.WideKeys, c.keyWidth); err != nil {
+			return 0, err
+		}
+	default:
+		keys = keysFromUint32s(keyResp.Keys)
 		c.totalKeyUpdateBytes += 4*len(keyResp.Keys) + len(keyResp.IsDeletion)
 	}
+	for _, key := range keys {
+		if len(key) != c.keyWidth {
+			return 0, fmt.Errorf("Key %s has %d bytes, expected: %d", key, len(key), c.keyWidth)
+		}
+	}
+	c.totalKeyUpdateBytes += len(keyResp.IsUpdate) + len(keyResp.IsAppend)
+	for _, delta := range keyResp.Deltas {
+		c.totalKeyUpdateBytes += len(delta)
+	}
 
 	newOps := make([]dbOp, len(keys))
+	deltas := keyResp.Deltas
 	for i := range keys {
 		isDelete := len(keyResp.IsDeletion) > 0 && (keyResp.IsDeletion[i/8]&(1<<(i%8))) != 0
+		isUpdate := len(keyResp.IsUpdate) > 0 && (keyResp.IsUpdate[i/8]&(1<<(i%8))) != 0
+		isAppend := len(keyResp.IsAppend) > 0 && (keyResp.IsAppend[i/8]&(1<<(i%8))) != 0
 		newOps[i] = dbOp{
 			Key:    keys[i],
 			Delete: isDelete,
+			Update: isUpdate,
+			Append: isAppend,
+		}
+		if isUpdate {
+			if len(deltas) == 0 {
+				return 0, fmt.Errorf("Missing value of updated key %s", keys[i])
+			}
+			newOps[i].data, deltas = deltas[0], deltas[1:]
 		}
 	}
+	if len(deltas) > 0 {
+		return 0, fmt.Errorf("%d values of updated keys in excess", len(deltas))
+	}
 
 	if keyResp.DefragTimestamp > c.defragTimestamp {
 		defraggedOps, _ := defrag(c.ops, keyResp.DefragTimestamp-c.initialTimestamp)
@@ -174,7 +452,7 @@ func (c *Client) processKeyUpdate(keyResp *KeyUpdatesResp) (numNewRows int, err
 		c.initialTimestamp += (len(c.ops) - len(defraggedOps))
 		c.ops = append(defraggedOps, newOps...)
 		c.numRows = 0
-		c.keyToPos = make(map[uint32]int32)
+		c.resetPositions()
 		newOps = c.ops
 		c.waterfall.reset()
 	} else {
@@ -182,7 +460,7 @@ func (c *Client) processKeyUpdate(keyResp *KeyUpdatesResp) (numNewRows int, err
 	}
 	numNewRows = 0
 	for _, op := range newOps {
-		if !op.Delete {
+		if !op.Delete && !op.Update {
 			numNewRows++
 		}
 	}
@@ -195,16 +473,37 @@ func (c *Client) processKeyUpdate(keyResp *KeyUpdatesResp) (numNewRows int, err
 func (c *Client) updatePositionMap(fromOpNumber int) {
 	for i := fromOpNumber; i < len(c.ops); i++ {
 		op := c.ops[i]
+		pos, exists := c.keyToPos.get(op.Key)
+		if op.Update {
+			if exists {
+				c.waterfall.ApplyUpdate(int(pos), op.data)
+			}
+			continue
+		}
+		if exists && op.Append {
+			c.olderPos[op.Key] = append(c.olderPos[op.Key], pos)
+		} else if exists {
+			c.waterfall.dropUpdate(int(pos))
+			for _, older := range c.olderPos[op.Key] {
+				c.waterfall.dropUpdate(int(older))
+			}
+			delete(c.olderPos, op.Key)
+		}
 		if op.Delete {
 			// propagate deletes backwards to previous layers
-			delete(c.keyToPos, op.Key)
+			c.keyToPos.delete(op.Key)
 			continue
 		}
-		c.keyToPos[op.Key] = int32(c.numRows)
+		c.keyToPos.set(op.Key, int32(c.numRows))
 		c.numRows++
 	}
 }
 
+func (c *Client) resetPositions() {
+	c.keyToPos = newPosMap()
+	c.olderPos = make(map[Key][]int32)
+}
+
 type compressedMap struct {
 	Present []byte
 	Keys    []int32
@@ -225,12 +524,16 @@ func compressPosMap(k2v map[uint32]int32, valRange int) compressedMap {
 }
 
 func (c *Client) keysSizeWithRice() (int, error) {
-	keys := make([]uint32, 0)
-	for k := range c.keyToPos {
-		keys = append(keys, k)
-	}
+	keys := c.AllKeys()
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	rice, err := EncodeRiceIntegers(keys)
+	if c.KeyWidth() != DefaultKeyWidth {
+		rice, err := EncodeRiceKeys(keys, c.KeyWidth())
+		if err != nil {
+			return 0, err
+		}
+		return len(rice.EncodedData), nil
+	}
+	rice, err := EncodeRiceIntegers(keysToUint32s(keys))
 	if err != nil {
 		return 0, err
 	}
@@ -240,7 +543,7 @@ func (c *Client) keysSizeWithRice() (int, error) {
 func (c *Client) StorageNumBytes(sizeFunc func(interface{}) (int, error)) int {
 	bitsPerKey, fixedSize := c.waterfall.State()
 
-	if c.waterfall.pirType != pir.Punc {
+	if !hasServerHint(c.waterfall.pirType) {
 		numBytes, err := c.keysSizeWithRice()
 		if err != nil {
 			log.Fatalf("%s", err)
@@ -250,9 +553,13 @@ func (c *Client) StorageNumBytes(sizeFunc func(interface{}) (int, error)) int {
 	}
 
 	// Add key size
-	bitsPerKey += 32
+	bitsPerKey += 8 * c.KeyWidth()
+	numValues := c.keyToPos.len()
+	for _, older := range c.olderPos {
+		numValues += len(older)
+	}
 	// Add one bit per row for 'is deleted' bitmap
-	numBytes := (len(c.keyToPos)*bitsPerKey + c.numRows) / 8
+	numBytes := (numValues*bitsPerKey + c.numRows) / 8
 	numBytes += fixedSize
 	return numBytes
 }
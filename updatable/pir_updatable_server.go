@@ -6,13 +6,19 @@ import (
 	"sort"
 
 	"checklist/pir"
-
-	"github.com/elliotchance/orderedmap"
 )
 
+// dbOp adds a row that replaces the values of a key, deletes all the
+// values of a key, or, if Update is set, changes the latest value of a key
+// in place. The data of an update is the XOR of the old and the new value,
+// and the row keeps its position in the database. If Append is set, the
+// added row is another value of the key, after those that it has. Added
+// rows are only kept in StaticDB.
 type dbOp struct {
-	Key    uint32
+	Key    Key
 	Delete bool
+	Update bool
+	Append bool
 	data   pir.Row
 }
 
@@ -21,71 +27,248 @@ type Server struct {
 	initialTimestamp int
 	defragTimestamp  int
 	ops              []dbOp
-	kv               *orderedmap.OrderedMap
+	kv               *keyStore
 
 	curTimestamp int32
 
 	defragRatio float64
+
+	// Number of chunks of every record, and the record of every chunk
+	// other than the first.
+	records         map[uint32]int
+	chunkOwner      map[uint32]uint32
+	maxRecordChunks int
+
+	// Width of the keys, if not DefaultKeyWidth.
+	keyWidth int
+
+	// The smallestLayerSizeOverride of the clients, for the cost model of
+	// updates.
+	smallestLayerSizeOverride int
+
+	// On-disk log and snapshots of a server opened with OpenServer, or nil.
+	persist *serverLog
 }
 
 func NewUpdatableServer() *Server {
 	s := Server{
 		curTimestamp: 0,
 		defragRatio:  4,
-		kv:           orderedmap.NewOrderedMap(),
+		kv:           newKeyStore(),
 	}
 	return &s
 }
 
-func (s *Server) Row(idx int) (uint32, pir.Row, error) {
-	for e, pos := s.kv.Front(), 0; e != nil; e, pos = e.Next(), pos+1 {
-		if pos == idx {
-			return uint32(e.Key.(uint32)), pir.Row(e.Value.(pir.Row)), nil
+// SetKeyWidth sets the number of bytes of the keys of an empty database.
+// The methods that take uint32 keys need the default width of 4 bytes.
+func (s *Server) SetKeyWidth(width int) error {
+	if err := validateKeyWidth(width); err != nil {
+		return err
+	}
+	if len(s.ops) > 0 {
+		return fmt.Errorf("Cannot change the key width of a database with keys")
+	}
+	if err := s.log(logEntry{Kind: logSetKeyWidth, KeyWidth: width}); err != nil {
+		return err
+	}
+	s.setKeyWidth(width)
+	return nil
+}
+
+func (s *Server) setKeyWidth(width int) {
+	s.keyWidth = width
+}
+
+func (s *Server) KeyWidth() int {
+	if s.keyWidth == 0 {
+		return DefaultKeyWidth
+	}
+	return s.keyWidth
+}
+
+func (s *Server) checkKeys(keys []Key) error {
+	for _, key := range keys {
+		if len(key) != s.KeyWidth() {
+			return fmt.Errorf("Key %s has %d bytes, expected: %d", key, len(key), s.KeyWidth())
 		}
 	}
-	return 0, nil, fmt.Errorf("Index %d out of bounds [0:%d)", idx, s.kv.Len())
+	return nil
+}
+
+// Row returns the key and the value at a position in the order in which
+// the keys were first added, in a database of 4-byte keys.
+func (s *Server) Row(idx int) (uint32, pir.Row, error) {
+	if s.KeyWidth() != DefaultKeyWidth {
+		return 0, nil, fmt.Errorf("Database has %d-byte keys", s.KeyWidth())
+	}
+	key, row, err := s.RowWithKey(idx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return key.Uint32(), row, nil
+}
+
+// RowWithKey is like Row for keys of any width.
+func (s *Server) RowWithKey(idx int) (Key, pir.Row, error) {
+	e, ok := s.kv.at(idx)
+	if !ok {
+		return "", nil, fmt.Errorf("Index %d out of bounds [0:%d)", idx, s.kv.Len())
+	}
+	return e.key, s.value(e), nil
+}
+
+// Value returns the current value of a key, or its latest value if it has
+// several.
+func (s *Server) Value(key Key) (pir.Row, bool) {
+	e, ok := s.kv.get(key)
+	if !ok {
+		return nil, false
+	}
+	return s.value(e), true
+}
+
+// Values returns all the values of a key, in the order in which they were
+// added.
+func (s *Server) Values(key Key) []pir.Row {
+	var rows []pir.Row
+	for _, e := range s.kv.values(key) {
+		rows = append(rows, s.value(e))
+	}
+	return rows
+}
+
+// RowIndex returns the position in StaticDB of the row of the latest value
+// of a key. The row does not include the updates since the last
+// defragmentation.
+func (s *Server) RowIndex(key Key) (int, bool) {
+	e, ok := s.kv.get(key)
+	if !ok {
+		return 0, false
+	}
+	return e.row, true
 }
 
+func (s *Server) value(e *storeEntry) pir.Row {
+	row := make(pir.Row, s.RowLen)
+	copy(row, s.StaticDB.Row(e.row))
+	if e.pending != nil {
+		xorInto(row, e.pending)
+	}
+	return row
+}
+
+// NumKeys returns the number of rows that clients see, which is the number
+// of keys unless some keys have several values.
 func (s *Server) NumKeys() int {
 	return s.kv.Len()
 }
 
+// SomeKeys returns the first num keys of a database of 4-byte keys, or
+// zeros after the last key.
 func (s *Server) SomeKeys(num int) []uint32 {
 	keys := make([]uint32, num)
-	for e, pos := s.kv.Front(), 0; e != nil; e, pos = e.Next(), pos+1 {
-		if pos == num {
-			break
-		}
-		keys[pos] = uint32(e.Key.(uint32))
+	for i, key := range s.FirstKeys(num) {
+		keys[i] = key.Uint32()
 	}
+	return keys
+}
 
+// FirstKeys returns up to num keys, in the order of Row, with a key of
+// several values once per value.
+func (s *Server) FirstKeys(num int) []Key {
+	keys := make([]Key, 0, num)
+	s.kv.each(func(e *storeEntry) bool {
+		if len(keys) == num {
+			return false
+		}
+		keys = append(keys, e.key)
+		return true
+	})
 	return keys
 }
 
 func (s *Server) AddRows(keys []uint32, rows []pir.Row) {
+	s.AddRowsWithKeys(keysFromUint32s(keys), rows)
+}
+
+// AddRowsWithKeys is like AddRows for keys of any width.
+func (s *Server) AddRowsWithKeys(keys []Key, rows []pir.Row) {
+	if len(rows) == 0 {
+		return
+	}
+	if s.RowLen != 0 && s.RowLen != len(rows[0]) {
+		log.Fatalf("Different row length added, expected: %d, got: %d", s.RowLen, len(rows[0]))
+	}
+	if err := s.checkKeys(keys); err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.mustLog(logEntry{Kind: logAddRows, Keys: keys, Rows: rowsOf(rows)})
+	s.addRows(keys, rows)
+	s.maybeSnapshot()
+}
+
+// AppendRows adds rows as other values of their keys, after the values
+// that the keys have, such as the full hashes that share a hash prefix.
+// Keys that appear several times get all their rows, in order. AddRows
+// replaces all the values of a key, DeleteRows deletes them all, and
+// UpdateRows changes the latest. Keys of records must not get other values.
+func (s *Server) AppendRows(keys []uint32, rows []pir.Row) {
+	s.AppendRowsWithKeys(keysFromUint32s(keys), rows)
+}
+
+// AppendRowsWithKeys is like AppendRows for keys of any width.
+func (s *Server) AppendRowsWithKeys(keys []Key, rows []pir.Row) {
+	if len(rows) == 0 {
+		return
+	}
+	if s.RowLen != 0 && s.RowLen != len(rows[0]) {
+		log.Fatalf("Different row length added, expected: %d, got: %d", s.RowLen, len(rows[0]))
+	}
+	if err := s.checkKeys(keys); err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.mustLog(logEntry{Kind: logAppendRows, Keys: keys, Rows: rowsOf(rows)})
+	s.appendRows(keys, rows)
+	s.maybeSnapshot()
+}
+
+func (s *Server) addRows(keys []Key, rows []pir.Row) {
+	s.insertRows(keys, rows, false)
+}
+
+func (s *Server) appendRows(keys []Key, rows []pir.Row) {
+	s.insertRows(keys, rows, true)
+}
+
+func (s *Server) insertRows(keys []Key, rows []pir.Row, appendValues bool) {
 	if len(rows) == 0 {
 		return
 	}
 	if s.RowLen == 0 {
 		s.RowLen = len(rows[0])
-	} else if s.RowLen != len(rows[0]) {
-		log.Fatalf("Different row length added, expected: %d, got: %d", s.RowLen, len(rows[0]))
 	}
 
 	ops := make([]dbOp, len(keys))
 	for i := range keys {
-		ops[i] = dbOp{Key: keys[i], data: rows[i]}
+		ops[i] = dbOp{Key: keys[i], Append: appendValues, data: rows[i]}
 	}
 
-	sort.Slice(ops, func(i, j int) bool { return ops[i].Key < ops[j].Key })
+	// The values of a key keep their order.
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Key < ops[j].Key })
 
+	s.FlatDb = append(s.FlatDb[:s.NumRows*s.RowLen], opsToFlatDB(ops)...)
 	for i := range ops {
-		s.kv.Set(ops[i].Key, ops[i].data)
+		if appendValues {
+			s.kv.append(ops[i].Key, s.NumRows+i)
+		} else {
+			s.kv.set(ops[i].Key, s.NumRows+i)
+		}
+		// The row is only kept in StaticDB.
+		ops[i].data = nil
 	}
 
 	s.ops = append(s.ops, ops...)
 	s.NumRows += len(rows)
-	s.FlatDb = append(s.FlatDb, opsToFlatDB(ops)...)
 }
 
 func opsToFlatDB(ops []dbOp) []byte {
@@ -103,29 +286,251 @@ func opsToFlatDB(ops []dbOp) []byte {
 }
 
 func (s *Server) DeleteRows(keys []uint32) {
+	s.DeleteRowsWithKeys(keysFromUint32s(keys))
+}
+
+// DeleteRowsWithKeys is like DeleteRows for keys of any width.
+func (s *Server) DeleteRowsWithKeys(keys []Key) {
+	if err := s.checkKeys(keys); err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.mustLog(logEntry{Kind: logDeleteRows, Keys: keys})
+	s.deleteRows(keys)
+	s.maybeSnapshot()
+}
+
+func (s *Server) deleteRows(keys []Key) {
 	ops := make([]dbOp, len(keys))
 	for i := range keys {
 		ops[i] = dbOp{Key: keys[i], Delete: true}
-		s.kv.Delete(keys[i])
+		s.kv.delete(keys[i])
 	}
 	s.ops = append(s.ops, ops...)
+	s.maybeDefrag()
+}
 
+func (s *Server) maybeDefrag() {
 	if len(s.ops) > int(s.defragRatio*float64(s.kv.Len())) {
 		endDefrag := len(s.ops) / 2
+		s.compactRows(endDefrag)
 		newOps, _ := defrag(s.ops, endDefrag)
 		s.defragTimestamp = s.initialTimestamp + endDefrag
 		s.initialTimestamp += (len(s.ops) - len(newOps))
 		s.ops = newOps
-		s.StaticDB = *pir.StaticDBFromRows(opsToRows(s.ops))
+		s.refreshPending()
+	}
+}
+
+// liveAdds returns the positions of the ops that added the values that
+// every key has after ops, in order.
+func liveAdds(ops []dbOp) map[Key][]int {
+	live := make(map[Key][]int)
+	for i, op := range ops {
+		switch {
+		case op.Update:
+		case op.Delete:
+			delete(live, op.Key)
+		case op.Append:
+			live[op.Key] = append(live[op.Key], i)
+		default:
+			live[op.Key] = []int{i}
+		}
+	}
+	return live
+}
+
+// keptOps marks the ops among the first n that add the values in live.
+func keptOps(live map[Key][]int, n int) []bool {
+	kept := make([]bool, n)
+	for _, adds := range live {
+		for _, i := range adds {
+			kept[i] = true
+		}
+	}
+	return kept
+}
+
+// compactRows moves the rows that defrag keeps among ops[:endDefrag]
+// forward in FlatDb, and the rows of the later ops after them, in place.
+// The updates among ops[:endDefrag] are applied to the rows that they
+// change.
+func (s *Server) compactRows(endDefrag int) {
+	kept := keptOps(liveAdds(s.ops[:endDefrag]), endDefrag)
+
+	keptRows := make(map[Key][]int)
+	oldRow, newRow := 0, 0
+	for i, op := range s.ops[:endDefrag] {
+		switch {
+		case op.Delete:
+		case op.Update:
+			// Updates before the first kept value of the key are
+			// dropped with the rows that they change, and the others
+			// change the latest value at the time.
+			if rows := keptRows[op.Key]; len(rows) > 0 {
+				xorInto(s.StaticDB.Row(rows[len(rows)-1]), op.data)
+			}
+		default:
+			if kept[i] {
+				if newRow != oldRow {
+					copy(s.StaticDB.Row(newRow), s.StaticDB.Row(oldRow))
+				}
+				keptRows[op.Key] = append(keptRows[op.Key], newRow)
+				newRow++
+			}
+			oldRow++
+		}
+	}
+	shift := oldRow - newRow
+	if shift == 0 {
+		return
+	}
+	copy(s.FlatDb[newRow*s.RowLen:], s.FlatDb[oldRow*s.RowLen:s.NumRows*s.RowLen])
+	s.NumRows -= shift
+	s.FlatDb = s.FlatDb[:s.NumRows*s.RowLen]
+	// The values of a key come in order, so the kept rows of a key are
+	// those of its first values.
+	next := make(map[Key]int)
+	s.kv.each(func(e *storeEntry) bool {
+		if e.row < oldRow {
+			e.row = keptRows[e.key][next[e.key]]
+			next[e.key]++
+		} else {
+			e.row -= shift
+		}
+		return true
+	})
+}
+
+// refreshPending recomputes the updates of every value that are not in
+// StaticDB from the ops.
+func (s *Server) refreshPending() {
+	s.kv.each(func(e *storeEntry) bool {
+		e.pending = nil
+		return true
+	})
+	live := liveAdds(s.ops)
+	for i, op := range s.ops {
+		adds := live[op.Key]
+		// Updates before the first value of the key change rows that
+		// are gone.
+		if !op.Update || len(adds) == 0 || i < adds[0] {
+			continue
+		}
+		values := s.kv.values(op.Key)
+		// The update changes the latest value at the time.
+		if j := sort.SearchInts(adds, i) - 1; j < len(values) {
+			values[j].pending = xorPending(values[j].pending, op.data)
+		}
+	}
+}
+
+// UpdateRows changes the values of existing keys. Only the latest value of
+// a key with several values changes.
+//
+// A value changed in place keeps its row: clients receive the XOR of the
+// old and the new value with the key updates and apply it to what they
+// read, so no hint is rebuilt. Otherwise the value is moved to a new row
+// as AddRows does. Changing in place costs every client a row per update,
+// and moving costs the hints of the layers that the new row passes
+// through, so values are changed in place when that is no more, by the
+// cost model of PlanWorkload for clients with the default configuration.
+// With the default layer sizes, the hints of a new row are smaller than
+// the row in databases of less than some tens of millions of rows, where
+// UpdateRows moves values and only saves the delete op of deleting and
+// adding the key. Keys with several values are always changed in place,
+// since adding would replace all their values.
+func (s *Server) UpdateRows(keys []uint32, rows []pir.Row) error {
+	return s.UpdateRowsWithKeys(keysFromUint32s(keys), rows)
+}
+
+// UpdateRowsWithKeys is like UpdateRows for keys of any width.
+func (s *Server) UpdateRowsWithKeys(keys []Key, rows []pir.Row) error {
+	if err := s.checkUpdate(keys, rows); err != nil {
+		return err
+	}
+	s.mustLog(logEntry{Kind: logUpdateRows, Keys: keys, Rows: rowsOf(rows)})
+	s.updateRows(keys, rows)
+	s.maybeSnapshot()
+	return nil
+}
+
+func (s *Server) checkUpdate(keys []Key, rows []pir.Row) error {
+	if len(keys) != len(rows) {
+		return fmt.Errorf("Mismatching number of keys and rows: %d != %d", len(keys), len(rows))
+	}
+	for i, key := range keys {
+		if _, ok := s.kv.get(key); !ok {
+			return fmt.Errorf("Key %s not found", key)
+		}
+		if len(rows[i]) != s.RowLen {
+			return fmt.Errorf("Different row length updated, expected: %d, got: %d", s.RowLen, len(rows[i]))
+		}
+	}
+	return nil
+}
+
+func (s *Server) updateRows(keys []Key, rows []pir.Row) {
+	inPlace := s.inPlaceCheaper()
+	var movedKeys []Key
+	var movedRows []pir.Row
+	for i, key := range keys {
+		e, _ := s.kv.get(key)
+		if !inPlace && e.prev == nil {
+			movedKeys = append(movedKeys, key)
+			movedRows = append(movedRows, rows[i])
+			continue
+		}
+		delta := xorRows(s.value(e), rows[i])
+		s.ops = append(s.ops, dbOp{Key: key, Update: true, data: delta})
+		e.pending = xorPending(e.pending, delta)
+	}
+	s.insertRows(movedKeys, movedRows, false)
+	s.maybeDefrag()
+}
+
+// inPlaceCheaper reports whether sending clients the change of a value
+// costs them no more than the hints of a new row, for clients with the
+// default configuration. It only depends on the database, so that updates
+// replayed from the log make the same ops.
+func (s *Server) inPlaceCheaper() bool {
+	w := Workload{NumRows: s.kv.Len(), RowLen: s.RowLen}
+	waterfall := NewWaterfallClient(nil, pir.Punc)
+	waterfall.smallestLayerSizeOverride = s.smallestLayerSizeOverride
+	plan := w.planWaterfall(waterfall)
+	return plan != nil && float64(s.RowLen) <= plan.AddedRowBytes
+}
+
+func xorRows(a, b pir.Row) pir.Row {
+	out := make(pir.Row, len(a))
+	copy(out, a)
+	xorInto(out, b)
+	return out
+}
+
+func xorInto(dst, src pir.Row) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// xorPending adds an update to the pending updates of a key.
+func xorPending(pending, delta pir.Row) pir.Row {
+	if pending == nil {
+		return append(pir.Row(nil), delta...)
 	}
+	xorInto(pending, delta)
+	return pending
 }
 
 func (s *Server) KeyUpdates(req KeyUpdatesReq, resp *KeyUpdatesResp) error {
 	resp.DefragTimestamp = s.defragTimestamp
 	resp.RowLen = s.RowLen
+	resp.MaxRecordChunks = s.maxRecordChunks
+	resp.KeyWidth = s.KeyWidth()
 
 	nextTimestamp := int(req.NextTimestamp)
-	if nextTimestamp < s.defragTimestamp {
+	// A client of a database with other keys starts over.
+	if nextTimestamp < s.defragTimestamp || (req.KeyWidth != 0 && int(req.KeyWidth) != s.KeyWidth()) {
 		resp.ShouldDeleteHistory = true
 		nextTimestamp = s.initialTimestamp
 	}
@@ -139,7 +544,7 @@ func (s *Server) KeyUpdates(req KeyUpdatesReq, resp *KeyUpdatesResp) error {
 	}
 
 	var err error
-	if opsToKeyUpdates(s.ops[firstPos:], resp) != nil {
+	if opsToKeyUpdates(s.ops[firstPos:], s.KeyWidth(), resp) != nil {
 		return fmt.Errorf("Failed to convert ops to keys: %v", err)
 	}
 	resp.InitialTimestamp = int32(s.initialTimestamp + firstPos)
@@ -147,66 +552,66 @@ func (s *Server) KeyUpdates(req KeyUpdatesReq, resp *KeyUpdatesResp) error {
 }
 
 func defrag(ops []dbOp, endDefrag int) (newOps []dbOp, numRemoved int) {
-	freed := 0
-
-	keyToPos := make(map[uint32]int)
-	for i, op := range ops[0:endDefrag] {
-		_, prevExists := keyToPos[op.Key]
-		if prevExists {
-			numRemoved++
-			freed++
-		}
-		if op.Delete {
-			freed++
-			delete(keyToPos, op.Key)
-		} else {
-			keyToPos[op.Key] = i
-		}
-	}
+	// The server applies updates to the rows that it keeps, so only the
+	// adds of the values that keys have are kept.
+	kept := keptOps(liveAdds(ops[:endDefrag]), endDefrag)
 
 	// Push forward all defragmented rows
-	newOps = make([]dbOp, len(ops)-freed)
-	newPos := 0
+	newOps = make([]dbOp, 0, len(ops))
 	for i, op := range ops[0:endDefrag] {
-		if pos, ok := keyToPos[op.Key]; ok && pos == i {
-			newOps[newPos] = op
-			newPos++
+		if kept[i] {
+			newOps = append(newOps, op)
+		} else if !op.Delete && !op.Update {
+			numRemoved++
 		}
 	}
-	copy(newOps[newPos:], ops[endDefrag:])
+	newOps = append(newOps, ops[endDefrag:]...)
 	return newOps, numRemoved
 }
 
-func opsToKeyUpdates(ops []dbOp, keyUpdate *KeyUpdatesResp) error {
-	keys := make([]uint32, len(ops))
+func opsToKeyUpdates(ops []dbOp, keyWidth int, keyUpdate *KeyUpdatesResp) error {
+	keys := make([]Key, len(ops))
 	keyUpdate.IsDeletion = make([]uint8, (len(keys)-1)/8+1)
 	hasDeletion := false
+	keyUpdate.IsUpdate = make([]uint8, (len(keys)-1)/8+1)
+	keyUpdate.Deltas = nil
+	keyUpdate.IsAppend = make([]uint8, (len(keys)-1)/8+1)
+	hasAppend := false
 	for j := range keys {
 		keys[j] = ops[j].Key
 		if ops[j].Delete {
 			keyUpdate.IsDeletion[j/8] |= (1 << (j % 8))
 			hasDeletion = true
 		}
+		if ops[j].Update {
+			keyUpdate.IsUpdate[j/8] |= (1 << (j % 8))
+			keyUpdate.Deltas = append(keyUpdate.Deltas, ops[j].data)
+		}
+		if ops[j].Append {
+			keyUpdate.IsAppend[j/8] |= (1 << (j % 8))
+			hasAppend = true
+		}
+	}
+	if !hasAppend {
+		keyUpdate.IsAppend = nil
 	}
 	if !hasDeletion {
 		keyUpdate.IsDeletion = nil
 	}
-	if sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] }) {
-		var err error
-		keyUpdate.KeysRice, err = EncodeRiceIntegers(keys)
-		return err
-	} else {
-		keyUpdate.Keys = keys
-		return nil
+	if len(keyUpdate.Deltas) == 0 {
+		keyUpdate.IsUpdate = nil
 	}
-}
-
-func opsToRows(ops []dbOp) []pir.Row {
-	db := make([]pir.Row, 0, len(ops))
-	for _, op := range ops {
-		if !op.Delete {
-			db = append(db, op.data)
-		}
+	sorted := sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	var err error
+	switch {
+	case keyWidth == DefaultKeyWidth && sorted:
+		keyUpdate.KeysRice, err = EncodeRiceIntegers(keysToUint32s(keys))
+	case keyWidth == DefaultKeyWidth:
+		keyUpdate.Keys = keysToUint32s(keys)
+	case sorted:
+		keyUpdate.WideKeysRice, err = EncodeRiceKeys(keys, keyWidth)
+	default:
+		keyUpdate.WideKeys = flattenKeys(keys, keyWidth)
 	}
-	return db
+	return err
 }
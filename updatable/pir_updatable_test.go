@@ -1,6 +1,15 @@
 package updatable
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
 	"testing"
 
 	"checklist/pir"
@@ -38,6 +47,62 @@ func TestPIRUpdatableStatic(t *testing.T) {
 	testRead(t, keys, rows, servers)
 }
 
+func TestPIRUpdatablePerm(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1200, 100)
+
+	initialSize := 1000
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+
+	servers := [2]UpdatableServer{leftServer, rightServer}
+
+	client := NewClient(pir.RandSource(), pir.Perm, servers)
+	client.waterfall.smallestLayerSizeOverride = 10
+
+	leftServer.AddRows(keys[0:initialSize], rows[0:initialSize])
+	rightServer.AddRows(keys[0:initialSize], rows[0:initialSize])
+
+	assert.NilError(t, client.Init())
+
+	leftServer.AddRows(keys[initialSize:], rows[initialSize:])
+	rightServer.AddRows(keys[initialSize:], rows[initialSize:])
+
+	assert.NilError(t, client.Update())
+
+	for _, readIndex := range []int{2, len(rows) - 100, len(rows) - 1} {
+		val, err := client.Read(keys[readIndex])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[readIndex])
+	}
+}
+
+func TestPIRUpdatableLWE(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1200, 32)
+
+	initialSize := 1000
+
+	server := NewUpdatableServer()
+
+	// Single-server scheme: only the first server is used.
+	client := NewClient(pir.RandSource(), pir.LWE, [2]UpdatableServer{server, nil})
+	client.waterfall.smallestLayerSizeOverride = 10
+
+	server.AddRows(keys[0:initialSize], rows[0:initialSize])
+
+	assert.NilError(t, client.Init())
+
+	server.AddRows(keys[initialSize:], rows[initialSize:])
+
+	assert.NilError(t, client.Update())
+
+	for _, readIndex := range []int{2, len(rows) - 100, len(rows) - 1} {
+		val, err := client.Read(keys[readIndex])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[readIndex])
+	}
+}
+
 func TestPIRUpdatableInitAfterFewAdditions(t *testing.T) {
 	keys, rows := pir.MakeKeysRows(3000, 100)
 
@@ -140,6 +205,45 @@ func TestPIRUpdatableUpdateAfterFewAdditions(t *testing.T) {
 	assert.DeepEqual(t, val, rows[readIndex])
 }
 
+func TestPIRUpdatableSaveRestore(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1200, 100)
+
+	initialSize := 1000
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+
+	servers := [2]UpdatableServer{leftServer, rightServer}
+
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	client.waterfall.smallestLayerSizeOverride = 10
+
+	leftServer.AddRows(keys[0:initialSize], rows[0:initialSize])
+	rightServer.AddRows(keys[0:initialSize], rows[0:initialSize])
+
+	assert.NilError(t, client.Init())
+	_, err := client.Read(keys[5])
+	assert.NilError(t, err)
+
+	data, err := client.MarshalBinary()
+	assert.NilError(t, err)
+
+	leftServer.AddRows(keys[initialSize:], rows[initialSize:])
+	rightServer.AddRows(keys[initialSize:], rows[initialSize:])
+
+	restored := NewClient(pir.RandSource(), pir.Punc, servers)
+	restored.waterfall.smallestLayerSizeOverride = 10
+	assert.NilError(t, restored.UnmarshalBinary(data))
+	assert.Equal(t, len(restored.Keys()), initialSize)
+
+	assert.NilError(t, restored.Update())
+	for _, readIndex := range []int{5, 2, len(rows) - 100, len(rows) - 1} {
+		val, err := restored.Read(keys[readIndex])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[readIndex])
+	}
+}
+
 func TestPIRUpdatableMultipleUpdates(t *testing.T) {
 	initialSize := 1000
 	delta := 200
@@ -424,3 +528,743 @@ func TestPIRUpdatableInitAfterKeyOverride(t *testing.T) {
 	assert.NilError(t, err)
 	assert.DeepEqual(t, val, rows[initialSize+readIndex])
 }
+
+type countingServer struct {
+	UpdatableServer
+	numAnswers int
+}
+
+func (s *countingServer) Answer(q pir.QueryReq, resp *interface{}) error {
+	s.numAnswers++
+	return s.UpdatableServer.Answer(q, resp)
+}
+
+type countingHintServer struct {
+	UpdatableServer
+	numHints int
+}
+
+func (s *countingHintServer) Hint(req pir.HintReq, resp *pir.HintResp) error {
+	s.numHints++
+	return s.UpdatableServer.Hint(req, resp)
+}
+
+func TestPIRUpdatableRecords(t *testing.T) {
+	source := pir.RandSource()
+	keys := pir.MakeKeys(source, 50)
+	records := make([][]byte, len(keys))
+	for i := range records {
+		records[i] = make([]byte, source.Intn(200))
+		source.Read(records[i])
+	}
+	records[0] = nil
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	for _, s := range []*Server{leftServer, rightServer} {
+		assert.NilError(t, s.AddRecords(keys, records, 32))
+	}
+	left := &countingServer{UpdatableServer: leftServer}
+	client := NewClient(pir.RandSource(), pir.Punc, [2]UpdatableServer{left, rightServer})
+	assert.NilError(t, client.Init())
+
+	maxChunks := client.maxRecordChunks
+	for _, i := range []int{0, 1, 2, 30, 49} {
+		left.numAnswers = 0
+		record, err := client.ReadRecord(keys[i])
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(record, records[i]))
+		assert.Equal(t, left.numAnswers, maxChunks)
+	}
+
+	// Shrink a record and delete another one
+	shorter := records[1][:len(records[1])/4]
+	for _, s := range []*Server{leftServer, rightServer} {
+		assert.NilError(t, s.AddRecords(keys[1:2], [][]byte{shorter}, 32))
+		s.DeleteRecords(keys[2:3])
+	}
+	assert.NilError(t, client.Update())
+
+	record, err := client.ReadRecord(keys[1])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, record, shorter)
+	left.numAnswers = 0
+	_, err = client.ReadRecord(keys[2])
+	assert.ErrorContains(t, err, "not found")
+	assert.Equal(t, left.numAnswers, maxChunks)
+	assert.Equal(t, len(client.Keys()), leftServer.NumKeys())
+
+	// A failed query of a chunk is padded like the chunks that a record
+	// does not have.
+	i := 3
+	for recordNumChunks(len(records[i]), 32) < 2 {
+		i++
+	}
+	failing := &failingServer{UpdatableServer: leftServer, failAt: 1}
+	client.servers[pir.Left] = failing
+	_, err = client.ReadRecord(keys[i])
+	assert.ErrorContains(t, err, "answer failed")
+	assert.Equal(t, failing.numAnswers, maxChunks)
+}
+
+func TestPIRUpdatableLayerTypes(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(2000, 100)
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	servers := [2]UpdatableServer{leftServer, rightServer}
+
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	client.SetLayerTypes(LayerTypes{SmallLayerType: pir.Matrix, MinHintLayerSize: 1000})
+	client.waterfall.smallestLayerSizeOverride = 10
+
+	leftServer.AddRows(keys[0:1500], rows[0:1500])
+	rightServer.AddRows(keys[0:1500], rows[0:1500])
+	assert.NilError(t, client.Init())
+	for _, start := range []int{1500, 1700} {
+		end := start + 200
+		leftServer.AddRows(keys[start:end], rows[start:end])
+		rightServer.AddRows(keys[start:end], rows[start:end])
+		assert.NilError(t, client.Update())
+	}
+
+	numMatrixLayers := 0
+	for _, layer := range client.waterfall.layers {
+		if layer.numRows == 0 {
+			continue
+		}
+		if layer.maxSize >= 1000 {
+			assert.Equal(t, layer.pirType, pir.Punc)
+		} else {
+			assert.Equal(t, layer.pirType, pir.Matrix)
+			numMatrixLayers++
+		}
+	}
+	assert.Assert(t, numMatrixLayers > 0)
+	for _, i := range []int{2, 1600, 1899} {
+		val, err := client.Read(keys[i])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[i])
+	}
+}
+
+func TestPlanWorkload(t *testing.T) {
+	w := Workload{NumRows: 1 << 22, RowLen: 32, QueriesPerDay: 1000, UpdatesPerDay: 10000}
+	plan, err := PlanWorkload(w)
+	assert.NilError(t, err)
+	assert.Equal(t, plan.PirType, pir.Punc, "%v", plan)
+	last := plan.Layers[len(plan.Layers)-1]
+	assert.Assert(t, last.PirType != pir.Punc)
+	assert.Equal(t, plan.Layers[0].MaxSize, w.NumRows)
+	clientBytes := 0
+	for _, layer := range plan.Layers {
+		clientBytes += layer.Cost.ClientBytes
+	}
+	assert.Equal(t, plan.ClientBytes, clientBytes)
+	assert.Assert(t, plan.AddedRowBytes > 0)
+	assert.Assert(t, math.Abs(plan.OfflineBytesPerDay-w.UpdatesPerDay*plan.AddedRowBytes) < 1e-6*plan.OfflineBytesPerDay)
+
+	// Hints do not fit in the storage of the client.
+	w.MaxClientBytes = 1 << 20
+	plan, err = PlanWorkload(w)
+	assert.NilError(t, err)
+	assert.Assert(t, plan.PirType == pir.DPF || plan.PirType == pir.Matrix, "%v", plan)
+	assert.Equal(t, plan.ClientBytes, 0)
+
+	w.AllowNonPrivate = true
+	plan, err = PlanWorkload(w)
+	assert.NilError(t, err)
+	assert.Equal(t, plan.PirType, pir.NonPrivate)
+
+	w.AllowNonPrivate = false
+	w.MaxBytesPerDay = 1000
+	_, err = PlanWorkload(w)
+	assert.ErrorContains(t, err, "No PIR configuration fits")
+}
+
+func TestPIRUpdatablePersist(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1200, 32)
+	dirs := [2]string{t.TempDir(), t.TempDir()}
+	var persistent [2]*Server
+	for i, dir := range dirs {
+		s, err := OpenServer(dir)
+		assert.NilError(t, err)
+		persistent[i] = s
+	}
+	reference := NewUpdatableServer()
+	all := []*Server{persistent[0], persistent[1], reference}
+	recordKeys := pir.MakeKeys(pir.RandSource(), 3)
+
+	for _, s := range all {
+		s.AddRows(keys[:1000], rows[:1000])
+		s.DeleteRows(keys[:10])
+		assert.NilError(t, s.AddRecords(recordKeys, [][]byte{rows[0], nil, make([]byte, 100)}, 32))
+		assert.NilError(t, s.UpdateRows(keys[950:960], rows[1100:1110]))
+	}
+	client := NewClient(pir.RandSource(), pir.Punc, [2]UpdatableServer{persistent[0], persistent[1]})
+	assert.NilError(t, client.Init())
+
+	// Changes before and after a snapshot, with a defragmentation.
+	assert.NilError(t, persistent[0].Snapshot())
+	for _, s := range all {
+		s.AddRows(keys[1000:1100], rows[1000:1100])
+		for j := 10; j < 900; j += 100 {
+			s.DeleteRows(keys[j : j+100])
+		}
+		s.AddRows(keys[1100:], rows[1100:])
+		assert.NilError(t, s.UpdateRows(keys[955:965], rows[1110:1120]))
+		s.DeleteRecords(recordKeys[:1])
+	}
+	assert.Check(t, reference.defragTimestamp > 0)
+	for i, dir := range dirs {
+		assert.NilError(t, persistent[i].Close())
+		s, err := OpenServer(dir)
+		assert.NilError(t, err)
+		defer s.Close()
+		persistent[i] = s
+
+		assert.Equal(t, s.initialTimestamp, reference.initialTimestamp)
+		assert.Equal(t, s.defragTimestamp, reference.defragTimestamp)
+		assert.DeepEqual(t, s.SomeKeys(s.NumKeys()), reference.SomeKeys(reference.NumKeys()))
+		for _, key := range reference.SomeKeys(reference.NumKeys()) {
+			val, _ := s.Value(KeyFromUint32(key))
+			expected, _ := reference.Value(KeyFromUint32(key))
+			assert.DeepEqual(t, val, expected)
+		}
+		assert.Assert(t, bytes.Equal(s.FlatDb, reference.FlatDb))
+		assert.DeepEqual(t, s.records, reference.records)
+		assert.DeepEqual(t, s.chunkOwner, reference.chunkOwner)
+	}
+
+	// Clients get the same updates as before the restart.
+	req := KeyUpdatesReq{DefragTimestamp: int32(client.defragTimestamp), NextTimestamp: int32(client.nextTimestamp())}
+	var resp, expected KeyUpdatesResp
+	assert.NilError(t, persistent[0].KeyUpdates(req, &resp))
+	assert.NilError(t, reference.KeyUpdates(req, &expected))
+	assert.DeepEqual(t, resp, expected)
+	client.servers = [2]UpdatableServer{persistent[0], persistent[1]}
+	assert.NilError(t, client.Update())
+	val, err := client.Read(keys[1150])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rows[1150])
+	val, err = client.Read(keys[960])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rows[1115])
+}
+
+func TestPIRUpdatablePersistTornLog(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(200, 32)
+	dir := t.TempDir()
+	s, err := OpenServer(dir)
+	assert.NilError(t, err)
+	s.AddRows(keys[:100], rows[:100])
+	s.AddRows(keys[100:], rows[100:])
+	assert.NilError(t, s.Close())
+
+	// Cut the last entry short, as if the server crashed while writing it.
+	path := logPath(dir, 0)
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Truncate(path, info.Size()-10))
+
+	s, err = OpenServer(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, s.NumKeys(), 100)
+	s.AddRows(keys[100:], rows[100:])
+	assert.NilError(t, s.Close())
+
+	s, err = OpenServer(dir)
+	assert.NilError(t, err)
+	defer s.Close()
+	reference := NewUpdatableServer()
+	reference.AddRows(keys[:100], rows[:100])
+	reference.AddRows(keys[100:], rows[100:])
+	assert.Equal(t, s.NumKeys(), 200)
+	assert.Assert(t, bytes.Equal(s.FlatDb, reference.FlatDb))
+}
+
+func TestPIRUpdatableUpdateInPlace(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1100, 32)
+	newRows := pir.MakeRows(pir.RandSource(), 20, 32)
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	servers := [2]UpdatableServer{leftServer, rightServer}
+	for _, s := range []*Server{leftServer, rightServer} {
+		// Rows are updated in place when the layers that new rows pass
+		// through have hints.
+		s.smallestLayerSizeOverride = 100
+		s.AddRows(keys[:1000], rows[:1000])
+	}
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	assert.NilError(t, client.Init())
+
+	// Update a key twice and a few others once, with no hint request.
+	counting := &countingHintServer{UpdatableServer: leftServer}
+	client.servers[pir.Left] = counting
+	for _, s := range []*Server{leftServer, rightServer} {
+		assert.NilError(t, s.UpdateRows(keys[0:10], newRows[0:10]))
+		assert.NilError(t, s.UpdateRows(keys[5:6], newRows[10:11]))
+	}
+	assert.NilError(t, client.Update())
+	assert.Equal(t, counting.numHints, 0)
+	assert.Equal(t, leftServer.NumRows, 1000)
+	for _, i := range []int{0, 5, 9, 10} {
+		expected := rows[i]
+		if i < 10 {
+			expected = newRows[i]
+		}
+		if i == 5 {
+			expected = newRows[10]
+		}
+		val, err := client.Read(keys[i])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, expected)
+	}
+	row, _ := leftServer.Value(KeyFromUint32(keys[5]))
+	assert.DeepEqual(t, row, newRows[10])
+
+	// Updates survive saving the client, and replacing or deleting keys.
+	data, err := client.MarshalBinary()
+	assert.NilError(t, err)
+	restored := NewClient(pir.RandSource(), pir.Punc, servers)
+	assert.NilError(t, restored.UnmarshalBinary(data))
+	for _, s := range []*Server{leftServer, rightServer} {
+		s.AddRows(keys[0:1], rows[1000:1001])
+		s.DeleteRows(keys[1:2])
+		s.AddRows(keys[1000:], rows[1000:])
+	}
+	assert.NilError(t, restored.Update())
+	val, err := restored.Read(keys[0])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rows[1000])
+	_, err = restored.Read(keys[1])
+	assert.Equal(t, err, pir.ErrKeyNotFound)
+	val, err = restored.Read(keys[5])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, newRows[10])
+
+	assert.ErrorContains(t, leftServer.UpdateRows(keys[1:2], newRows[:1]), "not found")
+}
+
+func TestPIRUpdatableDefragUpdates(t *testing.T) {
+	for _, inPlace := range []bool{true, false} {
+		t.Run(fmt.Sprintf("InPlace=%v", inPlace), func(t *testing.T) {
+			testDefragUpdates(t, inPlace)
+		})
+	}
+}
+
+func testDefragUpdates(t *testing.T, inPlace bool) {
+	const rowLen = 100
+	keys, rows := pir.MakeKeysRows(20, rowLen)
+	source := pir.RandSource()
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	servers := [2]UpdatableServer{leftServer, rightServer}
+	for _, s := range []*Server{leftServer, rightServer} {
+		// Without layers smaller than the database, no layer has a hint
+		// and values are moved.
+		if inPlace {
+			s.smallestLayerSizeOverride = 10
+		}
+		s.AddRows(keys, rows)
+	}
+	assert.Equal(t, leftServer.inPlaceCheaper(), inPlace)
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	client.waterfall.smallestLayerSizeOverride = 10
+	assert.NilError(t, client.Init())
+
+	// Enough updates to defragment, between which the client updates.
+	latest := append([]pir.Row{}, rows...)
+	for i := 0; i < len(rows)*10; i++ {
+		j := source.Intn(len(keys))
+		latest[j] = pir.MakeRows(source, 1, rowLen)[0]
+		for _, s := range []*Server{leftServer, rightServer} {
+			assert.NilError(t, s.UpdateRows(keys[j:j+1], latest[j:j+1]))
+		}
+		if i%7 == 0 {
+			assert.NilError(t, client.Update())
+		}
+	}
+	assert.NilError(t, client.Update())
+
+	assert.Check(t, leftServer.defragTimestamp > 0)
+	assert.Check(t, len(leftServer.ops) <= len(rows)*4)
+	assert.Check(t, len(client.ops) <= len(rows)*4)
+	for i := range keys {
+		val, err := client.Read(keys[i])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, latest[i])
+	}
+}
+
+func makeWideKeys(source *rand.Rand, num, width int) []Key {
+	keys := make([]Key, num)
+	for i := range keys {
+		k := make([]byte, width)
+		source.Read(k)
+		keys[i] = Key(k)
+	}
+	return keys
+}
+
+func TestPIRUpdatableKeyWidths(t *testing.T) {
+	source := pir.RandSource()
+	for _, width := range []int{8, 20} {
+		keys := makeWideKeys(source, 1100, width)
+		rows := pir.MakeRows(source, 1100, 32)
+		// Sorted keys are Rice-encoded, the others are sent as they are.
+		sorted := append([]Key(nil), keys[1000:]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		dirs := [2]string{t.TempDir(), t.TempDir()}
+		var servers [2]UpdatableServer
+		var persistent [2]*Server
+		for i, dir := range dirs {
+			s, err := OpenServer(dir)
+			assert.NilError(t, err)
+			assert.NilError(t, s.SetKeyWidth(width))
+			s.AddRowsWithKeys(keys[:1000], rows[:1000])
+			persistent[i] = s
+			servers[i] = s
+		}
+		client := NewClient(source, pir.Punc, servers)
+		assert.NilError(t, client.Init())
+		assert.Equal(t, client.KeyWidth(), width)
+
+		for _, s := range persistent {
+			s.AddRowsWithKeys(sorted, rows[1000:])
+			s.DeleteRowsWithKeys(keys[:10])
+			assert.NilError(t, s.UpdateRowsWithKeys(keys[10:11], rows[:1]))
+			assert.ErrorContains(t, s.SetKeyWidth(4), "key width")
+		}
+		assert.NilError(t, client.Update())
+		val, err := client.ReadKey(keys[10])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[0])
+		_, err = client.ReadKey(keys[0])
+		assert.Equal(t, err, pir.ErrKeyNotFound)
+		val, err = client.ReadKey(sorted[50])
+		assert.NilError(t, err)
+		row, _ := persistent[0].Value(sorted[50])
+		assert.DeepEqual(t, val, row)
+		_, err = client.Read(1)
+		assert.ErrorContains(t, err, "4 bytes")
+		assert.ErrorContains(t, persistent[0].AddRecords([]uint32{1}, [][]byte{nil}, 32), "4-byte keys")
+
+		// The key width survives restarting the servers and the client.
+		data, err := client.MarshalBinary()
+		assert.NilError(t, err)
+		for i, dir := range dirs {
+			assert.NilError(t, persistent[i].Close())
+			s, err := OpenServer(dir)
+			assert.NilError(t, err)
+			defer s.Close()
+			assert.Equal(t, s.KeyWidth(), width)
+			servers[i] = s
+		}
+		restored := NewClient(source, pir.Punc, servers)
+		assert.NilError(t, restored.UnmarshalBinary(data))
+		assert.NilError(t, restored.Update())
+		val, err = restored.ReadKey(keys[500])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, rows[500])
+	}
+}
+
+func TestPIRUpdatableKeyWidthChange(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(100, 32)
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	servers := [2]UpdatableServer{leftServer, rightServer}
+	for _, s := range []*Server{leftServer, rightServer} {
+		s.AddRows(keys, rows)
+	}
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	assert.NilError(t, client.Init())
+
+	// The servers start over with 8-byte keys, and the client follows.
+	wideKeys := makeWideKeys(pir.RandSource(), 100, 8)
+	for i, s := range []*Server{NewUpdatableServer(), NewUpdatableServer()} {
+		assert.NilError(t, s.SetKeyWidth(8))
+		s.AddRowsWithKeys(wideKeys, rows)
+		servers[i] = s
+	}
+	client.servers = servers
+	var resp KeyUpdatesResp
+	assert.NilError(t, servers[0].KeyUpdates(KeyUpdatesReq{
+		DefragTimestamp: int32(client.defragTimestamp),
+		NextTimestamp:   int32(client.defragTimestamp + len(client.ops)),
+		KeyWidth:        int32(client.keyWidth),
+	}, &resp))
+	assert.Assert(t, resp.ShouldDeleteHistory)
+	assert.Equal(t, resp.KeyWidth, 8)
+
+	assert.NilError(t, client.Update())
+	assert.Equal(t, client.KeyWidth(), 8)
+	val, err := client.ReadKey(wideKeys[3])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, val, rows[3])
+}
+
+func TestPIRUpdatableMultiValues(t *testing.T) {
+	keys, rows := pir.MakeKeysRows(1100, 32)
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	servers := [2]UpdatableServer{leftServer, rightServer}
+	for _, s := range []*Server{leftServer, rightServer} {
+		s.AddRows(keys[:1000], rows[:1000])
+		// Key 0 gets two more values, and key 1 one more.
+		s.AppendRows([]uint32{keys[0], keys[1], keys[0]}, rows[1000:1003])
+	}
+	client := NewClient(pir.RandSource(), pir.Punc, servers)
+	assert.NilError(t, client.Init())
+
+	// Every ReadAll issues as many queries as the key with most values.
+	counting := &countingServer{UpdatableServer: leftServer}
+	client.servers[pir.Left] = counting
+	for _, c := range []struct {
+		key      uint32
+		expected []pir.Row
+	}{
+		{keys[0], []pir.Row{rows[0], rows[1000], rows[1002]}},
+		{keys[1], []pir.Row{rows[1], rows[1001]}},
+		{keys[2], []pir.Row{rows[2]}},
+	} {
+		counting.numAnswers = 0
+		vals, err := client.ReadAll(c.key)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, vals, c.expected)
+		assert.Equal(t, counting.numAnswers, 3)
+
+		val, err := client.Read(c.key)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, c.expected[len(c.expected)-1])
+	}
+	client.SetReadAllQueries(5)
+	counting.numAnswers = 0
+	_, err := client.ReadAll(keys[3])
+	assert.NilError(t, err)
+	assert.Equal(t, counting.numAnswers, 5)
+	client.SetReadAllQueries(2)
+	_, err = client.ReadAll(keys[0])
+	assert.ErrorContains(t, err, "more than the 2 queries")
+	client.SetReadAllQueries(0)
+
+	// Updates change the latest value, adds replace all values, and
+	// deletes delete them all, across a saved client and defragmentation.
+	data, err := client.MarshalBinary()
+	assert.NilError(t, err)
+	restored := NewClient(pir.RandSource(), pir.Punc, servers)
+	assert.NilError(t, restored.UnmarshalBinary(data))
+	for _, s := range []*Server{leftServer, rightServer} {
+		assert.NilError(t, s.UpdateRows(keys[1:2], rows[1003:1004]))
+		s.AppendRows(keys[1:2], rows[1004:1005])
+		s.AddRows(keys[0:1], rows[1005:1006])
+		s.AppendRows(keys[2:3], rows[1006:1007])
+		s.DeleteRows(keys[2:3])
+		s.AppendRows(keys[2:4], rows[1007:1009])
+		for j := 10; j < 1000; j += 100 {
+			s.DeleteRows(keys[j : j+100])
+		}
+		assert.DeepEqual(t, s.Values(KeyFromUint32(keys[1])), []pir.Row{rows[1], rows[1003], rows[1004]})
+	}
+	assert.Check(t, leftServer.defragTimestamp > 0)
+	assert.NilError(t, restored.Update())
+	for _, c := range []struct {
+		key      uint32
+		expected []pir.Row
+	}{
+		{keys[0], []pir.Row{rows[1005]}},
+		{keys[1], []pir.Row{rows[1], rows[1003], rows[1004]}},
+		{keys[2], []pir.Row{rows[1007]}},
+		{keys[3], []pir.Row{rows[3], rows[1008]}},
+		{keys[5], []pir.Row{rows[5]}},
+	} {
+		vals, err := restored.ReadAll(c.key)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, vals, c.expected)
+	}
+	_, err = restored.ReadAll(keys[10])
+	assert.Equal(t, err, pir.ErrKeyNotFound)
+
+	// A failed query does not stop the others, so the servers still see
+	// the full number of queries.
+	restored.SetReadAllQueries(5)
+	countingLeft := &countingServer{UpdatableServer: leftServer}
+	failing := &failingServer{UpdatableServer: rightServer, failAt: 1}
+	restored.servers = [2]UpdatableServer{countingLeft, failing}
+	_, err = restored.ReadAll(keys[1])
+	assert.ErrorContains(t, err, "answer failed")
+	assert.Equal(t, countingLeft.numAnswers, 5)
+	assert.Equal(t, failing.numAnswers, 5)
+}
+
+// failingServer fails the answer with index failAt.
+type failingServer struct {
+	UpdatableServer
+	failAt     int
+	numAnswers int
+}
+
+func (s *failingServer) Answer(q pir.QueryReq, resp *interface{}) error {
+	s.numAnswers++
+	if s.numAnswers-1 == s.failAt {
+		return fmt.Errorf("answer failed")
+	}
+	return s.UpdatableServer.Answer(q, resp)
+}
+
+func TestPIRUpdatableIntegrity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(pir.RandSource())
+	assert.NilError(t, err)
+	// Signatures of anyone but the owner, such as a server, are rejected.
+	_, forger, err := ed25519.GenerateKey(pir.RandSource())
+	assert.NilError(t, err)
+
+	keys, rows := pir.MakeKeysRows(1000, 32)
+	newRows := pir.MakeRows(pir.RandSource(), 10, 32)
+	forgedRows := pir.MakeRows(pir.RandSource(), 1000, 32)
+	wideKeys := keysFromUint32s(keys)
+
+	leftServer := NewUpdatableServer()
+	rightServer := NewUpdatableServer()
+	badServer := NewUpdatableServer()
+	for _, s := range []*Server{leftServer, rightServer} {
+		s.AddRows(keys, SignRows(priv, wideKeys, rows))
+		assert.NilError(t, s.UpdateRows(keys[:10], SignRows(priv, wideKeys[:10], newRows)))
+	}
+	badServer.AddRows(keys, SignRows(forger, wideKeys, forgedRows))
+	assert.NilError(t, badServer.UpdateRows(keys[:10], SignRows(forger, wideKeys[:10], forgedRows[:10])))
+
+	for _, pirType := range []pir.PirType{pir.Punc, pir.Perm, pir.DPF} {
+		t.Run(pirType.String(), func(t *testing.T) {
+			client := NewClient(pir.RandSource(), pirType, [2]UpdatableServer{leftServer, rightServer})
+			client.SetVerifyKey(pub)
+			assert.NilError(t, client.Init())
+			for _, i := range []int{0, 9, 10, 999} {
+				expected := rows[i]
+				if i < 10 {
+					expected = newRows[i]
+				}
+				val, err := client.Read(keys[i])
+				assert.NilError(t, err)
+				assert.DeepEqual(t, val, expected)
+			}
+
+			client.servers[pir.Right] = badServer
+			for _, i := range []int{0, 10, 999} {
+				_, err := client.Read(keys[i])
+				assert.Assert(t, errors.Is(err, pir.ErrVerification), "got error: %v", err)
+			}
+		})
+	}
+}
+
+// hintBytesServer counts the bytes of the hints that it sends.
+type hintBytesServer struct {
+	UpdatableServer
+	hintBytes int
+}
+
+func (s *hintBytesServer) Hint(req pir.HintReq, resp *pir.HintResp) error {
+	if err := s.UpdatableServer.Hint(req, resp); err != nil {
+		return err
+	}
+	data, err := (*resp).(encoding.BinaryMarshaler).MarshalBinary()
+	s.hintBytes += len(data)
+	return err
+}
+
+// Updates must cost clients no more bandwidth than deleting and adding the
+// keys again, which makes them fetch hints for the new rows. Rows are
+// updated in place when the layers have hints, and otherwise moved to new
+// rows.
+func TestPIRUpdatableUpdateBytes(t *testing.T) {
+	for _, rowLen := range []int{DefaultKeyWidth, 32} {
+		for _, layerSize := range []int{1000, 0} {
+			t.Run(fmt.Sprintf("RowLen=%d/LayerSize=%d", rowLen, layerSize), func(t *testing.T) {
+				testUpdateBytes(t, rowLen, layerSize)
+			})
+		}
+	}
+}
+
+func testUpdateBytes(t *testing.T, rowLen, layerSize int) {
+	// Enough updates to merge several layers, and too few to defragment.
+	const numKeys, numBatches, batchSize = 50000, 20, 250
+	const numUpdates = numBatches * batchSize
+	keys, rows := pir.MakeKeysRows(numKeys, rowLen)
+	newRows := pir.MakeRows(pir.RandSource(), numUpdates, rowLen)
+
+	var totalBytes [2]int
+	for i, update := range []bool{true, false} {
+		leftServer := NewUpdatableServer()
+		rightServer := NewUpdatableServer()
+		for _, s := range []*Server{leftServer, rightServer} {
+			s.smallestLayerSizeOverride = layerSize
+			s.AddRows(keys, rows)
+		}
+		counting := &hintBytesServer{UpdatableServer: leftServer}
+		client := NewClient(pir.RandSource(), pir.Punc, [2]UpdatableServer{counting, rightServer})
+		client.waterfall.smallestLayerSizeOverride = layerSize
+		assert.NilError(t, client.Init())
+		counting.hintBytes = 0
+		keyBytes := client.totalKeyUpdateBytes
+
+		for b := 0; b < numBatches; b++ {
+			batchKeys := keys[b*batchSize : (b+1)*batchSize]
+			batchRows := newRows[b*batchSize : (b+1)*batchSize]
+			for _, s := range []*Server{leftServer, rightServer} {
+				if update {
+					assert.NilError(t, s.UpdateRows(batchKeys, batchRows))
+				} else {
+					s.DeleteRows(batchKeys)
+					s.AddRows(batchKeys, batchRows)
+				}
+			}
+			assert.NilError(t, client.Update())
+		}
+		assert.Equal(t, leftServer.defragTimestamp, 0)
+		if update && leftServer.inPlaceCheaper() {
+			assert.Equal(t, leftServer.NumRows, numKeys)
+			assert.Equal(t, counting.hintBytes, 0)
+		} else {
+			assert.Equal(t, leftServer.NumRows, numKeys+numUpdates)
+		}
+		keyBytes = client.totalKeyUpdateBytes - keyBytes
+		totalBytes[i] = keyBytes + counting.hintBytes
+		t.Logf("update: %t, key update bytes: %d, hint bytes: %d", update, keyBytes, counting.hintBytes)
+
+		val, err := client.Read(keys[numUpdates-1])
+		assert.NilError(t, err)
+		assert.DeepEqual(t, val, newRows[numUpdates-1])
+	}
+	assert.Assert(t, totalBytes[0] <= totalBytes[1], "update: %d bytes, delete and add: %d bytes", totalBytes[0], totalBytes[1])
+}
+
+// maxInt is maxInt, which needs Go 1.17.
+const maxInt = int(^uint(0) >> 1)
+
+func TestUpdatableReqValidation(t *testing.T) {
+	db := pir.MakeDB(100, 16)
+	for name, req := range map[string]*UpdatableHintReq{
+		"Overflow":   {Req: pir.NewDPFHintReq(), FirstRow: maxInt, NumRows: maxInt},
+		"Wrap":       {Req: pir.NewDPFHintReq(), FirstRow: 50, NumRows: maxInt - 10},
+		"FirstRow":   {Req: pir.NewDPFHintReq(), FirstRow: 101, NumRows: 0},
+		"NumRows":    {Req: pir.NewDPFHintReq(), FirstRow: 50, NumRows: 51},
+		"Negative":   {Req: pir.NewDPFHintReq(), FirstRow: -1, NumRows: 10},
+		"MissingReq": {FirstRow: 0, NumRows: 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := req.Process(db)
+			var validationErr *pir.ValidationError
+			assert.Assert(t, errors.As(err, &validationErr), "got: %v", err)
+		})
+	}
+	_, err := (&UpdatableHintReq{Req: pir.NewDPFHintReq(), FirstRow: 50, NumRows: 50}).Process(db)
+	assert.NilError(t, err)
+}
@@ -1,6 +1,8 @@
 package updatable
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math/rand"
 
@@ -19,11 +21,16 @@ type clientLayer struct {
 
 type WaterfallClient struct {
 	pirType    pir.PirType
+	layerTypes LayerTypes
 	randSource *rand.Rand
 	numRows    int
 	rowLen     int
 	layers     []clientLayer
 
+	// XOR of the changes to the rows that were updated in place, by
+	// position. The servers keep the old values until defragmentation.
+	updates map[int]pir.Row
+
 	// For testing
 	smallestLayerSizeOverride int
 }
@@ -34,9 +41,64 @@ func NewWaterfallClient(source *rand.Rand, pirType pir.PirType) *WaterfallClient
 		pirType:    pirType}
 }
 
+// LayerTypes chooses the PIR scheme of the small layers of a waterfall
+// whose two-server scheme needs a hint from the server. Those layers are
+// rebuilt often, so they use SmallLayerType, which needs no hint, instead:
+// the smallest layer, and the layers that hold fewer than MinHintLayerSize
+// rows.
+type LayerTypes struct {
+	SmallLayerType   pir.PirType
+	MinHintLayerSize int
+}
+
+// SetLayerTypes changes the schemes of the layers that are built from now
+// on. By default, only the smallest layer uses DPF.
+func (c *WaterfallClient) SetLayerTypes(types LayerTypes) {
+	c.layerTypes = types
+}
+
+func (c *WaterfallClient) layerType(i int) pir.PirType {
+	if !hasServerHint(c.pirType) || pir.NumServers(c.pirType) != 2 {
+		return c.pirType
+	}
+	if i < len(c.layers)-1 && c.layers[i].maxSize >= c.layerTypes.MinHintLayerSize {
+		return c.pirType
+	}
+	if c.layerTypes.SmallLayerType == pir.None {
+		return pir.DPF
+	}
+	return c.layerTypes.SmallLayerType
+}
+
 func (c *WaterfallClient) reset() {
 	c.numRows = 0
 	c.layers = nil
+	c.updates = nil
+}
+
+// ApplyUpdate records a change to the row at pos, given as the XOR of its
+// old and new value, which is applied to the row when it is read. The hint
+// of the layer that holds the row stays valid, since the servers do not
+// change the row itself.
+func (c *WaterfallClient) ApplyUpdate(pos int, delta pir.Row) {
+	if c.updates == nil {
+		c.updates = make(map[int]pir.Row)
+	}
+	if prev, ok := c.updates[pos]; ok {
+		delta = xorRows(prev, delta)
+	}
+	c.updates[pos] = delta
+}
+
+// dropUpdate forgets the changes to a row that was deleted or replaced.
+func (c *WaterfallClient) dropUpdate(pos int) {
+	delete(c.updates, pos)
+}
+
+// Offline/online schemes need the server to compute a hint over the layer's rows.
+// For the other schemes the client can initialize itself from the layer size alone.
+func hasServerHint(pirType pir.PirType) bool {
+	return pirType == pir.Punc || pirType == pir.Perm || pirType == pir.LWE
 }
 
 func (c *WaterfallClient) smallestLayerSize(nRows int) int {
@@ -50,7 +112,7 @@ func (c *WaterfallClient) LayersMaxSize(nRows int) []int {
 	// if nRows == 0 {
 	// 	return []int{}
 	// }
-	if c.pirType != pir.Punc {
+	if !hasServerHint(c.pirType) {
 		return []int{nRows}
 	}
 	maxSize := []int{nRows}
@@ -82,6 +144,14 @@ type UpdatableHintReq struct {
 }
 
 func (req *UpdatableHintReq) Process(db pir.StaticDB) (pir.HintResp, error) {
+	if req.Req == nil {
+		return nil, &pir.ValidationError{Msg: "missing layer hint request"}
+	}
+	// FirstRow+NumRows could overflow.
+	if req.FirstRow < 0 || req.NumRows < 0 || req.FirstRow > db.NumRows || req.NumRows > db.NumRows-req.FirstRow {
+		return nil, &pir.ValidationError{Msg: fmt.Sprintf("layer of %d rows from %d out of bounds [0:%d)",
+			req.NumRows, req.FirstRow, db.NumRows)}
+	}
 	layerFlatDb := db.Slice(req.FirstRow, req.FirstRow+req.NumRows)
 	return req.Req.Process(pir.StaticDB{NumRows: req.NumRows, RowLen: db.RowLen, FlatDb: layerFlatDb})
 }
@@ -94,7 +164,7 @@ func (c *WaterfallClient) HintUpdateReq(numNewRows int, rowLen int) (*UpdatableH
 		return nil, nil
 	}
 	layer := &c.layers[layerNum]
-	if layer.pirType != pir.Punc {
+	if !hasServerHint(layer.pirType) {
 		req, err := pir.NewHintReq(c.randSource, layer.pirType).Process(pir.StaticDB{NumRows: layer.numRows, RowLen: c.rowLen})
 		if err != nil {
 			return nil, err
@@ -105,7 +175,7 @@ func (c *WaterfallClient) HintUpdateReq(numNewRows int, rowLen int) (*UpdatableH
 	return &UpdatableHintReq{
 		FirstRow: layer.firstRow,
 		NumRows:  layer.numRows,
-		Req:      pir.NewPuncHintReq(c.randSource),
+		Req:      pir.NewHintReq(c.randSource, layer.pirType),
 	}, nil
 }
 
@@ -131,10 +201,7 @@ func (c *WaterfallClient) updateLayers(numNewRows int) int {
 	layer := &c.layers[i]
 	layer.numRows = numNewRows
 	layer.firstRow = c.numRows - numNewRows
-	layer.pirType = c.pirType
-	if i == len(c.layers)-1 && c.pirType == pir.Punc {
-		layer.pirType = pir.DPF
-	}
+	layer.pirType = c.layerType(i)
 	layer.pir = nil
 
 	return i
@@ -161,7 +228,26 @@ type UpdatableQueryReq struct {
 
 type UpdatableQueryResp []interface{}
 
+func (req UpdatableQueryReq) validate(db pir.StaticDB) error {
+	if len(req.FirstRow) != len(req.Reqs)+1 {
+		return &pir.ValidationError{Msg: fmt.Sprintf("%d layer boundaries for %d layers", len(req.FirstRow), len(req.Reqs))}
+	}
+	for l, q := range req.Reqs {
+		if q == nil {
+			return &pir.ValidationError{Msg: fmt.Sprintf("missing request for layer %d", l)}
+		}
+		if req.FirstRow[l] < 0 || req.FirstRow[l] > req.FirstRow[l+1] || req.FirstRow[l+1] > db.NumRows {
+			return &pir.ValidationError{Msg: fmt.Sprintf("layer rows [%d:%d) out of bounds [0:%d)",
+				req.FirstRow[l], req.FirstRow[l+1], db.NumRows)}
+		}
+	}
+	return nil
+}
+
 func (req UpdatableQueryReq) Process(db pir.StaticDB) (interface{}, error) {
+	if err := req.validate(db); err != nil {
+		return nil, err
+	}
 	resps := make([]interface{}, len(req.Reqs))
 	var err error
 	for l, q := range req.Reqs {
@@ -175,7 +261,29 @@ func (req UpdatableQueryReq) Process(db pir.StaticDB) (interface{}, error) {
 }
 
 func (c *WaterfallClient) Query(pos int) ([]pir.QueryReq, pir.ReconstructFunc) {
-	req := make([]UpdatableQueryReq, 2)
+	return c.query(pos, nil)
+}
+
+// QueryVerified is like Query, but the reconstruct function fails if verify
+// rejects the row. The row read from the layer is checked before the layer
+// client refreshes its hint with it, and again once an in-place update is
+// applied to it.
+func (c *WaterfallClient) QueryVerified(pos int, verify pir.VerifyFunc) ([]pir.QueryReq, pir.ReconstructFunc) {
+	return c.query(pos, verify)
+}
+
+// DummyQuery returns a query that is indistinguishable from a real one but
+// whose answer is not needed, to hide how many rows a client reads.
+func (c *WaterfallClient) DummyQuery() []pir.QueryReq {
+	queryReqs, _ := c.query(-1, nil)
+	return queryReqs
+}
+
+// query sends a dummy query to every layer that does not hold pos, so a
+// negative pos makes the whole query a dummy.
+func (c *WaterfallClient) query(pos int, verify pir.VerifyFunc) ([]pir.QueryReq, pir.ReconstructFunc) {
+	numServers := pir.NumServers(c.pirType)
+	req := make([]UpdatableQueryReq, numServers)
 	var reconstructFunc pir.ReconstructFunc
 
 	var layerEnd int
@@ -186,21 +294,32 @@ func (c *WaterfallClient) Query(pos int) ([]pir.QueryReq, pir.ReconstructFunc) {
 			continue
 		}
 		if layerEnd <= int(pos) && int(pos) < layerEnd+layer.numRows {
-			q, reconstructFunc = layer.pir.Query(int(pos) - layerEnd)
-			matchingLayer = len(req[pir.Left].Reqs)
+			if verify != nil {
+				q, reconstructFunc = pir.QueryVerified(layer.pir, int(pos)-layerEnd, func(_ int, row pir.Row) error {
+					return verify(pos, row)
+				})
+			} else {
+				q, reconstructFunc = layer.pir.Query(int(pos) - layerEnd)
+			}
+			matchingLayer = len(req[0].Reqs)
 		} else {
 			q = layer.pir.DummyQuery()
 		}
-		for s := range []int{pir.Left, pir.Right} {
+		for s := range req {
 			req[s].FirstRow = append(req[s].FirstRow, c.layers[l].firstRow)
 			req[s].Reqs = append(req[s].Reqs, q[s])
 		}
 		layerEnd += layer.numRows
 	}
-	for s := range []int{pir.Left, pir.Right} {
+	queryReqs := make([]pir.QueryReq, numServers)
+	for s := range req {
 		req[s].FirstRow = append(req[s].FirstRow, layerEnd)
+		queryReqs[s] = req[s]
 	}
-	return []pir.QueryReq{req[pir.Left], req[pir.Right]}, func(resps []interface{}) (pir.Row, error) {
+	if reconstructFunc == nil {
+		return queryReqs, nil
+	}
+	return queryReqs, func(resps []interface{}) (pir.Row, error) {
 		queryResps := make([][]interface{}, len(resps))
 		var ok bool
 		for i, r := range resps {
@@ -209,9 +328,19 @@ func (c *WaterfallClient) Query(pos int) ([]pir.QueryReq, pir.ReconstructFunc) {
 			}
 		}
 
-		row, err := reconstructFunc([]interface{}{
-			queryResps[pir.Left][matchingLayer],
-			queryResps[pir.Right][matchingLayer]})
+		layerResps := make([]interface{}, len(queryResps))
+		for s := range queryResps {
+			layerResps[s] = queryResps[s][matchingLayer]
+		}
+		row, err := reconstructFunc(layerResps)
+		if delta, ok := c.updates[pos]; ok && err == nil {
+			row = xorRows(row, delta)
+			if verify != nil {
+				if err := verify(pos, row); err != nil {
+					return nil, err
+				}
+			}
+		}
 		return row, err
 	}
 }
@@ -228,3 +357,78 @@ func (c *WaterfallClient) State() (bitsPerKey, fixedBytes int) {
 	}
 	return
 }
+
+type savedLayer struct {
+	MaxSize  int
+	FirstRow int
+	NumRows  int
+	PirType  pir.PirType
+	// Saved with pir.SaveClient, or empty if the layer has no client.
+	Client []byte
+}
+
+type savedWaterfall struct {
+	PirType pir.PirType
+	NumRows int
+	RowLen  int
+	Layers  []savedLayer
+}
+
+func (c *WaterfallClient) MarshalBinary() ([]byte, error) {
+	saved := savedWaterfall{
+		PirType: c.pirType,
+		NumRows: c.numRows,
+		RowLen:  c.rowLen,
+		Layers:  make([]savedLayer, len(c.layers)),
+	}
+	for i, layer := range c.layers {
+		saved.Layers[i] = savedLayer{
+			MaxSize:  layer.maxSize,
+			FirstRow: layer.firstRow,
+			NumRows:  layer.numRows,
+			PirType:  layer.pirType,
+		}
+		if layer.pir == nil {
+			continue
+		}
+		var err error
+		if saved.Layers[i].Client, err = pir.SaveClient(layer.pir); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&saved); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *WaterfallClient) UnmarshalBinary(data []byte) error {
+	var saved savedWaterfall
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return err
+	}
+	if saved.PirType != c.pirType {
+		return fmt.Errorf("Saved client has PIR type %s, expected: %s", saved.PirType, c.pirType)
+	}
+	layers := make([]clientLayer, len(saved.Layers))
+	for i, layer := range saved.Layers {
+		layers[i] = clientLayer{
+			maxSize:  layer.MaxSize,
+			firstRow: layer.FirstRow,
+			numRows:  layer.NumRows,
+			pirType:  layer.PirType,
+		}
+		if len(layer.Client) == 0 {
+			continue
+		}
+		var err error
+		if layers[i].pir, err = pir.LoadClient(layer.Client, c.randSource); err != nil {
+			return err
+		}
+	}
+	c.numRows = saved.NumRows
+	c.rowLen = saved.RowLen
+	c.layers = layers
+	return nil
+}
@@ -0,0 +1,164 @@
+package updatable
+
+import (
+	"fmt"
+	"math/rand"
+
+	"checklist/pir"
+)
+
+// Workload describes the database that clients read and what they can
+// afford, for the planner to choose a PIR configuration.
+type Workload struct {
+	NumRows int
+	RowLen  int
+
+	// Lookups of every client, and rows added to the database, per day.
+	QueriesPerDay float64
+	UpdatesPerDay float64
+
+	// Storage and communication per day of every client, or zero for no
+	// limit. Neither counts the keys of the rows, which every scheme needs.
+	MaxClientBytes int
+	MaxBytesPerDay float64
+
+	// NonPrivate is only chosen if the lookups need not be private. It
+	// is then always the cheapest choice.
+	AllowNonPrivate bool
+}
+
+// Plan is a PIR configuration for a workload and its predicted costs.
+type Plan struct {
+	PirType    pir.PirType
+	LayerTypes LayerTypes
+	// The largest size and the scheme of every layer of the waterfall.
+	Layers []PlannedLayer
+
+	// Storage of every client.
+	ClientBytes int
+	// Communication of every client per day, for the hints of rebuilt
+	// layers and for queries.
+	OfflineBytesPerDay float64
+	OnlineBytesPerDay  float64
+	// Bytes of the hints that every client downloads per row added to the
+	// database, for the rebuilds of the layers that the row passes through.
+	AddedRowBytes float64
+	// Rows that every server reads per query, and per day for the hints
+	// and queries of one client.
+	OnlineServerRows int
+	ServerRowsPerDay float64
+}
+
+type PlannedLayer struct {
+	MaxSize int
+	PirType pir.PirType
+	Cost    pir.Cost
+}
+
+func (p *Plan) BytesPerDay() float64 {
+	return p.OfflineBytesPerDay + p.OnlineBytesPerDay
+}
+
+func (p *Plan) String() string {
+	types := make([]string, len(p.Layers))
+	for i, layer := range p.Layers {
+		types[i] = fmt.Sprintf("%s(%d)", layer.PirType, layer.MaxSize)
+	}
+	return fmt.Sprintf("%s, layers %v: client %d bytes, %.0f offline + %.0f online bytes/day, server %d rows/query",
+		p.PirType, types, p.ClientBytes, p.OfflineBytesPerDay, p.OnlineBytesPerDay, p.OnlineServerRows)
+}
+
+// PlanWorkload chooses among Punc, DPF, Matrix and NonPrivate, and for
+// Punc the layers that use DPF or Matrix instead, the configuration that
+// fits in the budgets of the clients with the least work for the servers.
+//
+// The costs of every layer come from pir.EstimateCost, for a full layer.
+// A layer is rebuilt every time the layers below it fill up, about every
+// MaxSize/2 new rows, and the largest layer every MaxSize new rows.
+func PlanWorkload(w Workload) (*Plan, error) {
+	if w.NumRows < 1 || w.RowLen < 1 {
+		return nil, fmt.Errorf("Empty database: %d rows of %d bytes", w.NumRows, w.RowLen)
+	}
+	var plans []*Plan
+	if w.AllowNonPrivate {
+		plans = append(plans, w.plan(pir.NonPrivate, LayerTypes{}))
+	}
+	plans = append(plans, w.plan(pir.DPF, LayerTypes{}), w.plan(pir.Matrix, LayerTypes{}))
+	// Punc with the smallest k layers answered by DPF or Matrix. The
+	// smallest layer never has a hint.
+	sizes := NewWaterfallClient(nil, pir.Punc).LayersMaxSize(w.NumRows)
+	for k := 1; k < len(sizes); k++ {
+		for _, small := range []pir.PirType{pir.DPF, pir.Matrix} {
+			plans = append(plans, w.plan(pir.Punc, LayerTypes{SmallLayerType: small, MinHintLayerSize: sizes[len(sizes)-k-1]}))
+		}
+	}
+
+	var best *Plan
+	for _, p := range plans {
+		if p == nil || !w.fits(p) {
+			continue
+		}
+		if best == nil || p.ServerRowsPerDay < best.ServerRowsPerDay ||
+			(p.ServerRowsPerDay == best.ServerRowsPerDay && p.BytesPerDay() < best.BytesPerDay()) {
+			best = p
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("No PIR configuration fits in %d client bytes and %.0f bytes per day",
+			w.MaxClientBytes, w.MaxBytesPerDay)
+	}
+	return best, nil
+}
+
+func (w *Workload) fits(p *Plan) bool {
+	return (w.MaxClientBytes == 0 || p.ClientBytes <= w.MaxClientBytes) &&
+		(w.MaxBytesPerDay == 0 || p.BytesPerDay() <= w.MaxBytesPerDay)
+}
+
+// plan predicts the costs of a configuration, or returns nil if a scheme
+// has no cost model.
+func (w *Workload) plan(pirType pir.PirType, types LayerTypes) *Plan {
+	waterfall := NewWaterfallClient(nil, pirType)
+	waterfall.SetLayerTypes(types)
+	return w.planWaterfall(waterfall)
+}
+
+// planWaterfall predicts the costs of the configuration of a waterfall.
+func (w *Workload) planWaterfall(waterfall *WaterfallClient) *Plan {
+	pirType, types := waterfall.pirType, waterfall.layerTypes
+	waterfall.layers = waterfall.freshLayers(w.NumRows)
+
+	p := &Plan{PirType: pirType, LayerTypes: types}
+	numServers := float64(pir.NumServers(pirType))
+	for i, layer := range waterfall.layers {
+		layerType := waterfall.layerType(i)
+		cost, err := pir.EstimateCost(layerType, layer.maxSize, w.RowLen)
+		if err != nil {
+			return nil
+		}
+		p.Layers = append(p.Layers, PlannedLayer{MaxSize: layer.maxSize, PirType: layerType, Cost: cost})
+
+		rebuildsPerRow := 2 / float64(layer.maxSize)
+		if i == 0 {
+			rebuildsPerRow /= 2
+		}
+		rebuildsPerDay := w.UpdatesPerDay * rebuildsPerRow
+		p.ClientBytes += cost.ClientBytes
+		p.AddedRowBytes += rebuildsPerRow * float64(cost.OfflineBytes)
+		p.OfflineBytesPerDay += rebuildsPerDay * float64(cost.OfflineBytes)
+		// Every query reads all layers, with dummy queries to the layers
+		// that do not hold the row.
+		p.OnlineBytesPerDay += w.QueriesPerDay * float64(cost.OnlineBytes)
+		p.OnlineServerRows += cost.OnlineServerRows
+		p.ServerRowsPerDay += rebuildsPerDay*float64(cost.OfflineServerRows) +
+			w.QueriesPerDay*numServers*float64(cost.OnlineServerRows)
+	}
+	return p
+}
+
+// NewPlannedClient returns a client with the configuration of the plan.
+func NewPlannedClient(source *rand.Rand, plan *Plan, servers [2]UpdatableServer) *Client {
+	client := NewClient(source, plan.PirType, servers)
+	client.SetLayerTypes(plan.LayerTypes)
+	return client
+}
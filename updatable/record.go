@@ -0,0 +1,212 @@
+package updatable
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"checklist/pir"
+)
+
+// Records are values of arbitrary length stored on top of the fixed-length
+// rows of the database. A record is prefixed with its length, padded to a
+// multiple of the row length and split into chunks, one row each. Chunk 0 is
+// stored under the record's key and chunk i > 0 under RecordChunkKey(key, i).
+//
+// The server advertises the largest number of chunks of any record, and
+// ReadRecord always issues that many queries, padding with dummy queries, so
+// the servers do not learn the size of the record that was read.
+
+const recordHeaderLen = 4
+
+// RecordChunkKey returns the key under which chunk i of a record is stored.
+func RecordChunkKey(key uint32, i int) uint32 {
+	if i == 0 {
+		return key
+	}
+	// splitmix64 finalizer
+	z := uint64(key)<<32 | uint64(i)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return uint32(z ^ (z >> 31))
+}
+
+func recordNumChunks(recordLen, rowLen int) int {
+	return (recordHeaderLen+recordLen-1)/rowLen + 1
+}
+
+func encodeRecord(record []byte, rowLen int) []pir.Row {
+	numChunks := recordNumChunks(len(record), rowLen)
+	flat := make([]byte, numChunks*rowLen)
+	binary.LittleEndian.PutUint32(flat, uint32(len(record)))
+	copy(flat[recordHeaderLen:], record)
+	chunks := make([]pir.Row, numChunks)
+	for i := range chunks {
+		chunks[i] = flat[i*rowLen : (i+1)*rowLen]
+	}
+	return chunks
+}
+
+// AddRecords stores records of arbitrary length, split into rows of rowLen
+// bytes. rowLen must match the length of the rows already in the database.
+// Adding a record with an existing key replaces it.
+func (s *Server) AddRecords(keys []uint32, records [][]byte, rowLen int) error {
+	// Records are checked before the database is changed, so a failed
+	// call is logged, and replayed, as a no-op.
+	if err := s.log(logEntry{Kind: logAddRecords, Keys: keysFromUint32s(keys), Rows: records, RowLen: rowLen}); err != nil {
+		return err
+	}
+	err := s.addRecords(keys, records, rowLen)
+	s.maybeSnapshot()
+	return err
+}
+
+func (s *Server) addRecords(keys []uint32, records [][]byte, rowLen int) error {
+	if s.KeyWidth() != DefaultKeyWidth {
+		return fmt.Errorf("Records need %d-byte keys, the database has %d-byte keys", DefaultKeyWidth, s.KeyWidth())
+	}
+	if len(keys) != len(records) {
+		return fmt.Errorf("Mismatching number of keys and records: %d != %d", len(keys), len(records))
+	}
+	if rowLen <= recordHeaderLen {
+		return fmt.Errorf("Row length %d too short for records, must be larger than %d", rowLen, recordHeaderLen)
+	}
+	if s.RowLen != 0 && s.RowLen != rowLen {
+		return fmt.Errorf("Different row length added, expected: %d, got: %d", s.RowLen, rowLen)
+	}
+	if s.records == nil {
+		s.records = make(map[uint32]int)
+		s.chunkOwner = make(map[uint32]uint32)
+	}
+
+	var newKeys []uint32
+	var newRows []pir.Row
+	var staleKeys []uint32
+	owners := make(map[uint32]uint32)
+	for r, key := range keys {
+		if owner, ok := s.chunkOwner[key]; ok && owner != key {
+			return fmt.Errorf("Record key %x collides with a chunk of record %x", key, owner)
+		}
+		chunks := encodeRecord(records[r], rowLen)
+		for i, chunk := range chunks {
+			chunkKey := RecordChunkKey(key, i)
+			if owner, ok := owners[chunkKey]; ok {
+				return fmt.Errorf("Chunk key %x of record %x collides with record %x", chunkKey, key, owner)
+			}
+			owners[chunkKey] = key
+			if i == 0 {
+				continue
+			}
+			if _, exists := s.kv.get(KeyFromUint32(chunkKey)); exists {
+				if owner, ok := s.chunkOwner[chunkKey]; !ok || owner != key {
+					return fmt.Errorf("Chunk key %x of record %x collides with an existing key", chunkKey, key)
+				}
+			}
+			newKeys = append(newKeys, chunkKey)
+			newRows = append(newRows, chunk)
+		}
+		newKeys = append(newKeys, key)
+		newRows = append(newRows, chunks[0])
+		for i := len(chunks); i < s.records[key]; i++ {
+			staleKeys = append(staleKeys, RecordChunkKey(key, i))
+		}
+	}
+
+	if len(staleKeys) > 0 {
+		s.deleteChunkOwners(staleKeys)
+		s.deleteRows(keysFromUint32s(staleKeys))
+	}
+	s.addRows(keysFromUint32s(newKeys), newRows)
+	for r, key := range keys {
+		numChunks := recordNumChunks(len(records[r]), rowLen)
+		s.records[key] = numChunks
+		for i := 1; i < numChunks; i++ {
+			s.chunkOwner[RecordChunkKey(key, i)] = key
+		}
+		if numChunks > s.maxRecordChunks {
+			s.maxRecordChunks = numChunks
+		}
+	}
+	return nil
+}
+
+// DeleteRecords deletes records, with all their chunks.
+func (s *Server) DeleteRecords(keys []uint32) {
+	s.mustLog(logEntry{Kind: logDeleteRecords, Keys: keysFromUint32s(keys)})
+	s.deleteRecords(keys)
+	s.maybeSnapshot()
+}
+
+func (s *Server) deleteRecords(keys []uint32) {
+	var chunkKeys []uint32
+	for _, key := range keys {
+		numChunks, ok := s.records[key]
+		if !ok {
+			continue
+		}
+		for i := 0; i < numChunks; i++ {
+			chunkKeys = append(chunkKeys, RecordChunkKey(key, i))
+		}
+		delete(s.records, key)
+	}
+	s.deleteChunkOwners(chunkKeys)
+	s.deleteRows(keysFromUint32s(chunkKeys))
+}
+
+func (s *Server) deleteChunkOwners(chunkKeys []uint32) {
+	for _, chunkKey := range chunkKeys {
+		delete(s.chunkOwner, chunkKey)
+	}
+}
+
+// ReadRecord privately reads a record stored with Server.AddRecords. It
+// issues the same number of queries whatever the size of the record, and
+// whether or not the record is found or a query fails.
+func (c *Client) ReadRecord(key uint32) ([]byte, error) {
+	if c.maxRecordChunks == 0 {
+		return nil, fmt.Errorf("Database has no records")
+	}
+	record, numQueries, err := c.readRecordChunks(key)
+	for i := numQueries; i < c.maxRecordChunks; i++ {
+		if _, dummyErr := c.answer(c.waterfall.DummyQuery()); dummyErr != nil && err == nil {
+			err = dummyErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// readRecordChunks reads the chunks of a record, and returns the number of
+// queries that it issued.
+func (c *Client) readRecordChunks(key uint32) ([]byte, int, error) {
+	first, err := c.Read(key)
+	if err == pir.ErrKeyNotFound {
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 1, err
+	}
+	if len(first) < recordHeaderLen {
+		return nil, 1, fmt.Errorf("Row length %d too short for records", len(first))
+	}
+	recordLen := int(binary.LittleEndian.Uint32(first))
+	numChunks := recordNumChunks(recordLen, len(first))
+	if numChunks > c.maxRecordChunks {
+		return nil, 1, fmt.Errorf("Record %x has %d chunks, more than the maximum %d", key, numChunks, c.maxRecordChunks)
+	}
+
+	flat := make([]byte, 0, numChunks*len(first))
+	flat = append(flat, first...)
+	for i := 1; i < numChunks; i++ {
+		chunk, err := c.Read(RecordChunkKey(key, i))
+		if err == pir.ErrKeyNotFound {
+			return nil, i, fmt.Errorf("Failed to read chunk %d of record %x: %v", i, key, err)
+		}
+		if err != nil {
+			return nil, i + 1, fmt.Errorf("Failed to read chunk %d of record %x: %v", i, key, err)
+		}
+		flat = append(flat, chunk...)
+	}
+	return flat[recordHeaderLen : recordHeaderLen+recordLen], numChunks, nil
+}
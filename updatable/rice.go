@@ -2,6 +2,7 @@ package updatable
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"sort"
@@ -228,3 +229,163 @@ func (re *riceEncoder) WriteValue(v uint32) error {
 	}
 	return nil
 }
+
+// WideRiceEncoding Rice-encodes sorted keys of any width, like
+// RiceDeltaEncoding does for 4-byte keys. The first eight bytes of every
+// key, or all of them in narrower keys, are read as a big-endian integer,
+// and the differences between consecutive keys are Rice-encoded in up to 64
+// bits. The remaining bytes of every key follow its difference as they are.
+type WideRiceEncoding struct {
+	KeyWidth      int
+	FirstKey      []byte
+	NumEntries    int
+	RiceParameter int
+	EncodedData   []byte
+}
+
+func keyPrefix(k Key) uint64 {
+	var v uint64
+	for i := 0; i < len(k) && i < 8; i++ {
+		v = v<<8 | uint64(k[i])
+	}
+	return v
+}
+
+// EncodeRiceKeys encodes sorted keys of the given width.
+func EncodeRiceKeys(keys []Key, width int) (*WideRiceEncoding, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	for i, k := range keys {
+		if len(k) != width {
+			return nil, fmt.Errorf("Key %s has %d bytes, expected %d", k, len(k), width)
+		}
+		if i > 0 && keys[i-1] > k {
+			return nil, errors.New("Keys to Rice-encode are not sorted")
+		}
+	}
+	rice := &WideRiceEncoding{
+		KeyWidth:   width,
+		FirstKey:   []byte(keys[0]),
+		NumEntries: len(keys) - 1,
+	}
+	if rice.NumEntries == 0 {
+		return rice, nil
+	}
+	valRange := keyPrefix(keys[len(keys)-1]) - keyPrefix(keys[0])
+	if valRange > 0 {
+		rice.RiceParameter = int(math.Log2(float64(valRange) / float64(len(keys))))
+		if rice.RiceParameter < 0 {
+			rice.RiceParameter = 0
+		}
+	}
+	bw := newBitWriter()
+	for i := range keys[1:] {
+		delta := keyPrefix(keys[i+1]) - keyPrefix(keys[i])
+		q := delta >> uint(rice.RiceParameter)
+		for ; q >= 32; q -= 32 {
+			bw.Write(math.MaxUint32, 32)
+		}
+		bw.Write(1<<q-1, int(q+1))
+		bw.write64(delta, rice.RiceParameter)
+		for _, b := range []byte(keys[i+1][min(width, 8):]) {
+			bw.Write(uint32(b), 8)
+		}
+	}
+	rice.EncodedData = bw.Bytes()
+	return rice, nil
+}
+
+func DecodeRiceKeys(rice *WideRiceEncoding) ([]Key, error) {
+	if rice == nil {
+		return nil, errors.New("Missing Rice-encoded keys")
+	}
+	if err := validateKeyWidth(rice.KeyWidth); err != nil {
+		return nil, err
+	}
+	if len(rice.FirstKey) != rice.KeyWidth {
+		return nil, fmt.Errorf("First key has %d bytes, expected %d", len(rice.FirstKey), rice.KeyWidth)
+	}
+	if rice.RiceParameter < 0 || rice.RiceParameter > 64 {
+		return nil, errors.New("Invalid Rice parameter")
+	}
+	// Every key takes at least one bit.
+	if rice.NumEntries < 0 || rice.NumEntries > 8*len(rice.EncodedData) {
+		return nil, fmt.Errorf("%d Rice-encoded keys exceed the data", rice.NumEntries)
+	}
+	keys := make([]Key, 1, rice.NumEntries+1)
+	keys[0] = Key(rice.FirstKey)
+	prefixLen := min(rice.KeyWidth, 8)
+	prev := keyPrefix(keys[0])
+	br := newBitReader(rice.EncodedData)
+	key := make([]byte, rice.KeyWidth)
+	for i := 0; i < rice.NumEntries; i++ {
+		var q uint64
+		for {
+			bit, err := br.ReadBits(1)
+			if err != nil {
+				return nil, err
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		r, err := br.read64(rice.RiceParameter)
+		if err != nil {
+			return nil, err
+		}
+		if rice.RiceParameter < 64 && q > math.MaxUint64>>uint(rice.RiceParameter) {
+			return nil, errors.New("Rice-encoded key out of range")
+		}
+		delta := q<<uint(rice.RiceParameter) + r
+		if prev+delta < prev || (prefixLen < 8 && (prev+delta)>>(8*uint(prefixLen)) != 0) {
+			return nil, errors.New("Rice-encoded key out of range")
+		}
+		prev += delta
+		for j := 0; j < prefixLen; j++ {
+			key[j] = byte(prev >> (8 * uint(prefixLen-1-j)))
+		}
+		for j := prefixLen; j < rice.KeyWidth; j++ {
+			b, err := br.ReadBits(8)
+			if err != nil {
+				return nil, err
+			}
+			key[j] = byte(b)
+		}
+		keys = append(keys, Key(key))
+	}
+	if br.BitsRemaining() >= 8 {
+		return nil, errors.New("Unconsumed Rice-encoded data")
+	}
+	return keys, nil
+}
+
+func (bw *bitWriter) write64(v uint64, n int) {
+	if n > 32 {
+		bw.Write(uint32(v), 32)
+		bw.Write(uint32(v>>32), n-32)
+	} else {
+		bw.Write(uint32(v), n)
+	}
+}
+
+func (br *bitReader) read64(n int) (uint64, error) {
+	if n <= 32 {
+		v, err := br.ReadBits(n)
+		return uint64(v), err
+	}
+	lo, err := br.ReadBits(32)
+	if err != nil {
+		return 0, err
+	}
+	hi, err := br.ReadBits(n - 32)
+	return uint64(hi)<<32 | uint64(lo), err
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
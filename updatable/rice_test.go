@@ -7,6 +7,7 @@ import (
 	"sort"
 	"testing"
 
+	"checklist/pir"
 	sb "checklist/safebrowsing"
 
 	"github.com/golang/protobuf/proto"
@@ -417,3 +418,36 @@ loop:
 		assert.DeepEqual(t, rice, set.RiceIndices)
 	}
 }
+
+func TestWideRiceKeys(t *testing.T) {
+	source := pir.RandSource()
+	for _, width := range []int{1, 4, 5, 8, 20} {
+		for _, n := range []int{1, 2, 300} {
+			keys := make([]Key, n)
+			for i := range keys {
+				k := make([]byte, width)
+				source.Read(k)
+				keys[i] = Key(k)
+			}
+			// Repeated keys, and keys that differ only past 8 bytes.
+			keys = append(keys, keys[0])
+			if width > 8 {
+				k := []byte(keys[0])
+				k[width-1] ^= 1
+				keys = append(keys, Key(k))
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+			rice, err := EncodeRiceKeys(keys, width)
+			assert.NilError(t, err)
+			decoded, err := DecodeRiceKeys(rice)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, decoded, keys)
+		}
+	}
+
+	_, err := EncodeRiceKeys([]Key{KeyFromUint64(2), KeyFromUint64(1)}, 8)
+	assert.ErrorContains(t, err, "not sorted")
+	_, err = EncodeRiceKeys([]Key{KeyFromUint32(1)}, 8)
+	assert.ErrorContains(t, err, "has 4 bytes")
+}
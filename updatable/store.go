@@ -0,0 +1,178 @@
+package updatable
+
+import (
+	"checklist/pir"
+)
+
+// keyStore indexes the values of the keys of a Server. It keeps the values
+// in the order in which they were first added, like the database that
+// clients see, and finds the value at a position in that order, the values
+// of a key, and the row of a value in StaticDB, in O(log n) time.
+//
+// Every value takes a slot in insertion order, and a Fenwick tree counts
+// the slots in use, so that the position of a value is the number of slots
+// in use before its own. Deleted values leave an empty slot behind, which
+// is reclaimed once they outnumber the values.
+type keyStore struct {
+	// The latest value of every key.
+	entries map[Key]*storeEntry
+	slots   []*storeEntry
+	// counts[i] is the number of slots in use in (i+1-lowbit(i+1), i+1].
+	counts    []int
+	numValues int
+}
+
+type storeEntry struct {
+	key Key
+	// Position of the row of the value in StaticDB.
+	row int
+	// XOR of the updates of the value that are not in StaticDB yet, or nil.
+	pending pir.Row
+	slot    int
+	// The previous value of the key, or nil.
+	prev *storeEntry
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{entries: make(map[Key]*storeEntry)}
+}
+
+// Len returns the number of values, which is the number of keys unless
+// some keys have several values.
+func (st *keyStore) Len() int {
+	return st.numValues
+}
+
+// get returns the latest value of a key.
+func (st *keyStore) get(key Key) (*storeEntry, bool) {
+	e, ok := st.entries[key]
+	return e, ok
+}
+
+// values returns the values of a key, oldest first.
+func (st *keyStore) values(key Key) []*storeEntry {
+	var values []*storeEntry
+	for e := st.entries[key]; e != nil; e = e.prev {
+		values = append(values, e)
+	}
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values
+}
+
+// set makes row the only value of key, with no pending updates. A new key
+// goes last, and an existing key keeps the position of its first value.
+func (st *keyStore) set(key Key, row int) *storeEntry {
+	if _, ok := st.entries[key]; ok {
+		values := st.values(key)
+		for _, e := range values[1:] {
+			st.release(e)
+		}
+		e := values[0]
+		e.row = row
+		e.pending = nil
+		st.entries[key] = e
+		st.maybeCompact()
+		return e
+	}
+	return st.append(key, row)
+}
+
+// append adds row as the latest value of key, after all others.
+func (st *keyStore) append(key Key, row int) *storeEntry {
+	e := &storeEntry{key: key, row: row, slot: len(st.slots), prev: st.entries[key]}
+	st.entries[key] = e
+	st.slots = append(st.slots, e)
+	st.numValues++
+	// The new node of the tree covers (n-lowbit(n), n], where the slot
+	// itself is the last one.
+	n := len(st.slots)
+	st.counts = append(st.counts, 1+st.prefix(n-1)-st.prefix(n-(n&-n)))
+	return e
+}
+
+// delete deletes all the values of a key.
+func (st *keyStore) delete(key Key) {
+	e, ok := st.entries[key]
+	if !ok {
+		return
+	}
+	delete(st.entries, key)
+	for e != nil {
+		prev := e.prev
+		st.release(e)
+		e = prev
+	}
+	st.maybeCompact()
+}
+
+// release empties the slot of a value.
+func (st *keyStore) release(e *storeEntry) {
+	st.slots[e.slot] = nil
+	for i := e.slot + 1; i <= len(st.counts); i += i & -i {
+		st.counts[i-1]--
+	}
+	st.numValues--
+	e.prev = nil
+}
+
+func (st *keyStore) maybeCompact() {
+	if len(st.slots) > 64 && len(st.slots) > 2*st.numValues {
+		st.compact()
+	}
+}
+
+// prefix returns the number of slots in use among the first n.
+func (st *keyStore) prefix(n int) int {
+	sum := 0
+	for ; n > 0; n -= n & -n {
+		sum += st.counts[n-1]
+	}
+	return sum
+}
+
+// at returns the entry at a position in insertion order.
+func (st *keyStore) at(pos int) (*storeEntry, bool) {
+	if pos < 0 || pos >= st.numValues {
+		return nil, false
+	}
+	// Descend the tree for the smallest n with prefix(n) > pos.
+	step := 1
+	for step*2 <= len(st.counts) {
+		step *= 2
+	}
+	n, rem := 0, pos+1
+	for ; step > 0; step /= 2 {
+		if n+step <= len(st.counts) && st.counts[n+step-1] < rem {
+			n += step
+			rem -= st.counts[n-1]
+		}
+	}
+	return st.slots[n], true
+}
+
+// each calls f on the entries in insertion order until it returns false.
+func (st *keyStore) each(f func(e *storeEntry) bool) {
+	for _, e := range st.slots {
+		if e != nil && !f(e) {
+			return
+		}
+	}
+}
+
+// compact drops the empty slots.
+func (st *keyStore) compact() {
+	slots := make([]*storeEntry, 0, st.numValues)
+	st.each(func(e *storeEntry) bool {
+		e.slot = len(slots)
+		slots = append(slots, e)
+		return true
+	})
+	st.slots = slots
+	st.counts = make([]int, len(slots))
+	for i := range st.counts {
+		// Every slot is in use, so node i+1 counts lowbit(i+1) slots.
+		st.counts[i] = (i + 1) & -(i + 1)
+	}
+}
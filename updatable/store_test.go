@@ -0,0 +1,153 @@
+package updatable
+
+import (
+	"testing"
+
+	"checklist/pir"
+
+	"gotest.tools/assert"
+)
+
+func TestKeyStore(t *testing.T) {
+	source := pir.RandSource()
+	st := newKeyStore()
+	// Keys in insertion order, and their rows.
+	var order []Key
+	rows := make(map[Key]int)
+
+	for i := 0; i < 5000; i++ {
+		key := KeyFromUint32(uint32(source.Intn(300)))
+		if source.Intn(3) == 0 {
+			st.delete(key)
+			if _, ok := rows[key]; ok {
+				delete(rows, key)
+				for j := range order {
+					if order[j] == key {
+						order = append(order[:j], order[j+1:]...)
+						break
+					}
+				}
+			}
+		} else {
+			st.set(key, i)
+			if _, ok := rows[key]; !ok {
+				order = append(order, key)
+			}
+			rows[key] = i
+		}
+
+		if i%97 == 0 {
+			assert.Equal(t, st.Len(), len(order))
+			for pos, key := range order {
+				e, ok := st.at(pos)
+				assert.Assert(t, ok)
+				assert.Equal(t, e.key, key)
+				assert.Equal(t, e.row, rows[key])
+			}
+			_, ok := st.at(len(order))
+			assert.Assert(t, !ok)
+		}
+	}
+}
+
+func TestServerIndex(t *testing.T) {
+	source := pir.RandSource()
+	keys, rows := pir.MakeKeysRows(200, 16)
+	s := NewUpdatableServer()
+	s.AddRows(keys[:100], rows[:100])
+	values := make(map[uint32]pir.Row)
+	for i := range keys[:100] {
+		values[keys[i]] = rows[i]
+	}
+
+	for i := 0; i < 2000; i++ {
+		j := source.Intn(len(keys))
+		key := keys[j]
+		_, exists := values[key]
+		switch {
+		case exists && source.Intn(2) == 0:
+			s.DeleteRows([]uint32{key})
+			delete(values, key)
+		case exists && source.Intn(2) == 0:
+			row := pir.MakeRows(source, 1, 16)[0]
+			assert.NilError(t, s.UpdateRows([]uint32{key}, []pir.Row{row}))
+			values[key] = row
+		default:
+			s.AddRows([]uint32{key}, rows[j:j+1])
+			values[key] = rows[j]
+		}
+	}
+	assert.Check(t, s.defragTimestamp > 0)
+
+	assert.Equal(t, s.NumKeys(), len(values))
+	for idx := 0; idx < s.NumKeys(); idx++ {
+		key, row, err := s.Row(idx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, row, values[key])
+		val, ok := s.Value(KeyFromUint32(key))
+		assert.Assert(t, ok)
+		assert.DeepEqual(t, val, values[key])
+		_, ok = s.RowIndex(KeyFromUint32(key))
+		assert.Assert(t, ok)
+	}
+	// StaticDB holds the rows of the adds that the ops still hold.
+	numAdds := 0
+	for _, op := range s.ops {
+		if !op.Delete && !op.Update {
+			numAdds++
+		}
+	}
+	assert.Equal(t, s.NumRows, numAdds)
+	assert.Equal(t, len(s.FlatDb), s.NumRows*s.RowLen)
+}
+
+func TestServerMultiValues(t *testing.T) {
+	source := pir.RandSource()
+	keys, rows := pir.MakeKeysRows(50, 16)
+	dir := t.TempDir()
+	s, err := OpenServer(dir)
+	assert.NilError(t, err)
+	values := make(map[uint32][]pir.Row)
+	check := func(s *Server) {
+		numValues := 0
+		for _, key := range keys {
+			assert.DeepEqual(t, s.Values(KeyFromUint32(key)), values[key])
+			numValues += len(values[key])
+		}
+		assert.Equal(t, s.NumKeys(), numValues)
+	}
+
+	for i := 0; i < 3000; i++ {
+		j := source.Intn(len(keys))
+		key := keys[j]
+		row := pir.MakeRows(source, 1, 16)[0]
+		switch n := source.Intn(10); {
+		case n < 5:
+			s.AppendRows([]uint32{key}, []pir.Row{row})
+			values[key] = append(values[key], row)
+		case n < 7:
+			s.AddRows([]uint32{key}, rows[j:j+1])
+			values[key] = []pir.Row{rows[j]}
+		case n < 8 && len(values[key]) > 0:
+			assert.NilError(t, s.UpdateRows([]uint32{key}, []pir.Row{row}))
+			values[key][len(values[key])-1] = row
+		default:
+			s.DeleteRows([]uint32{key})
+			delete(values, key)
+		}
+		if i%101 == 0 {
+			check(s)
+		}
+		if i == 1500 {
+			assert.NilError(t, s.Snapshot())
+		}
+	}
+	assert.Check(t, s.defragTimestamp > 0)
+	check(s)
+
+	assert.NilError(t, s.Close())
+	s, err = OpenServer(dir)
+	assert.NilError(t, err)
+	defer s.Close()
+	check(s)
+}
@@ -0,0 +1,93 @@
+package updatable
+
+import (
+	"checklist/pir"
+)
+
+// Wire encodings of the waterfall messages, built on those of the pir
+// package. The layer requests and responses are nested messages.
+
+func (req *UpdatableHintReq) MarshalBinary() ([]byte, error) {
+	var w pir.WireWriter
+	w.Message(req.Req)
+	w.Int(req.FirstRow)
+	w.Int(req.NumRows)
+	return w.Finish()
+}
+
+func (req *UpdatableHintReq) UnmarshalBinary(data []byte) error {
+	r := pir.NewWireReader(data)
+	if m := r.Message(); m != nil {
+		hintReq, ok := m.(pir.HintReq)
+		if !ok {
+			r.Failf("%T is not a hint request", m)
+		}
+		req.Req = hintReq
+	}
+	req.FirstRow = r.Int()
+	req.NumRows = r.Int()
+	return r.Done()
+}
+
+// The layer boundaries are sent as the differences between consecutive
+// boundaries, which are small for all but the largest layers.
+func (req *UpdatableQueryReq) MarshalBinary() ([]byte, error) {
+	var w pir.WireWriter
+	w.Uvarint(uint64(len(req.Reqs)))
+	for _, q := range req.Reqs {
+		w.Message(q)
+	}
+	w.Uvarint(uint64(len(req.FirstRow)))
+	prev := 0
+	for _, row := range req.FirstRow {
+		w.Int(row - prev)
+		prev = row
+	}
+	return w.Finish()
+}
+
+func (req *UpdatableQueryReq) UnmarshalBinary(data []byte) error {
+	r := pir.NewWireReader(data)
+	if n := r.Length(1); n > 0 {
+		req.Reqs = make([]pir.QueryReq, n)
+		for i := range req.Reqs {
+			if m := r.Message(); m != nil {
+				q, ok := m.(pir.QueryReq)
+				if !ok {
+					r.Failf("%T is not a query request", m)
+				}
+				req.Reqs[i] = q
+			}
+		}
+	}
+	if n := r.Length(1); n > 0 {
+		req.FirstRow = make([]int, n)
+		prev := 0
+		for i := range req.FirstRow {
+			prev += r.Int()
+			req.FirstRow[i] = prev
+		}
+	}
+	return r.Done()
+}
+
+func (resp *UpdatableQueryResp) MarshalBinary() ([]byte, error) {
+	var w pir.WireWriter
+	w.Uvarint(uint64(len(*resp)))
+	for _, layerResp := range *resp {
+		w.Message(layerResp)
+	}
+	return w.Finish()
+}
+
+func (resp *UpdatableQueryResp) UnmarshalBinary(data []byte) error {
+	r := pir.NewWireReader(data)
+	*resp = nil
+	if n := r.Length(1); n > 0 {
+		*resp = make(UpdatableQueryResp, n)
+		for i := range *resp {
+			(*resp)[i] = r.Message()
+		}
+	}
+	return r.Done()
+}